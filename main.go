@@ -13,6 +13,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,8 +21,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
+// Bounds the connection of -check
+const checkTimeout = 30 * time.Second
+
 func main() {
 	protocolP := flag.String("p", "https", "Optional. The proxy protocol you wish to lookup. Default: https")
 	configP := flag.String("c", "", "Optional. Path to configuration file.")
@@ -29,6 +35,9 @@ func main() {
 	jsonP := flag.Bool("j", false, "Optional. If a proxy is found, write it as JSON instead of a URL.")
 	verboseP := flag.Bool("v", false, "Optional. If set, log content will be sent to stderr.")
 	useListP := flag.Bool("l", false, "Optional. If set, a list of proxy will be returned.")
+	explainP := flag.Bool("e", false, "Optional. If set, every source consulted during the lookup will be listed.")
+	sourcesP := flag.String("s", "", "Optional. Comma separated sources to consult, in order (i.e. system,config,env). Default: config,env,system")
+	checkP := flag.Bool("check", false, "Optional. If set, connect to the target (-t, i.e. https://rapid7.com or rapid7.com:443) through the proxy found, and exit non-zero should it fail.")
 
 	flag.Parse()
 	var (
@@ -38,6 +47,9 @@ func main() {
 		jsonOut  bool
 		verbose  bool
 		useList bool
+		explain  bool
+		sources  string
+		check    bool
 	)
 	if protocolP != nil {
 		protocol = *protocolP
@@ -63,11 +75,62 @@ func main() {
 	if useListP != nil {
 		useList = *useListP
 	}
+	if explainP != nil {
+		explain = *explainP
+	}
+	if sourcesP != nil {
+		sources = *sourcesP
+	}
+	if checkP != nil {
+		check = *checkP
+	}
+	if check && target == "" {
+		fmt.Fprintln(os.Stderr, "-check requires a target (-t)")
+		os.Exit(2)
+	}
+	opts := []proxy.Option{proxy.WithConfigFile(config)}
+	if sources != "" {
+		opts = append(opts, proxy.WithSourceOrder(strings.Split(sources, ",")...))
+	}
+	provider, err := proxy.NewProviderWithOptions(opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	var exit int
 
-	if useList {
-		ps := proxy.NewProvider(config).GetProxies(protocol, target)
-		if ps != nil {
+	if check {
+		p := provider.GetProxy(protocol, target)
+		if p == nil {
+			fmt.Fprintln(os.Stderr, "No proxy found")
+			os.Exit(1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		r, err := proxy.Verify(ctx, p, target)
+		cancel()
+		if jsonOut {
+			b, _ := json.MarshalIndent(r, "", "   ")
+			fmt.Println(string(b))
+		} else {
+			fmt.Print(r)
+		}
+		if err != nil {
+			exit = 1
+		}
+	} else if explain {
+		t := provider.Explain(protocol, target)
+		if jsonOut {
+			b, _ := json.MarshalIndent(t, "", "   ")
+			fmt.Println(string(b))
+		} else {
+			fmt.Print(t)
+		}
+		if len(t.Proxies) == 0 {
+			exit = 1
+		}
+	} else if useList {
+		ps := provider.GetProxies(protocol, target)
+		if len(ps) > 0 {
 			if jsonOut {
 				b, _ := json.MarshalIndent(ps, "", "   ")
 				fmt.Println(string(b))
@@ -80,7 +143,7 @@ func main() {
 			exit = 1
 		}
 	} else {
-		p := proxy.NewProvider(config).GetProxy(protocol, target)
+		p := provider.GetProxy(protocol, target)
 		if p != nil {
 			if jsonOut {
 				b, _ := json.MarshalIndent(p, "", "   ")
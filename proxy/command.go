@@ -0,0 +1,133 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the outcome of a command reading the system's settings (i.e. gsettings) is reused
+const commandCacheTTL = 30 * time.Second
+
+/*
+The outcome of running a command.
+*/
+type commandResult struct {
+	stdout string
+	stderr string
+	err    error
+	// When the command was run
+	ran time.Time
+}
+
+/*
+Keeps the outcome of the commands run by a source (i.e. gsettings by GNOMESource) for ttl, keyed by their arguments,
+so that consecutive lookups do not each run them. Failures are kept too: a program which is not installed,
+or did not complete in time, is not run again until ttl has passed.
+*/
+type commandCache struct {
+	mu      sync.Mutex
+	results map[string]*commandResult
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func newCommandCache() *commandCache {
+	return &commandCache{
+		results: map[string]*commandResult{},
+		ttl:     commandCacheTTL,
+		now:     time.Now,
+	}
+}
+
+/*
+Returns:
+	*commandResult: The outcome of the command named by key, run within ttl.
+	nil: The command is to be run. Always the case should c be nil.
+*/
+func (c *commandCache) get(key string) *commandResult {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, exists := c.results[key]; exists && c.now().Sub(r.ran) < c.ttl {
+		return r
+	}
+	return nil
+}
+
+/*
+Keep the outcome of the command named by key. Expired outcomes are then dropped. Does nothing should c be nil.
+*/
+func (c *commandCache) set(key string, r *commandResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.ran = c.now()
+	for k, cached := range c.results {
+		if r.ran.Sub(cached.ran) >= c.ttl {
+			delete(c.results, k)
+		}
+	}
+	c.results[key] = r
+}
+
+/*
+Returns a copy of p which keeps the outcome of the commands it runs in c. See runCommand.
+*/
+func (p *provider) withCommandCache(c *commandCache) *provider {
+	cached := *p
+	cached.commands = c
+	return &cached
+}
+
+/*
+Run the program name with arg, unless its outcome is kept by p.commands (see withCommandCache).
+Params:
+	ctx: Bounds the execution of the program. Should ctx be done, the outcome is not kept.
+	timeout: Applied to the program should ctx have no deadline.
+	name: The name of the program (i.e. gsettings)
+	arg: The list of the arguments (i.e. list-recursively org.gnome.system.proxy)
+Returns:
+	stdout, stderr, nil: The program succeeded.
+	stdout, stderr, error: The program failed, did not complete in time, or could not be run (i.e. exec.ErrNotFound).
+*/
+func (p *provider) runCommand(ctx context.Context, timeout time.Duration, name string, arg ...string) (string, string, error) {
+	key := strings.Join(append([]string{name}, arg...), " ")
+	if r := p.commands.get(key); r != nil {
+		return r.stdout, r.stderr, r.err
+	}
+	runCtx := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := p.proc(runCtx, name, arg...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	// Abandoned along with the lookup, which is not the outcome of the program
+	if ctx.Err() == nil {
+		p.commands.set(key, &commandResult{stdout: out.String(), stderr: stderr.String(), err: err})
+	}
+	return out.String(), stderr.String(), err
+}
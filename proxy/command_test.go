@@ -0,0 +1,67 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProvider_RunCommand(t *testing.T) {
+	a := assert.New(t)
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	p := newTestProvider("").withCommandCache(newCommandCache())
+	p.commands.now = func() time.Time { return now }
+	var ran []string
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		ran = append(ran, strings.Join(append([]string{name}, arg...), " "))
+		return exec.CommandContext(ctx, "program-not-installed")
+	}
+	run := func(ctx context.Context, arg ...string) {
+		_, _, err := p.runCommand(ctx, time.Second, "gsettings", arg...)
+		a.True(errors.Is(err, exec.ErrNotFound), err)
+	}
+
+	// The failure is kept, for the same arguments only
+	for i := 0; i < 3; i++ {
+		run(context.Background(), "list-recursively")
+	}
+	a.Equal([]string{"gsettings list-recursively"}, ran)
+	run(context.Background(), "get")
+	a.Equal([]string{"gsettings list-recursively", "gsettings get"}, ran)
+
+	// Run again once expired
+	now = now.Add(commandCacheTTL)
+	run(context.Background(), "list-recursively")
+	a.Len(ran, 3)
+	a.Len(p.commands.results, 1)
+
+	// Not kept should the lookup be abandoned
+	now = now.Add(commandCacheTTL)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	run(cancelled, "list-recursively")
+	run(cancelled, "list-recursively")
+	a.Len(ran, 5)
+
+	// Nothing is kept without a cache
+	p.commands = nil
+	run(context.Background(), "list-recursively")
+	run(context.Background(), "list-recursively")
+	a.Len(ran, 7)
+}
@@ -0,0 +1,245 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Dials connections, as net.Dialer does. Compatible with http.Transport.DialContext, and grpc.WithContextDialer.
+*/
+type ContextDialer interface {
+	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+/*
+Adapts a dial function (i.e. http.Transport.DialContext) to a ContextDialer.
+*/
+type dialContextFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+func (f dialContextFunc) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+/*
+Configures a Dialer. See Dialer.
+*/
+type DialerOption func(d *dialer)
+
+/*
+Dial the proxy with forward rather than a net.Dialer, i.e. to reach the proxy through another proxy.
+*/
+func WithForwardDialer(forward ContextDialer) DialerOption {
+	return func(d *dialer) {
+		d.forward = forward
+	}
+}
+
+/*
+Send header with each CONNECT request (i.e. a User-Agent the proxy requires).
+*/
+func WithConnectHeader(header http.Header) DialerOption {
+	return func(d *dialer) {
+		d.connectHeader = header
+	}
+}
+
+/*
+Create a dialer which connects to addresses through p.
+For example, to connect a client which does not support http.Transport.Proxy:
+	conn, err := proxy.Dialer(p).DialContext(ctx, "tcp", "test.endpoint.rapid7.com:443")
+Supported protocols are:
+	http: A tunnel is opened with an HTTP CONNECT request.
+		Should the proxy require authentication, the strongest scheme it offers is answered with the proxy's user info:
+		NTLMv2 (with the username in DOMAIN\user form), Digest (RFC 7616), or Basic should the proxy offer neither of those.
+		No credentials are sent until the proxy requires them.
+		A Digest challenge is answered again by later connections, until the proxy reports its nonce stale.
+		Should the proxy refuse, the error is a *ConnectError.
+	https: As http, over a TLS session with the proxy. See WithProxyTLS.
+	socks5, socks: Host names are resolved locally, and sent to the proxy as IP addresses (RFC 1928).
+		The proxy's user info, if any, is offered as username/password authentication (RFC 1929).
+		Should the proxy refuse, the error is a *SOCKSError.
+	socks5h: As socks5, but host names are sent to the proxy to resolve.
+	socks4: Host names are resolved locally, to IPv4 addresses. The proxy's username, if any, is sent as the user ID.
+		Should the proxy refuse, the error is a *SOCKSError.
+	socks4a: As socks4, but host names are sent to the proxy to resolve.
+Params:
+	p: The proxy to connect through.
+	opts: Optional. See WithForwardDialer, WithConnectHeader, and WithProxyTLS.
+Returns:
+	ContextDialer: Should p's protocol not be supported, DialContext returns an error.
+*/
+func Dialer(p Proxy, opts ...DialerOption) ContextDialer {
+	d := &dialer{proxy: p, forward: new(net.Dialer), digest: new(digestSession)}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+type dialer struct {
+	proxy         Proxy
+	forward       ContextDialer
+	connectHeader http.Header
+	tlsConfig     *ProxyTLSConfig
+	digest        *digestSession
+	verifyTLS     *tls.Config
+	trace         *dialTrace
+}
+
+/*
+Observes the phases of a connection through a proxy, see Verify.
+*/
+type dialTrace struct {
+	// The proxy is dialed, again should it close the connection while authenticating
+	dialing func()
+	// The proxy was connected to, or could not be
+	connected func(err error)
+	// The TLS handshake with an https proxy completed, or failed
+	proxyTLSDone func(err error)
+	// A response to a CONNECT request was read
+	connectResponse func(resp *http.Response)
+}
+
+func (d *dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if d.proxy == nil {
+		return nil, errors.New("nil proxy")
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q for proxy %s", network, d.proxy)
+	}
+	switch d.proxy.Protocol() {
+	case "", protocolHTTP, protocolHTTPS:
+		return d.dialConnect(ctx, addr)
+	case protocolSOCKS, protocolSOCKS5:
+		return d.dialSOCKS5(ctx, addr, false)
+	case protocolSOCKS5H:
+		return d.dialSOCKS5(ctx, addr, true)
+	case protocolSOCKS4:
+		return d.dialSOCKS4(ctx, addr, false)
+	case protocolSOCKS4A:
+		return d.dialSOCKS4(ctx, addr, true)
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol: %s", d.proxy)
+	}
+}
+
+/*
+Returns:
+	The host:port of p.
+*/
+func proxyAddr(p Proxy) string {
+	return net.JoinHostPort(p.Host(), strconv.Itoa(int(p.Port())))
+}
+
+/*
+Connect to the proxy with the forward dialer, and complete a TLS handshake with https proxies.
+*/
+func (d *dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	if d.trace != nil {
+		d.trace.dialing()
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyAddr(d.proxy))
+	if d.trace != nil {
+		d.trace.connected(err)
+	}
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return nil, err
+	}
+	if d.proxy.Protocol() == protocolHTTPS {
+		conn, err = proxyTLSHandshake(ctx, conn, d.proxy, d.tlsConfig)
+		if d.trace != nil {
+			d.trace.proxyTLSDone(err)
+		}
+	}
+	return conn, err
+}
+
+/*
+Run a proxy handshake over conn, bounded by ctx: conn is interrupted should ctx be done,
+and its deadline is cleared once the handshake completes.
+Returns:
+	nil: The handshake succeeded.
+	error: The error of the handshake, wrapped with ErrTimeout should ctx have expired.
+*/
+func handshake(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Unblock any pending read or write
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := f()
+	close(stop)
+	<-stopped
+	ctxErr := contextError(ctx)
+	if deadline, ok := ctx.Deadline(); ok && ctxErr == nil && err != nil && !time.Now().Before(deadline) {
+		// conn's deadline, which is that of ctx, passed before ctx was done
+		ctxErr = fmt.Errorf("%w: %w", ErrTimeout, context.DeadlineExceeded)
+	}
+	if ctxErr != nil {
+		if err == nil {
+			return ctxErr
+		}
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+/*
+A net.Conn whose first reads are served from the bytes buffered while reading the proxy's response.
+*/
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+/*
+Returns:
+	conn, wrapped should r hold bytes read from conn which are yet to be consumed.
+*/
+func withBuffered(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
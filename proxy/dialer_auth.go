@@ -0,0 +1,362 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerProxyAuthenticate = "Proxy-Authenticate"
+	authSchemeBasic         = "Basic"
+	authSchemeNTLM          = "NTLM"
+	// Bounds the requests of a connection attempt, should a proxy keep refusing
+	maxProxyAuthRequests = 5
+)
+
+// The schemes a CONNECT request authenticates with, in order of preference
+var proxyAuthSchemes = []string{authSchemeNTLM, authSchemeDigest, authSchemeBasic}
+
+/*
+Authenticates the CONNECT requests of a single connection attempt to an HTTP proxy, with the proxy's user info.
+The first request is sent without credentials, unless a Digest challenge of the proxy may be answered again.
+Should the proxy require authentication, the strongest scheme it offers which has not been refused is used (see proxyAuthSchemes).
+Basic is only used should the proxy offer no other scheme, so that the password is never sent in clear text to a proxy
+which supports a stronger one. The NEGOTIATE and AUTHENTICATE messages of NTLM are sent over the same connection.
+*/
+type proxyAuth struct {
+	proxy  Proxy
+	digest *digestSession
+	// The target of the CONNECT requests, answered by Digest
+	uri string
+	// The scheme of the last Proxy-Authorization, empty if none was sent
+	scheme string
+	// Whether the last Proxy-Authorization answered a Digest challenge of an earlier connection attempt
+	preemptive bool
+	// Set while awaiting the CHALLENGE message of NTLM
+	ntlm     *ntlmClient
+	refused  map[string]bool
+	requests int
+}
+
+/*
+Params:
+	p: The proxy.
+	digest: The Digest challenge of the proxy, shared by connection attempts.
+	uri: The target of the CONNECT requests.
+*/
+func newProxyAuth(p Proxy, digest *digestSession, uri string) *proxyAuth {
+	return &proxyAuth{proxy: p, digest: digest, uri: uri, refused: map[string]bool{}}
+}
+
+/*
+Returns:
+	The Proxy-Authorization of the first request, empty unless it answers a Digest challenge of an earlier connection attempt.
+*/
+func (a *proxyAuth) initial() string {
+	a.requests++
+	if username, _ := a.proxy.Username(); username == "" {
+		return ""
+	}
+	if authorization, ok := a.digest.authorize(nil, a.proxy, http.MethodConnect, a.uri); ok {
+		a.scheme, a.preemptive = authSchemeDigest, true
+		return authorization
+	}
+	return ""
+}
+
+/*
+Params:
+	resp: The proxy's response to the last request, a 407.
+Returns:
+	string, false, nil: The Proxy-Authorization to send next, over the same connection or a new one.
+	string, true, nil: The Proxy-Authorization to send next, which is only valid over the same connection.
+	"", false, nil: There are no further credentials to offer.
+	"", false, error: The proxy's challenge is invalid.
+*/
+func (a *proxyAuth) next(resp *http.Response) (string, bool, error) {
+	if a.requests++; a.requests > maxProxyAuthRequests {
+		return "", false, nil
+	} else if username, _ := a.proxy.Username(); username == "" {
+		return "", false, nil
+	}
+	challenges := parseAuthChallenges(resp.Header.Values(headerProxyAuthenticate))
+	if client := a.ntlm; client != nil {
+		a.ntlm = nil
+		if c := findAuthChallenge(challenges, authSchemeNTLM); c != nil && c.token != "" {
+			msg, err := ntlmChallengeToken(client, c.token)
+			if err != nil {
+				return "", false, err
+			}
+			return authSchemeNTLM + " " + msg, true, nil
+		}
+	}
+	if a.scheme == authSchemeDigest {
+		// A stale nonce, or one an earlier connection attempt was challenged with, is answered again with the new nonce
+		if c := selectDigestChallenge(challenges); c != nil && (a.preemptive || strings.EqualFold(c.params["stale"], "true")) {
+			a.preemptive = false
+			authorization, _ := a.digest.authorize(c, a.proxy, http.MethodConnect, a.uri)
+			return authorization, false, nil
+		}
+	}
+	if a.scheme != "" {
+		a.refused[a.scheme] = true
+	}
+	for _, scheme := range proxyAuthSchemes {
+		if a.refused[scheme] {
+			continue
+		}
+		switch scheme {
+		case authSchemeNTLM:
+			if findAuthChallenge(challenges, authSchemeNTLM) == nil {
+				continue
+			}
+			a.ntlm = newNTLMClient(a.proxy)
+			a.scheme = scheme
+			return authSchemeNTLM + " " + base64.StdEncoding.EncodeToString(a.ntlm.negotiate()), false, nil
+		case authSchemeDigest:
+			c := selectDigestChallenge(challenges)
+			if c == nil {
+				continue
+			}
+			a.scheme = scheme
+			authorization, _ := a.digest.authorize(c, a.proxy, http.MethodConnect, a.uri)
+			return authorization, false, nil
+		case authSchemeBasic:
+			if !basicAuthApplies(challenges) {
+				continue
+			}
+			a.scheme = scheme
+			return proxyBasicAuthorization(a.proxy), false, nil
+		}
+	}
+	return "", false, nil
+}
+
+/*
+Returns:
+	The Proxy-Authorization of Basic credentials, with the user info of p.
+*/
+func proxyBasicAuthorization(p Proxy) string {
+	username, _ := p.Username()
+	password, _ := p.Password()
+	return authSchemeBasic + " " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+/*
+Returns:
+	string, nil: The AUTHENTICATE message answering the base64 encoded CHALLENGE message token, base64 encoded.
+	"", error: The token is invalid.
+*/
+func ntlmChallengeToken(client *ntlmClient, token string) (string, error) {
+	challenge, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid NTLM challenge: %w", err)
+	}
+	msg, err := client.authenticate(challenge)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(msg), nil
+}
+
+/*
+A challenge of a Proxy-Authenticate header (RFC 7235 2.1), i.e. NTLM with its token, or Digest with its parameters.
+*/
+type authChallenge struct {
+	scheme string
+	token  string
+	// By lower case name, unquoted
+	params map[string]string
+}
+
+/*
+Parse the challenges of header values, several of which may be in a single value:
+	Digest realm="proxy", nonce="7ypf/xlj9XXwfDPEoM4URrv", qop="auth", NTLM, Basic realm="proxy"
+Returns:
+	The challenges, in order. Malformed parameters are skipped.
+*/
+func parseAuthChallenges(values []string) []authChallenge {
+	var challenges []authChallenge
+	for _, v := range values {
+		p := &authParser{s: v}
+		for {
+			p.skip(", \t")
+			scheme := p.word()
+			if scheme == "" {
+				break
+			}
+			c := authChallenge{scheme: scheme, params: map[string]string{}}
+			p.skip(" \t")
+			if token, ok := p.token68(); ok {
+				c.token = token
+			} else {
+				for {
+					mark := p.i
+					p.skip(", \t")
+					name := p.word()
+					p.skip(" \t")
+					if name == "" || !p.consume('=') {
+						p.i = mark
+						break
+					}
+					p.skip(" \t")
+					c.params[strings.ToLower(name)] = p.value()
+				}
+			}
+			challenges = append(challenges, c)
+		}
+	}
+	return challenges
+}
+
+/*
+Returns:
+	The first challenge of scheme, nil if scheme is not offered.
+*/
+func findAuthChallenge(challenges []authChallenge, scheme string) *authChallenge {
+	for i := range challenges {
+		if strings.EqualFold(challenges[i].scheme, scheme) {
+			return &challenges[i]
+		}
+	}
+	return nil
+}
+
+/*
+Schemes other than NTLM, Digest, and Basic (i.e. Negotiate), and Digest challenges which can not be answered, are ignored.
+Returns:
+	true: Basic is offered, or no scheme is (i.e. a 407 without Proxy-Authenticate), and neither NTLM nor Digest, which are preferred, is.
+*/
+func basicAuthApplies(challenges []authChallenge) bool {
+	if findAuthChallenge(challenges, authSchemeNTLM) != nil || selectDigestChallenge(challenges) != nil {
+		return false
+	}
+	return len(challenges) == 0 || findAuthChallenge(challenges, authSchemeBasic) != nil
+}
+
+/*
+Returns:
+	true: resp offers a scheme which a CONNECT request authenticates with, other than Basic (i.e. NTLM, or Digest).
+*/
+func offersProxyAuth(resp *http.Response) bool {
+	challenges := parseAuthChallenges(resp.Header.Values(headerProxyAuthenticate))
+	return findAuthChallenge(challenges, authSchemeNTLM) != nil || selectDigestChallenge(challenges) != nil
+}
+
+/*
+Returns:
+	The value of an auth-param, quoted.
+*/
+func quoteAuthParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+/*
+Scans the challenges of a Proxy-Authenticate header value.
+*/
+type authParser struct {
+	s string
+	i int
+}
+
+func (p *authParser) skip(chars string) {
+	for p.i < len(p.s) && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *authParser) consume(c byte) bool {
+	if p.i < len(p.s) && p.s[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+/*
+Returns:
+	The token at the current position (i.e. a scheme, or a parameter name), empty if none.
+*/
+func (p *authParser) word() string {
+	start := p.i
+	for p.i < len(p.s) && strings.IndexByte(" \t,=\"", p.s[p.i]) < 0 {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+/*
+Returns:
+	string, true: The token68 at the current position (i.e. the base64 data of NTLM), which ends the challenge.
+	"", false: There is none, and the position is unchanged.
+*/
+func (p *authParser) token68() (string, bool) {
+	start := p.i
+	if p.word() != "" {
+		for p.consume('=') {
+		}
+		end := p.i
+		p.skip(" \t")
+		if p.i == len(p.s) || p.s[p.i] == ',' {
+			return p.s[start:end], true
+		}
+	}
+	p.i = start
+	return "", false
+}
+
+/*
+Returns:
+	The parameter value at the current position: a token, or an unescaped quoted string.
+*/
+func (p *authParser) value() string {
+	if !p.consume('"') {
+		start := p.i
+		for p.i < len(p.s) && strings.IndexByte(" \t,", p.s[p.i]) < 0 {
+			p.i++
+		}
+		return p.s[start:p.i]
+	}
+	var b strings.Builder
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '"':
+			return b.String()
+		case c == '\\' && p.i < len(p.s):
+			b.WriteByte(p.s[p.i])
+			p.i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+/*
+Returns:
+	true: p has user info which a CONNECT request may authenticate with, should its protocol be http or https.
+*/
+func proxyAuthenticates(p Proxy) bool {
+	switch p.Protocol() {
+	case "", protocolHTTP, protocolHTTPS:
+		username, _ := p.Username()
+		return username != ""
+	}
+	return false
+}
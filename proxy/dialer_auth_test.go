@@ -0,0 +1,292 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+An in-process proxy which requires NTLMv2 authentication, issuing a challenge per connection,
+and verifying the response with the password it expects. Authenticated requests are served as by testConnectProxy.
+*/
+type testNTLMProxy struct {
+	*httptest.Server
+	domain   string
+	user     string
+	password string
+	// If true, the connection is closed after refusing a request without NTLM credentials
+	closeFirst bool
+	// If true, Basic is not offered alongside NTLM
+	ntlmOnly bool
+
+	// The requests with Basic credentials
+	basic int32
+
+	mu            sync.Mutex
+	challenges    map[string][]byte
+	authenticated int32
+}
+
+func newTestNTLMProxy(domain string, user string, password string, closeFirst bool) *testNTLMProxy {
+	p := &testNTLMProxy{domain: domain, user: user, password: password, closeFirst: closeFirst, challenges: map[string][]byte{}}
+	inner := &testConnectProxy{status: http.StatusOK}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get(headerProxyAuthorization), " ")
+		if scheme == authSchemeBasic {
+			atomic.AddInt32(&p.basic, 1)
+		}
+		msg, _ := base64.StdEncoding.DecodeString(token)
+		if scheme == authSchemeNTLM && checkNTLMMessage(msg, ntlmNegotiateMessage, ntlmNegotiateLen) == nil {
+			w.Header().Set(headerProxyAuthenticate, authSchemeNTLM+" "+base64.StdEncoding.EncodeToString(p.challenge(r.RemoteAddr)))
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if scheme == authSchemeNTLM && p.verify(r.RemoteAddr, msg) {
+			atomic.AddInt32(&p.authenticated, 1)
+			inner.handler().ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add(headerProxyAuthenticate, authSchemeNTLM)
+		if !p.ntlmOnly {
+			w.Header().Add(headerProxyAuthenticate, `Basic realm="test"`)
+		}
+		if p.closeFirst && scheme != authSchemeNTLM {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	return p
+}
+
+/*
+Returns:
+	A CHALLENGE message, whose server challenge is recorded for the connection from remoteAddr.
+*/
+func (p *testNTLMProxy) challenge(remoteAddr string) []byte {
+	serverChallenge := make([]byte, 8)
+	rand.Read(serverChallenge)
+	p.mu.Lock()
+	p.challenges[remoteAddr] = serverChallenge
+	p.mu.Unlock()
+
+	// MsvAvNbDomainName, and MsvAvTimestamp
+	targetInfo := append([]byte{2, 0, byte(len(ntlmUnicode(p.domain))), 0}, ntlmUnicode(p.domain)...)
+	targetInfo = append(append(targetInfo, ntlmAvTimestamp, 0, 8, 0), ntlmFileTime(time.Now())...)
+	targetInfo = append(targetInfo, ntlmAvEOL, 0, 0, 0)
+	b := putNTLMField(newNTLMMessage(ntlmChallengeMessage, ntlmChallengeLen), 12, ntlmUnicode(p.domain))
+	binary.LittleEndian.PutUint32(b[20:], ntlmNegotiateFlags)
+	copy(b[24:], serverChallenge)
+	return putNTLMField(b, 40, targetInfo)
+}
+
+/*
+Returns:
+	true: msg is an AUTHENTICATE message of the expected user,
+		whose NTLMv2 response proves the password for the challenge of the connection from remoteAddr.
+*/
+func (p *testNTLMProxy) verify(remoteAddr string, msg []byte) bool {
+	p.mu.Lock()
+	serverChallenge := p.challenges[remoteAddr]
+	delete(p.challenges, remoteAddr)
+	p.mu.Unlock()
+	if serverChallenge == nil || checkNTLMMessage(msg, ntlmAuthenticateMessage, ntlmAuthenticateLen) != nil {
+		return false
+	}
+	ntResponse, err := ntlmField(msg, 20)
+	domain, _ := ntlmField(msg, 28)
+	user, _ := ntlmField(msg, 36)
+	if err != nil || len(ntResponse) <= 16 || !bytes.Equal(domain, ntlmUnicode(p.domain)) || !bytes.Equal(user, ntlmUnicode(p.user)) {
+		return false
+	}
+	key := ntowfv2(p.user, p.password, p.domain)
+	return hmac.Equal(ntResponse[:16], ntlmHMAC(key, serverChallenge, ntResponse[16:]))
+}
+
+func (p *testNTLMProxy) proxy(a *assert.Assertions, user *url.Userinfo) Proxy {
+	return newTestProxyWithUser(a, p.URL, user)
+}
+
+/*
+Returns:
+	The proxy of rawUrl, with the given user info.
+*/
+func newTestProxyWithUser(a *assert.Assertions, rawUrl string, user *url.Userinfo) Proxy {
+	u, err := url.Parse(rawUrl)
+	if !a.NoError(err) {
+		return nil
+	}
+	u.User = user
+	p, err := NewProxy(u, "test")
+	a.NoError(err)
+	return p
+}
+
+var dataDialerNTLM = []struct {
+	name       string
+	user       *url.Userinfo
+	closeFirst bool
+	expectErr  bool
+}{
+	{"authenticated", url.UserPassword(`RAPID7\user`, "secret"), false, false},
+	{"reconnected", url.UserPassword(`RAPID7\user`, "secret"), true, false},
+	{"wrong password", url.UserPassword(`RAPID7\user`, "wrong"), false, true},
+	{"wrong domain", url.UserPassword(`EXAMPLE\user`, "secret"), false, true},
+	{"no user info", nil, false, true},
+}
+
+func TestDialer_ntlm(t *testing.T) {
+	echo := newTestEchoServer(assert.New(t))
+	defer echo.Close()
+	for _, tt := range dataDialerNTLM {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			p := newTestNTLMProxy("RAPID7", "user", "secret", tt.closeFirst)
+			defer p.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := Dialer(p.proxy(a, tt.user)).DialContext(ctx, "tcp", echo.Addr().String())
+			if tt.expectErr {
+				var connectErr *ConnectError
+				if a.True(errors.As(err, &connectErr)) {
+					a.Equal(http.StatusProxyAuthRequired, connectErr.StatusCode)
+				}
+				a.Equal(int32(0), atomic.LoadInt32(&p.authenticated))
+				return
+			}
+			if a.NoError(err) {
+				defer conn.Close()
+				assertEcho(a, conn)
+			}
+			a.Equal(int32(1), atomic.LoadInt32(&p.authenticated))
+		})
+	}
+}
+
+func TestDialer_ntlmOnly(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	p := newTestNTLMProxy("RAPID7", "user", "secret", false)
+	p.ntlmOnly = true
+	defer p.Close()
+	conn, err := Dialer(p.proxy(a, url.UserPassword(`RAPID7\user`, "secret"))).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+	}
+	a.Equal(int32(1), atomic.LoadInt32(&p.authenticated))
+	// The password is never sent in clear text
+	a.Equal(int32(0), atomic.LoadInt32(&p.basic))
+}
+
+func TestFailoverTransport_ntlm(t *testing.T) {
+	a := assert.New(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnelled "+r.URL.String())
+	})
+	tlsTarget := httptest.NewTLSServer(handler)
+	defer tlsTarget.Close()
+	target := httptest.NewServer(handler)
+	defer target.Close()
+	p := newTestNTLMProxy("RAPID7", "user", "secret", true)
+	defer p.Close()
+	proxy := p.proxy(a, url.UserPassword(`RAPID7\user`, "secret"))
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{proxy}}}
+	f := NewFailoverTransport(newTestProviderWithSources(s))
+	f.Base = tlsTarget.Client().Transport.(*http.Transport)
+	client := &http.Client{Transport: f}
+
+	// Tunnelled by Dialer
+	a.Equal("tunnelled /tls", testGet(a, client, tlsTarget.URL+"/tls"))
+	// Sent to the proxy without credentials, which are required, then tunnelled
+	a.Equal("tunnelled /http", testGet(a, client, target.URL+"/http"))
+	a.True(f.tunnelledHTTP[failoverKey(proxy)])
+	// The tunnel's connection is reused
+	a.Equal("tunnelled /again", testGet(a, client, target.URL+"/again"))
+	a.Equal(int32(2), atomic.LoadInt32(&p.authenticated))
+	a.Empty(f.failed)
+}
+
+var dataParseAuthChallenges = []struct {
+	values []string
+	expect []authChallenge
+}{
+	{[]string{"NTLM"}, []authChallenge{{authSchemeNTLM, "", map[string]string{}}}},
+	{[]string{"NTLM TlRMTVNTUAACAAAA=="}, []authChallenge{{authSchemeNTLM, "TlRMTVNTUAACAAAA==", map[string]string{}}}},
+	{[]string{`Basic realm="proxy", NTLM, Negotiate YII=`}, []authChallenge{
+		{authSchemeBasic, "", map[string]string{"realm": "proxy"}},
+		{authSchemeNTLM, "", map[string]string{}},
+		{"Negotiate", "YII=", map[string]string{}},
+	}},
+	{[]string{`Digest Realm="a \"b\"", nonce=xyz , QOP="auth,auth-int",Basic realm=proxy`, "NTLM"}, []authChallenge{
+		{authSchemeDigest, "", map[string]string{"realm": `a "b"`, "nonce": "xyz", "qop": "auth,auth-int"}},
+		{authSchemeBasic, "", map[string]string{"realm": "proxy"}},
+		{authSchemeNTLM, "", map[string]string{}},
+	}},
+	{[]string{"", " , "}, nil},
+}
+
+func TestParseAuthChallenges(t *testing.T) {
+	for _, tt := range dataParseAuthChallenges {
+		t.Run(strings.Join(tt.values, "|"), func(t *testing.T) {
+			assert.Equal(t, tt.expect, parseAuthChallenges(tt.values))
+		})
+	}
+}
+
+var dataProxyAuthNext = []struct {
+	challenges []string
+	expect     string
+}{
+	{[]string{`Basic realm="proxy"`, "NTLM", `Digest realm="proxy", nonce="n", qop="auth"`}, authSchemeNTLM},
+	{[]string{`Basic realm="proxy", Digest realm="proxy", nonce="n", qop="auth"`}, authSchemeDigest},
+	{[]string{`Digest realm="proxy", nonce="n", qop="auth-int"`, `Basic realm="proxy"`}, authSchemeBasic},
+	{[]string{`Negotiate`, `Basic realm="proxy"`}, authSchemeBasic},
+	{[]string{`Negotiate, Basic realm="proxy"`}, authSchemeBasic},
+	{[]string{`Negotiate`}, ""},
+	{[]string{`Basic realm="proxy"`}, authSchemeBasic},
+	{nil, authSchemeBasic},
+}
+
+func TestProxyAuth_next(t *testing.T) {
+	for _, tt := range dataProxyAuthNext {
+		t.Run(strings.Join(tt.challenges, "|"), func(t *testing.T) {
+			a := assert.New(t)
+			auth := newProxyAuth(newTestProxy("http", "proxy", 3128, url.UserPassword("user", "secret"), "test"), new(digestSession), "test:443")
+			// The first request is sent without credentials
+			a.Empty(auth.initial())
+			resp := &http.Response{StatusCode: http.StatusProxyAuthRequired, Header: http.Header{headerProxyAuthenticate: tt.challenges}}
+			authorization, _, err := auth.next(resp)
+			a.NoError(err)
+			scheme, _, _ := strings.Cut(authorization, " ")
+			a.Equal(tt.expect, scheme)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	headerProxyAuthorization = "Proxy-Authorization"
+	headerProxyConnection    = "Proxy-Connection"
+	// Bounds the body of a refused CONNECT which is discarded
+	maxConnectErrorBody = 64 * 1024
+)
+
+/*
+An HTTP proxy refused to open a CONNECT tunnel. Use errors.As to retrieve it from an error returned by DialContext.
+*/
+type ConnectError struct {
+	// The proxy, as a human readable string with user info obfuscated
+	Proxy string
+	// The address a tunnel was requested to
+	Addr string
+	// The status code of the proxy's response (i.e. 407)
+	StatusCode int
+	// The status line of the proxy's response (i.e. 407 Proxy Authentication Required)
+	Status string
+	// The headers of the proxy's response (i.e. Proxy-Authenticate)
+	Header http.Header
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("proxy %s refused CONNECT to %s: %s", e.Proxy, e.Addr, e.Status)
+}
+
+/*
+Open a tunnel to addr through the HTTP proxy with a CONNECT request, authenticating with the proxy's user info
+(see proxyAuth). Should the proxy close the connection while offering a scheme to authenticate with, it is dialed again.
+Returns:
+	net.Conn, nil: The tunnel is open.
+	nil, *ConnectError: The proxy responded, but not with a 2xx status.
+	nil, error: The proxy could not be reached, or its response could not be read.
+*/
+func (d *dialer) dialConnect(ctx context.Context, addr string) (net.Conn, error) {
+	auth := newProxyAuth(d.proxy, d.digest, addr)
+	authorization := auth.initial()
+	for {
+		conn, err := d.dialProxy(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var tunnel net.Conn
+		err = handshake(ctx, conn, func() error {
+			tunnel, authorization, err = d.connect(conn, addr, auth, authorization)
+			return err
+		})
+		if err == nil {
+			return tunnel, nil
+		}
+		conn.Close()
+		if authorization == "" || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+Send CONNECT requests for addr over conn, until the proxy accepts, or refuses with no further credentials to offer.
+Params:
+	auth: Provides the Proxy-Authorization of each request after the first.
+	authorization: The Proxy-Authorization of the first request, if any.
+Returns:
+	net.Conn, "", nil: The tunnel is open.
+	nil, string, *ConnectError: The proxy closed conn, but the returned Proxy-Authorization may be sent over a new connection.
+	nil, "", error: The proxy refused, or conn failed.
+*/
+func (d *dialer) connect(conn net.Conn, addr string, auth *proxyAuth, authorization string) (net.Conn, string, error) {
+	r := bufio.NewReader(conn)
+	for {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: http.Header{},
+		}
+		for k, v := range d.connectHeader {
+			req.Header[k] = v
+		}
+		if authorization != "" {
+			req.Header.Set(headerProxyAuthorization, authorization)
+		}
+		if err := req.Write(conn); err != nil {
+			return nil, "", err
+		}
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, "", err
+		}
+		if d.trace != nil {
+			d.trace.connectResponse(resp)
+		}
+		if resp.StatusCode/100 == 2 {
+			return withBuffered(conn, r), "", nil
+		}
+		reusable := discardConnectResponse(resp)
+		connectErr := &ConnectError{
+			Proxy:      d.proxy.String(),
+			Addr:       addr,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     resp.Header,
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			return nil, "", connectErr
+		}
+		next, sameConn, err := auth.next(resp)
+		switch {
+		case err != nil:
+			return nil, "", fmt.Errorf("%w: %w", connectErr, err)
+		case next == "" || (sameConn && !reusable):
+			return nil, "", connectErr
+		case !reusable:
+			return nil, next, connectErr
+		}
+		authorization = next
+	}
+}
+
+/*
+Discard the body of a refused CONNECT request.
+Returns:
+	true: The connection may be reused: the body was read whole, and the proxy did not ask to close the connection.
+*/
+func discardConnectResponse(resp *http.Response) bool {
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxConnectErrorBody))
+	resp.Body.Close()
+	return err == nil && n < maxConnectErrorBody && !resp.Close &&
+		!strings.EqualFold(resp.Header.Get(headerProxyConnection), "close")
+}
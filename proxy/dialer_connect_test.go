@@ -0,0 +1,180 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+A TCP server which echoes whatever it receives.
+*/
+func newTestEchoServer(a *assert.Assertions) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func assertEcho(a *assert.Assertions, conn net.Conn) {
+	if _, err := io.WriteString(conn, "ping"); !a.NoError(err) {
+		return
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); a.NoError(err) {
+		a.Equal("ping", string(b))
+	}
+}
+
+func TestDialer_connect(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	proxyServer := newTestConnectProxy(http.StatusOK)
+	defer proxyServer.Close()
+	p := newTestProxyFromURL(a, strings.Replace(proxyServer.URL, "http://", "http://user:pass@", 1))
+
+	conn, err := Dialer(p, WithConnectHeader(http.Header{"User-Agent": {"agent/1.0"}})).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	assertEcho(a, conn)
+	header := proxyServer.connectHeader.Load().(http.Header)
+	// No credentials are sent until the proxy requires them
+	a.Empty(header.Get("Proxy-Authorization"))
+	a.Equal("agent/1.0", header.Get("User-Agent"))
+}
+
+func TestDialer_connectBasic(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	inner := &testConnectProxy{status: http.StatusOK}
+	proxyServer := httptest.NewServer(testBasicAuthHandler(inner.handler()))
+	defer proxyServer.Close()
+
+	conn, err := Dialer(newTestProxyWithUser(a, proxyServer.URL, url.UserPassword("user", "secret"))).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+	}
+	a.Equal("Basic dXNlcjpzZWNyZXQ=", inner.connectHeader.Load().(http.Header).Get(headerProxyAuthorization))
+
+	// Refused
+	_, err = Dialer(newTestProxyWithUser(a, proxyServer.URL, url.UserPassword("user", "wrong"))).DialContext(context.Background(), "tcp", echo.Addr().String())
+	var connectErr *ConnectError
+	if a.True(errors.As(err, &connectErr)) {
+		a.Equal(http.StatusProxyAuthRequired, connectErr.StatusCode)
+	}
+
+	// Negotiate, which is not supported, is ignored
+	negotiate := &testConnectProxy{status: http.StatusOK}
+	negotiateServer := httptest.NewServer(testChallengeAuthHandler(negotiate.handler(), []string{"Negotiate", `Basic realm="test"`}))
+	defer negotiateServer.Close()
+	conn, err = Dialer(newTestProxyWithUser(a, negotiateServer.URL, url.UserPassword("user", "secret"))).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+	}
+	a.Equal("Basic dXNlcjpzZWNyZXQ=", negotiate.connectHeader.Load().(http.Header).Get(headerProxyAuthorization))
+
+	// A proxy which offers no scheme is sent Basic credentials
+	silent := &testConnectProxy{status: http.StatusOK}
+	silentServer := httptest.NewServer(testChallengeAuthHandler(silent.handler(), nil))
+	defer silentServer.Close()
+	conn, err = Dialer(newTestProxyWithUser(a, silentServer.URL, url.UserPassword("user", "secret"))).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+	}
+	a.Equal("Basic dXNlcjpzZWNyZXQ=", silent.connectHeader.Load().(http.Header).Get(headerProxyAuthorization))
+}
+
+func TestDialer_connectRefused(t *testing.T) {
+	a := assert.New(t)
+	proxyServer := newTestConnectProxy(http.StatusProxyAuthRequired)
+	defer proxyServer.Close()
+	_, err := Dialer(proxyServer.proxy(a)).DialContext(context.Background(), "tcp", "test.endpoint.rapid7.com:443")
+	var connectErr *ConnectError
+	if a.True(errors.As(err, &connectErr)) {
+		a.Equal(http.StatusProxyAuthRequired, connectErr.StatusCode)
+		a.Equal("407 Proxy Authentication Required", connectErr.Status)
+		a.Equal("denied", connectErr.Header.Get("X-Proxy-Reason"))
+		a.Equal("test.endpoint.rapid7.com:443", connectErr.Addr)
+	}
+}
+
+func TestDialer_connectTimeout(t *testing.T) {
+	a := assert.New(t)
+	// Accepts, but never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = Dialer(newTestProxyFromURL(a, "http://"+l.Addr().String())).DialContext(ctx, "tcp", "test.endpoint.rapid7.com:443")
+	a.True(errors.Is(err, ErrTimeout), "%v", err)
+}
+
+var dataDialerUnsupported = []struct {
+	proxy   string
+	network string
+}{
+	{"http://proxy:3128", "udp"},
+	{"ftp://proxy:2121", "tcp"},
+}
+
+func TestDialer_unsupported(t *testing.T) {
+	for _, tt := range dataDialerUnsupported {
+		t.Run(tt.proxy+" "+tt.network, func(t *testing.T) {
+			a := assert.New(t)
+			_, err := Dialer(newTestProxyFromURL(a, tt.proxy)).DialContext(context.Background(), tt.network, "test.endpoint.rapid7.com:443")
+			a.Error(err)
+		})
+	}
+	_, err := Dialer(nil).DialContext(context.Background(), "tcp", "test.endpoint.rapid7.com:443")
+	assert.Error(t, err)
+}
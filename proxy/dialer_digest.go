@@ -0,0 +1,204 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+const (
+	authSchemeDigest  = "Digest"
+	digestQopAuth     = "auth"
+	digestSessSuffix  = "-sess"
+	digestDefaultAlgo = "MD5"
+)
+
+// The Digest algorithms supported (RFC 7616 3.4.2), in order of preference. Their "-sess" variants are also supported.
+var digestAlgorithms = []struct {
+	name string
+	hash func() hash.Hash
+}{
+	{"SHA-256", sha256.New},
+	{digestDefaultAlgo, md5.New},
+}
+
+/*
+The Digest challenge a proxy last issued, shared by the connection attempts of a Dialer,
+so that later CONNECT requests authenticate without being challenged, counting their use of the nonce.
+*/
+type digestSession struct {
+	mu        sync.Mutex
+	challenge *authChallenge
+	nc        uint32
+}
+
+/*
+Returns the Digest Proxy-Authorization of a request (RFC 7616 3.4), with the next nonce count of the challenge answered.
+Params:
+	c: The challenge to answer, see selectDigestChallenge. If nil, that last answered is answered again.
+	p: The proxy, whose user info is answered with.
+	method: The method of the request (i.e. CONNECT).
+	uri: The target of the request (i.e. test.endpoint.rapid7.com:443).
+Returns:
+	string, true: The Proxy-Authorization.
+	"", false: c is nil, and no challenge has been answered.
+*/
+func (s *digestSession) authorize(c *authChallenge, p Proxy, method string, uri string) (string, bool) {
+	s.mu.Lock()
+	if c != nil && (s.challenge == nil || s.challenge.params["nonce"] != c.params["nonce"]) {
+		s.challenge, s.nc = c, 0
+	}
+	c = s.challenge
+	s.nc++
+	nc := fmt.Sprintf("%08x", s.nc)
+	s.mu.Unlock()
+	if c == nil {
+		return "", false
+	}
+
+	username, _ := p.Username()
+	password, _ := p.Password()
+	h, _ := digestHash(c)
+	qop, _ := digestQop(c)
+	b := make([]byte, 16)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	response := digestResponse(c, username, password, method, uri, cnonce, nc)
+	userhash := strings.EqualFold(c.params["userhash"], "true")
+	if userhash {
+		username = digestHex(h, username+":"+c.params["realm"])
+	}
+
+	fields := []string{
+		"username=" + quoteAuthParam(username),
+		"realm=" + quoteAuthParam(c.params["realm"]),
+		"uri=" + quoteAuthParam(uri),
+	}
+	if algorithm, exists := c.params["algorithm"]; exists {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	fields = append(fields, "nonce="+quoteAuthParam(c.params["nonce"]))
+	if qop != "" {
+		fields = append(fields, "nc="+nc, "cnonce="+quoteAuthParam(cnonce), "qop="+qop)
+	}
+	fields = append(fields, "response="+quoteAuthParam(response))
+	if opaque, exists := c.params["opaque"]; exists {
+		fields = append(fields, "opaque="+quoteAuthParam(opaque))
+	}
+	if userhash {
+		fields = append(fields, "userhash=true")
+	}
+	return authSchemeDigest + " " + strings.Join(fields, ", "), true
+}
+
+/*
+Returns:
+	The preferred supported Digest challenge of challenges (i.e. SHA-256 over MD5), nil if none is supported.
+*/
+func selectDigestChallenge(challenges []authChallenge) *authChallenge {
+	var selected *authChallenge
+	selectedRank := len(digestAlgorithms)
+	for i := range challenges {
+		c := &challenges[i]
+		if !strings.EqualFold(c.scheme, authSchemeDigest) || c.params["nonce"] == "" {
+			continue
+		}
+		if _, ok := digestQop(c); !ok {
+			continue
+		}
+		algorithm := strings.TrimSuffix(strings.ToUpper(c.params["algorithm"]), strings.ToUpper(digestSessSuffix))
+		if algorithm == "" {
+			algorithm = digestDefaultAlgo
+		}
+		for rank, a := range digestAlgorithms {
+			if a.name == algorithm && rank < selectedRank {
+				selected, selectedRank = c, rank
+			}
+		}
+	}
+	return selected
+}
+
+/*
+Returns:
+	func() hash.Hash, bool: The hash function of c's algorithm (MD5 if unspecified), and whether it is a "-sess" variant.
+	nil, false: The algorithm is not supported.
+*/
+func digestHash(c *authChallenge) (func() hash.Hash, bool) {
+	algorithm := strings.ToUpper(c.params["algorithm"])
+	if algorithm == "" {
+		algorithm = digestDefaultAlgo
+	}
+	sess := strings.HasSuffix(algorithm, strings.ToUpper(digestSessSuffix))
+	algorithm = strings.TrimSuffix(algorithm, strings.ToUpper(digestSessSuffix))
+	for _, a := range digestAlgorithms {
+		if a.name == algorithm {
+			return a.hash, sess
+		}
+	}
+	return nil, false
+}
+
+/*
+Returns:
+	"auth", true: c offers qop=auth.
+	"", true: c offers no qop (RFC 2069), so the nonce count and client nonce are not sent.
+	"", false: c only offers protections which are not supported (i.e. auth-int).
+*/
+func digestQop(c *authChallenge) (string, bool) {
+	qops, exists := c.params["qop"]
+	if !exists {
+		return "", true
+	}
+	for _, qop := range strings.Split(qops, ",") {
+		if strings.EqualFold(strings.TrimSpace(qop), digestQopAuth) {
+			return digestQopAuth, true
+		}
+	}
+	return "", false
+}
+
+/*
+Returns:
+	The response to the Digest challenge c (RFC 7616 3.4.1), for the request of method and uri.
+*/
+func digestResponse(c *authChallenge, username string, password string, method string, uri string, cnonce string, nc string) string {
+	h, sess := digestHash(c)
+	realm, nonce := c.params["realm"], c.params["nonce"]
+	ha1 := digestHex(h, username+":"+realm+":"+password)
+	if sess {
+		ha1 = digestHex(h, ha1+":"+nonce+":"+cnonce)
+	}
+	ha2 := digestHex(h, method+":"+uri)
+	if qop, _ := digestQop(c); qop != "" {
+		return digestHex(h, ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2)
+	}
+	return digestHex(h, ha1+":"+nonce+":"+ha2)
+}
+
+/*
+Returns:
+	The hash of s, hex encoded.
+*/
+func digestHex(h func() hash.Hash, s string) string {
+	d := h()
+	d.Write([]byte(s))
+	return hex.EncodeToString(d.Sum(nil))
+}
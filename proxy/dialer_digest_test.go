@@ -0,0 +1,242 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var dataDigestResponse = []struct {
+	algorithm string
+	expect    string
+}{
+	// RFC 7616 3.9.1
+	{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+	{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+}
+
+func TestDigestResponse(t *testing.T) {
+	for _, tt := range dataDigestResponse {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			c := &authChallenge{scheme: authSchemeDigest, params: map[string]string{
+				"realm":     "http-auth@example.org",
+				"qop":       "auth, auth-int",
+				"algorithm": tt.algorithm,
+				"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+				"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+			}}
+			assert.Equal(t, tt.expect, digestResponse(c, "Mufasa", "Circle of Life", http.MethodGet, "/dir/index.html",
+				"f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", "00000001"))
+		})
+	}
+}
+
+/*
+An in-process proxy which requires Digest authentication, issuing a challenge per entry of challenges
+with its current nonce. A nonce which expired is reported stale. Authenticated requests are served as by testConnectProxy.
+*/
+type testDigestProxy struct {
+	*httptest.Server
+	user     string
+	password string
+	// The parameters of each challenge, other than realm, nonce and opaque (i.e. `algorithm=SHA-256, qop="auth"`)
+	challenges []string
+	requests   int32
+
+	mu     sync.Mutex
+	nonce  int
+	lastNC uint32
+	// The nonce counts, and algorithms, of the requests authenticated
+	accepted   []string
+	algorithms []string
+}
+
+func newTestDigestProxy(user string, password string, challenges ...string) *testDigestProxy {
+	p := &testDigestProxy{user: user, password: password, challenges: challenges}
+	inner := &testConnectProxy{status: http.StatusOK}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.requests, 1)
+		credentials := parseAuthChallenges(r.Header.Values(headerProxyAuthorization))
+		stale := false
+		if len(credentials) == 1 && credentials[0].scheme == authSchemeDigest {
+			var ok bool
+			if ok, stale = p.verify(r, credentials[0].params); ok {
+				inner.handler().ServeHTTP(w, r)
+				return
+			}
+		}
+		p.mu.Lock()
+		nonce := fmt.Sprintf("nonce-%d", p.nonce)
+		p.mu.Unlock()
+		for _, c := range p.challenges {
+			challenge := fmt.Sprintf(`Digest realm="proxy@rapid7.com", nonce=%q, opaque="opaque"`, nonce)
+			if c != "" {
+				challenge += ", " + c
+			}
+			if stale {
+				challenge += ", stale=true"
+			}
+			w.Header().Add(headerProxyAuthenticate, challenge)
+		}
+		w.Header().Add(headerProxyAuthenticate, `Basic realm="proxy@rapid7.com"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	return p
+}
+
+/*
+Returns:
+	true, false: The credentials answer the current nonce, with a nonce count greater than those before.
+	false, true: The credentials answer an expired nonce.
+	false, false: The credentials are invalid.
+*/
+func (p *testDigestProxy) verify(r *http.Request, params map[string]string) (bool, bool) {
+	c := &authChallenge{scheme: authSchemeDigest, params: params}
+	h, _ := digestHash(c)
+	username := p.user
+	if params["userhash"] == "true" {
+		username = digestHex(h, p.user+":"+params["realm"])
+	}
+	if params["username"] != username || params["uri"] != r.Host || params["opaque"] != "opaque" ||
+		params["response"] != digestResponse(c, p.user, p.password, r.Method, params["uri"], params["cnonce"], params["nc"]) {
+		return false, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if params["nonce"] != fmt.Sprintf("nonce-%d", p.nonce) {
+		return false, true
+	}
+	var nc uint32
+	fmt.Sscanf(params["nc"], "%x", &nc)
+	if params["qop"] != "" && nc <= p.lastNC {
+		return false, false
+	}
+	p.lastNC = nc
+	p.accepted = append(p.accepted, params["nc"])
+	p.algorithms = append(p.algorithms, params["algorithm"])
+	return true, false
+}
+
+/*
+Issue a new nonce, so that the current one is reported stale.
+*/
+func (p *testDigestProxy) expire() {
+	p.mu.Lock()
+	p.nonce++
+	p.lastNC = 0
+	p.mu.Unlock()
+}
+
+func (p *testDigestProxy) proxy(a *assert.Assertions, user *url.Userinfo) Proxy {
+	return newTestProxyWithUser(a, p.URL, user)
+}
+
+var dataDialerDigest = []struct {
+	name            string
+	password        string
+	challenges      []string
+	expectAlgorithm string
+	expectErr       bool
+}{
+	{"md5", "secret", []string{`algorithm=MD5, qop="auth"`}, "MD5", false},
+	{"sha-256 preferred", "secret", []string{`algorithm=MD5, qop="auth"`, `algorithm=SHA-256, qop="auth,auth-int"`}, "SHA-256", false},
+	{"md5-sess", "secret", []string{`algorithm=MD5-sess, qop="auth"`}, "MD5-sess", false},
+	{"rfc 2069", "secret", []string{""}, "", false},
+	{"userhash", "secret", []string{`algorithm=SHA-256, qop="auth", userhash=true`}, "SHA-256", false},
+	{"unsupported algorithm", "secret", []string{`algorithm=SHA-512-256, qop="auth"`}, "", true},
+	{"unsupported qop", "secret", []string{`qop="auth-int"`}, "", true},
+	{"wrong password", "wrong", []string{`algorithm=SHA-256, qop="auth"`}, "", true},
+}
+
+func TestDialer_digest(t *testing.T) {
+	echo := newTestEchoServer(assert.New(t))
+	defer echo.Close()
+	for _, tt := range dataDialerDigest {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			p := newTestDigestProxy(`RAPID7\user`, "secret", tt.challenges...)
+			defer p.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := Dialer(p.proxy(a, url.UserPassword(`RAPID7\user`, tt.password))).DialContext(ctx, "tcp", echo.Addr().String())
+			if tt.expectErr {
+				var connectErr *ConnectError
+				if a.True(errors.As(err, &connectErr)) {
+					a.Equal(http.StatusProxyAuthRequired, connectErr.StatusCode)
+				}
+				a.Empty(p.accepted)
+				return
+			}
+			if a.NoError(err) {
+				defer conn.Close()
+				assertEcho(a, conn)
+			}
+			a.Equal([]string{tt.expectAlgorithm}, p.algorithms)
+		})
+	}
+}
+
+func TestDialer_digestNonce(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	p := newTestDigestProxy("user", "secret", `algorithm=SHA-256, qop="auth"`)
+	defer p.Close()
+	d := Dialer(p.proxy(a, url.UserPassword("user", "secret")))
+	dial := func() {
+		conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+		if a.NoError(err) {
+			assertEcho(a, conn)
+			conn.Close()
+		}
+	}
+
+	// Basic is refused, then the challenge is answered
+	dial()
+	a.Equal(int32(2), atomic.LoadInt32(&p.requests))
+	// The challenge is answered again, with the next nonce count
+	dial()
+	a.Equal(int32(3), atomic.LoadInt32(&p.requests))
+	// The nonce is stale, so the new one is answered
+	p.expire()
+	dial()
+	a.Equal(int32(5), atomic.LoadInt32(&p.requests))
+	a.Equal([]string{"00000001", "00000002", "00000001"}, p.accepted)
+}
+
+func TestFailoverTransport_digest(t *testing.T) {
+	a := assert.New(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnelled "+r.URL.String())
+	}))
+	defer target.Close()
+	p := newTestDigestProxy("user", "secret", `algorithm=SHA-256, qop="auth"`)
+	defer p.Close()
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{p.proxy(a, url.UserPassword("user", "secret"))}}}
+	client := &http.Client{Transport: NewFailoverTransport(newTestProviderWithSources(s))}
+
+	// Sent to the proxy with Basic credentials, which are refused, then tunnelled
+	a.Equal("tunnelled /http", testGet(a, client, target.URL+"/http"))
+	a.Equal([]string{"SHA-256"}, p.algorithms)
+}
@@ -0,0 +1,391 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	// SOCKS5 with remote name resolution
+	protocolSOCKS5H = "socks5h"
+	// SOCKS4 with remote name resolution
+	protocolSOCKS4A = "socks4a"
+
+	socks4Version      = 0x04
+	socks4CmdConnect   = 0x01
+	socks4ReplyVersion = 0x00
+	socks4ReplyGranted = 0x5A
+	socks4ReplyLength  = 8
+	socks4MaxUserIDLen = 255
+
+	socks5Version = 0x05
+	// RFC 1929
+	socks5AuthVersion      = 0x01
+	socks5MethodNoAuth     = 0x00
+	socks5MethodUserPass   = 0x02
+	socks5MethodNone       = 0xFF
+	socks5CmdConnect       = 0x01
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+	socks5ReplySucceeded   = 0x00
+	socks5MaxCredentialLen = 255
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+var socks4Replies = map[byte]string{
+	0x5B: "request rejected or failed",
+	0x5C: "request rejected because the proxy cannot connect to identd on the client",
+	0x5D: "request rejected because the client program and identd report different user IDs",
+}
+
+/*
+A SOCKS proxy refused a request. Use errors.As to retrieve it from an error returned by DialContext.
+*/
+type SOCKSError struct {
+	// The proxy, as a human readable string with user info obfuscated
+	Proxy string
+	// The address a connection was requested to
+	Addr string
+	// The SOCKS version of the proxy (i.e. 5)
+	Version int
+	// The reply code of the proxy (i.e. 0x05, connection refused, for SOCKS5, or 0x5B, request rejected, for SOCKS4)
+	Code byte
+}
+
+func (e *SOCKSError) Error() string {
+	return fmt.Sprintf("SOCKS%d proxy %s refused connection to %s: %s", e.Version, e.Proxy, e.Addr, e.reason())
+}
+
+/*
+Returns:
+	The meaning of the reply code (i.e. connection refused).
+*/
+func (e *SOCKSError) reason() string {
+	replies := socks5Replies
+	if e.Version == socks4Version {
+		replies = socks4Replies
+	}
+	if reason, exists := replies[e.Code]; exists {
+		return reason
+	}
+	return fmt.Sprintf("unknown reply 0x%02x", e.Code)
+}
+
+/*
+Connect to addr through the SOCKS5 proxy (RFC 1928), authenticating with the proxy's user info, if any (RFC 1929).
+Params:
+	ctx: Bounds the connection, and the handshake.
+	addr: The host:port to connect to.
+	remoteResolve: If true, a host name is sent to the proxy to resolve (socks5h). Otherwise it is resolved locally.
+Returns:
+	net.Conn, nil: The connection is established.
+	nil, *SOCKSError: The proxy refused the connection.
+	nil, error: The proxy could not be reached, refused the credentials, or addr could not be resolved.
+*/
+func (d *dialer) dialSOCKS5(ctx context.Context, addr string, remoteResolve bool) (net.Conn, error) {
+	host, port, err := splitSOCKSAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !remoteResolve {
+		if host, err = resolveSOCKSHost(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, func() error {
+		if err := d.socks5Authenticate(conn); err != nil {
+			return err
+		}
+		_, err := d.socks5Request(conn, socks5CmdConnect, host, port)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+Negotiate the authentication method, and authenticate should the proxy require it.
+*/
+func (d *dialer) socks5Authenticate(conn net.Conn) error {
+	username, _ := d.proxy.Username()
+	password, _ := d.proxy.Password()
+	methods := []byte{socks5MethodNoAuth}
+	if username != "" {
+		methods = append(methods, socks5MethodUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d from proxy %s", reply[0], d.proxy)
+	}
+	switch reply[1] {
+	case socks5MethodNoAuth:
+		return nil
+	case socks5MethodUserPass:
+		if username == "" {
+			break
+		}
+		if len(username) > socks5MaxCredentialLen || len(password) > socks5MaxCredentialLen {
+			return errors.New("SOCKS5 username and password must be at most 255 bytes")
+		}
+		req := []byte{socks5AuthVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[0] != socks5AuthVersion {
+			return fmt.Errorf("unexpected SOCKS5 authentication version %d from proxy %s", reply[0], d.proxy)
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 proxy %s refused the username and password", d.proxy)
+		}
+		return nil
+	}
+	return fmt.Errorf("SOCKS5 proxy %s accepts none of the offered authentication methods", d.proxy)
+}
+
+/*
+Send a request (i.e. CONNECT) for host:port, and read the reply.
+Returns:
+	The address bound by the proxy for the request, as host:port.
+*/
+func (d *dialer) socks5Request(conn net.Conn, cmd byte, host string, port int) (string, error) {
+	req, err := appendSOCKS5Addr([]byte{socks5Version, cmd, 0x00}, host, port)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d from proxy %s", reply[0], d.proxy)
+	}
+	if reply[1] != socks5ReplySucceeded {
+		return "", &SOCKSError{Proxy: d.proxy.String(), Addr: net.JoinHostPort(host, strconv.Itoa(port)), Version: 5, Code: reply[1]}
+	}
+	boundHost, boundPort, err := readSOCKS5Addr(conn)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(boundHost, strconv.Itoa(boundPort)), nil
+}
+
+/*
+Connect to addr through the SOCKS4 proxy, sending the proxy's username, if any, as the user ID.
+Params:
+	ctx: Bounds the connection, and the handshake.
+	addr: The host:port to connect to.
+	remoteResolve: If true, a host name is sent to the proxy to resolve (SOCKS4a). Otherwise it is resolved locally.
+Returns:
+	net.Conn, nil: The connection is established.
+	nil, *SOCKSError: The proxy refused the connection (i.e. its identd check failed).
+	nil, error: The proxy could not be reached, or addr could not be resolved to an IPv4 address.
+*/
+func (d *dialer) dialSOCKS4(ctx context.Context, addr string, remoteResolve bool) (net.Conn, error) {
+	host, port, err := splitSOCKSAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !remoteResolve || net.ParseIP(host) != nil {
+		if host, err = resolveSOCKSHost(ctx, host); err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host).To4() == nil {
+			return nil, fmt.Errorf("SOCKS4 supports only IPv4 addresses: %s", addr)
+		}
+	}
+	userID, _ := d.proxy.Username()
+	if len(userID) > socks4MaxUserIDLen {
+		return nil, errors.New("SOCKS4 user ID must be at most 255 bytes")
+	}
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, func() error {
+		return d.socks4Connect(conn, host, port, userID)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+Send a CONNECT request for host:port, and read the reply.
+Should host not be an IP address, it is sent for the proxy to resolve (SOCKS4a).
+*/
+func (d *dialer) socks4Connect(conn net.Conn, host string, port int, userID string) error {
+	req := binary.BigEndian.AppendUint16([]byte{socks4Version, socks4CmdConnect}, uint16(port))
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		// An invalid IP of 0.0.0.x signals the host name follows the user ID
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	req = append(append(append(req, ip...), userID...), 0x00)
+	if net.ParseIP(host) == nil {
+		req = append(append(req, host...), 0x00)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, socks4ReplyLength)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks4ReplyVersion {
+		return fmt.Errorf("unexpected SOCKS4 reply version %d from proxy %s", reply[0], d.proxy)
+	}
+	if reply[1] != socks4ReplyGranted {
+		return &SOCKSError{Proxy: d.proxy.String(), Addr: net.JoinHostPort(host, strconv.Itoa(port)), Version: socks4Version, Code: reply[1]}
+	}
+	return nil
+}
+
+/*
+Append the SOCKS5 encoding of host:port (ATYP, DST.ADDR, DST.PORT) to b.
+*/
+func appendSOCKS5Addr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socks5AddrIPv4), ip4...)
+		} else {
+			b = append(append(b, socks5AddrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long for SOCKS5: %s", host)
+		}
+		b = append(append(b, socks5AddrDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+/*
+Read a SOCKS5 encoded address (ATYP, ADDR, PORT) from r.
+*/
+func readSOCKS5Addr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", 0, fmt.Errorf("unknown SOCKS5 address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	host := string(addr)
+	if atyp[0] != socks5AddrDomain {
+		host = net.IP(addr).String()
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+/*
+Split addr into its host, and numeric port.
+*/
+func splitSOCKSAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+	return host, int(port), nil
+}
+
+/*
+Resolve host locally, preferring IPv4, which SOCKS proxies support most widely.
+Returns:
+	host, unchanged, should it already be an IP.
+*/
+func resolveSOCKSHost(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return "", fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			return a.IP.String(), nil
+		}
+	}
+	return addrs[0].IP.String(), nil
+}
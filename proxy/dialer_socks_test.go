@@ -0,0 +1,454 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+An in-process SOCKS5 server, which relays CONNECT requests unless reply is set.
+Username/password authentication is required if username is set, and replied with authVersion if set.
+*/
+type testSOCKS5Server struct {
+	net.Listener
+	username    string
+	password    string
+	authVersion byte
+	reply       byte
+	mu          sync.Mutex
+	// The address type, and host, of the last request
+	requestType byte
+	requestHost string
+}
+
+func newTestSOCKS5Server(a *assert.Assertions, username string, password string) *testSOCKS5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return nil
+	}
+	s := &testSOCKS5Server{Listener: l, username: username, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5MethodNoAuth)
+	if s.username != "" {
+		method = socks5MethodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5MethodNone})
+		return
+	}
+	conn.Write([]byte{socks5Version, method})
+	if method == socks5MethodUserPass {
+		username, password, err := readTestSOCKS5Credentials(conn)
+		if err != nil {
+			return
+		}
+		authVersion := byte(socks5AuthVersion)
+		if s.authVersion != 0 {
+			authVersion = s.authVersion
+		}
+		if username != s.username || password != s.password {
+			conn.Write([]byte{authVersion, 0x01})
+			return
+		}
+		conn.Write([]byte{authVersion, 0x00})
+	}
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req[:3]); err != nil {
+		return
+	}
+	host, port, err := readSOCKS5Addr(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.requestHost = host
+	if net.ParseIP(host) == nil {
+		s.requestType = socks5AddrDomain
+	} else if net.ParseIP(host).To4() != nil {
+		s.requestType = socks5AddrIPv4
+	} else {
+		s.requestType = socks5AddrIPv6
+	}
+	s.mu.Unlock()
+	if s.reply != socks5ReplySucceeded {
+		conn.Write([]byte{socks5Version, s.reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	if req[1] == socks5CmdUDPAssociate {
+		s.serveUDP(conn)
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	bound, _ := appendSOCKS5Addr([]byte{socks5Version, socks5ReplySucceeded, 0x00}, "127.0.0.1", 1080)
+	conn.Write(bound)
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+/*
+Relay the datagrams of a UDP association until conn is closed.
+The relay's address is replied as 0.0.0.0, so that the client must use the address of the proxy.
+*/
+func (s *testSOCKS5Server) serveUDP(conn net.Conn) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	_, port, _ := net.SplitHostPort(relay.LocalAddr().String())
+	relayPort, _ := strconv.Atoi(port)
+	reply, _ := appendSOCKS5Addr([]byte{socks5Version, socks5ReplySucceeded, 0x00}, "0.0.0.0", relayPort)
+	conn.Write(reply)
+	go func() {
+		var client net.Addr
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if client == nil || from.String() == client.String() {
+				// From the client: decapsulate, and send to the target
+				client = from
+				r := bytes.NewReader(buf[3:n])
+				host, port, err := readSOCKS5Addr(r)
+				if err != nil {
+					continue
+				}
+				s.mu.Lock()
+				s.requestHost = host
+				s.mu.Unlock()
+				target, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					continue
+				}
+				relay.WriteTo(buf[n-r.Len():n], target)
+				continue
+			}
+			// From a target: encapsulate, and send to the client
+			fromAddr := from.(*net.UDPAddr)
+			datagram, _ := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, fromAddr.IP.String(), fromAddr.Port)
+			relay.WriteTo(append(datagram, buf[:n]...), client)
+		}
+	}()
+	io.Copy(io.Discard, conn)
+}
+
+/*
+Read an RFC 1929 username/password request.
+*/
+func readTestSOCKS5Credentials(r io.Reader) (string, string, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return "", "", err
+	}
+	read := func() (string, error) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		_, err := io.ReadFull(r, b)
+		return string(b), err
+	}
+	username, err := read()
+	if err != nil {
+		return "", "", err
+	}
+	password, err := read()
+	return username, password, err
+}
+
+func (s *testSOCKS5Server) proxy(a *assert.Assertions, scheme string, user string) Proxy {
+	return newTestProxyFromURL(a, scheme+"://"+user+s.Addr().String())
+}
+
+func (s *testSOCKS5Server) request() (byte, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestType, s.requestHost
+}
+
+func TestDialer_socks5(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	s := newTestSOCKS5Server(a, "", "")
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// Resolved locally
+	conn, err := Dialer(s.proxy(a, "socks5", "")).DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+		requestType, requestHost := s.request()
+		a.Equal(byte(socks5AddrIPv4), requestType)
+		a.Equal("127.0.0.1", requestHost)
+	}
+
+	// Resolved remotely
+	conn, err = Dialer(s.proxy(a, "socks5h", "")).DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+		requestType, requestHost := s.request()
+		a.Equal(byte(socks5AddrDomain), requestType)
+		a.Equal("localhost", requestHost)
+	}
+}
+
+func TestDialer_socks5Auth(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	s := newTestSOCKS5Server(a, "user", "pass")
+	defer s.Close()
+
+	conn, err := Dialer(s.proxy(a, "socks5", "user:pass@")).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.NoError(err) {
+		assertEcho(a, conn)
+		conn.Close()
+	}
+	_, err = Dialer(s.proxy(a, "socks5", "user:wrong@")).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.Error(err) {
+		a.Contains(err.Error(), "refused the username and password")
+	}
+	_, err = Dialer(s.proxy(a, "socks5", "")).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.Error(err) {
+		a.Contains(err.Error(), "accepts none of the offered authentication methods")
+	}
+}
+
+func TestDialer_socks5AuthVersion(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	s := newTestSOCKS5Server(a, "user", "pass")
+	defer s.Close()
+	s.authVersion = socks5Version
+
+	_, err := Dialer(s.proxy(a, "socks5", "user:pass@")).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if a.Error(err) {
+		a.Contains(err.Error(), "unexpected SOCKS5 authentication version 5")
+	}
+}
+
+func TestDialer_socks5Refused(t *testing.T) {
+	a := assert.New(t)
+	s := newTestSOCKS5Server(a, "", "")
+	defer s.Close()
+	s.reply = 0x02
+	_, err := Dialer(s.proxy(a, "socks5h", "")).DialContext(context.Background(), "tcp", "test.endpoint.rapid7.com:443")
+	var socksErr *SOCKSError
+	if a.True(errors.As(err, &socksErr)) {
+		a.Equal(5, socksErr.Version)
+		a.Equal(byte(0x02), socksErr.Code)
+		a.Equal("test.endpoint.rapid7.com:443", socksErr.Addr)
+		a.Contains(err.Error(), "connection not allowed by ruleset")
+	}
+}
+
+var dataSOCKS5Addr = []struct {
+	host   string
+	port   int
+	expect []byte
+}{
+	{"127.0.0.1", 80, []byte{socks5AddrIPv4, 127, 0, 0, 1, 0, 80}},
+	{"::1", 443, []byte{socks5AddrIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187}},
+	{"rapid7.com", 1080, []byte{socks5AddrDomain, 10, 'r', 'a', 'p', 'i', 'd', '7', '.', 'c', 'o', 'm', 4, 56}},
+}
+
+func TestSOCKS5Addr(t *testing.T) {
+	for _, tt := range dataSOCKS5Addr {
+		t.Run(tt.host, func(t *testing.T) {
+			a := assert.New(t)
+			b, err := appendSOCKS5Addr(nil, tt.host, tt.port)
+			a.NoError(err)
+			a.Equal(tt.expect, b)
+			host, port, err := readSOCKS5Addr(bytes.NewReader(b))
+			a.NoError(err)
+			a.Equal(tt.host, host)
+			a.Equal(tt.port, port)
+		})
+	}
+}
+
+/*
+An in-process SOCKS4 server, which relays CONNECT requests unless reply is set.
+*/
+type testSOCKS4Server struct {
+	net.Listener
+	reply byte
+	mu    sync.Mutex
+	// The user ID, and host, of the last request
+	userID      string
+	requestHost string
+}
+
+func newTestSOCKS4Server(a *assert.Assertions, reply byte) *testSOCKS4Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return nil
+	}
+	s := &testSOCKS4Server{Listener: l, reply: reply}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSOCKS4Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	req := make([]byte, 8)
+	if _, err := io.ReadFull(r, req); err != nil || req[0] != socks4Version {
+		return
+	}
+	userID, err := r.ReadString(0x00)
+	if err != nil {
+		return
+	}
+	host := net.IP(req[4:8]).String()
+	if req[4] == 0 && req[5] == 0 && req[6] == 0 {
+		if host, err = r.ReadString(0x00); err != nil {
+			return
+		}
+		host = strings.TrimSuffix(host, "\x00")
+	}
+	s.mu.Lock()
+	s.userID = strings.TrimSuffix(userID, "\x00")
+	s.requestHost = host
+	s.mu.Unlock()
+	if s.reply != socks4ReplyGranted {
+		conn.Write([]byte{socks4ReplyVersion, s.reply, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(req[2:4])))))
+	if err != nil {
+		conn.Write([]byte{socks4ReplyVersion, 0x5B, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{socks4ReplyVersion, socks4ReplyGranted, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+func (s *testSOCKS4Server) request() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.userID, s.requestHost
+}
+
+var dataDialerSOCKS4 = []struct {
+	scheme     string
+	user       string
+	host       string
+	expectUser string
+	expectHost string
+}{
+	{"socks4", "", "localhost", "", "127.0.0.1"},
+	{"socks4", "agent@", "127.0.0.1", "agent", "127.0.0.1"},
+	{"socks4a", "agent@", "localhost", "agent", "localhost"},
+	{"socks4a", "", "127.0.0.1", "", "127.0.0.1"},
+}
+
+func TestDialer_socks4(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	s := newTestSOCKS4Server(a, socks4ReplyGranted)
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	for _, tt := range dataDialerSOCKS4 {
+		t.Run(tt.scheme+" "+tt.user+tt.host, func(t *testing.T) {
+			a := assert.New(t)
+			p := newTestProxyFromURL(a, tt.scheme+"://"+tt.user+s.Addr().String())
+			conn, err := Dialer(p).DialContext(context.Background(), "tcp", net.JoinHostPort(tt.host, port))
+			if !a.NoError(err) {
+				return
+			}
+			defer conn.Close()
+			assertEcho(a, conn)
+			userID, host := s.request()
+			a.Equal(tt.expectUser, userID)
+			a.Equal(tt.expectHost, host)
+		})
+	}
+}
+
+func TestDialer_socks4Refused(t *testing.T) {
+	a := assert.New(t)
+	s := newTestSOCKS4Server(a, 0x5C)
+	defer s.Close()
+	_, err := Dialer(newTestProxyFromURL(a, "socks4a://"+s.Addr().String())).DialContext(context.Background(), "tcp", "test.endpoint.rapid7.com:443")
+	var socksErr *SOCKSError
+	if a.True(errors.As(err, &socksErr)) {
+		a.Equal(4, socksErr.Version)
+		a.Equal(byte(0x5C), socksErr.Code)
+		a.Contains(err.Error(), "cannot connect to identd")
+	}
+	_, err = Dialer(newTestProxyFromURL(a, "socks4://"+s.Addr().String())).DialContext(context.Background(), "tcp", "[::1]:443")
+	if a.Error(err) {
+		a.Contains(err.Error(), "only IPv4")
+	}
+}
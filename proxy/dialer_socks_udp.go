@@ -0,0 +1,209 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5CmdUDPAssociate = 0x03
+	// RSV (2 bytes), FRAG, ATYP, and at most 255 bytes of DST.ADDR and 2 of DST.PORT
+	socks5MaxUDPHeader = 3 + 1 + 1 + 255 + 2
+)
+
+/*
+Create a net.PacketConn which sends and receives UDP datagrams through the SOCKS5 proxy p (RFC 1928 UDP ASSOCIATE).
+For example, to send a DNS query through ALL_PROXY:
+	conn, err := proxy.ListenPacket(ctx, provider.GetSOCKSProxy("udp://8.8.8.8:53"))
+	conn.WriteTo(query, &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53})
+Datagrams may be addressed to a *net.UDPAddr, or any net.Addr whose String is host:port.
+Host names are resolved locally, unless p's protocol is socks5h.
+The association lasts until the PacketConn is closed, or the proxy closes its control connection.
+Params:
+	ctx: Bounds the association. The PacketConn is not bound by ctx once returned.
+	p: The proxy. Supported protocols are socks5, socks5h, and socks.
+	opts: Optional. See WithForwardDialer, which is used for the control connection.
+Returns:
+	net.PacketConn, nil: The association is established.
+	nil, *SOCKSError: The proxy refused the association (i.e. command not supported).
+	nil, error: The proxy could not be reached, or does not support SOCKS5.
+*/
+func ListenPacket(ctx context.Context, p Proxy, opts ...DialerOption) (net.PacketConn, error) {
+	if p == nil {
+		return nil, errors.New("nil proxy")
+	}
+	d := Dialer(p, opts...).(*dialer)
+	remoteResolve := false
+	switch p.Protocol() {
+	case protocolSOCKS, protocolSOCKS5:
+	case protocolSOCKS5H:
+		remoteResolve = true
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol for UDP: %s", p)
+	}
+	ctrl, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var relay string
+	err = handshake(ctx, ctrl, func() error {
+		if err := d.socks5Authenticate(ctrl); err != nil {
+			return err
+		}
+		// The address datagrams are sent from is not yet known
+		relay, err = d.socks5Request(ctrl, socks5CmdUDPAssociate, net.IPv4zero.String(), 0)
+		return err
+	})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	relayHost, relayPort, err := splitSOCKSAddr(relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(relayHost); ip != nil && ip.IsUnspecified() {
+		// The relay listens on the address of the proxy
+		relayHost = p.Host()
+	}
+	udp, err := new(net.Dialer).DialContext(ctx, "udp", net.JoinHostPort(relayHost, strconv.Itoa(relayPort)))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &socks5PacketConn{ctrl: ctrl, udp: udp, remoteResolve: remoteResolve}
+	go func() {
+		// The association ends when the control connection does
+		io.Copy(io.Discard, ctrl)
+		udp.Close()
+	}()
+	return c, nil
+}
+
+/*
+A net.PacketConn which encapsulates datagrams with the SOCKS5 UDP request header, and sends them to the proxy's relay.
+*/
+type socks5PacketConn struct {
+	ctrl          net.Conn
+	udp           net.Conn
+	remoteResolve bool
+}
+
+/*
+A SOCKS5 UDP address which is a host name, received from a proxy.
+*/
+type socksAddr struct {
+	host string
+	port int
+}
+
+func (a *socksAddr) Network() string {
+	return "udp"
+}
+
+func (a *socksAddr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+/*
+Read a datagram from the relay, discarding those which are fragmented, or whose header is invalid.
+Returns:
+	The length of the payload, and the address it was sent from.
+*/
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+socks5MaxUDPHeader)
+	for {
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		r := bytes.NewReader(buf[:n])
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(r, header); err != nil || header[2] != 0x00 {
+			continue
+		}
+		host, port, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		var addr net.Addr = &socksAddr{host: host, port: port}
+		if ip := net.ParseIP(host); ip != nil {
+			addr = &net.UDPAddr{IP: ip, Port: port}
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+/*
+Send b to addr through the relay.
+Returns:
+	The length of b, should the datagram be sent.
+*/
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var (
+		host string
+		port int
+		err  error
+	)
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		host, port = udpAddr.IP.String(), udpAddr.Port
+	} else if host, port, err = splitSOCKSAddr(addr.String()); err != nil {
+		return 0, err
+	}
+	if !c.remoteResolve {
+		if host, err = resolveSOCKSHost(context.Background(), host); err != nil {
+			return 0, err
+		}
+	}
+	datagram, err := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, host, port)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.udp.Write(append(datagram, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	err := c.udp.Close()
+	if ctrlErr := c.ctrl.Close(); err == nil {
+		err = ctrlErr
+	}
+	return err
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *socks5PacketConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
@@ -0,0 +1,116 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+A UDP server which echoes each datagram to its sender.
+*/
+func newTestUDPEchoServer(a *assert.Assertions) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return nil
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+var dataListenPacket = []struct {
+	scheme     string
+	addr       func(echo *net.UDPAddr) net.Addr
+	expectHost string
+}{
+	{"socks5", func(echo *net.UDPAddr) net.Addr { return echo }, "127.0.0.1"},
+	{"socks5", func(echo *net.UDPAddr) net.Addr { return &socksAddr{host: "localhost", port: echo.Port} }, "127.0.0.1"},
+	{"socks5h", func(echo *net.UDPAddr) net.Addr { return &socksAddr{host: "localhost", port: echo.Port} }, "localhost"},
+}
+
+func TestListenPacket(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestUDPEchoServer(a)
+	defer echo.Close()
+	s := newTestSOCKS5Server(a, "user", "pass")
+	defer s.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	for _, tt := range dataListenPacket {
+		t.Run(tt.scheme+" "+tt.addr(echoAddr).String(), func(t *testing.T) {
+			a := assert.New(t)
+			conn, err := ListenPacket(context.Background(), s.proxy(a, tt.scheme, "user:pass@"))
+			if !a.NoError(err) {
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.WriteTo([]byte("ping"), tt.addr(echoAddr))
+			if !a.NoError(err) {
+				return
+			}
+			a.Equal(4, n)
+			b := make([]byte, 16)
+			n, from, err := conn.ReadFrom(b)
+			if !a.NoError(err) {
+				return
+			}
+			a.Equal("ping", string(b[:n]))
+			a.Equal(echoAddr.String(), from.String())
+			_, requestHost := s.request()
+			a.Equal(tt.expectHost, requestHost)
+		})
+	}
+}
+
+func TestListenPacket_closed(t *testing.T) {
+	a := assert.New(t)
+	s := newTestSOCKS5Server(a, "", "")
+	defer s.Close()
+	conn, err := ListenPacket(context.Background(), s.proxy(a, "socks5", ""))
+	if !a.NoError(err) {
+		return
+	}
+	conn.Close()
+	_, _, err = conn.ReadFrom(make([]byte, 16))
+	a.True(errors.Is(err, net.ErrClosed))
+}
+
+func TestListenPacket_unsupported(t *testing.T) {
+	a := assert.New(t)
+	s := newTestSOCKS5Server(a, "", "")
+	defer s.Close()
+	s.reply = 0x07
+	_, err := ListenPacket(context.Background(), s.proxy(a, "socks5", ""))
+	var socksErr *SOCKSError
+	if a.True(errors.As(err, &socksErr)) {
+		a.Equal(byte(0x07), socksErr.Code)
+	}
+	_, err = ListenPacket(context.Background(), newTestProxyFromURL(a, "http://proxy:3128"))
+	a.Error(err)
+	_, err = ListenPacket(context.Background(), nil)
+	a.Error(err)
+}
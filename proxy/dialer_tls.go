@@ -0,0 +1,212 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+/*
+Configures the TLS session with an https proxy (i.e. https://proxy.rapid7.com:443).
+The session is verified against RootCAs as usual, and additionally against PinnedSPKI, if set.
+May be set with WithProxyTLS, or the "tls" key of the configuration file:
+	{
+		"https": "https://proxy.rapid7.com:443",
+		"tls": {
+			"ca": "/etc/proxy/ca.pem",
+			"cert": "/etc/proxy/client.pem",
+			"key": "/etc/proxy/client.key",
+			"serverName": "proxy.rapid7.com",
+			"pinnedSPKI": ["d6qzRu9zOECb90Uez27xWltNsj0e1Md7GkYYkVoZWmM="]
+		}
+	}
+*/
+type ProxyTLSConfig struct {
+	// Optional. The root CAs the proxy's certificate must chain to. Default is the system's roots.
+	RootCAs *x509.CertPool
+	// Optional. The client certificates to present to the proxy.
+	Certificates []tls.Certificate
+	// Optional. The name sent as SNI, and verified against the proxy's certificate. Default is the proxy's host.
+	ServerName string
+	// Optional. Base64 encoded SHA-256 digests of SubjectPublicKeyInfo. The proxy's verified chain must contain one.
+	PinnedSPKI []string
+}
+
+/*
+The "tls" key of the configuration file. See ProxyTLSConfig.
+*/
+type proxyTLSFileConfig struct {
+	CA         string   `json:"ca"`
+	Cert       string   `json:"cert"`
+	Key        string   `json:"key"`
+	ServerName string   `json:"serverName"`
+	PinnedSPKI []string `json:"pinnedSPKI"`
+}
+
+/*
+Configure the TLS session with https proxies, overriding any configured by the configuration file.
+*/
+func WithProxyTLS(config *ProxyTLSConfig) DialerOption {
+	return func(d *dialer) {
+		d.tlsConfig = config
+	}
+}
+
+/*
+Load the files referenced by the "tls" key of the configuration file.
+Returns:
+	*ProxyTLSConfig, nil: The files were loaded.
+	nil, error: A file could not be read or parsed, or only one of cert and key is set.
+*/
+func (c *proxyTLSFileConfig) load() (*ProxyTLSConfig, error) {
+	config := &ProxyTLSConfig{ServerName: c.ServerName, PinnedSPKI: c.PinnedSPKI}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	for _, pin := range c.PinnedSPKI {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin, expected a base64 encoded SHA-256 digest: %q", pin)
+		}
+	}
+	return config, nil
+}
+
+/*
+Read the "tls" key of the proxy.config file.
+Params:
+	configFile: Optional. Path to the configuration file.
+Returns:
+	*ProxyTLSConfig, nil: The configuration, nil if the file or key is not present.
+	nil, error: The key is present, but is invalid, or references files which could not be loaded.
+*/
+func (p *provider) readConfigFileTLS(configFile string) (*ProxyTLSConfig, error) {
+	raw, err := p.readProxyConfigFile(configFile)
+	if err != nil {
+		return nil, nil
+	}
+	value, exists := raw[configKeyTLS]
+	if !exists {
+		return nil, nil
+	}
+	var c proxyTLSFileConfig
+	if err := json.Unmarshal(value, &c); err != nil {
+		return nil, err
+	}
+	return c.load()
+}
+
+/*
+Create the tls.Config for a session with the proxy at host.
+*/
+func (c *ProxyTLSConfig) clientConfig(host string) *tls.Config {
+	config := &tls.Config{ServerName: host}
+	if c == nil {
+		return config
+	}
+	config.RootCAs = c.RootCAs
+	config.Certificates = c.Certificates
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+	if len(c.PinnedSPKI) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range c.PinnedSPKI {
+			pins[pin] = true
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if pins[base64.StdEncoding.EncodeToString(digest[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("proxy certificate chain matches none of the pinned SPKI digests")
+		}
+	}
+	return config
+}
+
+/*
+Returns:
+	The TLS configuration p was created with (i.e. by the "tls" key of the configuration file), or nil.
+*/
+func proxyTLS(p Proxy) *ProxyTLSConfig {
+	if pp, ok := p.(*proxy); ok {
+		return pp.tls
+	}
+	return nil
+}
+
+/*
+Dial the https proxy p, and complete the TLS handshake with it.
+Params:
+	ctx: Bounds the connection, and the handshake.
+	dial: Connects to the proxy.
+	p: The proxy.
+	config: The TLS configuration. If nil, that p was created with is used.
+*/
+func dialTLSProxy(ctx context.Context, dial func(ctx context.Context, network string, addr string) (net.Conn, error), p Proxy, config *ProxyTLSConfig) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", proxyAddr(p))
+	if err != nil {
+		return nil, err
+	}
+	return proxyTLSHandshake(ctx, conn, p, config)
+}
+
+/*
+Complete the TLS handshake with the https proxy p over conn, which is closed should the handshake fail.
+Params:
+	ctx: Bounds the handshake.
+	conn: The connection to the proxy.
+	p: The proxy.
+	config: The TLS configuration. If nil, that p was created with is used.
+*/
+func proxyTLSHandshake(ctx context.Context, conn net.Conn, p Proxy, config *ProxyTLSConfig) (net.Conn, error) {
+	if config == nil {
+		config = proxyTLS(p)
+	}
+	tlsConn := tls.Client(conn, config.clientConfig(p.Host()))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return nil, fmt.Errorf("TLS handshake with proxy %s: %w", p, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestDialer_tls(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	proxyServer := newTestTLSConnectProxy(http.StatusOK, tls.RequireAnyClientCert)
+	defer proxyServer.Close()
+	p := proxyServer.proxy(a)
+	roots := x509.NewCertPool()
+	roots.AddCert(proxyServer.Certificate())
+	clientCert := proxyServer.TLS.Certificates
+
+	var data = []struct {
+		name      string
+		config    *ProxyTLSConfig
+		expectErr string
+	}{
+		{"roots", &ProxyTLSConfig{RootCAs: roots, Certificates: clientCert}, ""},
+		{"server name", &ProxyTLSConfig{RootCAs: roots, Certificates: clientCert, ServerName: "example.com"}, ""},
+		{"pinned", &ProxyTLSConfig{RootCAs: roots, Certificates: clientCert, PinnedSPKI: []string{testSPKIPin(proxyServer.Certificate())}}, ""},
+		{"system roots", &ProxyTLSConfig{Certificates: clientCert}, "certificate"},
+		{"wrong server name", &ProxyTLSConfig{RootCAs: roots, Certificates: clientCert, ServerName: "proxy.rapid7.invalid"}, "proxy.rapid7.invalid"},
+		{"wrong pin", &ProxyTLSConfig{RootCAs: roots, Certificates: clientCert, PinnedSPKI: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}}, "pinned SPKI"},
+		{"no client certificate", &ProxyTLSConfig{RootCAs: roots}, "certificate"},
+	}
+	for _, tt := range data {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			conn, err := Dialer(p, WithProxyTLS(tt.config)).DialContext(context.Background(), "tcp", echo.Addr().String())
+			if tt.expectErr != "" {
+				if a.Error(err) {
+					a.Contains(err.Error(), tt.expectErr)
+				}
+				return
+			}
+			if a.NoError(err) {
+				assertEcho(a, conn)
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestProxyTLS_configFile(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	proxyServer := newTestTLSConnectProxy(http.StatusOK, tls.NoClientCert)
+	defer proxyServer.Close()
+	tmpDir, err := os.MkdirTemp("", "TestProxyTLS")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	ca := filepath.Join(tmpDir, "ca.pem")
+	if !a.NoError(os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: proxyServer.Certificate().Raw}), 0644)) {
+		return
+	}
+	f := filepath.Join(tmpDir, "proxy.config")
+	config := fmt.Sprintf(`{"https": %q, "http": %q, "tls": {"ca": %q, "pinnedSPKI": [%q]}}`, proxyServer.URL, proxyServer.URL, ca, testSPKIPin(proxyServer.Certificate()))
+	if !a.NoError(os.WriteFile(f, []byte(config), 0644)) {
+		return
+	}
+	provider, err := NewProviderWithOptions(WithConfigFile(f), WithSourceOrder("config"))
+	if !a.NoError(err) {
+		return
+	}
+
+	// Dialer
+	p := provider.GetProxy("https", "https://test.endpoint.rapid7.com")
+	if a.NotNil(p) {
+		conn, err := Dialer(p).DialContext(context.Background(), "tcp", echo.Addr().String())
+		if a.NoError(err) {
+			assertEcho(a, conn)
+			conn.Close()
+		}
+	}
+
+	// Transports
+	client := &http.Client{Transport: NewTransport(provider)}
+	a.Equal("proxied http://test.endpoint.rapid7.invalid/", testGet(a, client, "http://test.endpoint.rapid7.invalid/"))
+	client = &http.Client{Transport: NewFailoverTransport(provider)}
+	a.Equal("proxied http://test.endpoint.rapid7.invalid/", testGet(a, client, "http://test.endpoint.rapid7.invalid/"))
+
+	// Invalid
+	for _, tlsConfig := range []string{`"ca.pem"`, `{"ca": "missing.pem"}`, `{"cert": "client.pem"}`, `{"pinnedSPKI": ["bogus"]}`} {
+		if !a.NoError(os.WriteFile(f, []byte(fmt.Sprintf(`{"https": %q, "tls": %s}`, proxyServer.URL, tlsConfig)), 0644)) {
+			return
+		}
+		a.Nil(provider.GetProxy("https", "https://test.endpoint.rapid7.com"), tlsConfig)
+	}
+}
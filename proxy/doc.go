@@ -13,6 +13,13 @@
 //	Linux:
 //		Configuration File
 //		Environment Variable: HTTPS_PROXY, HTTP_PROXY, FTP_PROXY, or ALL_PROXY. `NO_PROXY` is respected.
+//		Environment files: /etc/security/pam_env.conf, /etc/environment, /etc/profile.d/*.sh
+//		systemd: systemctl show-environment, or DefaultEnvironment= of /etc/systemd/system.conf(.d)
+//		GNOME: org.gnome.system.proxy (gsettings)
+//		KDE: ~/.config/kioslaverc
+//		NetworkManager: PAC URL or script of the active connections (nmcli)
+//		WPAD, only when the "wpad" source is named: PAC URL advertised by DHCP (option 252)
+//		WPAD, only when the "wpad" source is named: http://wpad.<domain>/wpad.dat for each of the host's DNS domains
 //
 //	MacOS:
 //		Configuration File
@@ -30,10 +37,31 @@
 //		)
 //
 //		func main() {
-//	    	p := proxy.NewProvider("").Get("https", "https://rapid7.com")
+//	    	p := proxy.NewProvider("").GetProxy("https", "https://rapid7.com")
 //			if p != nil {
 //				fmt.Printf("Found proxy: %s\n", p)
 //			}
 // 	   }
 //
+// Lookup additionally accepts a context, and distinguishes a proxy, a direct connection preferred by a PAC script,
+// and a bypassed target. Should nothing be found, the error matches ErrNotFound or ErrTimeout with errors.Is
+// (or context.Canceled, should the context have been cancelled), and any invalid configuration is available as a *ParseError with errors.As.
+//
+// Options
+//
+// NewProviderWithOptions accepts options which replace the inputs of NewProvider, so that a lookup may be deterministic,
+// or made on behalf of another process (i.e. WithConfigFile, WithEnvMap, WithCommandRunner, WithTimeouts, WithLogger,
+// WithHTTPClient).
+//
+// Source Order
+//
+// The sources may be reordered, or disabled, with WithSourceOrder or the "sources" key of the configuration file:
+//
+//		{"https": "http://proxy.rapid7.com:3128", "sources": ["system", "config", "env"]}
+//
+// Custom Sources
+//
+// Each location above is a Source (see DefaultSources). WithSources builds a Provider from any ordered
+// list of sources, so that proxies may be read from elsewhere (i.e. a management server's policy) without forking.
+//
 package proxy
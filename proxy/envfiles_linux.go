@@ -0,0 +1,613 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const sourceNameEnvFiles = "envfiles"
+
+/*
+Create a Source which reads HTTPS_PROXY, https_proxy, ..., respecting NO_PROXY and no_proxy, from the system-wide
+environment files which a service does not inherit: /etc/security/pam_env.conf, /etc/environment, and /etc/profile.d/*.sh.
+Proxies are sourced by the file which set them (i.e. /etc/environment[HTTPS_PROXY]).
+*/
+func EnvFilesSource() Source {
+	return &envFilesSource{files: defaultEnvFiles}
+}
+
+type envFilesSource struct {
+	// The files read, defaultEnvFiles but in tests
+	files []envFile
+}
+
+func (s *envFilesSource) Name() string {
+	return sourceNameEnvFiles
+}
+
+func (s *envFilesSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *envFilesSource) lookup(_ context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	if proxy := p.readEnvFilesProxy(s.files, protocol, targetUrl, t); proxy != nil {
+		return []Proxy{proxy}, nil
+	}
+	return nil, nil
+}
+
+const (
+	// Sources of the variables read from the environment files (i.e. /etc/environment[HTTPS_PROXY])
+	srcEnvironmentFileFmt = "%s[%s]"
+	// Sources of the variables which no environment file sets (i.e. EnvironmentFiles[HTTPS_PROXY])
+	srcEnvironmentFiles = "EnvironmentFiles"
+	maxEnvFileSize      = 1048576
+)
+
+// The syntax of an environment file
+type envFileFormat int
+
+const (
+	// KEY=VALUE, as /etc/environment, without expansion
+	envFormatPlain envFileFormat = iota
+	// VAR [DEFAULT=value] [OVERRIDE=value], as /etc/security/pam_env.conf
+	envFormatPAM
+	// Shell assignments (export KEY=VALUE), as /etc/profile.d/*.sh
+	envFormatShell
+)
+
+/*
+A file (or glob of files, read in lexical order) which sets environment variables.
+*/
+type envFile struct {
+	pattern string
+	format  envFileFormat
+}
+
+// The system-wide environment files, in the order a login shell reads them: later files override earlier ones.
+var defaultEnvFiles = []envFile{
+	{"/etc/security/pam_env.conf", envFormatPAM},
+	{"/etc/environment", envFormatPlain},
+	{"/etc/profile.d/*.sh", envFormatShell},
+}
+
+/*
+Variables read from environment files, and the file which set each.
+Only exported variables are part of the environment: the variables which shell scripts assign without exporting them
+are kept apart, for the expansion of later assignments.
+*/
+type fileEnv struct {
+	// Names the source of the variables which are not set
+	name   string
+	values map[string]string
+	files  map[string]string
+	// The shell variables which are not exported, and the file which set each
+	shell      map[string]string
+	shellFiles map[string]string
+}
+
+func newFileEnv(name string) *fileEnv {
+	return &fileEnv{name: name, values: map[string]string{}, files: map[string]string{}, shell: map[string]string{}, shellFiles: map[string]string{}}
+}
+
+func (e *fileEnv) getEnv(key string) string {
+	return e.values[key]
+}
+
+/*
+Returns:
+	string, bool: The value of the variable key, exported or not, as a shell expands it, and whether it is set.
+*/
+func (e *fileEnv) lookup(key string) (string, bool) {
+	if value, ok := e.shell[key]; ok {
+		return value, true
+	}
+	value, ok := e.values[key]
+	return value, ok
+}
+
+/*
+Set the environment variable key.
+*/
+func (e *fileEnv) set(key string, value string, file string) {
+	delete(e.shell, key)
+	delete(e.shellFiles, key)
+	e.values[key] = value
+	e.files[key] = file
+}
+
+/*
+Assign the shell variable key (KEY=VALUE), which remains in the environment if it is exported, and out of it otherwise.
+*/
+func (e *fileEnv) assign(key string, value string, file string) {
+	if _, exported := e.values[key]; exported {
+		e.set(key, value, file)
+		return
+	}
+	e.shell[key] = value
+	e.shellFiles[key] = file
+}
+
+/*
+Export the shell variable key (export KEY), should it be set.
+*/
+func (e *fileEnv) export(key string) {
+	if value, ok := e.shell[key]; ok {
+		e.set(key, value, e.shellFiles[key])
+	}
+}
+
+func (e *fileEnv) unset(key string) {
+	delete(e.values, key)
+	delete(e.files, key)
+	delete(e.shell, key)
+	delete(e.shellFiles, key)
+}
+
+/*
+Returns the source of the variable key: the file which set it (i.e. /etc/environment[HTTPS_PROXY]).
+*/
+func (e *fileEnv) src(key string) string {
+	if f, ok := e.files[key]; ok {
+		return fmt.Sprintf(srcEnvironmentFileFmt, f, key)
+	}
+	return fmt.Sprintf(srcEnvironmentFileFmt, e.name, key)
+}
+
+/*
+Find the proxy configured by the variables of the system-wide environment files, which a service
+does not inherit, for the given traffic protocol and targetUrl. NO_PROXY is respected as it is by the environment source.
+Params:
+	files: The environment files to read, in order. (i.e. defaultEnvFiles)
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	proxy: A proxy is found, its source naming the file which set it.
+	nil: No proxy is found, or targetUrl is bypassed.
+*/
+func (p *provider) readEnvFilesProxy(files []envFile, protocol string, targetUrl *url.URL, t *Trace) Proxy {
+	return p.readFileEnvProxy(p.readEnvFiles(files), protocol, targetUrl, t)
+}
+
+/*
+Same as readSystemEnvProxy, for the variables of env rather than those of the environment.
+*/
+func (p *provider) readFileEnvProxy(env *fileEnv, protocol string, targetUrl *url.URL, t *Trace) Proxy {
+	// Consulted as the environment is, through a provider reading env
+	envProvider := *p
+	envProvider.getEnv = env.getEnv
+	envProvider.envSrc = env.src
+	return envProvider.readSystemEnvProxy(protocol, targetUrl, t)
+}
+
+/*
+Read the variables of files, in order. Files which cannot be read are skipped.
+*/
+func (p *provider) readEnvFiles(files []envFile) *fileEnv {
+	env := newFileEnv(srcEnvironmentFiles)
+	for _, f := range files {
+		matches, err := filepath.Glob(f.pattern)
+		if err != nil {
+			p.logger.Printf("[proxy.Provider.readEnvFiles]: %s: %s\n", f.pattern, err)
+			continue
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			content, err := readEnvFile(match)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					p.logger.Printf("[proxy.Provider.readEnvFiles]: %s\n", err)
+				}
+				continue
+			}
+			switch f.format {
+			case envFormatPlain:
+				parseEnvironmentFile(content, match, env)
+			case envFormatPAM:
+				parsePAMEnvConf(content, match, env)
+			case envFormatShell:
+				parseShellEnv(content, match, env)
+			}
+		}
+	}
+	return env
+}
+
+func readEnvFile(f string) ([]byte, error) {
+	stat, err := os.Stat(f)
+	if err != nil {
+		return nil, err
+	} else if stat.IsDir() {
+		return nil, fmt.Errorf("environment file is a directory: %s", f)
+	} else if stat.Size() > maxEnvFileSize {
+		return nil, fmt.Errorf("environment file too large: %s", f)
+	}
+	return os.ReadFile(f)
+}
+
+/*
+Parse KEY=VALUE lines, as /etc/environment. Values may be quoted, and are not expanded.
+Lines prefixed by "export", as commonly (and wrongly) written, are accepted.
+*/
+func parseEnvironmentFile(content []byte, file string, env *fileEnv) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || !isEnvName(key) {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env.set(key, value, file)
+	}
+}
+
+/*
+Parse pam_env.conf lines: VAR [DEFAULT=value] [OVERRIDE=value], which may be continued by a trailing backslash.
+Values may be quoted, and ${VAR} is expanded with the variables read so far. @{HOME} and @{SHELL}, which are those
+of the user logging in, are expanded empty. OVERRIDE is used if it is not empty, otherwise DEFAULT.
+Should both be empty, the variable is unset.
+*/
+func parsePAMEnvConf(content []byte, file string, env *fileEnv) {
+	var lines []string
+	continued := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			continued += strings.TrimSuffix(line, "\\")
+			continue
+		}
+		lines = append(lines, continued+line)
+		continued = ""
+	}
+	for _, line := range lines {
+		fields := splitPAMEnvFields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || !isEnvName(fields[0]) {
+			continue
+		}
+		var defaultValue, overrideValue string
+		for _, field := range fields[1:] {
+			if v, ok := strings.CutPrefix(field, "DEFAULT="); ok {
+				defaultValue = expandPAMEnv(v, env)
+			} else if v, ok := strings.CutPrefix(field, "OVERRIDE="); ok {
+				overrideValue = expandPAMEnv(v, env)
+			}
+		}
+		switch {
+		case overrideValue != "":
+			env.set(fields[0], overrideValue, file)
+		case defaultValue != "":
+			env.set(fields[0], defaultValue, file)
+		default:
+			env.unset(fields[0])
+		}
+	}
+}
+
+/*
+Split a pam_env.conf line on white space which is not quoted, removing the quotes.
+*/
+func splitPAMEnvFields(line string) []string {
+	var fields []string
+	var b strings.Builder
+	inField, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		case c == '\\' && i+1 < len(line):
+			// Kept, so that expandPAMEnv may tell \$ from $
+			b.WriteByte(c)
+			i++
+			b.WriteByte(line[i])
+			inField = true
+		default:
+			b.WriteByte(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+	return fields
+}
+
+func expandPAMEnv(value string, env *fileEnv) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value):
+			i++
+			b.WriteByte(value[i])
+		case (c == '$' || c == '@') && i+1 < len(value) && value[i+1] == '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				b.WriteString(value[i:])
+				return b.String()
+			}
+			if c == '$' {
+				b.WriteString(env.getEnv(value[i+2 : i+end]))
+			}
+			i += end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+/*
+Parse the simple commands of a shell script, as /etc/profile.d/*.sh: assignments (KEY=VALUE), export (export KEY=VALUE,
+or export KEY), readonly, and unset. Only exported variables are set in env, see fileEnv.
+$VAR, ${VAR}, ${VAR:-word} and ${VAR-word} are expanded with the variables read so far, exported or not.
+The script is not executed: conditions are not evaluated, and commands which cannot be evaluated
+(i.e. command substitution) are skipped.
+*/
+func parseShellEnv(content []byte, file string, env *fileEnv) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		commands, ok := splitShellCommands(scanner.Text())
+		if !ok {
+			continue
+		}
+		for _, words := range commands {
+			applyShellCommand(words, file, env)
+		}
+	}
+}
+
+func applyShellCommand(words []string, file string, env *fileEnv) {
+	if len(words) == 0 {
+		return
+	}
+	switch words[0] {
+	case "export":
+		for _, word := range words[1:] {
+			key, value, ok := strings.Cut(word, "=")
+			if !isEnvName(key) {
+				continue
+			} else if !ok {
+				env.export(key)
+			} else if v, ok := expandShellWord(value, env); ok {
+				env.set(key, v, file)
+			}
+		}
+		return
+	case "readonly":
+		// Which does not export
+		for _, word := range words[1:] {
+			if key, value, ok := strings.Cut(word, "="); ok && isEnvName(key) {
+				if v, ok := expandShellWord(value, env); ok {
+					env.assign(key, v, file)
+				}
+			}
+		}
+		return
+	case "unset":
+		for _, word := range words[1:] {
+			if isEnvName(word) {
+				env.unset(word)
+			}
+		}
+		return
+	}
+	// Assignments only, as assignments followed by a command apply to that command alone
+	for _, word := range words {
+		if key, _, ok := strings.Cut(word, "="); !ok || !isEnvName(key) {
+			return
+		}
+	}
+	for _, word := range words {
+		key, value, _ := strings.Cut(word, "=")
+		if v, ok := expandShellWord(value, env); ok {
+			env.assign(key, v, file)
+		}
+	}
+}
+
+/*
+Split a line of a shell script into commands (separated by ;, && or ||) of words, which keep their quotes.
+Returns:
+	[][]string, true: The commands of the line.
+	nil, false: A quote is not terminated.
+*/
+func splitShellCommands(line string) ([][]string, bool) {
+	var commands [][]string
+	var words []string
+	var b strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			words = append(words, b.String())
+			b.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(words) > 0 {
+			commands = append(commands, words)
+			words = nil
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := i + 1
+			for ; end < len(line) && line[end] != c; end++ {
+				if c == '"' && line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, false
+			}
+			b.WriteString(line[i : end+1])
+			inWord = true
+			i = end
+		case c == '\\' && i+1 < len(line):
+			b.WriteString(line[i : i+2])
+			inWord = true
+			i++
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == ';' || c == '&' || c == '|':
+			endCommand()
+		case c == '#' && !inWord:
+			endCommand()
+			return commands, true
+		default:
+			b.WriteByte(c)
+			inWord = true
+		}
+	}
+	endCommand()
+	return commands, true
+}
+
+/*
+Remove the quotes of a shell word, expanding its variables outside of single quotes.
+Returns:
+	string, true: The value of the word.
+	"", false: The word cannot be evaluated without executing it (i.e. $(hostname)).
+*/
+func expandShellWord(word string, env *fileEnv) (string, bool) {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case c == '\'' && !quoted:
+			end := strings.IndexByte(word[i+1:], '\'')
+			if end < 0 {
+				return "", false
+			}
+			b.WriteString(word[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(word):
+			if next := word[i+1]; !quoted || strings.IndexByte("$`\"\\", next) >= 0 {
+				i++
+				b.WriteByte(next)
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '`':
+			return "", false
+		case c == '$' && i+1 < len(word):
+			value, n, ok := expandShellVariable(word[i+1:], env)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(value)
+			i += n
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), true
+}
+
+/*
+Expand the variable following a $: NAME, {NAME}, {NAME:-word} or {NAME-word}.
+Returns:
+	string, int, true: The value, and the length of the expression following the $.
+	"", 0, false: The expression is not supported (i.e. a command substitution).
+*/
+func expandShellVariable(s string, env *fileEnv) (string, int, bool) {
+	if s[0] != '{' {
+		n := 0
+		for n < len(s) && isEnvNameByte(s[n], n) {
+			n++
+		}
+		if n == 0 {
+			// A lone $
+			return "$", 0, s[0] != '('
+		}
+		value, _ := env.lookup(s[:n])
+		return value, n, true
+	}
+	end := strings.IndexByte(s, '}')
+	if end < 0 {
+		return "", 0, false
+	}
+	expr := s[1:end]
+	n := 0
+	for n < len(expr) && isEnvNameByte(expr[n], n) {
+		n++
+	}
+	name, op := expr[:n], expr[n:]
+	if name == "" {
+		return "", 0, false
+	}
+	value, set := env.lookup(name)
+	switch {
+	case op == "":
+	case strings.HasPrefix(op, ":-"):
+		if value == "" {
+			value = op[2:]
+		}
+	case strings.HasPrefix(op, "-"):
+		if !set {
+			value = op[1:]
+		}
+	default:
+		return "", 0, false
+	}
+	return value, end + 1, true
+}
+
+func isEnvName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isEnvNameByte(s[i], i) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameByte(c byte, i int) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+}
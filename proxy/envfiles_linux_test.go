@@ -0,0 +1,171 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFileEnv(values map[string]string) *fileEnv {
+	env := newFileEnv(srcEnvironmentFiles)
+	for k, v := range values {
+		env.set(k, v, "test")
+	}
+	return env
+}
+
+var dataParseEnvironmentFile = []struct {
+	content string
+	expect  map[string]string
+}{
+	{"HTTPS_PROXY=http://proxy.rapid7.com:3128\n", map[string]string{"HTTPS_PROXY": "http://proxy.rapid7.com:3128"}},
+	{"PATH=\"/usr/bin:/bin\"\nhttps_proxy='http://proxy:3128'\n", map[string]string{"PATH": "/usr/bin:/bin", "https_proxy": "http://proxy:3128"}},
+	{"export NO_PROXY=localhost,.rapid7.com\n", map[string]string{"NO_PROXY": "localhost,.rapid7.com"}},
+	{"# HTTPS_PROXY=http://commented:3128\n\n  HTTP_PROXY = http://spaced:3128\n", map[string]string{}},
+	{"HTTP_PROXY=$HTTPS_PROXY\n", map[string]string{"HTTP_PROXY": "$HTTPS_PROXY"}},
+	{"not an assignment\n1X=y\n", map[string]string{}},
+}
+
+func TestParseEnvironmentFile(t *testing.T) {
+	a := assert.New(t)
+	for _, tt := range dataParseEnvironmentFile {
+		env := newTestFileEnv(nil)
+		parseEnvironmentFile([]byte(tt.content), "/etc/environment", env)
+		a.Equal(tt.expect, env.values, tt.content)
+	}
+}
+
+var dataParsePAMEnvConf = []struct {
+	content string
+	env     map[string]string
+	expect  map[string]string
+}{
+	{"HTTPS_PROXY DEFAULT=http://proxy.rapid7.com:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://proxy.rapid7.com:3128"}},
+	{"HTTPS_PROXY DEFAULT=http://default:3128 OVERRIDE=http://override:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://override:3128"}},
+	{"HTTPS_PROXY DEFAULT=http://default:3128 OVERRIDE=${UNSET}\n", nil, map[string]string{"HTTPS_PROXY": "http://default:3128"}},
+	{"http_proxy OVERRIDE=${HTTPS_PROXY}\n", map[string]string{"HTTPS_PROXY": "http://proxy:3128"}, map[string]string{"HTTPS_PROXY": "http://proxy:3128", "http_proxy": "http://proxy:3128"}},
+	{"NO_PROXY DEFAULT=\"localhost, .rapid7.com\"\n", nil, map[string]string{"NO_PROXY": "localhost, .rapid7.com"}},
+	{"HTTPS_PROXY \\\n  DEFAULT=http://continued:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://continued:3128"}},
+	{"PROXY_PAC DEFAULT=@{HOME}/proxy.pac\nLITERAL DEFAULT=\\${HOME}\n", nil, map[string]string{"PROXY_PAC": "/proxy.pac", "LITERAL": "${HOME}"}},
+	{"HTTPS_PROXY\n", map[string]string{"HTTPS_PROXY": "http://proxy:3128"}, map[string]string{}},
+	{"# HTTPS_PROXY DEFAULT=http://commented:3128\n#HTTP_PROXY DEFAULT=x\n", nil, map[string]string{}},
+}
+
+func TestParsePAMEnvConf(t *testing.T) {
+	a := assert.New(t)
+	for _, tt := range dataParsePAMEnvConf {
+		env := newTestFileEnv(tt.env)
+		parsePAMEnvConf([]byte(tt.content), "/etc/security/pam_env.conf", env)
+		a.Equal(tt.expect, env.values, tt.content)
+	}
+}
+
+var dataParseShellEnv = []struct {
+	content string
+	env     map[string]string
+	expect  map[string]string
+}{
+	{"export HTTPS_PROXY=http://proxy.rapid7.com:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://proxy.rapid7.com:3128"}},
+	{"export http_proxy=\"http://proxy:3128\" https_proxy='http://proxy:3128'\n", nil, map[string]string{"http_proxy": "http://proxy:3128", "https_proxy": "http://proxy:3128"}},
+	{"PROXY=http://proxy:3128\nexport HTTPS_PROXY=$PROXY HTTP_PROXY=${PROXY}\n", nil, map[string]string{"HTTPS_PROXY": "http://proxy:3128", "HTTP_PROXY": "http://proxy:3128"}},
+	{"export no_proxy=\"${no_proxy:+$no_proxy,}.rapid7.com\"\n", nil, map[string]string{}},
+	{"export no_proxy=\"${no_proxy:-localhost},.rapid7.com\"\n", nil, map[string]string{"no_proxy": "localhost,.rapid7.com"}},
+	{"export no_proxy=\"${no_proxy},.rapid7.com\"\n", map[string]string{"no_proxy": "localhost"}, map[string]string{"no_proxy": "localhost,.rapid7.com"}},
+	{"https_proxy=http://proxy:3128; export https_proxy\n", nil, map[string]string{"https_proxy": "http://proxy:3128"}},
+	// Not exported
+	{"HTTPS_PROXY=http://proxy:3128\n", nil, map[string]string{}},
+	{"readonly HTTPS_PROXY=http://proxy:3128\n", nil, map[string]string{}},
+	{"HTTPS_PROXY=http://proxy:3128\nunset HTTPS_PROXY\nexport HTTPS_PROXY\n", nil, map[string]string{}},
+	// Assignments to exported variables remain exported
+	{"export HTTPS_PROXY=http://old:3128\nHTTPS_PROXY=http://proxy:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://proxy:3128"}},
+	{"HTTPS_PROXY=http://proxy:3128\n", map[string]string{"HTTPS_PROXY": "http://environment:3128"}, map[string]string{"HTTPS_PROXY": "http://proxy:3128"}},
+	{"export HTTPS_PROXY=http://proxy:3128 # the proxy\n# export HTTP_PROXY=http://commented:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://proxy:3128"}},
+	{"unset HTTPS_PROXY http_proxy\n", map[string]string{"HTTPS_PROXY": "x", "http_proxy": "y", "NO_PROXY": "z"}, map[string]string{"NO_PROXY": "z"}},
+	{"export HTTPS_PROXY=\"http://$(hostname):3128\"\nexport HTTP_PROXY=`cat /etc/proxy`\n", nil, map[string]string{}},
+	{"HTTPS_PROXY=http://proxy:3128 curl https://rapid7.com\n", nil, map[string]string{}},
+	{"export HTTPS_PROXY=\"http://unterminated\n", nil, map[string]string{}},
+	{"export PS1='\\u@\\h \\$ ' X=\"a\\\"b\" Y=a\\ b\n", nil, map[string]string{"PS1": "\\u@\\h \\$ ", "X": "a\"b", "Y": "a b"}},
+	{"[ -f /etc/proxy ] && export HTTPS_PROXY=http://proxy:3128\n", nil, map[string]string{"HTTPS_PROXY": "http://proxy:3128"}},
+}
+
+func TestParseShellEnv(t *testing.T) {
+	a := assert.New(t)
+	for _, tt := range dataParseShellEnv {
+		env := newTestFileEnv(tt.env)
+		parseShellEnv([]byte(tt.content), "/etc/profile.d/proxy.sh", env)
+		a.Equal(tt.expect, env.values, tt.content)
+	}
+}
+
+func TestProvider_ReadEnvFilesProxy(t *testing.T) {
+	a := assert.New(t)
+	tmpDir, err := os.MkdirTemp("", "TestProvider_ReadEnvFilesProxy")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	pamEnvConf := filepath.Join(tmpDir, "pam_env.conf")
+	environment := filepath.Join(tmpDir, "environment")
+	profile := filepath.Join(tmpDir, "profile.d")
+	if !a.NoError(os.Mkdir(profile, 0755)) {
+		return
+	}
+	files := map[string]string{
+		pamEnvConf:                           "HTTPS_PROXY DEFAULT=http://pam:3128\nFTP_PROXY DEFAULT=http://pam:2121\n",
+		environment:                          "HTTPS_PROXY=http://environment:3128\nNO_PROXY=localhost\n",
+		filepath.Join(profile, "a.sh"):       "export no_proxy=.intranet.rapid7.com\n",
+		filepath.Join(profile, "b-proxy.sh"): "export HTTP_PROXY=http://profile:8080\n",
+		filepath.Join(profile, "c-local.sh"): "ALL_PROXY=socks5://unexported:1080\n",
+		filepath.Join(profile, "ignored"):    "export HTTP_PROXY=http://ignored:8080\n",
+	}
+	for f, content := range files {
+		if !a.NoError(os.WriteFile(f, []byte(content), 0644)) {
+			return
+		}
+	}
+	p := newTestProvider("")
+	envFiles := []envFile{
+		{pamEnvConf, envFormatPAM},
+		{environment, envFormatPlain},
+		{filepath.Join(profile, "*.sh"), envFormatShell},
+	}
+	p.getEnv = func(string) string {
+		return "http://process:3128"
+	}
+
+	// Later files override earlier ones, and the file is the source
+	a.Equal(newTestProxy("http", "environment", 3128, nil, environment+"[HTTPS_PROXY]"), p.readEnvFilesProxy(envFiles, "https", ParseTargetURL("https://rapid7.com", ""), nil))
+	a.Equal(newTestProxy("http", "pam", 2121, nil, pamEnvConf+"[FTP_PROXY]"), p.readEnvFilesProxy(envFiles, "ftp", ParseTargetURL("ftp://rapid7.com", ""), nil))
+	a.Equal(newTestProxy("http", "profile", 8080, nil, filepath.Join(profile, "b-proxy.sh")+"[HTTP_PROXY]"), p.readEnvFilesProxy(envFiles, "http", ParseTargetURL("http://rapid7.com", ""), nil))
+	// Not exported
+	a.Nil(p.readEnvFilesProxy(envFiles, "socks", ParseTargetURL("rapid7.com:22", ""), nil))
+
+	// NO_PROXY and no_proxy are respected, wherever they are set
+	tr := newTrace("https", ParseTargetURL("https://wiki.intranet.rapid7.com", ""))
+	a.Nil(p.readEnvFilesProxy(envFiles, "https", ParseTargetURL("https://wiki.intranet.rapid7.com", ""), tr))
+	a.Equal([]*TraceStep{
+		{Source: environment + "[HTTPS_PROXY]", Enabled: true, Value: "http://environment:3128", Bypass: "no_proxy=.intranet.rapid7.com"},
+		{Source: "EnvironmentFiles[https_proxy]"},
+	}, tr.Steps)
+	a.Nil(p.readEnvFilesProxy(envFiles, "https", ParseTargetURL("https://localhost", ""), nil))
+
+	// The environment of this process is left to the environment source
+	a.Equal(newTestProxy("http", "process", 3128, nil, "Environment[HTTPS_PROXY]"), p.readSystemEnvProxy("https", ParseTargetURL("https://rapid7.com", ""), nil))
+
+	// No files
+	envFiles = []envFile{{filepath.Join(tmpDir, "missing"), envFormatPlain}}
+	a.Nil(p.readEnvFilesProxy(envFiles, "https", ParseTargetURL("https://rapid7.com", ""), nil))
+}
@@ -0,0 +1,393 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailoverCoolDown = 5 * time.Minute
+	failoverDirectKey       = "DIRECT"
+)
+
+/*
+An http.RoundTripper which tries each proxy found for a request in order (see Provider.GetProxies),
+moving on to the next should the connection to a proxy (including its TLS handshake), or its CONNECT tunnel, fail.
+A proxy which failed is tried after the others until CoolDown has passed, so that later requests avoid it.
+Failures after the request is sent (i.e. a response error, or a timeout) are returned as is, and are not retried.
+Requests through a proxy with user info are authenticated as by Dialer (i.e. with NTLM or Digest), over a tunnel it opens.
+Provider must be set, see NewFailoverTransport.
+*/
+type FailoverTransport struct {
+	// Looks up the proxies of each request
+	Provider Provider
+	// How long a proxy which failed is tried after the others. Default is 5 minutes.
+	CoolDown time.Duration
+	// If true, DIRECT entries following a proxy (i.e. a PAC result "PROXY a:3128; DIRECT") are tried in order.
+	// Otherwise only a leading DIRECT entry, or a bypassed target, connects directly.
+	DirectFallback bool
+	// Optional. Cloned for each candidate, so that its settings (i.e. TLSClientConfig) apply. Default is http.DefaultTransport.
+	Base *http.Transport
+
+	now        func() time.Time
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+	failed     map[string]time.Time
+	// The proxies which http requests are tunnelled through, see tunnelAuth
+	tunnelledHTTP map[string]bool
+	// The proxies which http requests are sent to with Basic credentials, see tunnelAuth
+	basicHTTP map[string]bool
+}
+
+/*
+Create a FailoverTransport with the default settings.
+Params:
+	provider: The provider to look up proxies with.
+*/
+func NewFailoverTransport(provider Provider) *FailoverTransport {
+	return &FailoverTransport{Provider: provider, CoolDown: defaultFailoverCoolDown}
+}
+
+/*
+Records the failures of a single attempt, which are those the attempt may be retried after.
+*/
+type failoverAttempt struct {
+	mu     sync.Mutex
+	failed bool
+}
+
+type failoverAttemptKey struct{}
+
+func (a *failoverAttempt) fail() {
+	a.mu.Lock()
+	a.failed = true
+	a.mu.Unlock()
+}
+
+func (a *failoverAttempt) retryable() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.failed
+}
+
+/*
+Send req through each candidate in turn, until one connects.
+Returns:
+	*http.Response, nil: A candidate connected, and the request was sent.
+	nil, error: The lookup failed, the request failed after connecting, or every candidate failed to connect.
+*/
+func (f *FailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	candidates, err := f.candidates(req)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	var errs []error
+	for i, c := range candidates {
+		attemptReq := req
+		if i > 0 {
+			if attemptReq, err = rewindRequest(req); err != nil {
+				errs = append(errs, err)
+				break
+			}
+		}
+		t, err := f.transport(c)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		attempt := new(failoverAttempt)
+		ctx := context.WithValue(attemptReq.Context(), failoverAttemptKey{}, attempt)
+		resp, err := t.RoundTrip(f.authorize(c, attemptReq).WithContext(ctx))
+		if err == nil && f.tunnelAuth(c, resp) {
+			if retryReq, rewindErr := rewindRequest(req); rewindErr == nil {
+				resp.Body.Close()
+				resp, err = t.RoundTrip(f.authorize(c, retryReq).WithContext(ctx))
+			}
+		}
+		if err == nil {
+			f.setFailed(c, false)
+			return resp, nil
+		}
+		if !attempt.retryable() || req.Context().Err() != nil {
+			return nil, err
+		}
+		f.setFailed(c, true)
+		errs = append(errs, fmt.Errorf("%s: %w", c, err))
+	}
+	return nil, fmt.Errorf("all proxies failed: %w", errors.Join(errs...))
+}
+
+/*
+Close the idle connections of every candidate.
+*/
+func (f *FailoverTransport) CloseIdleConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range f.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+/*
+Look up the candidates of req: proxies which have not recently failed, in order, followed by those which have.
+Returns:
+	[]Proxy, nil: The candidates. A DIRECT entry (see IsDirect) connects directly.
+	nil, error: The lookup was abandoned (see ErrTimeout).
+*/
+func (f *FailoverTransport) candidates(req *http.Request) ([]Proxy, error) {
+	r, err := f.Provider.Lookup(req.Context(), requestProtocol(req), req.URL.String())
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err != nil || r.Kind == ResultBypassed {
+		return []Proxy{NewDirectProxy(r.Src)}, nil
+	}
+	var fresh, coolingDown []Proxy
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, p := range r.Proxies {
+		if i > 0 && IsDirect(p) && !f.DirectFallback {
+			continue
+		}
+		if failed, exists := f.failed[failoverKey(p)]; exists && f.timeNow().Sub(failed) < f.coolDown() {
+			coolingDown = append(coolingDown, p)
+		} else {
+			fresh = append(fresh, p)
+		}
+	}
+	return append(fresh, coolingDown...), nil
+}
+
+/*
+Returns:
+	*http.Transport, nil: The transport which connects through p, created on first use.
+	nil, error: The protocol of p is not supported by http.Transport.
+*/
+func (f *FailoverTransport) transport(p Proxy) (*http.Transport, error) {
+	var proxyUrl *url.URL
+	tlsProxies := new(tlsProxies)
+	if !IsDirect(p) {
+		var err error
+		if proxyUrl, err = tlsProxies.proxyURL(p); err != nil {
+			return nil, err
+		}
+	}
+	key := failoverKey(p)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, exists := f.transports[key]; exists {
+		return t, nil
+	}
+	base := f.Base
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	t.Proxy = nil
+	if proxyUrl != nil && proxyAuthenticates(p) {
+		// http.Transport would send Basic credentials before the proxy offers any scheme, see authorize
+		proxyUrl.User = nil
+	}
+	if proxyUrl != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if f.tunnelled(p, req) {
+				return nil, nil
+			}
+			return proxyUrl, nil
+		}
+	}
+	dial := tlsProxies.dialContext(t.DialContext)
+	if proxyUrl != nil && proxyAuthenticates(p) {
+		// Requests which are not sent to the proxy are sent over a tunnel opened by Dialer,
+		// which authenticates with the schemes http.Transport does not (i.e. NTLM, Digest).
+		// Dialer completes the TLS handshake with https proxies itself, so it dials them without tlsProxies.
+		forward := t.DialContext
+		if forward == nil {
+			forward = new(net.Dialer).DialContext
+		}
+		proxyDial, proxyHost := dial, proxyUrl.Host
+		tunnel := Dialer(p, WithForwardDialer(dialContextFunc(forward)), WithConnectHeader(t.ProxyConnectHeader))
+		dial = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if strings.EqualFold(addr, proxyHost) {
+				return proxyDial(ctx, network, addr)
+			}
+			return tunnel.DialContext(ctx, network, addr)
+		}
+	}
+	t.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if attempt, ok := ctx.Value(failoverAttemptKey{}).(*failoverAttempt); ok && err != nil {
+			attempt.fail()
+		}
+		return conn, err
+	}
+	onConnect := t.OnProxyConnectResponse
+	t.OnProxyConnectResponse = func(ctx context.Context, proxyUrl *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+		if attempt, ok := ctx.Value(failoverAttemptKey{}).(*failoverAttempt); ok && connectRes.StatusCode/100 != 2 {
+			attempt.fail()
+		}
+		if onConnect != nil {
+			return onConnect(ctx, proxyUrl, connectReq, connectRes)
+		}
+		return nil
+	}
+	if f.transports == nil {
+		f.transports = map[string]*http.Transport{}
+	}
+	f.transports[key] = t
+	return t, nil
+}
+
+/*
+Returns:
+	true: req is to be sent through p over a tunnel opened by Dialer, rather than by http.Transport.
+		That is the case of requests through proxies with user info which would otherwise be tunnelled (i.e. https),
+		and of http requests through proxies which offer a scheme Dialer authenticates with (see tunnelAuth).
+*/
+func (f *FailoverTransport) tunnelled(p Proxy, req *http.Request) bool {
+	if !proxyAuthenticates(p) {
+		return false
+	}
+	if requestProtocol(req) != protocolHTTP {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tunnelledHTTP[failoverKey(p)]
+}
+
+/*
+http requests through a proxy with user info are sent without credentials, until the proxy requires them.
+Should the proxy p then offer a scheme Dialer authenticates with (i.e. NTLM, Digest), later http requests through p are tunnelled,
+so that the handshake takes place over the connection of the tunnel. Should it offer Basic but neither of those, they are sent with Basic credentials.
+Returns:
+	true: resp is such a requirement, and its request is to be sent again.
+*/
+func (f *FailoverTransport) tunnelAuth(p Proxy, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusProxyAuthRequired || !proxyAuthenticates(p) || requestProtocol(resp.Request) != protocolHTTP {
+		return false
+	}
+	basic := basicAuthApplies(parseAuthChallenges(resp.Header.Values(headerProxyAuthenticate)))
+	if !basic && !offersProxyAuth(resp) {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := failoverKey(p)
+	if f.tunnelledHTTP[key] || f.basicHTTP[key] {
+		return false
+	}
+	if basic {
+		if f.basicHTTP == nil {
+			f.basicHTTP = map[string]bool{}
+		}
+		f.basicHTTP[key] = true
+	} else {
+		if f.tunnelledHTTP == nil {
+			f.tunnelledHTTP = map[string]bool{}
+		}
+		f.tunnelledHTTP[key] = true
+	}
+	return true
+}
+
+/*
+Returns:
+	req, with the Basic credentials of p should http requests through p be sent with them (see tunnelAuth).
+*/
+func (f *FailoverTransport) authorize(p Proxy, req *http.Request) *http.Request {
+	if !proxyAuthenticates(p) || requestProtocol(req) != protocolHTTP {
+		return req
+	}
+	f.mu.Lock()
+	basic := f.basicHTTP[failoverKey(p)]
+	f.mu.Unlock()
+	if !basic {
+		return req
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(headerProxyAuthorization, proxyBasicAuthorization(p))
+	return r
+}
+
+func (f *FailoverTransport) setFailed(p Proxy, failed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !failed {
+		delete(f.failed, failoverKey(p))
+		return
+	}
+	if f.failed == nil {
+		f.failed = map[string]time.Time{}
+	}
+	f.failed[failoverKey(p)] = f.timeNow()
+}
+
+func (f *FailoverTransport) coolDown() time.Duration {
+	if f.CoolDown <= 0 {
+		return defaultFailoverCoolDown
+	}
+	return f.CoolDown
+}
+
+func (f *FailoverTransport) timeNow() time.Time {
+	if f.now == nil {
+		return time.Now()
+	}
+	return f.now()
+}
+
+/*
+Returns:
+	The key of p's cool-down and transport. User info is included, as proxies may differ only by credentials.
+*/
+func failoverKey(p Proxy) string {
+	if IsDirect(p) {
+		return failoverDirectKey
+	}
+	return p.URL().String()
+}
+
+/*
+Copy req with a fresh body, so that it may be sent again.
+Returns:
+	*http.Request, nil: The copy.
+	nil, error: req has a body which cannot be read again (see http.Request.GetBody).
+*/
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be sent again, see http.Request.GetBody")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = body
+	return r, nil
+}
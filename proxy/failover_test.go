@@ -0,0 +1,297 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+An in-process proxy: plain HTTP requests are answered with the URL received,
+CONNECT requests are answered with status and, if successful, tunnelled to the requested address.
+*/
+type testConnectProxy struct {
+	*httptest.Server
+	status   int
+	requests int32
+	// The headers of the last CONNECT request
+	connectHeader atomic.Value
+}
+
+func newTestConnectProxy(status int) *testConnectProxy {
+	p := &testConnectProxy{status: status}
+	p.Server = httptest.NewServer(p.handler())
+	return p
+}
+
+/*
+A testConnectProxy served over TLS, with the certificate of httptest, requiring client certificates per clientAuth.
+*/
+func newTestTLSConnectProxy(status int, clientAuth tls.ClientAuthType) *testConnectProxy {
+	p := &testConnectProxy{status: status}
+	p.Server = httptest.NewUnstartedServer(p.handler())
+	p.Server.TLS = &tls.Config{ClientAuth: clientAuth}
+	p.Server.StartTLS()
+	return p
+}
+
+func (p *testConnectProxy) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.requests, 1)
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(p.status)
+			io.WriteString(w, "proxied "+r.URL.String())
+			return
+		}
+		p.connectHeader.Store(r.Header.Clone())
+		if p.status != http.StatusOK {
+			w.Header().Set("X-Proxy-Reason", "denied")
+			w.WriteHeader(p.status)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(target, buf)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	})
+}
+
+func (p *testConnectProxy) proxy(a *assert.Assertions) Proxy {
+	return newTestProxyFromURL(a, p.URL)
+}
+
+func newTestProxyFromURL(a *assert.Assertions, rawUrl string) Proxy {
+	u, err := url.Parse(rawUrl)
+	if !a.NoError(err) {
+		return nil
+	}
+	p, err := NewProxy(u, "test")
+	a.NoError(err)
+	return p
+}
+
+/*
+Returns:
+	The URL of a proxy which refuses connections.
+*/
+func newTestDeadProxyURL(a *assert.Assertions) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return ""
+	}
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func TestFailoverTransport_dial(t *testing.T) {
+	a := assert.New(t)
+	good := newTestConnectProxy(http.StatusOK)
+	defer good.Close()
+	dead := newTestProxyFromURL(a, newTestDeadProxyURL(a))
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{dead, good.proxy(a)}}}
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	f := NewFailoverTransport(newTestProviderWithSources(s))
+	f.now = func() time.Time { return now }
+	client := &http.Client{Transport: f}
+
+	a.Equal("proxied http://test.endpoint.rapid7.invalid/", testGet(a, client, "http://test.endpoint.rapid7.invalid/"))
+	a.Contains(f.failed, failoverKey(dead))
+
+	// The dead proxy is cooling down, so is tried last
+	candidates, err := f.candidates(httptest.NewRequest(http.MethodGet, "http://test.endpoint.rapid7.invalid/", nil))
+	a.NoError(err)
+	a.Equal([]Proxy{good.proxy(a), dead}, candidates)
+	now = now.Add(defaultFailoverCoolDown)
+	candidates, err = f.candidates(httptest.NewRequest(http.MethodGet, "http://test.endpoint.rapid7.invalid/", nil))
+	a.NoError(err)
+	a.Equal([]Proxy{dead, good.proxy(a)}, candidates)
+
+	// Every proxy fails
+	s.result = SourceResult{Proxies: []Proxy{dead}}
+	_, err = client.Get("http://test.endpoint.rapid7.invalid/")
+	if a.Error(err) {
+		a.Contains(err.Error(), "all proxies failed")
+	}
+}
+
+func TestFailoverTransport_connect(t *testing.T) {
+	a := assert.New(t)
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnelled "+r.URL.String())
+	}))
+	defer target.Close()
+	denied := newTestConnectProxy(http.StatusForbidden)
+	defer denied.Close()
+	good := newTestConnectProxy(http.StatusOK)
+	defer good.Close()
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{denied.proxy(a), good.proxy(a)}}}
+	f := NewFailoverTransport(newTestProviderWithSources(s))
+	f.Base = target.Client().Transport.(*http.Transport)
+	client := &http.Client{Transport: f}
+
+	body := "a request body"
+	resp, err := client.Post(target.URL+"/upload", "text/plain", strings.NewReader(body))
+	if a.NoError(err) {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		a.Equal("tunnelled /upload", string(b))
+	}
+	a.Equal(int32(1), atomic.LoadInt32(&denied.requests))
+	a.Equal(int32(1), atomic.LoadInt32(&good.requests))
+}
+
+func TestFailoverTransport_notRetried(t *testing.T) {
+	a := assert.New(t)
+	failing := newTestConnectProxy(http.StatusBadGateway)
+	defer failing.Close()
+	good := newTestConnectProxy(http.StatusOK)
+	defer good.Close()
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{failing.proxy(a), good.proxy(a)}}}
+	client := &http.Client{Transport: NewFailoverTransport(newTestProviderWithSources(s))}
+
+	// The request reached the proxy, which answered
+	resp, err := client.Get("http://test.endpoint.rapid7.invalid/")
+	if a.NoError(err) {
+		resp.Body.Close()
+		a.Equal(http.StatusBadGateway, resp.StatusCode)
+	}
+	a.Equal(int32(0), atomic.LoadInt32(&good.requests))
+}
+
+func TestFailoverTransport_directFallback(t *testing.T) {
+	a := assert.New(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "direct "+r.URL.String())
+	}))
+	defer target.Close()
+	dead := newTestProxyFromURL(a, newTestDeadProxyURL(a))
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{dead, NewDirectProxy("test")}}}
+	f := NewFailoverTransport(newTestProviderWithSources(s))
+	client := &http.Client{Transport: f}
+
+	_, err := client.Get(target.URL + "/path")
+	a.Error(err)
+	f.DirectFallback = true
+	a.Equal("direct /path", testGet(a, client, target.URL+"/path"))
+
+	// Bypassed, and not found, connect directly
+	s.result = SourceResult{Bypass: "127.0.0.1"}
+	a.Equal("direct /path", testGet(a, client, target.URL+"/path"))
+	s.result, s.err = SourceResult{}, ErrNotFound
+	a.Equal("direct /path", testGet(a, client, target.URL+"/path"))
+}
+
+/*
+Returns:
+	A proxy handler which requires the Basic credentials user:secret, offering no other scheme, before serving with inner.
+*/
+func testBasicAuthHandler(inner http.Handler) http.Handler {
+	return testChallengeAuthHandler(inner, []string{`Basic realm="test"`})
+}
+
+/*
+Returns:
+	A proxy handler which requires the Basic credentials user:secret, offering the challenges, before serving with inner.
+*/
+func testChallengeAuthHandler(inner http.Handler, challenges []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := &http.Request{Header: http.Header{"Authorization": {r.Header.Get(headerProxyAuthorization)}}}
+		if user, password, ok := auth.BasicAuth(); !ok || user != "user" || password != "secret" {
+			for _, c := range challenges {
+				w.Header().Add(headerProxyAuthenticate, c)
+			}
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+func TestFailoverTransport_basic(t *testing.T) {
+	a := assert.New(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "target "+r.URL.String())
+	}))
+	defer target.Close()
+	inner := &testConnectProxy{status: http.StatusOK}
+	var requests, basic int32
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get(headerProxyAuthorization) != "" {
+			atomic.AddInt32(&basic, 1)
+		}
+		testBasicAuthHandler(inner.handler()).ServeHTTP(w, r)
+	}))
+	defer proxyServer.Close()
+	p := newTestProxyWithUser(a, proxyServer.URL, url.UserPassword("user", "secret"))
+	f := NewFailoverTransport(newTestProviderWithSources(&testSource{name: "test", result: SourceResult{Proxies: []Proxy{p}}}))
+	client := &http.Client{Transport: f}
+
+	// Sent without credentials, which are required, then with Basic credentials, as the proxy offers no other scheme
+	a.Equal("proxied "+target.URL+"/http", testGet(a, client, target.URL+"/http"))
+	a.Equal(int32(2), atomic.LoadInt32(&requests))
+	a.Equal(int32(1), atomic.LoadInt32(&basic))
+	a.True(f.basicHTTP[failoverKey(p)])
+	a.False(f.tunnelledHTTP[failoverKey(p)])
+	// Later requests are sent with them
+	a.Equal("proxied "+target.URL+"/again", testGet(a, client, target.URL+"/again"))
+	a.Equal(int32(3), atomic.LoadInt32(&requests))
+	a.Equal(int32(2), atomic.LoadInt32(&basic))
+}
+
+func TestFailoverTransport_httpsProxyAuth(t *testing.T) {
+	a := assert.New(t)
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnelled "+r.URL.String())
+	}))
+	defer target.Close()
+	inner := &testConnectProxy{status: http.StatusOK}
+	proxyServer := httptest.NewTLSServer(testBasicAuthHandler(inner.handler()))
+	defer proxyServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(proxyServer.Certificate())
+	p := newTestProxyWithUser(a, proxyServer.URL, url.UserPassword("user", "secret"))
+	p.(*proxy).tls = &ProxyTLSConfig{RootCAs: roots}
+
+	s := &testSource{name: "test", result: SourceResult{Proxies: []Proxy{p}}}
+	f := NewFailoverTransport(newTestProviderWithSources(s))
+	f.Base = target.Client().Transport.(*http.Transport)
+	client := &http.Client{Transport: f}
+	a.Equal("tunnelled /tls", testGet(a, client, target.URL+"/tls"))
+	a.Equal(int32(1), atomic.LoadInt32(&inner.requests))
+	a.Empty(f.failed)
+}
@@ -0,0 +1,340 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const sourceNameGNOME = "gnome"
+
+/*
+Create a Source which reads the GNOME proxy settings (org.gnome.system.proxy) through gsettings, respecting ignore-hosts.
+In the automatic mode, the PAC script of autoconfig-url is evaluated. Should it be empty, WPAD is left to WPADSource.
+The output of gsettings is reused for 30 seconds.
+*/
+func GNOMESource() Source {
+	return &gnomeSource{commands: newCommandCache()}
+}
+
+type gnomeSource struct {
+	commands *commandCache
+}
+
+func (s *gnomeSource) Name() string {
+	return sourceNameGNOME
+}
+
+func (s *gnomeSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *gnomeSource) lookup(ctx context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	return p.withCommandCache(s.commands).readGNOMEProxy(ctx, protocol, targetUrl, t)
+}
+
+const (
+	gsettingsBinary          = "gsettings"
+	gsettingsListRecursively = "list-recursively"
+	gnomeProxySchema         = "org.gnome.system.proxy"
+	gnomeModeNone            = "none"
+	gnomeModeManual          = "manual"
+	gnomeModeAuto            = "auto"
+	gnomeKeyMode             = "mode"
+	gnomeKeyAutoconfigURL    = "autoconfig-url"
+	gnomeKeyIgnoreHosts      = "ignore-hosts"
+	gnomeKeyHost             = "host"
+	gnomeKeyPort             = "port"
+	gnomeKeyUseAuth          = "use-authentication"
+	gnomeKeyAuthUser         = "authentication-user"
+	gnomeKeyAuthPassword     = "authentication-password"
+	// The schema of the SOCKS proxy, which is used for any protocol without a proxy of its own
+	gnomeSchemaSOCKS = "socks"
+	srcGNOME         = "GNOME:" + gnomeProxySchema
+	srcGNOMEPAC      = "GNOME:" + gnomeKeyAutoconfigURL
+	// Applied to gsettings when the lookup's context has no deadline
+	gsettingsTimeout = time.Second
+)
+
+/*
+Returns the proxies configured in the GNOME proxy settings.
+Params:
+	ctx: Bounds the execution of gsettings, and the download of the PAC script.
+	protocol: The proxy's protocol (i.e. https)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	See parseGsettingsData.
+*/
+func (p *provider) readGNOMEProxy(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	proxies, err := p.parseGsettingsData(ctx, protocol, targetUrl, t, gsettingsBinary, gsettingsListRecursively, gnomeProxySchema)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			p.logger.Printf("[proxy.Provider.readGNOMEProxy]: %s proxy is not configured.\n", protocol)
+		} else {
+			p.logger.Printf("[proxy.Provider.readGNOMEProxy]: Failed to read GNOME proxy settings, %s\n", err)
+		}
+	}
+	return proxies, err
+}
+
+/*
+Returns the proxies found by parsing the output of gsettings list-recursively org.gnome.system.proxy.
+For example:
+	org.gnome.system.proxy mode 'manual'
+	org.gnome.system.proxy ignore-hosts ['localhost', '127.0.0.0/8', '::1']
+	org.gnome.system.proxy.http host 'proxy.rapid7.com'
+	org.gnome.system.proxy.http port 3128
+Params:
+	ctx: Bounds the execution of the program, and the download of the PAC script. If ctx has no deadline,
+		gsettingsTimeout is applied to the program.
+	protocol: The proxy's protocol (i.e. https)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+	name: The name of the program (gsettings)
+	arg: The list of the arguments (list-recursively org.gnome.system.proxy)
+Returns:
+	[]Proxy, nil: A proxy was found, or the PAC script of autoconfig-url was evaluated
+	nil, nil: The proxy is bypassed for targetUrl
+	nil, ErrNotFound: gsettings or the schema is not installed, or no proxy is configured for protocol
+	nil, ErrTimeout: The program did not complete in time, or failed
+	nil, *ParseError: The settings are not valid
+	nil, error: The PAC script could not be fetched or evaluated
+*/
+func (p *provider) parseGsettingsData(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace, name string, arg ...string) ([]Proxy, error) {
+	out, stderr, err := p.runCommand(ctx, gsettingsTimeout, name, arg...)
+	if err != nil {
+		step := t.step(srcGNOME)
+		// Not a GNOME desktop
+		if errors.Is(err, exec.ErrNotFound) || strings.Contains(stderr, "schema") {
+			return nil, fmt.Errorf("%w: %s: %s", ErrNotFound, name, strings.TrimSpace(stderr))
+		}
+		err = fmt.Errorf("%w: %s: %w", ErrTimeout, name, err)
+		step.setError(err)
+		return nil, err
+	}
+	settings, err := parseGsettings(out)
+	if err != nil {
+		step := t.step(srcGNOME)
+		err = &ParseError{Src: srcGNOME, Value: out, Err: err}
+		step.setError(err)
+		return nil, err
+	}
+
+	switch mode := settings[gnomeKeyMode]; mode {
+	case gnomeModeAuto:
+		pacUrl := settings[gnomeKeyAutoconfigURL]
+		if pacUrl == "" {
+			// Automatic detection, which is WPADSource's
+			t.step(srcGNOMEPAC)
+			return nil, ErrNotFound
+		}
+		proxies := p.readPACProxy(ctx, srcGNOMEPAC, pacUrl, targetUrl, t)
+		if proxies == nil {
+			return nil, fmt.Errorf("failed to evaluate PAC script %s", pacUrl)
+		}
+		return proxies, nil
+	case gnomeModeManual:
+		return p.readGNOMEManualProxy(protocol, targetUrl, t, settings)
+	case gnomeModeNone, "":
+		t.step(srcGNOME)
+		return nil, ErrNotFound
+	default:
+		step := t.step(srcGNOME)
+		err := &ParseError{Src: srcGNOME, Value: mode, Err: fmt.Errorf("unknown %s", gnomeKeyMode)}
+		step.setError(err)
+		return nil, err
+	}
+}
+
+/*
+Returns the proxy of the manual mode for protocol: that of protocol's schema (i.e. org.gnome.system.proxy.https),
+or else that of the SOCKS schema. Authentication applies to the HTTP schema only, as it does for GNOME.
+*/
+func (p *provider) readGNOMEManualProxy(protocol string, targetUrl *url.URL, t *Trace, settings map[string]string) ([]Proxy, error) {
+	schema := strings.ToLower(protocol)
+	switch schema {
+	case protocolHTTP, protocolHTTPS, protocolFTP, gnomeSchemaSOCKS:
+	default:
+		schema = gnomeSchemaSOCKS
+	}
+	if settings[schema+"."+gnomeKeyHost] == "" {
+		schema = gnomeSchemaSOCKS
+	}
+	src := srcGNOME + "." + schema
+	step := t.step(src)
+	host := settings[schema+"."+gnomeKeyHost]
+	if host == "" {
+		return nil, ErrNotFound
+	}
+	proxyUrlStr := host
+	if port := settings[schema+"."+gnomeKeyPort]; port != "" && port != "0" {
+		proxyUrlStr = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		proxyUrlStr = "[" + host + "]"
+	}
+	scheme := protocolHTTP
+	if schema == gnomeSchemaSOCKS {
+		scheme = protocolSOCKS5
+	}
+	proxyUrlStr = scheme + "://" + proxyUrlStr
+	step.setValue(proxyUrlStr)
+	proxyUrl, err := ParseURL(proxyUrlStr, "")
+	if err != nil {
+		err = &ParseError{Src: src, Value: proxyUrlStr, Err: err}
+		step.setError(err)
+		return nil, err
+	}
+	if schema == protocolHTTP && settings[schema+"."+gnomeKeyUseAuth] == "true" {
+		proxyUrl.User = url.UserPassword(settings[schema+"."+gnomeKeyAuthUser], settings[schema+"."+gnomeKeyAuthPassword])
+	}
+	proxy, err := NewProxy(proxyUrl, src)
+	if err != nil {
+		err = &ParseError{Src: src, Value: proxyUrlStr, Err: err}
+		step.setError(err)
+		return nil, err
+	}
+	ignoreHosts := settings[gnomeKeyIgnoreHosts]
+	if match, bypass := p.matchGNOMEIgnoreHosts(targetUrl, ignoreHosts); bypass {
+		p.logger.Printf("[proxy.Provider.readGNOMEManualProxy]: ignore-hosts=\"%s\", targetUrl=%s, bypass=%t", ignoreHosts, targetUrl, bypass)
+		step.setBypass(fmt.Sprintf("%s=%s", gnomeKeyIgnoreHosts, match))
+		return nil, nil
+	}
+	step.setProxies(proxy)
+	return []Proxy{proxy}, nil
+}
+
+/*
+Same as matchProxyBypass with the comma separated ignore-hosts, additionally matching IP addresses against its
+IP and CIDR entries (i.e. ::1, 127.0.0.0/8).
+*/
+func (p *provider) matchGNOMEIgnoreHosts(targetUrl *url.URL, ignoreHosts string) (string, bool) {
+	targetHost, _, _ := SplitHostPort(targetUrl)
+	if ip := net.ParseIP(strings.Trim(targetHost, "[]")); ip != nil {
+		for _, s := range strings.Split(ignoreHosts, ",") {
+			s = strings.TrimSpace(s)
+			if _, prefix, err := net.ParseCIDR(s); err == nil && prefix.Contains(ip) {
+				return s, true
+			} else if ip.Equal(net.ParseIP(s)) {
+				return s, true
+			}
+		}
+	}
+	return p.matchProxyBypass(targetUrl, ignoreHosts, ",")
+}
+
+/*
+Parse the output of gsettings list-recursively, one "schema key value" per line, into a map of keys to values.
+Keys of the sub-schemas of org.gnome.system.proxy are prefixed by their name (i.e. http.host).
+Strings are unquoted, and arrays of strings are joined by commas.
+*/
+func parseGsettings(data string) (map[string]string, error) {
+	settings := map[string]string{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		schema, key, value := fields[0], fields[1], fields[2]
+		if schema != gnomeProxySchema {
+			if !strings.HasPrefix(schema, gnomeProxySchema+".") {
+				continue
+			}
+			key = strings.TrimPrefix(schema, gnomeProxySchema+".") + "." + key
+		}
+		v, err := parseGVariant(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		settings[key] = v
+	}
+	return settings, nil
+}
+
+/*
+Parse a GVariant in its text format, as printed by gsettings: a string ('proxy' or "it's"), an array of strings
+(['localhost', '::1'] or @as []), a number, or a boolean.
+Returns:
+	string, nil: The value. Arrays are joined by commas.
+	"", error: The value is a malformed string or array.
+*/
+func parseGVariant(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "@") {
+		// Type annotation of an empty array, i.e. @as []
+		if i := strings.IndexByte(value, ' '); i >= 0 {
+			value = strings.TrimSpace(value[i:])
+		}
+	}
+	switch {
+	case strings.HasPrefix(value, "["):
+		var items []string
+		rest := strings.TrimSpace(value[1:])
+		for !strings.HasPrefix(rest, "]") {
+			item, n, err := parseGVariantString(rest)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(rest[n:])
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", fmt.Errorf("malformed array %s", value)
+			}
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(value, "'"), strings.HasPrefix(value, "\""):
+		s, n, err := parseGVariantString(value)
+		if err != nil {
+			return "", err
+		} else if n != len(value) {
+			return "", fmt.Errorf("malformed string %s", value)
+		}
+		return s, nil
+	}
+	return value, nil
+}
+
+/*
+Parse the quoted string at the start of s, unescaping backslashes.
+Returns:
+	string, int, nil: The string, and the length of its quoted form in s.
+	"", 0, error: s does not start with a terminated quoted string.
+*/
+func parseGVariantString(s string) (string, int, error) {
+	if s == "" || (s[0] != '\'' && s[0] != '"') {
+		return "", 0, fmt.Errorf("expected a string at %q", s)
+	}
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %s", s)
+}
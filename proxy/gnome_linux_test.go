@@ -0,0 +1,250 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const testGsettingsManual = `org.gnome.system.proxy autoconfig-url ''
+org.gnome.system.proxy ignore-hosts ['localhost', '127.0.0.0/8', '::1', '*.intranet.rapid7.com', 'example.com']
+org.gnome.system.proxy mode 'manual'
+org.gnome.system.proxy use-same-proxy true
+org.gnome.system.proxy.ftp host ''
+org.gnome.system.proxy.ftp port 0
+org.gnome.system.proxy.http authentication-password 'it\'s secret'
+org.gnome.system.proxy.http authentication-user "RAPID7\\user"
+org.gnome.system.proxy.http enabled false
+org.gnome.system.proxy.http host 'proxy.rapid7.com'
+org.gnome.system.proxy.http port 3128
+org.gnome.system.proxy.http use-authentication true
+org.gnome.system.proxy.https host 'secure.rapid7.com'
+org.gnome.system.proxy.https port 0
+org.gnome.system.proxy.socks host 'socks.rapid7.com'
+org.gnome.system.proxy.socks port 1081
+`
+
+var dataParseGsettingsData = []struct {
+	name      string
+	output    string
+	protocol  string
+	targetUrl string
+	expect    []Proxy
+	err       error
+}{
+	{"http", testGsettingsManual, "http", "http://test.endpoint.rapid7.com",
+		[]Proxy{newTestProxy("http", "proxy.rapid7.com", 3128, url.UserPassword("RAPID7\\user", "it's secret"), srcGNOME+".http")}, nil},
+	{"https without a port", testGsettingsManual, "https", "https://test.endpoint.rapid7.com",
+		[]Proxy{newTestProxy("http", "secure.rapid7.com", defaultPort, nil, srcGNOME+".https")}, nil},
+	{"ftp falls back to socks", testGsettingsManual, "ftp", "ftp://test.endpoint.rapid7.com",
+		[]Proxy{newTestProxy("socks5", "socks.rapid7.com", 1081, nil, srcGNOME+".socks")}, nil},
+	{"socks", testGsettingsManual, "socks", "test.endpoint.rapid7.com:22",
+		[]Proxy{newTestProxy("socks5", "socks.rapid7.com", 1081, nil, srcGNOME+".socks")}, nil},
+	{"ignored host", testGsettingsManual, "https", "https://localhost", nil, nil},
+	{"ignored wildcard", testGsettingsManual, "https", "https://wiki.intranet.rapid7.com", nil, nil},
+	{"ignored domain", testGsettingsManual, "https", "https://www.example.com", nil, nil},
+	{"ignored CIDR", testGsettingsManual, "https", "https://127.0.0.53:8443", nil, nil},
+	{"ignored IPv6", testGsettingsManual, "https", "https://[::1]:8443", nil, nil},
+	{"not ignored", testGsettingsManual, "https", "https://128.0.0.1",
+		[]Proxy{newTestProxy("http", "secure.rapid7.com", defaultPort, nil, srcGNOME+".https")}, nil},
+	{"IPv6 proxy", "org.gnome.system.proxy mode 'manual'\norg.gnome.system.proxy ignore-hosts @as []\norg.gnome.system.proxy.http host 'fd00::1'\n", "http", "http://rapid7.com",
+		[]Proxy{newTestProxy("http", "[fd00::1]", defaultPort, nil, srcGNOME+".http")}, nil},
+	{"no proxy for protocol", "org.gnome.system.proxy mode 'manual'\norg.gnome.system.proxy.http host 'proxy.rapid7.com'\n", "https", "https://rapid7.com", nil, ErrNotFound},
+	{"disabled", "org.gnome.system.proxy mode 'none'\norg.gnome.system.proxy.http host 'proxy.rapid7.com'\n", "http", "http://rapid7.com", nil, ErrNotFound},
+	{"no settings", "", "http", "http://rapid7.com", nil, ErrNotFound},
+	{"automatic detection", "org.gnome.system.proxy autoconfig-url ''\norg.gnome.system.proxy mode 'auto'\n", "https", "https://rapid7.com", nil, ErrNotFound},
+}
+
+func TestParseGsettingsData(t *testing.T) {
+	for _, tt := range dataParseGsettingsData {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			p := newTestProvider("")
+			proxies, err := p.parseGsettingsData(context.Background(), tt.protocol, ParseTargetURL(tt.targetUrl, ""), nil, "echo", "-n", tt.output)
+			a.Equal(tt.expect, proxies)
+			if tt.err == nil {
+				a.NoError(err)
+			} else {
+				a.True(errors.Is(err, tt.err), err)
+			}
+		})
+	}
+}
+
+func TestParseGsettingsData_bypassTrace(t *testing.T) {
+	a := assert.New(t)
+	p := newTestProvider("")
+	tr := newTrace("https", ParseTargetURL("https://127.0.0.1", ""))
+	proxies, err := p.parseGsettingsData(context.Background(), "https", ParseTargetURL("https://127.0.0.1", ""), tr, "echo", "-n", testGsettingsManual)
+	a.NoError(err)
+	a.Nil(proxies)
+	a.Equal([]*TraceStep{
+		{Source: srcGNOME + ".https", Enabled: true, Value: "http://secure.rapid7.com", Bypass: "ignore-hosts=127.0.0.0/8"},
+	}, tr.Steps)
+}
+
+func TestParseGsettingsData_auto(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(`function FindProxyForURL(url, host) {
+		return "PROXY pac.rapid7.com:3128; DIRECT";
+	}`)
+	defer s.Close()
+	p := newTestProvider("")
+	p.pacFetcher = newPACFetcher()
+	output := "org.gnome.system.proxy autoconfig-url '" + s.URL + "/proxy.pac'\norg.gnome.system.proxy mode 'auto'\n"
+	proxies, err := p.parseGsettingsData(context.Background(), "https", ParseTargetURL("https://rapid7.com", ""), nil, "echo", "-n", output)
+	a.NoError(err)
+	a.Equal([]Proxy{newTestProxy("http", "pac.rapid7.com", 3128, nil, srcGNOMEPAC), NewDirectProxy(srcGNOMEPAC)}, proxies)
+
+	// The script cannot be fetched
+	output = "org.gnome.system.proxy autoconfig-url '" + s.URL + "/missing\x01'\norg.gnome.system.proxy mode 'auto'\n"
+	_, err = p.parseGsettingsData(context.Background(), "https", ParseTargetURL("https://rapid7.com", ""), nil, "echo", "-n", output)
+	if a.Error(err) {
+		a.False(errors.Is(err, ErrNotFound))
+	}
+}
+
+func TestParseGsettingsData_errors(t *testing.T) {
+	a := assert.New(t)
+	p := newTestProvider("")
+	targetUrl := ParseTargetURL("https://rapid7.com", "")
+
+	// Not installed
+	_, err := p.parseGsettingsData(context.Background(), "https", targetUrl, nil, "gsettings-not-installed")
+	a.True(errors.Is(err, ErrNotFound), err)
+	_, err = p.parseGsettingsData(context.Background(), "https", targetUrl, nil, "sh", "-c", "echo 'No such schema “org.gnome.system.proxy”' >&2; exit 1")
+	a.True(errors.Is(err, ErrNotFound), err)
+
+	// Failed
+	_, err = p.parseGsettingsData(context.Background(), "https", targetUrl, nil, "false")
+	a.True(errors.Is(err, ErrTimeout), err)
+
+	// Invalid
+	var parseErr *ParseError
+	_, err = p.parseGsettingsData(context.Background(), "https", targetUrl, nil, "echo", "org.gnome.system.proxy mode 'bogus'")
+	if a.True(errors.As(err, &parseErr)) {
+		a.Equal(srcGNOME, parseErr.Src)
+		a.Equal("bogus", parseErr.Value)
+	}
+	_, err = p.parseGsettingsData(context.Background(), "https", targetUrl, nil, "echo", "org.gnome.system.proxy ignore-hosts ['localhost'")
+	a.True(errors.As(err, &parseErr))
+	_, err = p.parseGsettingsData(context.Background(), "https", targetUrl, nil, "echo", "org.gnome.system.proxy mode 'manual'\norg.gnome.system.proxy.https host 'proxy:rapid7'")
+	if a.True(errors.As(err, &parseErr)) {
+		a.Equal(srcGNOME+".https", parseErr.Src)
+	}
+}
+
+var dataParseGVariant = []struct {
+	value  string
+	expect string
+	err    bool
+}{
+	{"'proxy.rapid7.com'", "proxy.rapid7.com", false},
+	{`"it's"`, "it's", false},
+	{`'a\\b\'c'`, `a\b'c`, false},
+	{"''", "", false},
+	{"3128", "3128", false},
+	{"true", "true", false},
+	{"['localhost', '127.0.0.0/8', '::1']", "localhost,127.0.0.0/8,::1", false},
+	{"[ 'a' ,'b' ]", "a,b", false},
+	{"@as []", "", false},
+	{"[]", "", false},
+	{"'unterminated", "", true},
+	{"'a' 'b'", "", true},
+	{"['a' 'b']", "", true},
+	{"['a',", "", true},
+	{"[3128]", "", true},
+}
+
+func TestParseGVariant(t *testing.T) {
+	a := assert.New(t)
+	for _, tt := range dataParseGVariant {
+		v, err := parseGVariant(tt.value)
+		if tt.err {
+			a.Error(err, tt.value)
+		} else if a.NoError(err, tt.value) {
+			a.Equal(tt.expect, v, tt.value)
+		}
+	}
+}
+
+func TestProviderLinux_Lookup_gnome(t *testing.T) {
+	a := assert.New(t)
+	p := newTestProviderLinux(map[string]string{})
+	var ran []string
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		ran = append([]string{name}, arg...)
+		return exec.CommandContext(ctx, "echo", "-n", testGsettingsManual)
+	}
+	r, err := p.Lookup(context.Background(), "https", "https://test.endpoint.rapid7.com")
+	a.NoError(err)
+	a.Equal([]string{"gsettings", "list-recursively", "org.gnome.system.proxy"}, ran)
+	proxy := newTestProxy("http", "secure.rapid7.com", defaultPort, nil, srcGNOME+".https")
+	a.Equal(Result{Kind: ResultProxy, Proxy: proxy, Proxies: []Proxy{proxy}, Src: srcGNOME + ".https"}, r)
+
+	r, err = p.Lookup(context.Background(), "https", "https://localhost")
+	a.NoError(err)
+	a.Equal(Result{Kind: ResultBypassed, Proxies: []Proxy{}, Src: srcGNOME + ".https", Bypass: "ignore-hosts=localhost"}, r)
+
+	// The environment takes precedence
+	p.getEnv = func(key string) string {
+		return map[string]string{"HTTPS_PROXY": "http://env:8080"}[key]
+	}
+	a.Equal(newTestProxy("http", "env", 8080, nil, "Environment[HTTPS_PROXY]"), p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+}
+
+func TestProviderLinux_Lookup_gnomeCached(t *testing.T) {
+	a := assert.New(t)
+	p := newTestProviderLinux(map[string]string{})
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	for _, s := range p.sources {
+		if s, ok := s.(*gnomeSource); ok {
+			s.commands.now = func() time.Time { return now }
+		}
+	}
+	runs := 0
+	program := "echo"
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		if name != gsettingsBinary {
+			return exec.CommandContext(ctx, "true")
+		}
+		runs++
+		return exec.CommandContext(ctx, program, "-n", testGsettingsManual)
+	}
+	proxy := newTestProxy("http", "secure.rapid7.com", defaultPort, nil, srcGNOME+".https")
+
+	// gsettings is run once for consecutive lookups
+	for i := 0; i < 3; i++ {
+		a.Equal(proxy, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	}
+	a.Nil(p.GetProxy("https", "https://localhost"))
+	a.Equal(1, runs)
+
+	// And again once its output expires
+	now = now.Add(commandCacheTTL)
+	a.Equal(proxy, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	a.Equal(2, runs)
+
+	// Not installed
+	now = now.Add(commandCacheTTL)
+	program = "gsettings-not-installed"
+	a.Nil(p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	a.Nil(p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	a.Equal(3, runs)
+}
@@ -0,0 +1,283 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sourceNameKDE = "kde"
+
+/*
+Create a Source which reads the KDE proxy settings ([Proxy Settings] of ~/.config/kioslaverc), respecting NoProxyFor.
+In the automatic mode, the PAC script of "Proxy Config Script" is evaluated. Detection is left to WPADSource.
+*/
+func KDESource() Source {
+	return new(kdeSource)
+}
+
+type kdeSource struct{}
+
+func (s *kdeSource) Name() string {
+	return sourceNameKDE
+}
+
+func (s *kdeSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *kdeSource) lookup(ctx context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	return p.readKDEProxy(ctx, protocol, targetUrl, t)
+}
+
+const (
+	kioslavercFile          = "kioslaverc"
+	kdeProxyGroup           = "[Proxy Settings]"
+	kdeKeyProxyType         = "ProxyType"
+	kdeKeyNoProxyFor        = "NoProxyFor"
+	kdeKeyReversedException = "ReversedException"
+	kdeKeyProxyConfigScript = "Proxy Config Script"
+	// Keys of the proxies are suffixed protocols (i.e. httpsProxy)
+	kdeKeyProxySuffix  = "Proxy"
+	kdeProxyTypeNone   = "0"
+	kdeProxyTypeManual = "1"
+	kdeProxyTypePAC    = "2"
+	kdeProxyTypeWPAD   = "3"
+	// As kdeProxyTypeManual, but the values are the names of environment variables (i.e. httpsProxy=HTTPS_PROXY)
+	kdeProxyTypeEnv   = "4"
+	envXDGConfigHome  = "XDG_CONFIG_HOME"
+	envHome           = "HOME"
+	srcKDE            = "KDE:" + kioslavercFile
+	srcKDEFmt         = srcKDE + "[%s]"
+	maxKioslavercSize = 1048576
+)
+
+/*
+Returns the proxies configured in the kioslaverc of the user, found through XDG_CONFIG_HOME or HOME.
+Params:
+	ctx: Bounds the download of the PAC script.
+	protocol: The proxy's protocol (i.e. https)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	See parseKioslaverc. Should kioslaverc not exist, ErrNotFound is returned.
+*/
+func (p *provider) readKDEProxy(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	content, err := p.readKioslaverc()
+	if err != nil {
+		step := t.step(srcKDE)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		step.setError(err)
+		p.logger.Printf("[proxy.Provider.readKDEProxy]: Failed to read kioslaverc, %s\n", err)
+		return nil, err
+	}
+	proxies, err := p.parseKioslaverc(ctx, protocol, targetUrl, t, content)
+	if errors.Is(err, ErrNotFound) {
+		p.logger.Printf("[proxy.Provider.readKDEProxy]: %s proxy is not configured.\n", protocol)
+	} else if err != nil {
+		p.logger.Printf("[proxy.Provider.readKDEProxy]: Failed to parse kioslaverc, %s\n", err)
+	}
+	return proxies, err
+}
+
+func (p *provider) readKioslaverc() ([]byte, error) {
+	dir := p.getEnv(envXDGConfigHome)
+	if dir == "" {
+		home := p.getEnv(envHome)
+		if home == "" {
+			return nil, fmt.Errorf("neither %s nor %s is set: %w", envXDGConfigHome, envHome, os.ErrNotExist)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	f := filepath.Join(dir, kioslavercFile)
+	stat, err := os.Stat(f)
+	if err != nil {
+		return nil, err
+	} else if stat.Size() > maxKioslavercSize {
+		return nil, fmt.Errorf("kioslaverc too large: %s", f)
+	}
+	return os.ReadFile(f)
+}
+
+/*
+Returns the proxies found by parsing the [Proxy Settings] group of kioslaverc. For example:
+	[Proxy Settings]
+	NoProxyFor=localhost,127.0.0.1,.rapid7.com
+	ProxyType=1
+	httpProxy=http://proxy.rapid7.com 3128
+	httpsProxy=http://proxy.rapid7.com 3128
+Should ReversedException be true, only the hosts of NoProxyFor are proxied.
+Params:
+	ctx: Bounds the download of the PAC script.
+	protocol: The proxy's protocol (i.e. https)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+	content: The content of kioslaverc.
+Returns:
+	[]Proxy, nil: A proxy was found, or the PAC script of "Proxy Config Script" was evaluated
+	nil, nil: The proxy is bypassed for targetUrl
+	nil, ErrNotFound: No proxy is configured for protocol, or proxies are to be detected through WPAD
+	nil, *ParseError: The settings are not valid
+	nil, error: The PAC script could not be fetched or evaluated
+*/
+func (p *provider) parseKioslaverc(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace, content []byte) ([]Proxy, error) {
+	settings := parseKDEConfigGroup(content, kdeProxyGroup)
+	switch proxyType := settings[kdeKeyProxyType]; proxyType {
+	case kdeProxyTypeManual, kdeProxyTypeEnv:
+		return p.readKDEManualProxy(protocol, targetUrl, t, settings, proxyType == kdeProxyTypeEnv)
+	case kdeProxyTypePAC:
+		pacUrl := settings[kdeKeyProxyConfigScript]
+		src := fmt.Sprintf(srcKDEFmt, kdeKeyProxyConfigScript)
+		if pacUrl == "" {
+			t.step(src)
+			return nil, ErrNotFound
+		}
+		proxies := p.readPACProxy(ctx, src, pacUrl, targetUrl, t)
+		if proxies == nil {
+			return nil, fmt.Errorf("failed to evaluate PAC script %s", pacUrl)
+		}
+		return proxies, nil
+	case kdeProxyTypeNone, kdeProxyTypeWPAD, "":
+		t.step(srcKDE)
+		return nil, ErrNotFound
+	default:
+		step := t.step(srcKDE)
+		err := &ParseError{Src: srcKDE, Value: proxyType, Err: fmt.Errorf("unknown %s", kdeKeyProxyType)}
+		step.setError(err)
+		return nil, err
+	}
+}
+
+/*
+Returns the proxy of the manual mode for protocol: that of protocol's key (i.e. httpsProxy), or else socksProxy.
+Params:
+	env: If true, the values are the names of the environment variables to read (i.e. httpsProxy=HTTPS_PROXY).
+*/
+func (p *provider) readKDEManualProxy(protocol string, targetUrl *url.URL, t *Trace, settings map[string]string, env bool) ([]Proxy, error) {
+	value := func(key string) string {
+		if env {
+			return p.getEnv(settings[key])
+		}
+		return settings[key]
+	}
+	key := strings.ToLower(protocol) + kdeKeyProxySuffix
+	switch strings.ToLower(protocol) {
+	case protocolHTTP, protocolHTTPS, protocolFTP, protocolSOCKS:
+	default:
+		key = protocolSOCKS + kdeKeyProxySuffix
+	}
+	if value(key) == "" {
+		key = protocolSOCKS + kdeKeyProxySuffix
+	}
+	src := fmt.Sprintf(srcKDEFmt, key)
+	step := t.step(src)
+	proxyUrlStr := kdeProxyURL(value(key))
+	if proxyUrlStr == "" {
+		return nil, ErrNotFound
+	}
+	step.setValue(proxyUrlStr)
+	proxyUrl, err := ParseURL(proxyUrlStr, "")
+	if err != nil {
+		err = &ParseError{Src: src, Value: proxyUrlStr, Err: err}
+		step.setError(err)
+		return nil, err
+	}
+	proxy, err := NewProxy(proxyUrl, src)
+	if err != nil {
+		err = &ParseError{Src: src, Value: proxyUrlStr, Err: err}
+		step.setError(err)
+		return nil, err
+	}
+	// Entries are separated by commas, or white space
+	noProxyFor := strings.Join(strings.FieldsFunc(value(kdeKeyNoProxyFor), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}), ",")
+	match, bypass := p.matchProxyBypass(targetUrl, noProxyFor, ",")
+	if settings[kdeKeyReversedException] == "true" {
+		// Only the hosts of NoProxyFor are proxied
+		if !bypass {
+			p.logger.Printf("[proxy.Provider.readKDEManualProxy]: NoProxyFor=\"%s\" is reversed, targetUrl=%s, bypass=true", noProxyFor, targetUrl)
+			step.setBypass(fmt.Sprintf("%s=true", kdeKeyReversedException))
+			return nil, nil
+		}
+	} else if bypass {
+		p.logger.Printf("[proxy.Provider.readKDEManualProxy]: NoProxyFor=\"%s\", targetUrl=%s, bypass=true", noProxyFor, targetUrl)
+		step.setBypass(fmt.Sprintf("%s=%s", kdeKeyNoProxyFor, match))
+		return nil, nil
+	}
+	step.setProxies(proxy)
+	return []Proxy{proxy}, nil
+}
+
+/*
+Returns the URL of a proxy as written by KDE, which separates the port with a space.
+For example:
+	http://proxy.rapid7.com 3128 -> http://proxy.rapid7.com:3128
+	http://proxy.rapid7.com:3128 -> http://proxy.rapid7.com:3128
+	http://proxy.rapid7.com 0 -> http://proxy.rapid7.com
+*/
+func kdeProxyURL(value string) string {
+	fields := strings.Fields(value)
+	switch {
+	case len(fields) == 0:
+		return ""
+	case len(fields) == 1 || fields[1] == "0":
+		return fields[0]
+	}
+	return fields[0] + ":" + fields[1]
+}
+
+/*
+Parse the entries of group (i.e. [Proxy Settings]) in a KDE configuration file, which is an INI file.
+Options of keys (i.e. ProxyType[$i]) are dropped, and the escape sequences of values (\s, \t, \n, \r, \\) are replaced.
+*/
+func parseKDEConfigGroup(content []byte, group string) map[string]string {
+	settings := map[string]string{}
+	inGroup := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		} else if strings.HasPrefix(line, "[") {
+			inGroup = line == group
+			continue
+		} else if !inGroup {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if i := strings.Index(key, "[$"); i >= 0 {
+			key = strings.TrimSpace(key[:i])
+		}
+		settings[key] = kdeConfigUnescape(strings.TrimSpace(value))
+	}
+	return settings
+}
+
+func kdeConfigUnescape(value string) string {
+	return strings.NewReplacer(`\s`, " ", `\t`, "\t", `\n`, "\n", `\r`, "\r", `\\`, `\`).Replace(value)
+}
@@ -0,0 +1,170 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var (
+	// No source is configured with a proxy for the target
+	ErrNotFound = errors.New("no proxy found")
+	// The lookup was abandoned because its context expired, or an external resource did not respond in time
+	ErrTimeout = errors.New("timed out")
+)
+
+/*
+A proxy value read from a source could not be parsed.
+Use errors.As to retrieve it from an error returned by Lookup.
+*/
+type ParseError struct {
+	// Human readable location of the value (i.e. Environment[HTTPS_PROXY])
+	Src string
+	// The raw value, which may contain user info
+	Value string
+	// The underlying error
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Src, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+/*
+The outcome of a successful lookup.
+*/
+type ResultKind int
+
+const (
+	// Connect through Result.Proxy
+	ResultProxy ResultKind = iota + 1
+	// Connect directly, as preferred by a PAC script
+	ResultDirect
+	// Connect directly, as the target matches a bypass list (i.e. NO_PROXY)
+	ResultBypassed
+)
+
+func (k ResultKind) String() string {
+	switch k {
+	case ResultProxy:
+		return "Proxy"
+	case ResultDirect:
+		return "Direct"
+	case ResultBypassed:
+		return "Bypassed"
+	default:
+		return fmt.Sprintf("ResultKind(%d)", int(k))
+	}
+}
+
+/*
+The result of ProviderV2.Lookup.
+*/
+type Result struct {
+	Kind ResultKind
+	// The preferred proxy when Kind is ResultProxy, otherwise nil
+	Proxy Proxy
+	// Every candidate in order of preference, including DIRECT entries (see IsDirect). Empty when Kind is ResultBypassed.
+	Proxies []Proxy
+	// Human readable location which determined the result (i.e. Environment[HTTPS_PROXY])
+	Src string
+	// The bypass entry which matched the target when Kind is ResultBypassed (i.e. NO_PROXY=.rapid7.com)
+	Bypass string
+}
+
+/*
+Looks up proxies for a single source chain, given a context and a Trace to record into.
+Implemented by each platform's provider.
+*/
+type proxiesFunc func(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace) []Proxy
+
+/*
+Run the lookup of protocol for targetUrlStr, and classify its outcome.
+Params:
+	ctx: Bounds the lookup. Sources which require external resources (i.e. WPAD/PAC, scutil) are abandoned once it is done.
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrlStr: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	get: The platform's source chain.
+Returns:
+	Result, Trace, nil: A source determined the result.
+	Result, Trace, error: No source determined the result. The error matches ErrNotFound, ErrTimeout,
+		or context.Canceled should ctx have been cancelled, with errors.Is,
+		and wraps any errors encountered reading sources (i.e. *ParseError).
+		Result.Proxies is still that which GetProxies returns.
+*/
+func lookup(ctx context.Context, protocol string, targetUrlStr string, get proxiesFunc) (Result, *Trace, error) {
+	targetUrl := ParseTargetURL(targetUrlStr, protocol)
+	t := newTrace(protocol, targetUrl)
+	proxies := get(ctx, protocol, targetUrl, t)
+	t.finish(proxies)
+	r := Result{Proxies: proxies, Src: t.Winner}
+	var selected *TraceStep
+	for _, s := range t.Steps {
+		if s.Selected {
+			selected = s
+		}
+	}
+	switch {
+	case selected == nil:
+		return r, t, t.err(ctx)
+	case len(proxies) == 0:
+		r.Kind = ResultBypassed
+		r.Bypass = selected.Bypass
+	case IsDirect(proxies[0]):
+		r.Kind = ResultDirect
+	default:
+		r.Kind = ResultProxy
+		r.Proxy = proxies[0]
+	}
+	return r, t, nil
+}
+
+/*
+Returns:
+	The error to return for a lookup which found nothing, wrapping the errors of each step.
+*/
+func (t *Trace) err(ctx context.Context) error {
+	cause := ErrNotFound
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		cause = ctxErr
+	}
+	var errs []error
+	for _, s := range t.Steps {
+		if s.err != nil {
+			errs = append(errs, s.err)
+		}
+	}
+	if len(errs) == 0 {
+		return cause
+	}
+	return fmt.Errorf("%w: %w", cause, errors.Join(errs...))
+}
+
+/*
+Wrap a ctx error as ErrTimeout when it represents an expired deadline.
+A cancelled ctx is not a timeout, and its error (context.Canceled) is returned as is.
+*/
+func contextError(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
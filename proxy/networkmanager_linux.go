@@ -0,0 +1,194 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const sourceNameNetworkManager = "networkmanager"
+
+/*
+Create a Source which reads the proxy settings of the active NetworkManager connections through nmcli:
+the PAC URL (proxy.pac-url) or inline PAC script (proxy.pac-script) of the first connection which has one.
+Connections whose settings are for browsers only are ignored. Detection is left to WPADSource.
+The output of nmcli is reused for 30 seconds.
+*/
+func NetworkManagerSource() Source {
+	return &networkManagerSource{commands: newCommandCache()}
+}
+
+type networkManagerSource struct {
+	commands *commandCache
+}
+
+func (s *networkManagerSource) Name() string {
+	return sourceNameNetworkManager
+}
+
+func (s *networkManagerSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *networkManagerSource) lookup(ctx context.Context, p *provider, _ string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	return p.withCommandCache(s.commands).readNetworkManagerProxy(ctx, targetUrl, t)
+}
+
+const (
+	nmcliBinary          = "nmcli"
+	nmProxyMethod        = "proxy.method"
+	nmProxyBrowserOnly   = "proxy.browser-only"
+	nmProxyPACURL        = "proxy.pac-url"
+	nmProxyPACScript     = "proxy.pac-script"
+	nmMethodNone         = "none"
+	nmMethodAuto         = "auto"
+	srcNetworkManager    = "NetworkManager"
+	srcNetworkManagerFmt = srcNetworkManager + ":%s"
+	// Applied to each execution of nmcli when the lookup's context has no deadline
+	nmcliTimeout = time.Second
+)
+
+// Terse output, with values which are not escaped, and the fields requested by the arguments following
+var nmcliArgs = []string{"--terse", "--escape", "no", "--fields"}
+
+/*
+Returns the proxies of the first active NetworkManager connection configured with a PAC URL or script.
+Params:
+	ctx: Bounds the executions of nmcli, and the download of the PAC script. If ctx has no deadline,
+		nmcliTimeout is applied to each execution of nmcli.
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	[]Proxy, nil: The PAC script of a connection was evaluated.
+	nil, ErrNotFound: nmcli is not installed, NetworkManager is not running, or no active connection has a PAC script.
+	nil, ErrTimeout: nmcli did not complete in time, or failed.
+	nil, error: A connection's settings are not valid, or its PAC script could not be fetched or evaluated.
+*/
+func (p *provider) readNetworkManagerProxy(ctx context.Context, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	active, err := p.runNmcli(ctx, "UUID,NAME", "connection", "show", "--active")
+	if err != nil {
+		step := t.step(srcNetworkManager)
+		if !errors.Is(err, ErrNotFound) {
+			step.setError(err)
+			p.logger.Printf("[proxy.Provider.readNetworkManagerProxy]: Failed to list the active connections, %s\n", err)
+		}
+		return nil, err
+	}
+	var lastErr error
+	for _, line := range strings.Split(active, "\n") {
+		uuid, name, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		proxies, err := p.readNetworkManagerConnectionProxy(ctx, uuid, name, targetUrl, t)
+		if err == nil {
+			return proxies, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			p.logger.Printf("[proxy.Provider.readNetworkManagerProxy]: %s: %s\n", name, err)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	p.logger.Printf("[proxy.Provider.readNetworkManagerProxy]: No active connection has a PAC script.\n")
+	t.step(srcNetworkManager)
+	return nil, ErrNotFound
+}
+
+/*
+Returns the proxies of the given connection. See readNetworkManagerProxy.
+*/
+func (p *provider) readNetworkManagerConnectionProxy(ctx context.Context, uuid string, name string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	src := fmt.Sprintf(srcNetworkManagerFmt, name)
+	out, err := p.runNmcli(ctx, "proxy", "connection", "show", uuid)
+	if err != nil {
+		t.step(src).setError(err)
+		return nil, err
+	}
+	settings := parseNmcliSettings(out)
+	switch method := settings[nmProxyMethod]; method {
+	case nmMethodNone, "":
+		t.step(src)
+		return nil, ErrNotFound
+	case nmMethodAuto:
+	default:
+		step := t.step(src)
+		err := &ParseError{Src: src, Value: method, Err: fmt.Errorf("unknown %s", nmProxyMethod)}
+		step.setError(err)
+		return nil, err
+	}
+	if settings[nmProxyBrowserOnly] == "yes" {
+		p.logger.Printf("[proxy.Provider.readNetworkManagerConnectionProxy]: %s: %s is set, ignoring.\n", name, nmProxyBrowserOnly)
+		t.step(src)
+		return nil, ErrNotFound
+	}
+	var proxies []Proxy
+	if pacUrl := settings[nmProxyPACURL]; pacUrl != "" {
+		if proxies = p.readPACProxy(ctx, src, pacUrl, targetUrl, t); proxies == nil {
+			return nil, fmt.Errorf("failed to evaluate PAC script %s", pacUrl)
+		}
+	} else if script := settings[nmProxyPACScript]; script != "" {
+		if proxies = p.readPACScriptProxy(ctx, src, nmProxyPACScript, script, targetUrl, t); proxies == nil {
+			return nil, fmt.Errorf("failed to evaluate %s of %s", nmProxyPACScript, name)
+		}
+	} else {
+		// Detection, which is WPADSource's
+		t.step(src)
+		return nil, ErrNotFound
+	}
+	return proxies, nil
+}
+
+/*
+Run nmcli with terse output of the given fields. If ctx has no deadline, nmcliTimeout is applied.
+Returns:
+	string, nil: The output.
+	"", ErrNotFound: nmcli is not installed, or NetworkManager is not running.
+	"", ErrTimeout: nmcli did not complete in time, or failed.
+*/
+func (p *provider) runNmcli(ctx context.Context, fields string, arg ...string) (string, error) {
+	out, stderr, err := p.runCommand(ctx, nmcliTimeout, nmcliBinary, append(append(append([]string{}, nmcliArgs...), fields), arg...)...)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || strings.Contains(stderr, "not running") {
+			return "", fmt.Errorf("%w: %s: %s", ErrNotFound, nmcliBinary, strings.TrimSpace(stderr))
+		}
+		return "", fmt.Errorf("%w: %s: %w", ErrTimeout, nmcliBinary, err)
+	}
+	return out, nil
+}
+
+/*
+Parse the terse output of nmcli connection show, one "setting:value" per line, into a map of settings to values.
+Lines which do not start with a setting continue the value of the previous one (i.e. a multi-line proxy.pac-script).
+*/
+func parseNmcliSettings(out string) map[string]string {
+	settings := map[string]string{}
+	last := ""
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.HasPrefix(key, "proxy.") && !strings.ContainsAny(key, " \t") {
+			settings[key] = value
+			last = key
+		} else if last != "" {
+			settings[last] += "\n" + line
+		}
+	}
+	return settings
+}
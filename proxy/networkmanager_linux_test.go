@@ -0,0 +1,226 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const (
+	testNmcliWired = "0a5c2b2e-7f1d-4c55-9e8a-2f0b5f7c1d11"
+	testNmcliWiFi  = "6b2f9d4c-3e8a-4b1f-8c7d-5a9e0f1b2c33"
+	testNmcliVPN   = "9c1e7a5b-2d4f-4e6a-b8c0-1d3f5e7a9b55"
+)
+
+/*
+A fake nmcli, which answers each command by its last argument (--active, or the UUID of a connection).
+Should there be no answer, NetworkManager is not running.
+*/
+func newTestNmcli(outputs map[string]string) commandAdapter {
+	return func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		out, ok := outputs[arg[len(arg)-1]]
+		if !ok {
+			return exec.CommandContext(ctx, "sh", "-c", "echo 'Error: NetworkManager is not running.' >&2; exit 8")
+		}
+		return exec.CommandContext(ctx, "echo", "-n", out)
+	}
+}
+
+func testNmcliProxy(method string, browserOnly string, pacUrl string, pacScript string) string {
+	return "proxy.method:" + method + "\nproxy.browser-only:" + browserOnly + "\nproxy.pac-url:" + pacUrl + "\nproxy.pac-script:" + pacScript + "\n"
+}
+
+func TestProvider_ReadNetworkManagerProxy(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(`function FindProxyForURL(url, host) {
+		return "PROXY office.rapid7.com:3128; DIRECT";
+	}`)
+	defer s.Close()
+	targetUrl := ParseTargetURL("https://test.endpoint.rapid7.com", "")
+	src := "NetworkManager:Office: Wi-Fi"
+	p := newTestProvider("")
+	p.pacFetcher = newPACFetcher()
+	var ran [][]string
+	nmcli := newTestNmcli(map[string]string{
+		"--active":     testNmcliWired + ":Wired connection 1\n" + testNmcliWiFi + ":Office: Wi-Fi\n",
+		testNmcliWired: testNmcliProxy("none", "no", "", ""),
+		testNmcliWiFi:  testNmcliProxy("auto", "no", s.URL+"/wpad.dat", ""),
+	})
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		ran = append(ran, append([]string{name}, arg...))
+		return nmcli(ctx, name, arg...)
+	}
+	tr := newTrace("https", targetUrl)
+	proxies, err := p.readNetworkManagerProxy(context.Background(), targetUrl, tr)
+	a.NoError(err)
+	a.Equal([]Proxy{newTestProxy("http", "office.rapid7.com", 3128, nil, src), NewDirectProxy(src)}, proxies)
+	a.Equal([][]string{
+		{"nmcli", "--terse", "--escape", "no", "--fields", "UUID,NAME", "connection", "show", "--active"},
+		{"nmcli", "--terse", "--escape", "no", "--fields", "proxy", "connection", "show", testNmcliWired},
+		{"nmcli", "--terse", "--escape", "no", "--fields", "proxy", "connection", "show", testNmcliWiFi},
+	}, ran)
+	if a.Len(tr.Steps, 2) {
+		a.Equal(&TraceStep{Source: "NetworkManager:Wired connection 1"}, tr.Steps[0])
+		a.Equal(src, tr.Steps[1].Source)
+		a.Equal(s.URL+"/wpad.dat => PROXY office.rapid7.com:3128; DIRECT", tr.Steps[1].Value)
+	}
+}
+
+func TestProvider_ReadNetworkManagerProxy_pacScript(t *testing.T) {
+	a := assert.New(t)
+	p := newTestProvider("")
+	p.proc = newTestNmcli(map[string]string{
+		"--active": testNmcliVPN + ":VPN\n",
+		testNmcliVPN: testNmcliProxy("auto", "no", "", `function FindProxyForURL(url, host) {
+  if (dnsDomainIs(host, ".rapid7.com")) {
+    return "PROXY vpn.rapid7.com:8080";
+  }
+  return "DIRECT";
+}`),
+	})
+	a.Equal([]Proxy{newTestProxy("http", "vpn.rapid7.com", 8080, nil, "NetworkManager:VPN")},
+		nmProxies(p.readNetworkManagerProxy(context.Background(), ParseTargetURL("https://test.endpoint.rapid7.com", ""), nil)))
+	a.Equal([]Proxy{NewDirectProxy("NetworkManager:VPN")},
+		nmProxies(p.readNetworkManagerProxy(context.Background(), ParseTargetURL("https://example.com", ""), nil)))
+}
+
+var dataReadNetworkManagerProxyNotFound = []struct {
+	name    string
+	outputs map[string]string
+}{
+	{"not running", map[string]string{}},
+	{"no active connection", map[string]string{"--active": ""}},
+	{"none", map[string]string{"--active": testNmcliWired + ":Wired\n", testNmcliWired: testNmcliProxy("none", "no", "", "")}},
+	{"detection", map[string]string{"--active": testNmcliWired + ":Wired\n", testNmcliWired: testNmcliProxy("auto", "no", "", "")}},
+	{"browser only", map[string]string{"--active": testNmcliWired + ":Wired\n", testNmcliWired: testNmcliProxy("auto", "yes", "http://wpad/wpad.dat", "")}},
+	{"no proxy settings", map[string]string{"--active": testNmcliWired + ":Wired\n", testNmcliWired: ""}},
+}
+
+func TestProvider_ReadNetworkManagerProxy_notFound(t *testing.T) {
+	for _, tt := range dataReadNetworkManagerProxyNotFound {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			p := newTestProvider("")
+			p.proc = newTestNmcli(tt.outputs)
+			proxies, err := p.readNetworkManagerProxy(context.Background(), ParseTargetURL("https://rapid7.com", ""), nil)
+			a.Nil(proxies)
+			a.True(errors.Is(err, ErrNotFound), err)
+		})
+	}
+}
+
+func TestProvider_ReadNetworkManagerProxy_errors(t *testing.T) {
+	a := assert.New(t)
+	targetUrl := ParseTargetURL("https://rapid7.com", "")
+	p := newTestProvider("")
+
+	// Not installed
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "nmcli-not-installed", arg...)
+	}
+	_, err := p.readNetworkManagerProxy(context.Background(), targetUrl, nil)
+	a.True(errors.Is(err, ErrNotFound), err)
+
+	// Failed
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "false")
+	}
+	_, err = p.readNetworkManagerProxy(context.Background(), targetUrl, nil)
+	a.True(errors.Is(err, ErrTimeout), err)
+
+	// Invalid
+	p.proc = newTestNmcli(map[string]string{"--active": testNmcliWired + ":Wired\n", testNmcliWired: testNmcliProxy("manual", "no", "", "")})
+	_, err = p.readNetworkManagerProxy(context.Background(), targetUrl, nil)
+	var parseErr *ParseError
+	if a.True(errors.As(err, &parseErr)) {
+		a.Equal("NetworkManager:Wired", parseErr.Src)
+		a.Equal("manual", parseErr.Value)
+	}
+	p.proc = newTestNmcli(map[string]string{"--active": testNmcliWired + ":Wired\n", testNmcliWired: testNmcliProxy("auto", "no", "", "function notAPAC() {}")})
+	_, err = p.readNetworkManagerProxy(context.Background(), targetUrl, nil)
+	if a.Error(err) {
+		a.False(errors.Is(err, ErrNotFound))
+	}
+
+	// The next connection is consulted
+	p.proc = newTestNmcli(map[string]string{
+		"--active":     testNmcliWired + ":Wired\n" + testNmcliVPN + ":VPN\n",
+		testNmcliWired: testNmcliProxy("auto", "no", "", "function notAPAC() {}"),
+		testNmcliVPN:   testNmcliProxy("auto", "no", "", "function FindProxyForURL(url, host) { return 'PROXY vpn.rapid7.com:8080'; }"),
+	})
+	proxies, err := p.readNetworkManagerProxy(context.Background(), targetUrl, nil)
+	a.NoError(err)
+	a.Equal([]Proxy{newTestProxy("http", "vpn.rapid7.com", 8080, nil, "NetworkManager:VPN")}, proxies)
+}
+
+func TestParseNmcliSettings(t *testing.T) {
+	a := assert.New(t)
+	script := "function FindProxyForURL(url, host) {\n  return \"DIRECT\";\n}"
+	a.Equal(map[string]string{
+		"proxy.method":       "auto",
+		"proxy.browser-only": "no",
+		"proxy.pac-url":      "http://wpad.rapid7.com:8080/wpad.dat",
+		"proxy.pac-script":   script,
+	}, parseNmcliSettings(testNmcliProxy("auto", "no", "http://wpad.rapid7.com:8080/wpad.dat", script)))
+	a.Equal(map[string]string{}, parseNmcliSettings(""))
+	a.Equal(map[string]string{"proxy.pac-script": "a\n\nb"}, parseNmcliSettings("proxy.pac-script:a\n\nb\n"))
+}
+
+func nmProxies(proxies []Proxy, _ error) []Proxy {
+	return proxies
+}
+
+func TestProviderLinux_Lookup_networkManagerCached(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(`function FindProxyForURL(url, host) {
+		return "PROXY office.rapid7.com:3128";
+	}`)
+	defer s.Close()
+	p := newTestProviderLinux(map[string]string{})
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	for _, s := range p.sources {
+		if s, ok := s.(*networkManagerSource); ok {
+			s.commands.now = func() time.Time { return now }
+		}
+	}
+	var ran [][]string
+	nmcli := newTestNmcli(map[string]string{
+		"--active":    testNmcliWiFi + ":Office: Wi-Fi\n",
+		testNmcliWiFi: testNmcliProxy("auto", "no", s.URL+"/wpad.dat", ""),
+	})
+	proc := p.proc
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		if name != nmcliBinary {
+			return proc(ctx, name, arg...)
+		}
+		ran = append(ran, arg)
+		return nmcli(ctx, name, arg...)
+	}
+	proxy := newTestProxy("http", "office.rapid7.com", 3128, nil, "NetworkManager:Office: Wi-Fi")
+
+	// nmcli is run once for consecutive lookups
+	for i := 0; i < 3; i++ {
+		a.Equal(proxy, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	}
+	a.Len(ran, 2)
+
+	// And again once its output expires
+	now = now.Add(commandCacheTTL)
+	a.Equal(proxy, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	a.Len(ran, 4)
+}
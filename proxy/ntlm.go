@@ -0,0 +1,297 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ntlmSignature           = "NTLMSSP\x00"
+	ntlmNegotiateMessage    = 1
+	ntlmChallengeMessage    = 2
+	ntlmAuthenticateMessage = 3
+
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+	ntlmNegotiateFlags                   = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSessionSecurity | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+	// The AV_PAIR IDs of the target info of a CHALLENGE message
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+
+	// The length of a NEGOTIATE message without a version, and of a CHALLENGE message up to its target info
+	ntlmNegotiateLen = 32
+	ntlmChallengeLen = 48
+	// The offset of the payload of an AUTHENTICATE message without a version or MIC
+	ntlmAuthenticateLen = 64
+	// Seconds between the epoch of a Windows FILETIME (1601) and the Unix epoch
+	ntlmFileTimeEpoch = 11644473600
+)
+
+/*
+The client side of an NTLMv2 handshake (MS-NLMP), with the credentials of a proxy.
+Only authentication is provided: no session key is negotiated, so messages are neither signed nor sealed.
+*/
+type ntlmClient struct {
+	domain   string
+	user     string
+	password string
+	// The sources of the client challenge and timestamp, replaced by tests
+	rand io.Reader
+	now  func() time.Time
+}
+
+/*
+Params:
+	p: The proxy, whose username may be qualified by a domain (i.e. RAPID7\user).
+		A user principal name (i.e. user@rapid7.com) is sent as the user, with no domain.
+*/
+func newNTLMClient(p Proxy) *ntlmClient {
+	username, _ := p.Username()
+	password, _ := p.Password()
+	c := &ntlmClient{user: username, password: password, rand: rand.Reader, now: time.Now}
+	if i := strings.Index(username, `\`); i >= 0 {
+		c.domain, c.user = username[:i], username[i+1:]
+	}
+	return c
+}
+
+/*
+Returns:
+	The NEGOTIATE message, which starts the handshake.
+*/
+func (c *ntlmClient) negotiate() []byte {
+	// The domain and workstation fields are left empty
+	b := newNTLMMessage(ntlmNegotiateMessage, ntlmNegotiateLen)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateFlags)
+	return b
+}
+
+/*
+Params:
+	challenge: The CHALLENGE message the proxy answered the NEGOTIATE message with.
+Returns:
+	[]byte, nil: The AUTHENTICATE message, which completes the handshake.
+	nil, error: The CHALLENGE message is invalid.
+*/
+func (c *ntlmClient) authenticate(challenge []byte) ([]byte, error) {
+	ch, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	if ch.flags&ntlmNegotiateUnicode == 0 {
+		return nil, errors.New("NTLM challenge does not support Unicode")
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := io.ReadFull(c.rand, clientChallenge); err != nil {
+		return nil, err
+	}
+	responseKey := ntowfv2(c.user, c.password, c.domain)
+	lmResponse := make([]byte, 24)
+	timestamp, exists := ntlmTargetTimestamp(ch.targetInfo)
+	if !exists {
+		timestamp = ntlmFileTime(c.now())
+		// The LMv2 response is only sent when the server's time is not known (MS-NLMP 3.1.5.1.2)
+		lmResponse = append(ntlmHMAC(responseKey, ch.serverChallenge, clientChallenge), clientChallenge...)
+	}
+	ntResponse := ntlmv2Response(responseKey, ch.serverChallenge, clientChallenge, timestamp, ch.targetInfo)
+
+	b := newNTLMMessage(ntlmAuthenticateMessage, ntlmAuthenticateLen)
+	b = putNTLMField(b, 12, lmResponse)
+	b = putNTLMField(b, 20, ntResponse)
+	b = putNTLMField(b, 28, ntlmUnicode(c.domain))
+	b = putNTLMField(b, 36, ntlmUnicode(c.user))
+	// The workstation and session key fields are left empty
+	b = putNTLMField(b, 44, nil)
+	b = putNTLMField(b, 52, nil)
+	binary.LittleEndian.PutUint32(b[60:], ch.flags&ntlmNegotiateFlags)
+	return b, nil
+}
+
+/*
+The fields of a CHALLENGE message used to authenticate.
+*/
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetInfo      []byte
+}
+
+/*
+Returns:
+	*ntlmChallenge, nil: The fields of b.
+	nil, error: b is not a CHALLENGE message, or is truncated.
+*/
+func parseNTLMChallenge(b []byte) (*ntlmChallenge, error) {
+	if err := checkNTLMMessage(b, ntlmChallengeMessage, ntlmChallengeLen); err != nil {
+		return nil, err
+	}
+	targetInfo, err := ntlmField(b, 40)
+	if err != nil {
+		return nil, err
+	}
+	return &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(b[20:]),
+		serverChallenge: b[24:32],
+		targetInfo:      targetInfo,
+	}, nil
+}
+
+/*
+Returns:
+	A message of type msgType, with headerLen bytes of header, and the signature and type set.
+*/
+func newNTLMMessage(msgType uint32, headerLen int) []byte {
+	b := make([]byte, headerLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], msgType)
+	return b
+}
+
+/*
+Returns:
+	nil: b is an NTLM message of type msgType, with at least headerLen bytes.
+	error: Otherwise.
+*/
+func checkNTLMMessage(b []byte, msgType uint32, headerLen int) error {
+	if len(b) < headerLen || !bytes.HasPrefix(b, []byte(ntlmSignature)) {
+		return errors.New("invalid NTLM message")
+	}
+	if t := binary.LittleEndian.Uint32(b[8:]); t != msgType {
+		return fmt.Errorf("unexpected NTLM message type %d, expected %d", t, msgType)
+	}
+	return nil
+}
+
+/*
+Append value to the payload of message b, and point the field (length, maximum length, and offset) at offset to it.
+*/
+func putNTLMField(b []byte, offset int, value []byte) []byte {
+	binary.LittleEndian.PutUint16(b[offset:], uint16(len(value)))
+	binary.LittleEndian.PutUint16(b[offset+2:], uint16(len(value)))
+	binary.LittleEndian.PutUint32(b[offset+4:], uint32(len(b)))
+	return append(b, value...)
+}
+
+/*
+Returns:
+	[]byte, nil: The payload pointed to by the field at offset of message b.
+	nil, error: The field points outside of b.
+*/
+func ntlmField(b []byte, offset int) ([]byte, error) {
+	if len(b) < offset+8 {
+		return nil, errors.New("invalid NTLM message")
+	}
+	length := int(binary.LittleEndian.Uint16(b[offset:]))
+	start := int(binary.LittleEndian.Uint32(b[offset+4:]))
+	if length == 0 {
+		return nil, nil
+	}
+	if start > len(b) || length > len(b)-start {
+		return nil, errors.New("invalid NTLM message field")
+	}
+	return b[start : start+length], nil
+}
+
+/*
+Returns:
+	[]byte, true: The MsvAvTimestamp of the CHALLENGE message's target info.
+	nil, false: The target info has no timestamp.
+*/
+func ntlmTargetTimestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAvEOL || len(targetInfo) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return targetInfo[4:12], true
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return nil, false
+}
+
+/*
+Returns:
+	t as a Windows FILETIME: little endian 100 nanosecond intervals since 1601.
+*/
+func ntlmFileTime(t time.Time) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(t.Unix()+ntlmFileTimeEpoch)*1e7+uint64(t.Nanosecond()/100))
+}
+
+/*
+Returns:
+	s, encoded as UTF-16LE.
+*/
+func ntlmUnicode(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+/*
+Returns:
+	The HMAC-MD5 of the concatenation of data, keyed by key.
+*/
+func ntlmHMAC(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+/*
+Returns:
+	The NTLMv2 response key of the credentials (NTOWFv2, MS-NLMP 3.3.2).
+*/
+func ntowfv2(user string, password string, domain string) []byte {
+	hash := md4Sum(ntlmUnicode(password))
+	return ntlmHMAC(hash[:], ntlmUnicode(strings.ToUpper(user)+domain))
+}
+
+/*
+Returns:
+	The NTLMv2 response (MS-NLMP 3.3.2): the NTProofStr, followed by the client's blob it proves.
+*/
+func ntlmv2Response(responseKey []byte, serverChallenge []byte, clientChallenge []byte, timestamp []byte, targetInfo []byte) []byte {
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+	return append(ntlmHMAC(responseKey, serverChallenge, blob), blob...)
+}
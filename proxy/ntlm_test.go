@@ -0,0 +1,63 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var dataMD4 = []struct {
+	in     string
+	expect string
+}{
+	// RFC 1320 A.5
+	{"", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+	{"a", "bde52cb31de33e46245e05fbdbd6fb24"},
+	{"abc", "a448017aaf21d8525fc10ae87aa6729d"},
+	{"message digest", "d9130a8164549fe818874806e1c7014b"},
+	{"abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"},
+	{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", "e33b4ddc9c38f2199c3e7b164fcc0536"},
+}
+
+func TestMD4(t *testing.T) {
+	for _, tt := range dataMD4 {
+		t.Run(tt.in, func(t *testing.T) {
+			sum := md4Sum([]byte(tt.in))
+			assert.Equal(t, tt.expect, hex.EncodeToString(sum[:]))
+		})
+	}
+}
+
+func TestNTLMv2(t *testing.T) {
+	a := assert.New(t)
+	// MS-NLMP 4.2.4
+	serverChallenge := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	clientChallenge := []byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	targetInfo := append(append([]byte{0x02, 0x00, 0x0c, 0x00}, ntlmUnicode("Domain")...), 0x01, 0x00, 0x0c, 0x00)
+	targetInfo = append(append(targetInfo, ntlmUnicode("Server")...), 0x00, 0x00, 0x00, 0x00)
+	key := ntowfv2("User", "Password", "Domain")
+	a.Equal("0c868a403bfd7a93a3001ef22ef02e3f", hex.EncodeToString(key))
+	a.Equal("86c35097ac9cec102554764a57cccc19", hex.EncodeToString(ntlmHMAC(key, serverChallenge, clientChallenge)))
+	response := ntlmv2Response(key, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	a.Equal("68cd0ab851e51c96aabc927bebef6a1c", hex.EncodeToString(response[:16]))
+}
+
+func TestNTLMFileTime(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("0000000000000000", hex.EncodeToString(ntlmFileTime(time.Date(1601, time.January, 1, 0, 0, 0, 0, time.UTC))))
+	// 116444736000000000 intervals
+	a.Equal("00803ed5deb19d01", hex.EncodeToString(ntlmFileTime(time.Unix(0, 0))))
+}
@@ -0,0 +1,131 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os/exec"
+)
+
+/*
+Configures a Provider. See NewProviderWithOptions.
+*/
+type Option func(p *provider)
+
+/*
+Read proxies from a JSON configuration file, mapping protocols to proxies. See ConfigFileSource.
+For example:
+	{"https": "http://proxy.rapid7.com:3128", "ftp": "proxy.rapid7.com:2121"}
+Params:
+	configFile: Path to the configuration file. If empty, no configuration file is read.
+*/
+func WithConfigFile(configFile string) Option {
+	return func(p *provider) {
+		p.configFile = configFile
+	}
+}
+
+/*
+Consult sources, in order, rather than those of the source order. WithSourceOrder, and the "sources" key of the
+configuration file, are then ignored.
+For example, to consult a custom source before the default sources:
+	proxy.WithSources(append([]proxy.Source{policySource}, proxy.DefaultSources("")...)...)
+Params:
+	sources: The sources to consult. See DefaultSources, ConfigFileSource, EnvironmentSource, and those of the system
+		(i.e. WPADSource on Linux, ScutilSource on MacOS, WinHTTPSource on Windows).
+*/
+func WithSources(sources ...Source) Option {
+	return func(p *provider) {
+		p.sources = append([]Source{}, sources...)
+	}
+}
+
+/*
+Read environment variables (i.e. HTTPS_PROXY, NO_PROXY) with getEnv rather than os.Getenv.
+For example, to look up proxies for the environment of a child process:
+	proxy.WithEnv(func(key string) string { return childEnv[key] })
+Params:
+	getEnv: Returns the value of the given variable, or "" if it is not set.
+*/
+func WithEnv(getEnv func(key string) string) Option {
+	return func(p *provider) {
+		p.getEnv = getEnv
+	}
+}
+
+/*
+Read environment variables from env rather than the environment of this process. See WithEnv.
+Keys are case sensitive, as they are on Linux and MacOS: both HTTPS_PROXY and https_proxy are consulted.
+Params:
+	env: Variable names to values. Variables which are not present are not set.
+*/
+func WithEnvMap(env map[string]string) Option {
+	return WithEnv(func(key string) string {
+		return env[key]
+	})
+}
+
+/*
+Run the commands which read the system's settings (i.e. scutil on MacOS, gsettings and nmcli on Linux) with run rather than exec.CommandContext.
+Params:
+	run: Returns the command to run, as exec.CommandContext does.
+*/
+func WithCommandRunner(run func(ctx context.Context, name string, arg ...string) *exec.Cmd) Option {
+	return func(p *provider) {
+		p.proc = run
+	}
+}
+
+/*
+Set the timeouts used making a call which requires external resources (i.e. WPAD/PAC). See Provider.SetTimeouts.
+Params:
+	resolve: Time in milliseconds to use for name resolution. Provider default is 5000.
+	connect: Time in milliseconds to use for server connection requests. Provider default is 5000.
+	send: Time in milliseconds to use for sending requests. Provider default is 20000.
+	receive: Time in milliseconds to receive a response to a request. Provider default is 20000.
+*/
+func WithTimeouts(resolve int, connect int, send int, receive int) Option {
+	return func(p *provider) {
+		p.SetTimeouts(resolve, connect, send, receive)
+	}
+}
+
+/*
+Write log messages to logger rather than the standard logger.
+Messages written by PAC scripts themselves (i.e. alert) are still written to the standard logger.
+Params:
+	logger: The logger to write to. Use log.New(io.Discard, "", 0) to discard messages.
+*/
+func WithLogger(logger *log.Logger) Option {
+	return func(p *provider) {
+		p.logger = logger
+	}
+}
+
+/*
+Download PAC scripts (i.e. WPAD) with client.
+The connect, send and receive timeouts (see WithTimeouts) are then those of client.
+Scripts downloaded by this provider are cached separately from those of other providers.
+Params:
+	client: The client to download with. It should not use a proxy itself.
+*/
+func WithHTTPClient(client *http.Client) Option {
+	return func(p *provider) {
+		p.pacFetcher = newPACFetcher()
+		p.pacFetcher.client = func(pacTimeouts) *http.Client {
+			return client
+		}
+	}
+}
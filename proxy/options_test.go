@@ -0,0 +1,78 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewProviderWithOptions(t *testing.T) {
+	a := assert.New(t)
+	tmpDir, err := os.MkdirTemp("", "TestNewProvider")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	f := filepath.Join(tmpDir, "proxy.config")
+	if !a.NoError(os.WriteFile(f, []byte(`{"ftp": "http://config:2121"}`), 0644)) {
+		return
+	}
+	var logs bytes.Buffer
+	p, err := NewProviderWithOptions(
+		WithConfigFile(f),
+		WithSourceOrder("config", "env"),
+		WithEnvMap(map[string]string{"HTTPS_PROXY": "http://env:8080", "HTTP_PROXY": "http://bad:port"}),
+		WithLogger(log.New(&logs, "", 0)))
+	if !a.NoError(err) {
+		return
+	}
+	a.Equal(newTestProxy("http", "config", 2121, nil, srcConfigurationFile), p.GetProxy("ftp", "ftp://test.endpoint.rapid7.com"))
+	a.Equal(newTestProxy("http", "env", 8080, nil, "Environment[HTTPS_PROXY]"), p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	a.Empty(logs.String())
+	a.Nil(p.GetProxy("http", "http://test.endpoint.rapid7.com"))
+	a.Contains(logs.String(), "[proxy.Provider.readSystemEnvProxy]: failed to parse \"HTTP_PROXY\" value")
+}
+
+func TestOptions(t *testing.T) {
+	a := assert.New(t)
+	client := new(http.Client)
+	var ran []string
+	run := func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		ran = append(ran, name)
+		return exec.CommandContext(ctx, name, arg...)
+	}
+	p := new(provider)
+	p.init(nil)
+	for _, opt := range []Option{
+		WithTimeouts(1, 2, 3, 4),
+		WithHTTPClient(client),
+		WithCommandRunner(run),
+		WithEnv(func(key string) string { return "value of " + key }),
+	} {
+		opt(p)
+	}
+	a.Equal(pacTimeouts{resolve: 1, connect: 2, send: 3, receive: 4}, p.pacTimeouts())
+	a.NotSame(defaultPACFetcher, p.pacFetcher)
+	a.Equal(client, p.pacFetcher.client(p.pacTimeouts()))
+	p.proc(context.Background(), "scutil")
+	a.Equal([]string{"scutil"}, ran)
+	a.Equal("value of HTTPS_PROXY", p.getEnv("HTTPS_PROXY"))
+}
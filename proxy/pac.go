@@ -0,0 +1,639 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Represents a compiled proxy auto-config (PAC) script.
+A PAC is safe for concurrent use, every evaluation runs in a fresh JavaScript environment.
+*/
+type PAC interface {
+	/*
+		Evaluate the script's FindProxyForURL(url, host) function.
+		Should the script define FindProxyForURLEx (Microsoft's IPv6 aware variant), it is used instead.
+		Params:
+			targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+			host: Optional. The host of targetUrl. If empty, it is derived from targetUrl.
+		Returns:
+			string, nil: The value returned by the script. (i.e. "PROXY 1.2.3.4:3128; DIRECT")
+			"", error: The script failed to evaluate
+	*/
+	FindProxyForURL(targetUrl string, host string) (string, error)
+}
+
+/*
+Compile the given PAC script.
+Params:
+	script: The JavaScript source of the PAC file
+Returns:
+	PAC, nil: The script compiled successfully
+	nil, error: The script is invalid
+*/
+func NewPAC(script string) (PAC, error) {
+	return newPAC(script, defaultResolveTimeout)
+}
+
+const (
+	pacFunctionName   = "FindProxyForURL"
+	pacFunctionNameEx = "FindProxyForURLEx"
+	pacGMT            = "GMT"
+)
+
+type pac struct {
+	program *jsProgram
+	// Resolves a host name to its IP addresses
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	// Returns the IP addresses of this machine, preferred address first
+	localIPs       func(logger *log.Logger) []net.IP
+	now            func() time.Time
+	resolveTimeout time.Duration
+}
+
+/*
+Compile the given PAC script, using resolveTimeout (in milliseconds) for DNS lookups performed by the script.
+*/
+func newPAC(script string, resolveTimeout int) (*pac, error) {
+	program, err := jsParse(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &pac{
+		program:        program,
+		lookupIP:       lookupIP,
+		localIPs:       localIPs,
+		now:            time.Now,
+		resolveTimeout: time.Duration(resolveTimeout) * time.Millisecond,
+	}
+	defined := false
+	for _, f := range program.funcs {
+		defined = defined || f.name == pacFunctionName || f.name == pacFunctionNameEx
+	}
+	for _, v := range program.vars {
+		// var FindProxyForURL = function(url, host) {...}
+		defined = defined || v == pacFunctionName || v == pacFunctionNameEx
+	}
+	if !defined {
+		return nil, fmt.Errorf("PAC script does not define %s", pacFunctionName)
+	}
+	return p, nil
+}
+
+func (p *pac) FindProxyForURL(targetUrl string, host string) (string, error) {
+	return p.findProxyForURL(context.Background(), log.Default(), targetUrl, host)
+}
+
+/*
+Same as FindProxyForURL, abandoning the evaluation, and the DNS lookups made by the script, once ctx is done.
+Params:
+	ctx: Bounds the evaluation.
+	logger: Receives the script's alerts, and its failed DNS lookups. That of the provider evaluating the script,
+		as scripts are shared by providers.
+Returns:
+	"", error: The script failed to evaluate. Should ctx be done, the error wraps that of ctx.
+*/
+func (p *pac) findProxyForURL(ctx context.Context, logger *log.Logger, targetUrl string, host string) (string, error) {
+	if host == "" {
+		host, _, _ = SplitHostPort(ParseTargetURL(targetUrl, ""))
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	it := newJSInterpreter(ctx, p.now)
+	e := &pacEvaluation{pac: p, ctx: ctx, logger: logger, dns: map[string][]net.IP{}}
+	e.install(it)
+	if err := it.run(p.program); err != nil {
+		return "", fmt.Errorf("failed to evaluate PAC script: %w", err)
+	}
+	name := pacFunctionName
+	if fn, ok := it.global.vars[pacFunctionNameEx]; ok && jsIsCallable(fn) {
+		name = pacFunctionNameEx
+	}
+	v, err := it.callGlobal(name, targetUrl, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate %s: %w", name, err)
+	}
+	switch v.(type) {
+	case jsUndefinedType, nil:
+		return "", fmt.Errorf("%s returned %s", name, jsToString(v))
+	}
+	return jsToString(v), nil
+}
+
+/*
+The state of a single evaluation. DNS results are cached for the duration of the evaluation, as scripts
+commonly resolve the same host several times (i.e. consecutive isInNet calls).
+*/
+type pacEvaluation struct {
+	pac *pac
+	// Bounds the DNS lookups made by the script
+	ctx    context.Context
+	logger *log.Logger
+	dns    map[string][]net.IP
+	local  []net.IP
+}
+
+func (e *pacEvaluation) install(it *jsInterpreter) {
+	str := func(args []jsValue, i int) string {
+		return jsToString(jsArg(args, i))
+	}
+	it.define("isPlainHostName", func(args []jsValue) (jsValue, error) {
+		return pacIsPlainHostName(str(args, 0)), nil
+	})
+	it.define("dnsDomainIs", func(args []jsValue) (jsValue, error) {
+		return pacDnsDomainIs(str(args, 0), str(args, 1)), nil
+	})
+	it.define("localHostOrDomainIs", func(args []jsValue) (jsValue, error) {
+		return pacLocalHostOrDomainIs(str(args, 0), str(args, 1)), nil
+	})
+	it.define("isResolvable", func(args []jsValue) (jsValue, error) {
+		return e.resolve(str(args, 0), true) != nil, nil
+	})
+	it.define("isInNet", func(args []jsValue) (jsValue, error) {
+		return e.isInNet(str(args, 0), str(args, 1), str(args, 2)), nil
+	})
+	it.define("dnsResolve", func(args []jsValue) (jsValue, error) {
+		if ip := e.resolve(str(args, 0), true); ip != nil {
+			return ip.String(), nil
+		}
+		return nil, nil
+	})
+	it.define("myIpAddress", func(args []jsValue) (jsValue, error) {
+		for _, ip := range e.localIPs() {
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4.String(), nil
+			}
+		}
+		return "127.0.0.1", nil
+	})
+	it.define("dnsDomainLevels", func(args []jsValue) (jsValue, error) {
+		return float64(pacDnsDomainLevels(str(args, 0))), nil
+	})
+	it.define("shExpMatch", func(args []jsValue) (jsValue, error) {
+		return pacShExpMatch(str(args, 0), str(args, 1)), nil
+	})
+	it.define("weekdayRange", func(args []jsValue) (jsValue, error) {
+		return pacWeekdayRange(e.pac.now(), pacStringArgs(args)), nil
+	})
+	it.define("dateRange", func(args []jsValue) (jsValue, error) {
+		return pacDateRange(e.pac.now(), pacStringArgs(args)), nil
+	})
+	it.define("timeRange", func(args []jsValue) (jsValue, error) {
+		return pacTimeRange(e.pac.now(), pacStringArgs(args)), nil
+	})
+	it.define("convert_addr", func(args []jsValue) (jsValue, error) {
+		ip := net.ParseIP(str(args, 0)).To4()
+		if ip == nil {
+			return 0.0, nil
+		}
+		return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+	})
+	it.define("alert", func(args []jsValue) (jsValue, error) {
+		e.logger.Printf("[proxy.PAC.alert]: %s\n", str(args, 0))
+		return jsUndefined, nil
+	})
+	// Microsoft's IPv6 extensions
+	it.define("isResolvableEx", func(args []jsValue) (jsValue, error) {
+		return len(e.resolveAll(str(args, 0))) > 0, nil
+	})
+	it.define("dnsResolveEx", func(args []jsValue) (jsValue, error) {
+		return pacJoinIPs(e.resolveAll(str(args, 0))), nil
+	})
+	it.define("myIpAddressEx", func(args []jsValue) (jsValue, error) {
+		return pacJoinIPs(e.localIPs()), nil
+	})
+	it.define("isInNetEx", func(args []jsValue) (jsValue, error) {
+		_, prefix, err := net.ParseCIDR(str(args, 1))
+		if err != nil {
+			return false, nil
+		}
+		for _, ip := range e.resolveAll(str(args, 0)) {
+			if prefix.Contains(ip) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	it.define("sortIpAddressList", func(args []jsValue) (jsValue, error) {
+		return pacSortIPAddressList(str(args, 0)), nil
+	})
+	it.define("getClientVersion", func(args []jsValue) (jsValue, error) {
+		return "1.0", nil
+	})
+}
+
+func (e *pacEvaluation) localIPs() []net.IP {
+	if e.local == nil {
+		e.local = e.pac.localIPs(e.logger)
+	}
+	return e.local
+}
+
+/*
+Resolve the given host to a single IP address.
+Params:
+	host: Hostname or IP.
+	ipv4: Only consider IPv4 addresses.
+Returns:
+	The first matching address, or nil if the host cannot be resolved.
+*/
+func (e *pacEvaluation) resolve(host string, ipv4 bool) net.IP {
+	for _, ip := range e.resolveAll(host) {
+		if !ipv4 {
+			return ip
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
+
+func (e *pacEvaluation) resolveAll(host string) []net.IP {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	if ips, ok := e.dns[host]; ok {
+		return ips
+	}
+	if e.ctx.Err() != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, e.pac.resolveTimeout)
+	defer cancel()
+	ips, err := e.pac.lookupIP(ctx, host)
+	if err != nil {
+		e.logger.Printf("[proxy.PAC.resolve]: failed to resolve \"%s\": %s\n", host, err)
+		ips = nil
+	}
+	e.dns[host] = ips
+	return ips
+}
+
+/*
+Returns true if the IPv4 address of host, masked with mask, equals pattern masked with mask.
+For example:
+	("10.1.2.3", "10.0.0.0", "255.0.0.0") -> true
+	("192.168.1.1", "10.0.0.0", "255.0.0.0") -> false
+*/
+func (e *pacEvaluation) isInNet(host string, pattern string, mask string) bool {
+	patternIP := net.ParseIP(strings.TrimSpace(pattern)).To4()
+	maskIP := net.ParseIP(strings.TrimSpace(mask)).To4()
+	if patternIP == nil || maskIP == nil {
+		return false
+	}
+	ip := e.resolve(host, true)
+	if ip == nil {
+		return false
+	}
+	return ip.Mask(net.IPMask(maskIP)).Equal(patternIP.Mask(net.IPMask(maskIP)))
+}
+
+/*
+Returns true if there is no domain name in the host name (no dots).
+*/
+func pacIsPlainHostName(host string) bool {
+	return !strings.Contains(host, domainDelimiter)
+}
+
+/*
+Returns true if the domain of host matches domain.
+For example:
+	("www.rapid7.com", ".rapid7.com") -> true
+	("www", ".rapid7.com") -> false
+*/
+func pacDnsDomainIs(host string, domain string) bool {
+	return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+}
+
+/*
+Returns true if host matches hostdom exactly, or if host has no domain and matches the host part of hostdom.
+For example:
+	("www.rapid7.com", "www.rapid7.com") -> true
+	("www", "www.rapid7.com") -> true
+	("www.example.com", "www.rapid7.com") -> false
+*/
+func pacLocalHostOrDomainIs(host string, hostdom string) bool {
+	host = strings.ToLower(host)
+	hostdom = strings.ToLower(hostdom)
+	if host == hostdom {
+		return true
+	}
+	return pacIsPlainHostName(host) && strings.HasPrefix(hostdom, host+domainDelimiter)
+}
+
+/*
+Returns the number of DNS domain levels (number of dots) in host.
+*/
+func pacDnsDomainLevels(host string) int {
+	return strings.Count(host, domainDelimiter)
+}
+
+/*
+Returns true if str matches the shell expression shexp, where "*" matches any sequence and "?" any single character.
+The expression is matched directly, rather than compiled, as scripts commonly match each request against many.
+*/
+func pacShExpMatch(str string, shexp string) bool {
+	s, exp := []rune(str), []rune(shexp)
+	i, j := 0, 0
+	// Should the characters following the last "*" not match, that "*" matches one more character of str
+	star, starMatched := -1, 0
+	for i < len(s) {
+		switch {
+		case j < len(exp) && exp[j] == '*':
+			star, starMatched = j, i
+			j++
+		case j < len(exp) && (exp[j] == '?' || exp[j] == s[i]):
+			i++
+			j++
+		case star >= 0:
+			starMatched++
+			i, j = starMatched, star+1
+		default:
+			return false
+		}
+	}
+	for j < len(exp) && exp[j] == '*' {
+		j++
+	}
+	return j == len(exp)
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var pacMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+func pacIndex(values []string, s string) int {
+	for i, v := range values {
+		if v == strings.ToUpper(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+func pacStringArgs(args []jsValue) []string {
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = jsToString(a)
+	}
+	return s
+}
+
+/*
+Remove the trailing "GMT" argument if present, and return the time in the appropriate time zone.
+*/
+func pacTimeZone(now time.Time, args []string) (time.Time, []string) {
+	if len(args) > 0 && strings.ToUpper(args[len(args)-1]) == pacGMT {
+		return now.UTC(), args[:len(args)-1]
+	}
+	return now, args
+}
+
+/*
+Returns true if v is within the inclusive range [lo, hi], where the range wraps around when lo > hi.
+*/
+func pacInRange(v int, lo int, hi int) bool {
+	if lo <= hi {
+		return lo <= v && v <= hi
+	}
+	return v >= lo || v <= hi
+}
+
+/*
+Evaluate weekdayRange(wd1[, wd2][, "GMT"]).
+For example, on a Wednesday:
+	("MON", "FRI") -> true
+	("SAT", "SUN") -> false
+	("WED") -> true
+*/
+func pacWeekdayRange(now time.Time, args []string) bool {
+	now, args = pacTimeZone(now, args)
+	if len(args) == 0 || len(args) > 2 {
+		return false
+	}
+	wd1 := pacIndex(pacWeekdays, args[0])
+	wd2 := wd1
+	if len(args) == 2 {
+		wd2 = pacIndex(pacWeekdays, args[1])
+	}
+	if wd1 < 0 || wd2 < 0 {
+		return false
+	}
+	return pacInRange(int(now.Weekday()), wd1, wd2)
+}
+
+/*
+Evaluate dateRange, which accepts the following forms, each optionally followed by "GMT":
+	(day), (day1, day2)
+	(month), (month1, month2)
+	(year), (year1, year2)
+	(day1, month1, day2, month2)
+	(month1, year1, month2, year2)
+	(day1, month1, year1, day2, month2, year2)
+Days are 1-31, months are JAN-DEC, and years are four digits.
+*/
+func pacDateRange(now time.Time, args []string) bool {
+	now, args = pacTimeZone(now, args)
+	if len(args) == 0 || len(args) > 6 || (len(args) > 1 && len(args)%2 != 0) {
+		return false
+	}
+	// Each bound is a list of (kind, value) components, compared in order of significance
+	const (
+		kindYear = iota
+		kindMonth
+		kindDay
+	)
+	parse := func(s string) (int, int) {
+		if m := pacIndex(pacMonths, s); m >= 0 {
+			return kindMonth, m
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return -1, 0
+		} else if n < 32 {
+			return kindDay, n
+		}
+		return kindYear, n
+	}
+	current := map[int]int{kindYear: now.Year(), kindMonth: int(now.Month()) - 1, kindDay: now.Day()}
+	half := len(args) / 2
+	if len(args) == 1 {
+		half = 1
+	}
+	var kinds []int
+	var lo, hi, v []int
+	for i := 0; i < half; i++ {
+		kind, n := parse(args[i])
+		if kind < 0 {
+			return false
+		}
+		kinds = append(kinds, kind)
+		lo = append(lo, n)
+		if len(args) == 1 {
+			hi = append(hi, n)
+			continue
+		}
+		kind2, n2 := parse(args[half+i])
+		if kind2 != kind {
+			return false
+		}
+		hi = append(hi, n2)
+	}
+	// Order components from most to least significant
+	order := make([]int, len(kinds))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return kinds[order[a]] < kinds[order[b]]
+	})
+	key := func(values []int) int {
+		k := 0
+		for _, i := range order {
+			k = k*10000 + values[i]
+		}
+		return k
+	}
+	for _, kind := range kinds {
+		v = append(v, current[kind])
+	}
+	if kinds[order[0]] == kindYear {
+		// Year ranges do not wrap around
+		return key(lo) <= key(v) && key(v) <= key(hi)
+	}
+	return pacInRange(key(v), key(lo), key(hi))
+}
+
+/*
+Evaluate timeRange, which accepts the following forms, each optionally followed by "GMT":
+	(hour): The current hour equals hour
+	(hour1, hour2): From hour1:00:00 until hour2:59:59
+	(hour1, min1, hour2, min2): From hour1:min1:00 until hour2:min2:59
+	(hour1, min1, sec1, hour2, min2, sec2): From hour1:min1:sec1 until hour2:min2:sec2
+*/
+func pacTimeRange(now time.Time, args []string) bool {
+	now, args = pacTimeZone(now, args)
+	n := make([]int, len(args))
+	for i, a := range args {
+		v, err := strconv.Atoi(strings.TrimSpace(a))
+		if err != nil {
+			return false
+		}
+		n[i] = v
+	}
+	seconds := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	switch len(n) {
+	case 1:
+		return now.Hour() == n[0]
+	case 2:
+		return pacInRange(seconds, n[0]*3600, n[1]*3600+3599)
+	case 4:
+		return pacInRange(seconds, n[0]*3600+n[1]*60, n[2]*3600+n[3]*60+59)
+	case 6:
+		return pacInRange(seconds, n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5])
+	}
+	return false
+}
+
+func pacJoinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ";")
+}
+
+/*
+Sort a semicolon separated list of IP addresses, IPv6 addresses first.
+Returns an empty string should any of the addresses be invalid.
+*/
+func pacSortIPAddressList(list string) string {
+	var ips []net.IP
+	for _, s := range strings.Split(list, ";") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return ""
+		}
+		ips = append(ips, ip)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		iv4 := ips[i].To4() != nil
+		jv4 := ips[j].To4() != nil
+		if iv4 != jv4 {
+			return !iv4
+		}
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	return pacJoinIPs(ips)
+}
+
+/*
+Resolve the given host using the system resolver.
+*/
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+/*
+Returns the IP addresses of this machine, the address of the interface used for the default route first.
+Falls back to the loopback address should none be found. Failures are logged to logger.
+*/
+func localIPs(logger *log.Logger) []net.IP {
+	var ips []net.IP
+	// Connecting a UDP socket sends no packets, but reveals the source address the OS would route with
+	if c, err := net.Dial("udp4", "198.51.100.1:80"); err == nil {
+		if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+			ips = append(ips, addr.IP)
+		}
+		c.Close()
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil && len(ips) == 0 {
+		logger.Printf("[proxy.PAC.localIPs]: failed to list interface addresses: %s\n", err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if len(ips) > 0 && ips[0].Equal(ipNet.IP) {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		ips = append(ips, net.IPv4(127, 0, 0, 1))
+	}
+	return ips
+}
@@ -0,0 +1,395 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPACFileSize = 1048576
+	// How long a fetched script is used before it is revalidated
+	pacCacheTTL           = 5 * time.Minute
+	pacContentType        = "application/x-ns-proxy-autoconfig"
+	pacSchemeFile         = "file"
+	headerETag            = "ETag"
+	headerLastModified    = "Last-Modified"
+	headerIfNoneMatch     = "If-None-Match"
+	headerIfModifiedSince = "If-Modified-Since"
+	// The number of scripts, and of failed discoveries, kept. The least recently used are evicted.
+	maxPACCacheEntries = 32
+)
+
+// Shared by all providers, so that repeated NewProvider calls benefit from the cache
+var defaultPACFetcher = newPACFetcher()
+
+/*
+Timeouts, in milliseconds, applied to the individual phases of a PAC download.
+See Provider.SetTimeouts.
+*/
+type pacTimeouts struct {
+	resolve int
+	connect int
+	send    int
+	receive int
+}
+
+/*
+Downloads and compiles PAC scripts.
+Compiled scripts are cached in memory keyed by URL and timeouts, as a script resolves host names within the resolve timeout
+it was compiled with. At most maxPACCacheEntries are kept. Once an entry is older than ttl it is revalidated:
+http(s) scripts with a conditional request (If-None-Match/If-Modified-Since), file scripts by size and modification time.
+Should revalidation fail, the cached script continues to be used until the next revalidation.
+Inline scripts (see compileScript) are cached alongside, keyed by the digest of their content, and never revalidated.
+Failed discoveries of a script (i.e. WPAD) are also remembered for ttl, see missed.
+*/
+type pacFetcher struct {
+	mu    sync.Mutex
+	cache map[pacCacheKey]*pacCacheEntry
+	// When the discovery of a script at the given locations last failed
+	misses map[string]time.Time
+	ttl    time.Duration
+	now    func() time.Time
+	// Creates the client used to download http(s) scripts
+	client func(timeouts pacTimeouts) *http.Client
+}
+
+type pacCacheKey struct {
+	url string
+	// The SHA-256 digest of an inline script, which has no url
+	digest   string
+	timeouts pacTimeouts
+}
+
+type pacCacheEntry struct {
+	// Serializes fetches of the same URL
+	mu sync.Mutex
+	// When the entry was last fetched, guarded by pacFetcher.mu
+	used         time.Time
+	pac          *pac
+	etag         string
+	lastModified string
+	modTime      time.Time
+	size         int64
+	checked      time.Time
+}
+
+func newPACFetcher() *pacFetcher {
+	return &pacFetcher{
+		cache:  map[pacCacheKey]*pacCacheEntry{},
+		misses: map[string]time.Time{},
+		ttl:    pacCacheTTL,
+		now:    time.Now,
+		client: newPACClient,
+	}
+}
+
+/*
+Return the compiled PAC script located at pacUrl, downloading it if it is not cached or is stale.
+Params:
+	ctx: Bounds the download of http(s) scripts.
+	pacUrl: The location of the script. Supported schemes are file, http, and https.
+	timeouts: The timeouts to apply to the download, and to DNS lookups performed by the script.
+	logger: Receives revalidation failures.
+Returns:
+	*pac, nil: The script was fetched (or cached) and compiled.
+	nil, error: The script could not be fetched or compiled, and no cached copy exists.
+*/
+func (f *pacFetcher) fetch(ctx context.Context, pacUrl string, timeouts pacTimeouts, logger *log.Logger) (*pac, error) {
+	u, err := url.Parse(strings.TrimSpace(pacUrl))
+	if err != nil {
+		return nil, err
+	}
+	entry := f.entry(pacCacheKey{url: u.String(), timeouts: timeouts})
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	now := f.now()
+	if entry.pac != nil && now.Sub(entry.checked) < f.ttl {
+		return entry.pac, nil
+	}
+	switch strings.ToLower(u.Scheme) {
+	case pacSchemeFile:
+		err = f.fetchFile(entry, u, timeouts)
+	case protocolHTTP, protocolHTTPS:
+		err = f.fetchHTTP(ctx, entry, u, timeouts)
+	default:
+		err = fmt.Errorf("unsupported PAC URL scheme: %s", u)
+	}
+	if err != nil {
+		if entry.pac == nil {
+			return nil, err
+		}
+		// Keep serving the last good script, and don't retry until the next revalidation
+		logger.Printf("[proxy.pacFetcher.fetch]: failed to revalidate %s, using cached script: %s\n", u, err)
+	}
+	entry.checked = now
+	return entry.pac, nil
+}
+
+/*
+Return the compiled inline PAC script (i.e. that of a NetworkManager connection), compiling it should it not be cached.
+Params:
+	script: The content of the script.
+	timeouts: The timeouts to apply to DNS lookups performed by the script.
+Returns:
+	*pac, nil: The script was compiled (or cached).
+	nil, error: The script could not be compiled. Failures are not cached.
+*/
+func (f *pacFetcher) compileScript(script string, timeouts pacTimeouts) (*pac, error) {
+	if len(script) > maxPACFileSize {
+		return nil, errors.New("PAC script too large")
+	}
+	digest := sha256.Sum256([]byte(script))
+	entry := f.entry(pacCacheKey{digest: hex.EncodeToString(digest[:]), timeouts: timeouts})
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.pac == nil {
+		compiled, err := newPAC(script, timeouts.resolve)
+		if err != nil {
+			return nil, err
+		}
+		entry.pac = compiled
+	}
+	return entry.pac, nil
+}
+
+/*
+Returns the cache entry of key, created should it not exist. Should the cache be full, the least recently used entry is evicted.
+*/
+func (f *pacFetcher) entry(key pacCacheKey) *pacCacheEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, exists := f.cache[key]
+	if !exists {
+		if len(f.cache) >= maxPACCacheEntries {
+			var lru *pacCacheKey
+			for k, e := range f.cache {
+				if lru == nil || e.used.Before(f.cache[*lru].used) {
+					k := k
+					lru = &k
+				}
+			}
+			delete(f.cache, *lru)
+		}
+		entry = new(pacCacheEntry)
+		f.cache[key] = entry
+	}
+	entry.used = f.now()
+	return entry
+}
+
+/*
+Returns:
+	true: The discovery of a script at the locations named by key (i.e. the WPAD host names tried) failed within ttl,
+		and is not to be attempted again.
+*/
+func (f *pacFetcher) missed(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failed, exists := f.misses[key]
+	return exists && f.now().Sub(failed) < f.ttl
+}
+
+/*
+Record that the discovery of a script at the locations named by key failed.
+Expired records are then dropped, as is the oldest should maxPACCacheEntries be kept.
+*/
+func (f *pacFetcher) setMissed(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	oldest := ""
+	for k, failed := range f.misses {
+		if now.Sub(failed) >= f.ttl {
+			delete(f.misses, k)
+		} else if oldest == "" || failed.Before(f.misses[oldest]) {
+			oldest = k
+		}
+	}
+	if _, exists := f.misses[key]; !exists && len(f.misses) >= maxPACCacheEntries {
+		delete(f.misses, oldest)
+	}
+	f.misses[key] = now
+}
+
+func (f *pacFetcher) fetchFile(entry *pacCacheEntry, u *url.URL, timeouts pacTimeouts) error {
+	path := u.Path
+	// file:///C:/proxy.pac
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	if path == "" {
+		path = u.Opaque
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	} else if stat.IsDir() {
+		return fmt.Errorf("PAC file is a directory: %s", path)
+	} else if stat.Size() > maxPACFileSize {
+		return fmt.Errorf("PAC file too large: %s", path)
+	}
+	if entry.pac != nil && stat.Size() == entry.size && stat.ModTime().Equal(entry.modTime) {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	compiled, err := f.compile(file, timeouts)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	entry.pac = compiled
+	entry.size = stat.Size()
+	entry.modTime = stat.ModTime()
+	return nil
+}
+
+func (f *pacFetcher) fetchHTTP(ctx context.Context, entry *pacCacheEntry, u *url.URL, timeouts pacTimeouts) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", pacContentType+", */*")
+	if entry.pac != nil {
+		if entry.etag != "" {
+			req.Header.Set(headerIfNoneMatch, entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set(headerIfModifiedSince, entry.lastModified)
+		}
+	}
+	client := f.client(timeouts)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry.pac != nil:
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("failed to download PAC script %s: %s", u, resp.Status)
+	case resp.ContentLength > maxPACFileSize:
+		return fmt.Errorf("PAC script too large: %s", u)
+	}
+	compiled, err := f.compile(resp.Body, timeouts)
+	if err != nil {
+		return fmt.Errorf("%s: %s", u, err)
+	}
+	entry.pac = compiled
+	entry.etag = resp.Header.Get(headerETag)
+	entry.lastModified = resp.Header.Get(headerLastModified)
+	return nil
+}
+
+func (f *pacFetcher) compile(r io.Reader, timeouts pacTimeouts) (*pac, error) {
+	script, err := io.ReadAll(io.LimitReader(r, maxPACFileSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(script) > maxPACFileSize {
+		return nil, errors.New("PAC script too large")
+	}
+	return newPAC(string(script), timeouts.resolve)
+}
+
+/*
+Create an HTTP client for downloading PAC scripts.
+The client never uses a proxy, and applies each timeout to its respective phase:
+name resolution, connection (including the TLS handshake), each write, and each read.
+*/
+func newPACClient(timeouts pacTimeouts) *http.Client {
+	resolve := time.Duration(timeouts.resolve) * time.Millisecond
+	connect := time.Duration(timeouts.connect) * time.Millisecond
+	send := time.Duration(timeouts.send) * time.Millisecond
+	receive := time.Duration(timeouts.receive) * time.Millisecond
+	dialer := &net.Dialer{Timeout: connect}
+	dial := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		resolveCtx := ctx
+		if resolve > 0 {
+			var cancel context.CancelFunc
+			resolveCtx, cancel = context.WithTimeout(ctx, resolve)
+			defer cancel()
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(resolveCtx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return &deadlineConn{Conn: conn, send: send, receive: receive}, nil
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dial,
+			TLSHandshakeTimeout: connect,
+			DisableKeepAlives:   true,
+		},
+	}
+}
+
+/*
+A net.Conn which applies a fresh deadline to every Write (send) and Read (receive).
+*/
+type deadlineConn struct {
+	net.Conn
+	send    time.Duration
+	receive time.Duration
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.send > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.send)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.receive > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.receive)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,330 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testFetcherPACScript = "function FindProxyForURL(url, host) { return 'PROXY %s:8080; DIRECT'; }"
+
+var testPACTimeouts = pacTimeouts{
+	resolve: defaultResolveTimeout,
+	connect: defaultConnectTimeout,
+	send:    defaultSendTimeout,
+	receive: defaultReceiveTimeout,
+}
+
+/*
+A PAC server which supports ETag revalidation, and counts full downloads and conditional requests.
+*/
+type testPACServer struct {
+	*httptest.Server
+	script      atomic.Value
+	etag        atomic.Value
+	downloads   int32
+	revalidated int32
+	status      int32
+}
+
+func newTestPACServer(script string) *testPACServer {
+	s := new(testPACServer)
+	s.script.Store(script)
+	s.etag.Store("\"v1\"")
+	s.status = http.StatusOK
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := int(atomic.LoadInt32(&s.status)); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		etag := s.etag.Load().(string)
+		if r.Header.Get(headerIfNoneMatch) == etag {
+			atomic.AddInt32(&s.revalidated, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&s.downloads, 1)
+		w.Header().Set("Content-Type", pacContentType)
+		w.Header().Set(headerETag, etag)
+		w.Write([]byte(s.script.Load().(string)))
+	}))
+	return s
+}
+
+func TestPACFetcher_Fetch_http(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(strings.Replace(testFetcherPACScript, "%s", "v1", 1))
+	defer s.Close()
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	f := newPACFetcher()
+	f.now = func() time.Time { return now }
+	pacUrl := s.URL + "/wpad.dat"
+
+	// Initial download
+	assertFetchedPAC(a, f, pacUrl, "PROXY v1:8080; DIRECT")
+	a.Equal(int32(1), atomic.LoadInt32(&s.downloads))
+
+	// Cached, no request made
+	for i := 0; i < 100; i++ {
+		assertFetchedPAC(a, f, pacUrl, "PROXY v1:8080; DIRECT")
+	}
+	a.Equal(int32(1), atomic.LoadInt32(&s.downloads))
+	a.Equal(int32(0), atomic.LoadInt32(&s.revalidated))
+
+	// Stale, revalidated with the ETag and not modified
+	now = now.Add(pacCacheTTL)
+	assertFetchedPAC(a, f, pacUrl, "PROXY v1:8080; DIRECT")
+	a.Equal(int32(1), atomic.LoadInt32(&s.downloads))
+	a.Equal(int32(1), atomic.LoadInt32(&s.revalidated))
+
+	// Stale, and modified
+	s.script.Store(strings.Replace(testFetcherPACScript, "%s", "v2", 1))
+	s.etag.Store("\"v2\"")
+	now = now.Add(pacCacheTTL)
+	assertFetchedPAC(a, f, pacUrl, "PROXY v2:8080; DIRECT")
+	a.Equal(int32(2), atomic.LoadInt32(&s.downloads))
+
+	// Stale, and the server fails: the cached script is kept
+	atomic.StoreInt32(&s.status, http.StatusInternalServerError)
+	now = now.Add(pacCacheTTL)
+	assertFetchedPAC(a, f, pacUrl, "PROXY v2:8080; DIRECT")
+}
+
+func TestPACFetcher_Fetch_timeouts(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(strings.Replace(testFetcherPACScript, "%s", "v1", 1))
+	defer s.Close()
+	f := newPACFetcher()
+	pacUrl := s.URL + "/wpad.dat"
+	timeouts := testPACTimeouts
+	timeouts.resolve = 100
+
+	// Scripts fetched with other timeouts are compiled apart, with their own resolve timeout
+	first, err := f.fetch(context.Background(), pacUrl, testPACTimeouts, log.Default())
+	a.NoError(err)
+	second, err := f.fetch(context.Background(), pacUrl, timeouts, log.Default())
+	if !a.NoError(err) {
+		return
+	}
+	a.NotSame(first, second)
+	a.Equal(time.Duration(defaultResolveTimeout)*time.Millisecond, first.resolveTimeout)
+	a.Equal(100*time.Millisecond, second.resolveTimeout)
+	a.Equal(int32(2), atomic.LoadInt32(&s.downloads))
+}
+
+func TestPACFetcher_Fetch_evicted(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(strings.Replace(testFetcherPACScript, "%s", "v1", 1))
+	defer s.Close()
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	f := newPACFetcher()
+	f.now = func() time.Time { return now }
+
+	for i := 0; i < maxPACCacheEntries+1; i++ {
+		now = now.Add(time.Second)
+		assertFetchedPAC(a, f, fmt.Sprintf("%s/%d.dat", s.URL, i), "PROXY v1:8080; DIRECT")
+		// The first script is kept in use, the second is the least recently used
+		assertFetchedPAC(a, f, s.URL+"/0.dat", "PROXY v1:8080; DIRECT")
+	}
+	a.Len(f.cache, maxPACCacheEntries)
+	a.Equal(int32(maxPACCacheEntries+1), atomic.LoadInt32(&s.downloads))
+	assertFetchedPAC(a, f, s.URL+"/0.dat", "PROXY v1:8080; DIRECT")
+	a.Equal(int32(maxPACCacheEntries+1), atomic.LoadInt32(&s.downloads))
+	assertFetchedPAC(a, f, s.URL+"/1.dat", "PROXY v1:8080; DIRECT")
+	a.Equal(int32(maxPACCacheEntries+2), atomic.LoadInt32(&s.downloads))
+}
+
+func TestPACFetcher_Fetch_httpError(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(testFetcherPACScript)
+	defer s.Close()
+	atomic.StoreInt32(&s.status, http.StatusNotFound)
+	_, err := newPACFetcher().fetch(context.Background(), s.URL+"/wpad.dat", testPACTimeouts, log.Default())
+	if a.Error(err) {
+		a.Contains(err.Error(), "404 Not Found")
+	}
+}
+
+func TestPACFetcher_Fetch_httpTooLarge(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(testFetcherPACScript + strings.Repeat(" ", maxPACFileSize))
+	defer s.Close()
+	_, err := newPACFetcher().fetch(context.Background(), s.URL+"/wpad.dat", testPACTimeouts, log.Default())
+	if a.Error(err) {
+		a.Contains(err.Error(), "too large")
+	}
+}
+
+func TestPACFetcher_Fetch_receiveTimeout(t *testing.T) {
+	a := assert.New(t)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte(testFetcherPACScript))
+	}))
+	defer s.Close()
+	timeouts := testPACTimeouts
+	timeouts.receive = 50
+	_, err := newPACFetcher().fetch(context.Background(), s.URL+"/wpad.dat", timeouts, log.Default())
+	if a.Error(err) {
+		a.Contains(err.Error(), "timeout")
+	}
+}
+
+func TestPACFetcher_Fetch_file(t *testing.T) {
+	a := assert.New(t)
+	tmpDir, err := os.MkdirTemp("", "TestPACFetcher")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	f := filepath.Join(tmpDir, "proxy.pac")
+	if !a.NoError(os.WriteFile(f, []byte(strings.Replace(testFetcherPACScript, "%s", "v1", 1)), 0644)) {
+		return
+	}
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	fetcher := newPACFetcher()
+	fetcher.now = func() time.Time { return now }
+	pacUrl := (&url.URL{Scheme: "file", Path: filepath.ToSlash(f)}).String()
+	assertFetchedPAC(a, fetcher, pacUrl, "PROXY v1:8080; DIRECT")
+
+	// Modified, but still fresh
+	modified := strings.Replace(testFetcherPACScript, "%s", "v2-longer", 1)
+	if !a.NoError(os.WriteFile(f, []byte(modified), 0644)) {
+		return
+	}
+	assertFetchedPAC(a, fetcher, pacUrl, "PROXY v1:8080; DIRECT")
+
+	// Stale, and modified
+	now = now.Add(pacCacheTTL)
+	assertFetchedPAC(a, fetcher, pacUrl, "PROXY v2-longer:8080; DIRECT")
+
+	// Stale, and removed: the cached script is kept
+	os.Remove(f)
+	now = now.Add(pacCacheTTL)
+	assertFetchedPAC(a, fetcher, pacUrl, "PROXY v2-longer:8080; DIRECT")
+}
+
+var dataPACFetcherFetchInvalid = []struct {
+	content string
+	expect  string
+}{
+	{"function notAPAC() {}", "does not define FindProxyForURL"},
+	{"function FindProxyForURL(url, host) {", "SyntaxError"},
+	{testFetcherPACScript + strings.Repeat(" ", maxPACFileSize), "too large"},
+}
+
+func TestPACFetcher_Fetch_fileInvalid(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "TestPACFetcher")
+	defer os.RemoveAll(tmpDir)
+	for _, tt := range dataPACFetcherFetchInvalid {
+		t.Run(tt.expect, func(t *testing.T) {
+			a := assert.New(t)
+			if !a.NoError(err) {
+				return
+			}
+			f := filepath.Join(tmpDir, "proxy.pac")
+			if !a.NoError(os.WriteFile(f, []byte(tt.content), 0644)) {
+				return
+			}
+			_, err := newPACFetcher().fetch(context.Background(), "file://"+filepath.ToSlash(f), testPACTimeouts, log.Default())
+			if a.Error(err) {
+				a.Contains(err.Error(), tt.expect)
+			}
+		})
+	}
+}
+
+func TestPACFetcher_Fetch_unsupportedScheme(t *testing.T) {
+	a := assert.New(t)
+	_, err := newPACFetcher().fetch(context.Background(), "ftp://wpad/wpad.dat", testPACTimeouts, log.Default())
+	if a.Error(err) {
+		a.Contains(err.Error(), "unsupported PAC URL scheme")
+	}
+}
+
+func TestPACFetcher_CompileScript(t *testing.T) {
+	a := assert.New(t)
+	f := newPACFetcher()
+	script := strings.Replace(testFetcherPACScript, "%s", "v1", 1)
+	timeouts := testPACTimeouts
+	timeouts.resolve = 100
+
+	// Compiled once per content and timeouts
+	first, err := f.compileScript(script, testPACTimeouts)
+	if !a.NoError(err) {
+		return
+	}
+	again, err := f.compileScript(script, testPACTimeouts)
+	a.NoError(err)
+	a.Same(first, again)
+	other, err := f.compileScript(script, timeouts)
+	a.NoError(err)
+	a.NotSame(first, other)
+	changed, err := f.compileScript(strings.Replace(testFetcherPACScript, "%s", "v2", 1), testPACTimeouts)
+	a.NoError(err)
+	a.NotSame(first, changed)
+	a.Len(f.cache, 3)
+
+	// Failures are not cached
+	_, err = f.compileScript("function FindProxyForURL(url, host) {", testPACTimeouts)
+	a.Error(err)
+	_, err = f.compileScript(strings.Repeat(" ", maxPACFileSize+1), testPACTimeouts)
+	a.EqualError(err, "PAC script too large")
+	_, err = f.compileScript("function FindProxyForURL(url, host) {", testPACTimeouts)
+	a.Error(err)
+}
+
+func TestProvider_ReadPACProxy(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(`function FindProxyForURL(url, host) {
+		if (dnsDomainIs(host, ".rapid7.com")) {
+			return "PROXY proxy.rapid7.com:3128; SOCKS5 socks.rapid7.com; DIRECT";
+		}
+		return "DIRECT";
+	}`)
+	defer s.Close()
+	p := newTestProvider("")
+	p.pacFetcher = newPACFetcher()
+	pacUrl := s.URL + "/wpad.dat"
+	src := "PAC"
+	a.Equal([]Proxy{
+		newTestProxy("http", "proxy.rapid7.com", 3128, nil, src),
+		newTestProxy("socks5", "socks.rapid7.com", 1080, nil, src),
+		NewDirectProxy(src),
+	}, p.readPACProxy(context.Background(), src, pacUrl, ParseTargetURL("https://test.endpoint.rapid7.com", ""), nil))
+	a.Equal([]Proxy{NewDirectProxy(src)}, p.readPACProxy(context.Background(), src, pacUrl, ParseTargetURL("https://example.com", ""), nil))
+	a.Equal(int32(1), atomic.LoadInt32(&s.downloads))
+	a.Nil(p.readPACProxy(context.Background(), src, s.URL+"/missing\x00", ParseTargetURL("https://example.com", ""), nil))
+}
+
+func assertFetchedPAC(a *assert.Assertions, f *pacFetcher, pacUrl string, expect string) {
+	script, err := f.fetch(context.Background(), pacUrl, testPACTimeouts, log.Default())
+	if !a.NoError(err) {
+		return
+	}
+	result, err := script.FindProxyForURL("https://rapid7.com", "rapid7.com")
+	a.NoError(err)
+	a.Equal(expect, result)
+}
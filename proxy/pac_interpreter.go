@@ -0,0 +1,2474 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+This file contains a tree walking interpreter for programs produced by jsParse.
+Strings are treated as byte sequences rather than UTF-16, which is sufficient for the host names and URLs PAC
+scripts operate on.
+*/
+
+const (
+	// Maximum number of statements and calls a single evaluation may execute
+	jsMaxSteps = 10000000
+	// Maximum depth of nested function calls
+	jsMaxCallDepth = 512
+	// Maximum number of bytes of strings, array elements and object properties a single evaluation may allocate
+	jsMaxAllocation = 8 << 20
+	// The bytes accounted for each array element and object property
+	jsElementSize = 16
+	// The number of steps between checks of whether the evaluation has been abandoned
+	jsContextCheckSteps = 1024
+)
+
+var errJSStepLimit = errors.New("script exceeded the maximum number of execution steps")
+
+var errJSCallDepth = errors.New("script exceeded the maximum call depth")
+
+type jsValue interface{}
+
+type jsUndefinedType struct{}
+
+var jsUndefined jsValue = jsUndefinedType{}
+
+type jsObject struct {
+	props map[string]jsValue
+	keys  []string
+	// "Object" or "Error"
+	class string
+}
+
+type jsArray struct {
+	elements []jsValue
+}
+
+type jsFunction struct {
+	decl  *jsFunctionDecl
+	scope *jsScope
+}
+
+type jsNativeFunction struct {
+	name string
+	fn   func(this jsValue, args []jsValue) (jsValue, error)
+	// Invoked for "new", nil if the function is not a constructor
+	construct func(args []jsValue) (jsValue, error)
+}
+
+type jsRegExp struct {
+	source    string
+	flags     string
+	re        *regexp.Regexp
+	lastIndex int
+}
+
+type jsDate struct {
+	t time.Time
+}
+
+func newJSObject() *jsObject {
+	return &jsObject{props: map[string]jsValue{}, class: "Object"}
+}
+
+func (o *jsObject) get(key string) (jsValue, bool) {
+	v, ok := o.props[key]
+	return v, ok
+}
+
+func (o *jsObject) set(key string, v jsValue) {
+	if _, ok := o.props[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.props[key] = v
+}
+
+func (o *jsObject) delete(key string) {
+	if _, ok := o.props[key]; !ok {
+		return
+	}
+	delete(o.props, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+/*
+A value thrown by the script, either through a throw statement or a runtime error (i.e. TypeError).
+*/
+type jsThrow struct {
+	value jsValue
+}
+
+func (e *jsThrow) Error() string {
+	return "uncaught exception: " + jsToString(e.value)
+}
+
+type jsScope struct {
+	vars   map[string]jsValue
+	parent *jsScope
+}
+
+func newJSScope(parent *jsScope) *jsScope {
+	return &jsScope{vars: map[string]jsValue{}, parent: parent}
+}
+
+func (s *jsScope) lookup(name string) (*jsScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+type jsCompletion int
+
+const (
+	jsCompletionNormal jsCompletion = iota
+	jsCompletionReturn
+	jsCompletionBreak
+	jsCompletionContinue
+)
+
+type jsInterpreter struct {
+	ctx      context.Context
+	builtins *jsScope
+	global   *jsScope
+	steps    int
+	depth    int
+	// Bytes allocated by the script, see alloc
+	allocated int
+	now       func() time.Time
+}
+
+/*
+Create a new interpreter with the standard built-ins installed.
+Params:
+	ctx: Bounds the evaluation. Once it is done, the script is abandoned with its error.
+	now: The clock used by Date.
+*/
+func newJSInterpreter(ctx context.Context, now func() time.Time) *jsInterpreter {
+	it := &jsInterpreter{ctx: ctx, now: now}
+	it.builtins = newJSScope(nil)
+	it.global = newJSScope(it.builtins)
+	it.installBuiltins()
+	return it
+}
+
+/*
+Define a native function in the built-in scope.
+*/
+func (it *jsInterpreter) define(name string, fn func(args []jsValue) (jsValue, error)) {
+	it.builtins.vars[name] = &jsNativeFunction{name: name, fn: func(this jsValue, args []jsValue) (jsValue, error) {
+		return fn(args)
+	}}
+}
+
+/*
+Run the given program in the global scope.
+*/
+func (it *jsInterpreter) run(prog *jsProgram) error {
+	it.global.vars["this"] = jsUndefined
+	it.hoist(it.global, prog.vars, prog.funcs)
+	ctl, _, err := it.execList(prog.body, it.global)
+	if err != nil {
+		return err
+	}
+	if ctl != jsCompletionNormal {
+		return it.syntaxError("illegal return, break or continue")
+	}
+	return nil
+}
+
+/*
+Call the global function with the given name.
+Returns:
+	jsValue, nil: The function's return value
+	nil, error: The function is not defined, or threw an exception
+*/
+func (it *jsInterpreter) callGlobal(name string, args ...jsValue) (jsValue, error) {
+	fn, ok := it.global.vars[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not defined", name)
+	}
+	return it.call(fn, jsUndefined, args)
+}
+
+func (it *jsInterpreter) hoist(scope *jsScope, vars []string, funcs []*jsFunctionDecl) {
+	for _, name := range vars {
+		if _, ok := scope.vars[name]; !ok {
+			scope.vars[name] = jsUndefined
+		}
+	}
+	for _, decl := range funcs {
+		scope.vars[decl.name] = &jsFunction{decl, scope}
+	}
+}
+
+func (it *jsInterpreter) step() error {
+	it.steps++
+	if it.steps > jsMaxSteps {
+		return errJSStepLimit
+	}
+	if it.steps%jsContextCheckSteps == 0 {
+		return it.ctx.Err()
+	}
+	return nil
+}
+
+/*
+Account for n bytes about to be allocated by the script.
+Returns:
+	nil: The allocation is within jsMaxAllocation.
+	error: A RangeError, the evaluation has exceeded jsMaxAllocation.
+*/
+func (it *jsInterpreter) alloc(n int) error {
+	if n < 0 || n > jsMaxAllocation-it.allocated {
+		return it.throwf("RangeError", "script exceeded the maximum memory allocation")
+	}
+	it.allocated += n
+	return nil
+}
+
+/*
+Account for the string s, returning it.
+*/
+func (it *jsInterpreter) allocString(s string) (jsValue, error) {
+	if err := it.alloc(len(s)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+Account for n additional elements of an array.
+*/
+func (it *jsInterpreter) allocElements(n int) error {
+	if n > jsMaxAllocation/jsElementSize {
+		return it.alloc(-1)
+	}
+	return it.alloc(n * jsElementSize)
+}
+
+/*
+Returns the number of array elements the script may still allocate, plus one so that exceeding it is detected.
+*/
+func (it *jsInterpreter) maxElements() int {
+	return (jsMaxAllocation-it.allocated)/jsElementSize + 1
+}
+
+func (it *jsInterpreter) newError(name string, msg string) *jsObject {
+	o := newJSObject()
+	o.class = "Error"
+	o.set("name", name)
+	o.set("message", msg)
+	return o
+}
+
+func (it *jsInterpreter) throwf(name string, format string, args ...interface{}) error {
+	return &jsThrow{it.newError(name, fmt.Sprintf(format, args...))}
+}
+
+func (it *jsInterpreter) typeError(format string, args ...interface{}) error {
+	return it.throwf("TypeError", format, args...)
+}
+
+func (it *jsInterpreter) syntaxError(format string, args ...interface{}) error {
+	return it.throwf("SyntaxError", format, args...)
+}
+
+func (it *jsInterpreter) execList(body []jsNode, scope *jsScope) (jsCompletion, jsValue, error) {
+	for _, stmt := range body {
+		ctl, v, err := it.exec(stmt, scope)
+		if err != nil || ctl != jsCompletionNormal {
+			return ctl, v, err
+		}
+	}
+	return jsCompletionNormal, nil, nil
+}
+
+func (it *jsInterpreter) exec(node jsNode, scope *jsScope) (jsCompletion, jsValue, error) {
+	if err := it.step(); err != nil {
+		return jsCompletionNormal, nil, err
+	}
+	switch n := node.(type) {
+	case *jsEmpty:
+		return jsCompletionNormal, nil, nil
+	case *jsExprStmt:
+		_, err := it.eval(n.expr, scope)
+		return jsCompletionNormal, nil, err
+	case *jsVarDecl:
+		for i, name := range n.names {
+			if n.inits[i] == nil {
+				continue
+			}
+			v, err := it.eval(n.inits[i], scope)
+			if err != nil {
+				return jsCompletionNormal, nil, err
+			}
+			it.assignIdentifier(scope, name, v)
+		}
+		return jsCompletionNormal, nil, nil
+	case *jsBlock:
+		return it.execList(n.body, scope)
+	case *jsIf:
+		test, err := it.eval(n.test, scope)
+		if err != nil {
+			return jsCompletionNormal, nil, err
+		}
+		if jsToBoolean(test) {
+			return it.exec(n.consequent, scope)
+		} else if n.alternate != nil {
+			return it.exec(n.alternate, scope)
+		}
+		return jsCompletionNormal, nil, nil
+	case *jsReturn:
+		if n.value == nil {
+			return jsCompletionReturn, jsUndefined, nil
+		}
+		v, err := it.eval(n.value, scope)
+		return jsCompletionReturn, v, err
+	case *jsBreak:
+		return jsCompletionBreak, nil, nil
+	case *jsContinue:
+		return jsCompletionContinue, nil, nil
+	case *jsFor:
+		if n.init != nil {
+			if _, _, err := it.exec(n.init, scope); err != nil {
+				return jsCompletionNormal, nil, err
+			}
+		}
+		for {
+			if n.test != nil {
+				test, err := it.eval(n.test, scope)
+				if err != nil {
+					return jsCompletionNormal, nil, err
+				}
+				if !jsToBoolean(test) {
+					break
+				}
+			}
+			ctl, v, err := it.exec(n.body, scope)
+			if err != nil || ctl == jsCompletionReturn {
+				return ctl, v, err
+			} else if ctl == jsCompletionBreak {
+				break
+			}
+			if n.update != nil {
+				if _, err := it.eval(n.update, scope); err != nil {
+					return jsCompletionNormal, nil, err
+				}
+			}
+		}
+		return jsCompletionNormal, nil, nil
+	case *jsForIn:
+		object, err := it.eval(n.object, scope)
+		if err != nil {
+			return jsCompletionNormal, nil, err
+		}
+		for _, key := range jsEnumerableKeys(object) {
+			it.assignIdentifier(scope, n.name, key)
+			ctl, v, err := it.exec(n.body, scope)
+			if err != nil || ctl == jsCompletionReturn {
+				return ctl, v, err
+			} else if ctl == jsCompletionBreak {
+				break
+			}
+		}
+		return jsCompletionNormal, nil, nil
+	case *jsWhile:
+		for {
+			test, err := it.eval(n.test, scope)
+			if err != nil {
+				return jsCompletionNormal, nil, err
+			}
+			if !jsToBoolean(test) {
+				break
+			}
+			ctl, v, err := it.exec(n.body, scope)
+			if err != nil || ctl == jsCompletionReturn {
+				return ctl, v, err
+			} else if ctl == jsCompletionBreak {
+				break
+			}
+		}
+		return jsCompletionNormal, nil, nil
+	case *jsDoWhile:
+		for {
+			ctl, v, err := it.exec(n.body, scope)
+			if err != nil || ctl == jsCompletionReturn {
+				return ctl, v, err
+			} else if ctl == jsCompletionBreak {
+				break
+			}
+			test, err := it.eval(n.test, scope)
+			if err != nil {
+				return jsCompletionNormal, nil, err
+			}
+			if !jsToBoolean(test) {
+				break
+			}
+		}
+		return jsCompletionNormal, nil, nil
+	case *jsSwitch:
+		return it.execSwitch(n, scope)
+	case *jsThrowStmt:
+		v, err := it.eval(n.value, scope)
+		if err != nil {
+			return jsCompletionNormal, nil, err
+		}
+		return jsCompletionNormal, nil, &jsThrow{v}
+	case *jsTry:
+		return it.execTry(n, scope)
+	}
+	return jsCompletionNormal, nil, fmt.Errorf("unsupported statement %T", node)
+}
+
+func (it *jsInterpreter) execSwitch(n *jsSwitch, scope *jsScope) (jsCompletion, jsValue, error) {
+	discriminant, err := it.eval(n.discriminant, scope)
+	if err != nil {
+		return jsCompletionNormal, nil, err
+	}
+	start := -1
+	for i, test := range n.tests {
+		if test == nil {
+			continue
+		}
+		v, err := it.eval(test, scope)
+		if err != nil {
+			return jsCompletionNormal, nil, err
+		}
+		if jsStrictEquals(discriminant, v) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		for i, test := range n.tests {
+			if test == nil {
+				start = i
+				break
+			}
+		}
+	}
+	if start < 0 {
+		return jsCompletionNormal, nil, nil
+	}
+	for _, body := range n.bodies[start:] {
+		ctl, v, err := it.execList(body, scope)
+		if err != nil || ctl == jsCompletionReturn || ctl == jsCompletionContinue {
+			return ctl, v, err
+		} else if ctl == jsCompletionBreak {
+			break
+		}
+	}
+	return jsCompletionNormal, nil, nil
+}
+
+func (it *jsInterpreter) execTry(n *jsTry, scope *jsScope) (jsCompletion, jsValue, error) {
+	ctl, v, err := it.execList(n.block, scope)
+	if thrown, ok := err.(*jsThrow); ok && n.handler != nil {
+		it.assignIdentifier(scope, n.param, thrown.value)
+		ctl, v, err = it.execList(n.handler, scope)
+	}
+	if n.finalizer != nil {
+		if _, isThrow := err.(*jsThrow); err != nil && !isThrow {
+			// Resource limits cannot be intercepted by the script
+			return ctl, v, err
+		}
+		fCtl, fV, fErr := it.execList(n.finalizer, scope)
+		if fErr != nil || fCtl != jsCompletionNormal {
+			return fCtl, fV, fErr
+		}
+	}
+	return ctl, v, err
+}
+
+// A reference to an assignable location
+type jsReference struct {
+	scope  *jsScope
+	name   string
+	object jsValue
+	key    string
+}
+
+func (it *jsInterpreter) reference(node jsNode, scope *jsScope) (*jsReference, error) {
+	switch n := node.(type) {
+	case *jsIdentifier:
+		return &jsReference{scope: scope, name: n.name}, nil
+	case *jsMember:
+		object, err := it.eval(n.object, scope)
+		if err != nil {
+			return nil, err
+		}
+		key, err := it.memberKey(n, scope)
+		if err != nil {
+			return nil, err
+		}
+		return &jsReference{object: object, key: key}, nil
+	}
+	return nil, it.syntaxError("invalid assignment target")
+}
+
+func (it *jsInterpreter) getReference(ref *jsReference) (jsValue, error) {
+	if ref.scope != nil {
+		return it.lookupIdentifier(ref.scope, ref.name)
+	}
+	return it.getMember(ref.object, ref.key)
+}
+
+func (it *jsInterpreter) setReference(ref *jsReference, v jsValue) error {
+	if ref.scope != nil {
+		it.assignIdentifier(ref.scope, ref.name, v)
+		return nil
+	}
+	return it.setMember(ref.object, ref.key, v)
+}
+
+func (it *jsInterpreter) lookupIdentifier(scope *jsScope, name string) (jsValue, error) {
+	if s, ok := scope.lookup(name); ok {
+		return s.vars[name], nil
+	}
+	return nil, it.throwf("ReferenceError", "%s is not defined", name)
+}
+
+func (it *jsInterpreter) assignIdentifier(scope *jsScope, name string, v jsValue) {
+	if s, ok := scope.lookup(name); ok && s != it.builtins {
+		s.vars[name] = v
+		return
+	}
+	// Assignment to an undeclared variable creates a global
+	it.global.vars[name] = v
+}
+
+func (it *jsInterpreter) memberKey(n *jsMember, scope *jsScope) (string, error) {
+	if n.property == nil {
+		return n.name, nil
+	}
+	k, err := it.eval(n.property, scope)
+	if err != nil {
+		return "", err
+	}
+	return jsToString(k), nil
+}
+
+func (it *jsInterpreter) eval(node jsNode, scope *jsScope) (jsValue, error) {
+	switch n := node.(type) {
+	case *jsLiteral:
+		return n.value, nil
+	case *jsIdentifier:
+		return it.lookupIdentifier(scope, n.name)
+	case *jsArrayLiteral:
+		if err := it.allocElements(len(n.elements)); err != nil {
+			return nil, err
+		}
+		arr := &jsArray{elements: make([]jsValue, len(n.elements))}
+		for i, e := range n.elements {
+			if e == nil {
+				arr.elements[i] = jsUndefined
+				continue
+			}
+			v, err := it.eval(e, scope)
+			if err != nil {
+				return nil, err
+			}
+			arr.elements[i] = v
+		}
+		return arr, nil
+	case *jsObjectLiteral:
+		obj := newJSObject()
+		for i, key := range n.keys {
+			v, err := it.eval(n.values[i], scope)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key, v)
+		}
+		return obj, nil
+	case *jsFunctionLiteral:
+		return &jsFunction{n.decl, scope}, nil
+	case *jsRegExpLiteral:
+		return it.newRegExp(n.source, n.flags)
+	case *jsUnary:
+		return it.evalUnary(n, scope)
+	case *jsUpdate:
+		ref, err := it.reference(n.target, scope)
+		if err != nil {
+			return nil, err
+		}
+		old, err := it.getReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		oldNum := jsToNumber(old)
+		newNum := oldNum + 1
+		if n.op == "--" {
+			newNum = oldNum - 1
+		}
+		if err := it.setReference(ref, newNum); err != nil {
+			return nil, err
+		}
+		if n.prefix {
+			return newNum, nil
+		}
+		return oldNum, nil
+	case *jsBinary:
+		left, err := it.eval(n.left, scope)
+		if err != nil {
+			return nil, err
+		}
+		right, err := it.eval(n.right, scope)
+		if err != nil {
+			return nil, err
+		}
+		return it.binary(n.op, left, right)
+	case *jsLogical:
+		left, err := it.eval(n.left, scope)
+		if err != nil {
+			return nil, err
+		}
+		if jsToBoolean(left) == (n.op == "||") {
+			return left, nil
+		}
+		return it.eval(n.right, scope)
+	case *jsConditional:
+		test, err := it.eval(n.test, scope)
+		if err != nil {
+			return nil, err
+		}
+		if jsToBoolean(test) {
+			return it.eval(n.consequent, scope)
+		}
+		return it.eval(n.alternate, scope)
+	case *jsAssign:
+		ref, err := it.reference(n.target, scope)
+		if err != nil {
+			return nil, err
+		}
+		var v jsValue
+		if n.op == "=" {
+			if v, err = it.eval(n.value, scope); err != nil {
+				return nil, err
+			}
+		} else {
+			old, err := it.getReference(ref)
+			if err != nil {
+				return nil, err
+			}
+			right, err := it.eval(n.value, scope)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = it.binary(strings.TrimSuffix(n.op, "="), old, right); err != nil {
+				return nil, err
+			}
+		}
+		return v, it.setReference(ref, v)
+	case *jsMember:
+		object, err := it.eval(n.object, scope)
+		if err != nil {
+			return nil, err
+		}
+		key, err := it.memberKey(n, scope)
+		if err != nil {
+			return nil, err
+		}
+		return it.getMember(object, key)
+	case *jsCall:
+		var this jsValue = jsUndefined
+		var callee jsValue
+		var err error
+		if member, ok := n.callee.(*jsMember); ok {
+			if this, err = it.eval(member.object, scope); err != nil {
+				return nil, err
+			}
+			key, err := it.memberKey(member, scope)
+			if err != nil {
+				return nil, err
+			}
+			if callee, err = it.getMember(this, key); err != nil {
+				return nil, err
+			}
+		} else if callee, err = it.eval(n.callee, scope); err != nil {
+			return nil, err
+		}
+		args, err := it.evalArgs(n.args, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !jsIsCallable(callee) {
+			return nil, it.typeError("%s is not a function", jsDescribeNode(n.callee))
+		}
+		return it.call(callee, this, args)
+	case *jsNew:
+		callee, err := it.eval(n.callee, scope)
+		if err != nil {
+			return nil, err
+		}
+		args, err := it.evalArgs(n.args, scope)
+		if err != nil {
+			return nil, err
+		}
+		return it.construct(callee, args, jsDescribeNode(n.callee))
+	case *jsSequence:
+		var v jsValue = jsUndefined
+		for _, e := range n.exprs {
+			var err error
+			if v, err = it.eval(e, scope); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported expression %T", node)
+}
+
+func (it *jsInterpreter) evalArgs(nodes []jsNode, scope *jsScope) ([]jsValue, error) {
+	args := make([]jsValue, len(nodes))
+	for i, a := range nodes {
+		v, err := it.eval(a, scope)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+/*
+Describe the given expression for use in error messages.
+*/
+func jsDescribeNode(node jsNode) string {
+	switch n := node.(type) {
+	case *jsIdentifier:
+		return n.name
+	case *jsMember:
+		if n.property == nil {
+			return jsDescribeNode(n.object) + "." + n.name
+		}
+		return jsDescribeNode(n.object) + "[...]"
+	case *jsCall:
+		return jsDescribeNode(n.callee) + "(...)"
+	}
+	return "expression"
+}
+
+func (it *jsInterpreter) evalUnary(n *jsUnary, scope *jsScope) (jsValue, error) {
+	switch n.op {
+	case "typeof":
+		if id, ok := n.operand.(*jsIdentifier); ok {
+			if _, found := scope.lookup(id.name); !found {
+				return "undefined", nil
+			}
+		}
+	case "delete":
+		if member, ok := n.operand.(*jsMember); ok {
+			object, err := it.eval(member.object, scope)
+			if err != nil {
+				return nil, err
+			}
+			key, err := it.memberKey(member, scope)
+			if err != nil {
+				return nil, err
+			}
+			if o, ok := object.(*jsObject); ok {
+				o.delete(key)
+			}
+		}
+		return true, nil
+	}
+	v, err := it.eval(n.operand, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		return !jsToBoolean(v), nil
+	case "-":
+		return -jsToNumber(v), nil
+	case "+":
+		return jsToNumber(v), nil
+	case "~":
+		return float64(^jsToInt32(v)), nil
+	case "void":
+		return jsUndefined, nil
+	case "typeof":
+		return jsTypeOf(v), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", n.op)
+}
+
+func (it *jsInterpreter) binary(op string, left jsValue, right jsValue) (jsValue, error) {
+	switch op {
+	case "+":
+		l := jsToPrimitive(left, false)
+		r := jsToPrimitive(right, false)
+		_, lString := l.(string)
+		_, rString := r.(string)
+		if lString || rString {
+			ls, rs := jsToString(l), jsToString(r)
+			if err := it.alloc(len(ls) + len(rs)); err != nil {
+				return nil, err
+			}
+			return ls + rs, nil
+		}
+		return jsToNumber(l) + jsToNumber(r), nil
+	case "-":
+		return jsToNumber(left) - jsToNumber(right), nil
+	case "*":
+		return jsToNumber(left) * jsToNumber(right), nil
+	case "/":
+		return jsToNumber(left) / jsToNumber(right), nil
+	case "%":
+		return math.Mod(jsToNumber(left), jsToNumber(right)), nil
+	case "==":
+		return jsLooseEquals(left, right), nil
+	case "!=":
+		return !jsLooseEquals(left, right), nil
+	case "===":
+		return jsStrictEquals(left, right), nil
+	case "!==":
+		return !jsStrictEquals(left, right), nil
+	case "<":
+		less, ok := jsLess(left, right)
+		return ok && less, nil
+	case ">":
+		less, ok := jsLess(right, left)
+		return ok && less, nil
+	case "<=":
+		less, ok := jsLess(right, left)
+		return ok && !less, nil
+	case ">=":
+		less, ok := jsLess(left, right)
+		return ok && !less, nil
+	case "&":
+		return float64(jsToInt32(left) & jsToInt32(right)), nil
+	case "|":
+		return float64(jsToInt32(left) | jsToInt32(right)), nil
+	case "^":
+		return float64(jsToInt32(left) ^ jsToInt32(right)), nil
+	case "<<":
+		return float64(jsToInt32(left) << (uint32(jsToInt32(right)) & 31)), nil
+	case ">>":
+		return float64(jsToInt32(left) >> (uint32(jsToInt32(right)) & 31)), nil
+	case ">>>":
+		return float64(uint32(jsToInt32(left)) >> (uint32(jsToInt32(right)) & 31)), nil
+	case "in":
+		key := jsToString(left)
+		switch o := right.(type) {
+		case *jsObject:
+			_, ok := o.get(key)
+			return ok, nil
+		case *jsArray:
+			i, ok := jsArrayIndex(key)
+			return (ok && i < len(o.elements)) || key == "length", nil
+		}
+		return nil, it.typeError("cannot use 'in' operator to search for '%s' in %s", key, jsToString(right))
+	case "instanceof":
+		ctor, ok := right.(*jsNativeFunction)
+		if !ok {
+			if !jsIsCallable(right) {
+				return nil, it.typeError("right-hand side of 'instanceof' is not callable")
+			}
+			return false, nil
+		}
+		switch left.(type) {
+		case *jsArray:
+			return ctor.name == "Array" || ctor.name == "Object", nil
+		case *jsRegExp:
+			return ctor.name == "RegExp" || ctor.name == "Object", nil
+		case *jsDate:
+			return ctor.name == "Date" || ctor.name == "Object", nil
+		case *jsObject:
+			if left.(*jsObject).class == "Error" {
+				name, _ := left.(*jsObject).get("name")
+				return ctor.name == "Error" || ctor.name == name || ctor.name == "Object", nil
+			}
+			return ctor.name == "Object", nil
+		case *jsFunction, *jsNativeFunction:
+			return ctor.name == "Function" || ctor.name == "Object", nil
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
+
+func jsIsCallable(v jsValue) bool {
+	switch v.(type) {
+	case *jsFunction, *jsNativeFunction:
+		return true
+	}
+	return false
+}
+
+func (it *jsInterpreter) call(fn jsValue, this jsValue, args []jsValue) (jsValue, error) {
+	if err := it.step(); err != nil {
+		return nil, err
+	}
+	switch f := fn.(type) {
+	case *jsNativeFunction:
+		return f.fn(this, args)
+	case *jsFunction:
+		if it.depth >= jsMaxCallDepth {
+			return nil, errJSCallDepth
+		}
+		it.depth++
+		defer func() { it.depth-- }()
+		scope := newJSScope(f.scope)
+		if !f.decl.declaration && f.decl.name != "" {
+			// Named function expressions can refer to themselves
+			scope.vars[f.decl.name] = f
+		}
+		scope.vars["this"] = this
+		scope.vars["arguments"] = &jsArray{elements: append([]jsValue{}, args...)}
+		for i, param := range f.decl.params {
+			if i < len(args) {
+				scope.vars[param] = args[i]
+			} else {
+				scope.vars[param] = jsUndefined
+			}
+		}
+		it.hoist(scope, f.decl.vars, f.decl.funcs)
+		ctl, v, err := it.execList(f.decl.body, scope)
+		if err != nil {
+			return nil, err
+		}
+		if ctl == jsCompletionReturn {
+			return v, nil
+		}
+		return jsUndefined, nil
+	}
+	return nil, it.typeError("%s is not a function", jsToString(fn))
+}
+
+func (it *jsInterpreter) construct(callee jsValue, args []jsValue, name string) (jsValue, error) {
+	switch f := callee.(type) {
+	case *jsNativeFunction:
+		if f.construct == nil {
+			return nil, it.typeError("%s is not a constructor", name)
+		}
+		return f.construct(args)
+	case *jsFunction:
+		obj := newJSObject()
+		v, err := it.call(f, obj, args)
+		if err != nil {
+			return nil, err
+		}
+		switch v.(type) {
+		case *jsObject, *jsArray, *jsRegExp, *jsDate, *jsFunction, *jsNativeFunction:
+			return v, nil
+		}
+		return obj, nil
+	}
+	return nil, it.typeError("%s is not a constructor", name)
+}
+
+func (it *jsInterpreter) native(name string, fn func(this jsValue, args []jsValue) (jsValue, error)) *jsNativeFunction {
+	return &jsNativeFunction{name: name, fn: fn}
+}
+
+func (it *jsInterpreter) getMember(object jsValue, key string) (jsValue, error) {
+	switch o := object.(type) {
+	case jsUndefinedType, nil:
+		return nil, it.typeError("cannot read property '%s' of %s", key, jsToString(object))
+	case string:
+		if key == "length" {
+			return float64(len(o)), nil
+		}
+		if i, ok := jsArrayIndex(key); ok {
+			if i < len(o) {
+				return o[i : i+1], nil
+			}
+			return jsUndefined, nil
+		}
+		if m := it.stringMethod(o, key); m != nil {
+			return m, nil
+		}
+	case float64:
+		if m := it.numberMethod(o, key); m != nil {
+			return m, nil
+		}
+	case bool:
+		if key == "toString" || key == "valueOf" {
+			return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+				if key == "valueOf" {
+					return o, nil
+				}
+				return jsToString(o), nil
+			}), nil
+		}
+	case *jsArray:
+		if key == "length" {
+			return float64(len(o.elements)), nil
+		}
+		if i, ok := jsArrayIndex(key); ok {
+			if i < len(o.elements) {
+				return o.elements[i], nil
+			}
+			return jsUndefined, nil
+		}
+		if m := it.arrayMethod(o, key); m != nil {
+			return m, nil
+		}
+	case *jsObject:
+		if v, ok := o.get(key); ok {
+			return v, nil
+		}
+		if m := it.objectMethod(o, key); m != nil {
+			return m, nil
+		}
+	case *jsRegExp:
+		if v := it.regExpMember(o, key); v != nil {
+			return v, nil
+		}
+	case *jsDate:
+		if m := it.dateMethod(o, key); m != nil {
+			return m, nil
+		}
+	case *jsFunction, *jsNativeFunction:
+		if m := it.functionMethod(o, key); m != nil {
+			return m, nil
+		}
+	}
+	return jsUndefined, nil
+}
+
+func (it *jsInterpreter) setMember(object jsValue, key string, v jsValue) error {
+	switch o := object.(type) {
+	case jsUndefinedType, nil:
+		return it.typeError("cannot set property '%s' of %s", key, jsToString(object))
+	case *jsObject:
+		if _, ok := o.props[key]; !ok {
+			if err := it.alloc(len(key) + jsElementSize); err != nil {
+				return err
+			}
+		}
+		o.set(key, v)
+	case *jsArray:
+		if key == "length" {
+			n := jsToNumber(v)
+			if n < 0 || n != math.Trunc(n) || n > jsMaxSteps {
+				return it.throwf("RangeError", "invalid array length")
+			}
+			if grow := int(n) - len(o.elements); grow > 0 {
+				if err := it.allocElements(grow); err != nil {
+					return err
+				}
+			}
+			o.resize(int(n))
+		} else if i, ok := jsArrayIndex(key); ok {
+			if i >= len(o.elements) {
+				if i >= len(o.elements)+jsMaxSteps {
+					return it.throwf("RangeError", "invalid array index")
+				}
+				if err := it.allocElements(i + 1 - len(o.elements)); err != nil {
+					return err
+				}
+				o.resize(i + 1)
+			}
+			o.elements[i] = v
+		}
+	case *jsRegExp:
+		if key == "lastIndex" {
+			o.lastIndex = int(jsToInteger(v))
+		}
+	}
+	// Assignments to properties of primitives are silently ignored
+	return nil
+}
+
+func (a *jsArray) resize(n int) {
+	for len(a.elements) < n {
+		a.elements = append(a.elements, jsUndefined)
+	}
+	a.elements = a.elements[:n]
+}
+
+/*
+Parse the given property key as an array index.
+*/
+func jsArrayIndex(key string) (int, bool) {
+	if key == "" || (len(key) > 1 && key[0] == '0') {
+		return 0, false
+	}
+	for i := 0; i < len(key); i++ {
+		if !isDigit(key[i]) {
+			return 0, false
+		}
+	}
+	i, err := strconv.Atoi(key)
+	return i, err == nil
+}
+
+func jsEnumerableKeys(v jsValue) []jsValue {
+	var keys []jsValue
+	switch o := v.(type) {
+	case *jsObject:
+		for _, k := range o.keys {
+			keys = append(keys, k)
+		}
+	case *jsArray:
+		for i := range o.elements {
+			keys = append(keys, strconv.Itoa(i))
+		}
+	case string:
+		for i := range o {
+			keys = append(keys, strconv.Itoa(i))
+		}
+	}
+	return keys
+}
+
+// Conversions
+
+func jsTypeOf(v jsValue) string {
+	switch v.(type) {
+	case jsUndefinedType:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *jsFunction, *jsNativeFunction:
+		return "function"
+	}
+	return "object"
+}
+
+func jsToBoolean(v jsValue) bool {
+	switch x := v.(type) {
+	case jsUndefinedType, nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0 && !math.IsNaN(x)
+	case string:
+		return x != ""
+	}
+	return true
+}
+
+/*
+Convert the given value to a primitive. Objects are converted to strings, except for dates when a number is preferred.
+*/
+func jsToPrimitive(v jsValue, preferNumber bool) jsValue {
+	switch x := v.(type) {
+	case *jsDate:
+		if preferNumber {
+			return float64(x.t.UnixMilli())
+		}
+		return jsToString(x)
+	case *jsObject, *jsArray, *jsRegExp, *jsFunction, *jsNativeFunction:
+		return jsToString(x)
+	}
+	return v
+}
+
+func jsToNumber(v jsValue) float64 {
+	switch x := v.(type) {
+	case jsUndefinedType:
+		return math.NaN()
+	case nil:
+		return 0
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	case float64:
+		return x
+	case string:
+		return jsStringToNumber(x)
+	}
+	return jsToNumber(jsToPrimitive(v, true))
+}
+
+func jsStringToNumber(s string) float64 {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return 0
+	case "Infinity", "+Infinity":
+		return math.Inf(1)
+	case "-Infinity":
+		return math.Inf(-1)
+	}
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isDigit(c) && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return math.NaN()
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return n
+}
+
+func jsToInteger(v jsValue) float64 {
+	n := jsToNumber(v)
+	if math.IsNaN(n) {
+		return 0
+	}
+	if math.IsInf(n, 0) {
+		return n
+	}
+	return math.Trunc(n)
+}
+
+func jsToInt32(v jsValue) int32 {
+	n := jsToNumber(v)
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	n = math.Mod(math.Trunc(n), 4294967296)
+	if n < 0 {
+		n += 4294967296
+	}
+	return int32(uint32(n))
+}
+
+func jsNumberToString(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "Infinity"
+	case math.IsInf(n, -1):
+		return "-Infinity"
+	case n == 0:
+		return "0"
+	}
+	abs := math.Abs(n)
+	if abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	s := strconv.FormatFloat(n, 'e', -1, 64)
+	// Go pads the exponent to two digits (1e-07), JavaScript does not (1e-7)
+	mantissa, exponent, _ := strings.Cut(s, "e")
+	sign := exponent[0]
+	exponent = strings.TrimLeft(exponent[1:], "0")
+	return mantissa + "e" + string(sign) + exponent
+}
+
+func jsToString(v jsValue) string {
+	switch x := v.(type) {
+	case jsUndefinedType:
+		return "undefined"
+	case nil:
+		return "null"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return jsNumberToString(x)
+	case string:
+		return x
+	case *jsArray:
+		return jsJoin(x, ",")
+	case *jsObject:
+		if x.class == "Error" {
+			name, _ := x.get("name")
+			msg, _ := x.get("message")
+			if m := jsToString(msg); m != "" {
+				return jsToString(name) + ": " + m
+			}
+			return jsToString(name)
+		}
+		return "[object Object]"
+	case *jsFunction:
+		return "function " + x.decl.name + "() { [code] }"
+	case *jsNativeFunction:
+		return "function " + x.name + "() { [native code] }"
+	case *jsRegExp:
+		return "/" + x.source + "/" + x.flags
+	case *jsDate:
+		return x.t.Format("Mon Jan 02 2006 15:04:05 GMT-0700 (MST)")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+/*
+Join the elements of a, as Array.prototype.join does. Arrays nested within themselves are joined as empty strings.
+The result is truncated once it exceeds jsMaxAllocation bytes, which the script may not allocate.
+*/
+func jsJoin(a *jsArray, sep string) string {
+	var b strings.Builder
+	jsJoinTo(&b, a, sep, map[*jsArray]bool{})
+	return b.String()
+}
+
+func jsJoinTo(b *strings.Builder, a *jsArray, sep string, joining map[*jsArray]bool) {
+	if joining[a] {
+		return
+	}
+	joining[a] = true
+	defer delete(joining, a)
+	for i, e := range a.elements {
+		if b.Len() > jsMaxAllocation {
+			return
+		}
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		switch x := e.(type) {
+		case jsUndefinedType, nil:
+		case *jsArray:
+			jsJoinTo(b, x, ",", joining)
+		default:
+			b.WriteString(jsToString(e))
+		}
+	}
+}
+
+func jsStrictEquals(a jsValue, b jsValue) bool {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	case *jsFunction, *jsNativeFunction, *jsObject, *jsArray, *jsRegExp, *jsDate:
+		return a == b
+	}
+	return a == b
+}
+
+func jsLooseEquals(a jsValue, b jsValue) bool {
+	if jsTypeOf(a) == jsTypeOf(b) && !(a == nil) == !(b == nil) {
+		return jsStrictEquals(a, b)
+	}
+	aNullish := a == nil || a == jsUndefined
+	bNullish := b == nil || b == jsUndefined
+	if aNullish || bNullish {
+		return aNullish && bNullish
+	}
+	switch a.(type) {
+	case bool:
+		return jsLooseEquals(jsToNumber(a), b)
+	case *jsObject, *jsArray, *jsRegExp, *jsDate, *jsFunction, *jsNativeFunction:
+		return jsLooseEquals(jsToPrimitive(a, false), b)
+	}
+	switch b.(type) {
+	case bool:
+		return jsLooseEquals(a, jsToNumber(b))
+	case *jsObject, *jsArray, *jsRegExp, *jsDate, *jsFunction, *jsNativeFunction:
+		return jsLooseEquals(a, jsToPrimitive(b, false))
+	}
+	// One string and one number
+	return jsToNumber(a) == jsToNumber(b)
+}
+
+/*
+Returns:
+	less, true: The comparison a < b
+	false, false: The comparison is undefined (NaN)
+*/
+func jsLess(a jsValue, b jsValue) (bool, bool) {
+	pa := jsToPrimitive(a, true)
+	pb := jsToPrimitive(b, true)
+	sa, aString := pa.(string)
+	sb, bString := pb.(string)
+	if aString && bString {
+		return sa < sb, true
+	}
+	na := jsToNumber(pa)
+	nb := jsToNumber(pb)
+	if math.IsNaN(na) || math.IsNaN(nb) {
+		return false, false
+	}
+	return na < nb, true
+}
+
+func jsArg(args []jsValue, i int) jsValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return jsUndefined
+}
+
+/*
+Resolve a relative index as used by slice, where negative values count from the end.
+*/
+func jsRelativeIndex(v jsValue, length int, def int) int {
+	if v == jsUndefined {
+		return def
+	}
+	n := jsToInteger(v)
+	if n < 0 {
+		n += float64(length)
+		if n < 0 {
+			n = 0
+		}
+	}
+	if n > float64(length) {
+		n = float64(length)
+	}
+	return int(n)
+}
+
+func jsClampIndex(v jsValue, length int, def int) int {
+	if v == jsUndefined {
+		return def
+	}
+	n := jsToInteger(v)
+	if n < 0 {
+		return 0
+	}
+	if n > float64(length) {
+		return length
+	}
+	return int(n)
+}
+
+// Built-ins
+
+func (it *jsInterpreter) installBuiltins() {
+	b := it.builtins.vars
+	b["undefined"] = jsUndefined
+	b["NaN"] = math.NaN()
+	b["Infinity"] = math.Inf(1)
+	it.define("parseInt", func(args []jsValue) (jsValue, error) {
+		return jsParseInt(jsToString(jsArg(args, 0)), int(jsToInteger(jsArg(args, 1)))), nil
+	})
+	it.define("parseFloat", func(args []jsValue) (jsValue, error) {
+		return jsParseFloat(jsToString(jsArg(args, 0))), nil
+	})
+	it.define("isNaN", func(args []jsValue) (jsValue, error) {
+		return math.IsNaN(jsToNumber(jsArg(args, 0))), nil
+	})
+	it.define("isFinite", func(args []jsValue) (jsValue, error) {
+		n := jsToNumber(jsArg(args, 0))
+		return !math.IsNaN(n) && !math.IsInf(n, 0), nil
+	})
+	it.define("String", func(args []jsValue) (jsValue, error) {
+		if len(args) == 0 {
+			return "", nil
+		}
+		return it.allocString(jsToString(args[0]))
+	})
+	it.define("Number", func(args []jsValue) (jsValue, error) {
+		if len(args) == 0 {
+			return 0.0, nil
+		}
+		return jsToNumber(args[0]), nil
+	})
+	it.define("Boolean", func(args []jsValue) (jsValue, error) {
+		return jsToBoolean(jsArg(args, 0)), nil
+	})
+	newArray := func(args []jsValue) (jsValue, error) {
+		if len(args) == 1 {
+			if n, ok := args[0].(float64); ok {
+				if n < 0 || n != math.Trunc(n) || n > jsMaxSteps {
+					return nil, it.throwf("RangeError", "invalid array length")
+				}
+				if err := it.allocElements(int(n)); err != nil {
+					return nil, err
+				}
+				a := new(jsArray)
+				a.resize(int(n))
+				return a, nil
+			}
+		}
+		if err := it.allocElements(len(args)); err != nil {
+			return nil, err
+		}
+		return &jsArray{elements: append([]jsValue{}, args...)}, nil
+	}
+	b["Array"] = &jsNativeFunction{name: "Array", fn: func(this jsValue, args []jsValue) (jsValue, error) {
+		return newArray(args)
+	}, construct: newArray}
+	newObject := func(args []jsValue) (jsValue, error) {
+		switch v := jsArg(args, 0).(type) {
+		case *jsObject, *jsArray, *jsRegExp, *jsDate:
+			return v, nil
+		}
+		return newJSObject(), nil
+	}
+	b["Object"] = &jsNativeFunction{name: "Object", fn: func(this jsValue, args []jsValue) (jsValue, error) {
+		return newObject(args)
+	}, construct: newObject}
+	newRegExp := func(args []jsValue) (jsValue, error) {
+		if re, ok := jsArg(args, 0).(*jsRegExp); ok && jsArg(args, 1) == jsUndefined {
+			return it.newRegExp(re.source, re.flags)
+		}
+		source := ""
+		if len(args) > 0 && args[0] != jsUndefined {
+			source = jsToString(args[0])
+		}
+		flags := ""
+		if len(args) > 1 && args[1] != jsUndefined {
+			flags = jsToString(args[1])
+		}
+		return it.newRegExp(source, flags)
+	}
+	b["RegExp"] = &jsNativeFunction{name: "RegExp", fn: func(this jsValue, args []jsValue) (jsValue, error) {
+		return newRegExp(args)
+	}, construct: newRegExp}
+	b["Date"] = &jsNativeFunction{name: "Date", fn: func(this jsValue, args []jsValue) (jsValue, error) {
+		return jsToString(&jsDate{it.now()}), nil
+	}, construct: func(args []jsValue) (jsValue, error) {
+		return it.newDate(args), nil
+	}}
+	for _, name := range []string{"Error", "TypeError", "RangeError", "SyntaxError", "ReferenceError"} {
+		name := name
+		newError := func(args []jsValue) (jsValue, error) {
+			msg := ""
+			if len(args) > 0 && args[0] != jsUndefined {
+				msg = jsToString(args[0])
+			}
+			return it.newError(name, msg), nil
+		}
+		b[name] = &jsNativeFunction{name: name, fn: func(this jsValue, args []jsValue) (jsValue, error) {
+			return newError(args)
+		}, construct: newError}
+	}
+	b["Math"] = it.newMath()
+}
+
+func (it *jsInterpreter) newMath() *jsObject {
+	m := newJSObject()
+	m.set("PI", math.Pi)
+	m.set("E", math.E)
+	unary := map[string]func(float64) float64{
+		"abs": math.Abs, "ceil": math.Ceil, "floor": math.Floor, "sqrt": math.Sqrt, "log": math.Log, "exp": math.Exp,
+		"round": func(x float64) float64 { return math.Floor(x + 0.5) },
+	}
+	for _, name := range []string{"abs", "ceil", "floor", "sqrt", "log", "exp", "round"} {
+		f := unary[name]
+		m.set(name, it.native(name, func(this jsValue, args []jsValue) (jsValue, error) {
+			return f(jsToNumber(jsArg(args, 0))), nil
+		}))
+	}
+	m.set("pow", it.native("pow", func(this jsValue, args []jsValue) (jsValue, error) {
+		return math.Pow(jsToNumber(jsArg(args, 0)), jsToNumber(jsArg(args, 1))), nil
+	}))
+	m.set("max", it.native("max", func(this jsValue, args []jsValue) (jsValue, error) {
+		r := math.Inf(-1)
+		for _, a := range args {
+			r = math.Max(r, jsToNumber(a))
+		}
+		return r, nil
+	}))
+	m.set("min", it.native("min", func(this jsValue, args []jsValue) (jsValue, error) {
+		r := math.Inf(1)
+		for _, a := range args {
+			r = math.Min(r, jsToNumber(a))
+		}
+		return r, nil
+	}))
+	m.set("random", it.native("random", func(this jsValue, args []jsValue) (jsValue, error) {
+		// Scripts use this for load balancing, a clock derived value is sufficient
+		return float64(it.now().UnixNano()%1000000) / 1000000, nil
+	}))
+	return m
+}
+
+func jsParseInt(s string, radix int) float64 {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if radix == 0 || radix == 16 {
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			s = s[2:]
+			radix = 16
+		}
+	}
+	if radix == 0 {
+		radix = 10
+	}
+	if radix < 2 || radix > 36 {
+		return math.NaN()
+	}
+	result := 0.0
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		var d int
+		switch {
+		case isDigit(c):
+			d = int(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = int(c-'a') + 10
+		case c >= 'A' && c <= 'Z':
+			d = int(c-'A') + 10
+		default:
+			d = radix
+		}
+		if d >= radix {
+			break
+		}
+		result = result*float64(radix) + float64(d)
+		digits++
+	}
+	if digits == 0 {
+		return math.NaN()
+	}
+	return sign * result
+}
+
+var jsFloatPrefix = regexp.MustCompile(`^[+-]?(Infinity|(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?)`)
+
+func jsParseFloat(s string) float64 {
+	m := jsFloatPrefix.FindString(strings.TrimSpace(s))
+	if m == "" {
+		return math.NaN()
+	}
+	if strings.HasSuffix(m, "Infinity") {
+		if m[0] == '-' {
+			return math.Inf(-1)
+		}
+		return math.Inf(1)
+	}
+	n, err := strconv.ParseFloat(m, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return n
+}
+
+func (it *jsInterpreter) functionMethod(fn jsValue, key string) jsValue {
+	switch key {
+	case "call":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			var rest []jsValue
+			if len(args) > 1 {
+				rest = args[1:]
+			}
+			return it.call(fn, jsArg(args, 0), rest)
+		})
+	case "apply":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			var rest []jsValue
+			if a, ok := jsArg(args, 1).(*jsArray); ok {
+				rest = a.elements
+			}
+			return it.call(fn, jsArg(args, 0), rest)
+		})
+	case "toString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return jsToString(fn), nil
+		})
+	}
+	return nil
+}
+
+func (it *jsInterpreter) objectMethod(o *jsObject, key string) jsValue {
+	switch key {
+	case "hasOwnProperty":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			_, ok := o.get(jsToString(jsArg(args, 0)))
+			return ok, nil
+		})
+	case "toString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return jsToString(o), nil
+		})
+	}
+	return nil
+}
+
+func (it *jsInterpreter) numberMethod(n float64, key string) jsValue {
+	switch key {
+	case "toString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			radix := jsArg(args, 0)
+			if radix == jsUndefined || jsToInteger(radix) == 10 {
+				return jsNumberToString(n), nil
+			}
+			r := int(jsToInteger(radix))
+			if r < 2 || r > 36 {
+				return nil, it.throwf("RangeError", "toString() radix must be between 2 and 36")
+			}
+			if n != math.Trunc(n) || math.IsInf(n, 0) || math.IsNaN(n) {
+				return jsNumberToString(n), nil
+			}
+			return strconv.FormatInt(int64(n), r), nil
+		})
+	case "toFixed":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			digits := int(jsToInteger(jsArg(args, 0)))
+			if digits < 0 || digits > 100 {
+				return nil, it.throwf("RangeError", "toFixed() digits argument must be between 0 and 100")
+			}
+			return strconv.FormatFloat(n, 'f', digits, 64), nil
+		})
+	case "valueOf":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return n, nil
+		})
+	}
+	return nil
+}
+
+func (it *jsInterpreter) stringMethod(s string, key string) jsValue {
+	switch key {
+	case "charAt":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			i := jsToInteger(jsArg(args, 0))
+			if i < 0 || i >= float64(len(s)) {
+				return "", nil
+			}
+			return s[int(i) : int(i)+1], nil
+		})
+	case "charCodeAt":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			i := jsToInteger(jsArg(args, 0))
+			if i < 0 || i >= float64(len(s)) {
+				return math.NaN(), nil
+			}
+			return float64(s[int(i)]), nil
+		})
+	case "indexOf":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			sub := jsToString(jsArg(args, 0))
+			from := jsClampIndex(jsArg(args, 1), len(s), 0)
+			i := strings.Index(s[from:], sub)
+			if i < 0 {
+				return -1.0, nil
+			}
+			return float64(i + from), nil
+		})
+	case "lastIndexOf":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			sub := jsToString(jsArg(args, 0))
+			end := len(s)
+			if from := jsArg(args, 1); from != jsUndefined && !math.IsNaN(jsToNumber(from)) {
+				end = jsClampIndex(from, len(s), len(s)) + len(sub)
+				if end > len(s) {
+					end = len(s)
+				}
+			}
+			return float64(strings.LastIndex(s[:end], sub)), nil
+		})
+	case "substring":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			start := jsClampIndex(jsArg(args, 0), len(s), 0)
+			end := jsClampIndex(jsArg(args, 1), len(s), len(s))
+			if start > end {
+				start, end = end, start
+			}
+			return s[start:end], nil
+		})
+	case "substr":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			start := jsRelativeIndex(jsArg(args, 0), len(s), 0)
+			length := len(s) - start
+			if l := jsArg(args, 1); l != jsUndefined {
+				length = int(math.Min(math.Max(jsToInteger(l), 0), float64(length)))
+			}
+			return s[start : start+length], nil
+		})
+	case "slice":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			start := jsRelativeIndex(jsArg(args, 0), len(s), 0)
+			end := jsRelativeIndex(jsArg(args, 1), len(s), len(s))
+			if start >= end {
+				return "", nil
+			}
+			return s[start:end], nil
+		})
+	case "toLowerCase", "toLocaleLowerCase":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			if err := it.alloc(len(s)); err != nil {
+				return nil, err
+			}
+			return strings.ToLower(s), nil
+		})
+	case "toUpperCase", "toLocaleUpperCase":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			if err := it.alloc(len(s)); err != nil {
+				return nil, err
+			}
+			return strings.ToUpper(s), nil
+		})
+	case "trim":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return strings.TrimSpace(s), nil
+		})
+	case "startsWith":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			from := jsClampIndex(jsArg(args, 1), len(s), 0)
+			return strings.HasPrefix(s[from:], jsToString(jsArg(args, 0))), nil
+		})
+	case "endsWith":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			end := jsClampIndex(jsArg(args, 1), len(s), len(s))
+			return strings.HasSuffix(s[:end], jsToString(jsArg(args, 0))), nil
+		})
+	case "includes":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			from := jsClampIndex(jsArg(args, 1), len(s), 0)
+			return strings.Contains(s[from:], jsToString(jsArg(args, 0))), nil
+		})
+	case "concat":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			parts := []string{s}
+			n := len(s)
+			for _, a := range args {
+				parts = append(parts, jsToString(a))
+				n += len(parts[len(parts)-1])
+			}
+			if err := it.alloc(n); err != nil {
+				return nil, err
+			}
+			return strings.Join(parts, ""), nil
+		})
+	case "split":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return it.split(s, jsArg(args, 0), jsArg(args, 1))
+		})
+	case "replace":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return it.replace(s, jsArg(args, 0), jsArg(args, 1))
+		})
+	case "match":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			re, err := it.toRegExp(jsArg(args, 0))
+			if err != nil {
+				return nil, err
+			}
+			if !strings.Contains(re.flags, "g") {
+				return re.exec(s), nil
+			}
+			matches := re.re.FindAllString(s, it.maxElements())
+			if matches == nil {
+				return nil, nil
+			} else if err := it.allocElements(len(matches)); err != nil {
+				return nil, err
+			}
+			arr := new(jsArray)
+			for _, m := range matches {
+				arr.elements = append(arr.elements, m)
+			}
+			return arr, nil
+		})
+	case "search":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			re, err := it.toRegExp(jsArg(args, 0))
+			if err != nil {
+				return nil, err
+			}
+			loc := re.re.FindStringIndex(s)
+			if loc == nil {
+				return -1.0, nil
+			}
+			return float64(loc[0]), nil
+		})
+	case "toString", "valueOf":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return s, nil
+		})
+	}
+	return nil
+}
+
+func (it *jsInterpreter) split(s string, sep jsValue, limit jsValue) (jsValue, error) {
+	max := -1
+	if limit != jsUndefined {
+		max = int(uint32(jsToInt32(limit)))
+	}
+	var parts []string
+	switch sp := sep.(type) {
+	case jsUndefinedType:
+		parts = []string{s}
+	case *jsRegExp:
+		if s == "" {
+			if sp.re.MatchString("") {
+				parts = []string{}
+			} else {
+				parts = []string{""}
+			}
+		} else {
+			parts = sp.re.Split(s, it.maxElements())
+		}
+	default:
+		str := jsToString(sep)
+		if s == "" && str != "" {
+			parts = []string{""}
+		} else if s == "" {
+			parts = []string{}
+		} else {
+			parts = strings.SplitN(s, str, it.maxElements())
+		}
+	}
+	if max >= 0 && len(parts) > max {
+		parts = parts[:max]
+	}
+	if err := it.allocElements(len(parts)); err != nil {
+		return nil, err
+	}
+	arr := &jsArray{elements: make([]jsValue, len(parts))}
+	for i, p := range parts {
+		arr.elements[i] = p
+	}
+	return arr, nil
+}
+
+func (it *jsInterpreter) replace(s string, pattern jsValue, replacement jsValue) (jsValue, error) {
+	// Locate the matches as submatch index slices
+	var matches [][]int
+	if re, ok := pattern.(*jsRegExp); ok {
+		if strings.Contains(re.flags, "g") {
+			matches = re.re.FindAllStringSubmatchIndex(s, it.maxElements())
+			if err := it.allocElements(len(matches)); err != nil {
+				return nil, err
+			}
+		} else if m := re.re.FindStringSubmatchIndex(s); m != nil {
+			matches = [][]int{m}
+		}
+	} else {
+		p := jsToString(pattern)
+		if i := strings.Index(s, p); i >= 0 {
+			matches = [][]int{{i, i + len(p)}}
+		}
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(s[last:m[0]])
+		if jsIsCallable(replacement) {
+			args := make([]jsValue, 0, len(m)/2+2)
+			for g := 0; g < len(m)/2; g++ {
+				if m[2*g] < 0 {
+					args = append(args, jsUndefined)
+				} else {
+					args = append(args, s[m[2*g]:m[2*g+1]])
+				}
+			}
+			args = append(args, float64(m[0]), s)
+			v, err := it.call(replacement, jsUndefined, args)
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(jsToString(v))
+		} else {
+			jsExpandReplacement(&b, jsToString(replacement), s, m)
+		}
+		last = m[1]
+		if b.Len() > jsMaxAllocation-it.allocated {
+			return nil, it.alloc(b.Len())
+		}
+	}
+	b.WriteString(s[last:])
+	return it.allocString(b.String())
+}
+
+/*
+Expand the $ patterns ($$, $&, $`, $', $n, $nn) of a String.prototype.replace replacement string into b.
+Expansion stops once b exceeds jsMaxAllocation bytes, which the script may not allocate.
+*/
+func jsExpandReplacement(b *strings.Builder, repl string, s string, m []int) {
+	groups := len(m)/2 - 1
+	for i := 0; i < len(repl) && b.Len() <= jsMaxAllocation; i++ {
+		c := repl[i]
+		if c != '$' || i+1 >= len(repl) {
+			b.WriteByte(c)
+			continue
+		}
+		n := repl[i+1]
+		switch {
+		case n == '$':
+			b.WriteByte('$')
+			i++
+		case n == '&':
+			b.WriteString(s[m[0]:m[1]])
+			i++
+		case n == '`':
+			b.WriteString(s[:m[0]])
+			i++
+		case n == '\'':
+			b.WriteString(s[m[1]:])
+			i++
+		case isDigit(n):
+			g := int(n - '0')
+			width := 1
+			if i+2 < len(repl) && isDigit(repl[i+2]) {
+				if g2 := g*10 + int(repl[i+2]-'0'); g2 >= 1 && g2 <= groups {
+					g = g2
+					width = 2
+				}
+			}
+			if g < 1 || g > groups {
+				b.WriteByte(c)
+				continue
+			}
+			if m[2*g] >= 0 {
+				b.WriteString(s[m[2*g]:m[2*g+1]])
+			}
+			i += width
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (it *jsInterpreter) arrayMethod(a *jsArray, key string) jsValue {
+	switch key {
+	case "push":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			if err := it.allocElements(len(args)); err != nil {
+				return nil, err
+			}
+			a.elements = append(a.elements, args...)
+			return float64(len(a.elements)), nil
+		})
+	case "pop":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			if len(a.elements) == 0 {
+				return jsUndefined, nil
+			}
+			v := a.elements[len(a.elements)-1]
+			a.elements = a.elements[:len(a.elements)-1]
+			return v, nil
+		})
+	case "shift":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			if len(a.elements) == 0 {
+				return jsUndefined, nil
+			}
+			v := a.elements[0]
+			a.elements = a.elements[1:]
+			return v, nil
+		})
+	case "unshift":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			if err := it.allocElements(len(args) + len(a.elements)); err != nil {
+				return nil, err
+			}
+			a.elements = append(append([]jsValue{}, args...), a.elements...)
+			return float64(len(a.elements)), nil
+		})
+	case "join":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			sep := ","
+			if s := jsArg(args, 0); s != jsUndefined {
+				sep = jsToString(s)
+			}
+			return it.allocString(jsJoin(a, sep))
+		})
+	case "toString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return it.allocString(jsJoin(a, ","))
+		})
+	case "indexOf", "includes":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			from := jsRelativeIndex(jsArg(args, 1), len(a.elements), 0)
+			for i := from; i < len(a.elements); i++ {
+				if jsStrictEquals(a.elements[i], jsArg(args, 0)) {
+					if key == "includes" {
+						return true, nil
+					}
+					return float64(i), nil
+				}
+			}
+			if key == "includes" {
+				return false, nil
+			}
+			return -1.0, nil
+		})
+	case "lastIndexOf":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			for i := len(a.elements) - 1; i >= 0; i-- {
+				if jsStrictEquals(a.elements[i], jsArg(args, 0)) {
+					return float64(i), nil
+				}
+			}
+			return -1.0, nil
+		})
+	case "slice":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			start := jsRelativeIndex(jsArg(args, 0), len(a.elements), 0)
+			end := jsRelativeIndex(jsArg(args, 1), len(a.elements), len(a.elements))
+			if start >= end {
+				return new(jsArray), nil
+			}
+			if err := it.allocElements(end - start); err != nil {
+				return nil, err
+			}
+			return &jsArray{elements: append([]jsValue{}, a.elements[start:end]...)}, nil
+		})
+	case "concat":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			n := len(a.elements)
+			for _, arg := range args {
+				if other, ok := arg.(*jsArray); ok {
+					n += len(other.elements)
+				} else {
+					n++
+				}
+			}
+			if err := it.allocElements(n); err != nil {
+				return nil, err
+			}
+			r := &jsArray{elements: append([]jsValue{}, a.elements...)}
+			for _, arg := range args {
+				if other, ok := arg.(*jsArray); ok {
+					r.elements = append(r.elements, other.elements...)
+				} else {
+					r.elements = append(r.elements, arg)
+				}
+			}
+			return r, nil
+		})
+	case "reverse":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			for i, j := 0, len(a.elements)-1; i < j; i, j = i+1, j-1 {
+				a.elements[i], a.elements[j] = a.elements[j], a.elements[i]
+			}
+			return a, nil
+		})
+	case "sort":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			compare := jsArg(args, 0)
+			var sortErr error
+			sort.SliceStable(a.elements, func(i, j int) bool {
+				if sortErr != nil {
+					return false
+				}
+				x, y := a.elements[i], a.elements[j]
+				if jsIsCallable(compare) {
+					v, err := it.call(compare, jsUndefined, []jsValue{x, y})
+					if err != nil {
+						sortErr = err
+						return false
+					}
+					return jsToNumber(v) < 0
+				}
+				return jsToString(x) < jsToString(y)
+			})
+			return a, sortErr
+		})
+	case "forEach", "map", "filter", "some", "every":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			callback := jsArg(args, 0)
+			if !jsIsCallable(callback) {
+				return nil, it.typeError("%s is not a function", jsToString(callback))
+			}
+			// The elements are copied, and at most as many are mapped or filtered
+			n := len(a.elements)
+			if key == "map" || key == "filter" {
+				n *= 2
+			}
+			if err := it.allocElements(n); err != nil {
+				return nil, err
+			}
+			result := new(jsArray)
+			elements := append([]jsValue{}, a.elements...)
+			for i, e := range elements {
+				v, err := it.call(callback, jsArg(args, 1), []jsValue{e, float64(i), a})
+				if err != nil {
+					return nil, err
+				}
+				switch key {
+				case "map":
+					result.elements = append(result.elements, v)
+				case "filter":
+					if jsToBoolean(v) {
+						result.elements = append(result.elements, e)
+					}
+				case "some":
+					if jsToBoolean(v) {
+						return true, nil
+					}
+				case "every":
+					if !jsToBoolean(v) {
+						return false, nil
+					}
+				}
+			}
+			switch key {
+			case "map", "filter":
+				return result, nil
+			case "some":
+				return false, nil
+			case "every":
+				return true, nil
+			}
+			return jsUndefined, nil
+		})
+	}
+	return nil
+}
+
+/*
+Create a RegExp, translating the JavaScript syntax to Go's RE2 syntax where they differ.
+Features RE2 does not support (i.e. lookahead, back references) result in a SyntaxError being thrown.
+*/
+func (it *jsInterpreter) newRegExp(source string, flags string) (*jsRegExp, error) {
+	prefix := ""
+	for _, f := range flags {
+		switch f {
+		case 'i':
+			prefix += "i"
+		case 'm':
+			prefix += "m"
+		case 's':
+			prefix += "s"
+		case 'g', 'y', 'u':
+		default:
+			return nil, it.syntaxError("invalid regular expression flags '%s'", flags)
+		}
+	}
+	pattern := jsTranslateRegExp(source)
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, it.syntaxError("invalid regular expression /%s/: %s", source, err)
+	}
+	return &jsRegExp{source: source, flags: flags, re: re}, nil
+}
+
+func jsTranslateRegExp(source string) string {
+	var b strings.Builder
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		if c == '\\' && i+1 < len(source) {
+			n := source[i+1]
+			if n == 'u' && i+5 < len(source)+0 && i+6 <= len(source) {
+				b.WriteString(`\x{` + source[i+2:i+6] + `}`)
+				i += 5
+				continue
+			}
+			if n == '/' {
+				b.WriteByte('/')
+				i++
+				continue
+			}
+			b.WriteByte(c)
+			b.WriteByte(n)
+			i++
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (it *jsInterpreter) toRegExp(v jsValue) (*jsRegExp, error) {
+	if re, ok := v.(*jsRegExp); ok {
+		return re, nil
+	}
+	if v == jsUndefined {
+		return it.newRegExp("", "")
+	}
+	return it.newRegExp(regexp.QuoteMeta(jsToString(v)), "")
+}
+
+/*
+Execute the regular expression against s, returning the match array or null.
+*/
+func (re *jsRegExp) exec(s string) jsValue {
+	global := strings.ContainsAny(re.flags, "gy")
+	start := 0
+	if global {
+		start = re.lastIndex
+		if start > len(s) {
+			re.lastIndex = 0
+			return nil
+		}
+	}
+	m := re.re.FindStringSubmatchIndex(s[start:])
+	if m == nil {
+		if global {
+			re.lastIndex = 0
+		}
+		return nil
+	}
+	arr := new(jsArray)
+	for g := 0; g < len(m)/2; g++ {
+		if m[2*g] < 0 {
+			arr.elements = append(arr.elements, jsUndefined)
+		} else {
+			arr.elements = append(arr.elements, s[start+m[2*g]:start+m[2*g+1]])
+		}
+	}
+	if global {
+		re.lastIndex = start + m[1]
+	}
+	return arr
+}
+
+func (it *jsInterpreter) regExpMember(re *jsRegExp, key string) jsValue {
+	switch key {
+	case "source":
+		return re.source
+	case "flags":
+		return re.flags
+	case "global":
+		return strings.Contains(re.flags, "g")
+	case "ignoreCase":
+		return strings.Contains(re.flags, "i")
+	case "multiline":
+		return strings.Contains(re.flags, "m")
+	case "lastIndex":
+		return float64(re.lastIndex)
+	case "test":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return re.exec(jsToString(jsArg(args, 0))) != nil, nil
+		})
+	case "exec":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return re.exec(jsToString(jsArg(args, 0))), nil
+		})
+	case "toString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return jsToString(re), nil
+		})
+	}
+	return nil
+}
+
+/*
+Create a Date from the arguments to the Date constructor:
+	(): The current time
+	(milliseconds): Milliseconds since the epoch
+	(year, month[, day[, hours[, minutes[, seconds[, milliseconds]]]]]): Local time components
+*/
+func (it *jsInterpreter) newDate(args []jsValue) *jsDate {
+	now := it.now()
+	switch len(args) {
+	case 0:
+		return &jsDate{now}
+	case 1:
+		if d, ok := args[0].(*jsDate); ok {
+			return &jsDate{d.t}
+		}
+		ms := jsToNumber(args[0])
+		if s, ok := args[0].(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return &jsDate{t.In(now.Location())}
+			}
+		}
+		return &jsDate{time.UnixMilli(int64(ms)).In(now.Location())}
+	}
+	c := [7]int{0, 0, 1, 0, 0, 0, 0}
+	for i := 0; i < len(args) && i < 7; i++ {
+		c[i] = int(jsToInteger(args[i]))
+	}
+	if c[0] >= 0 && c[0] <= 99 {
+		c[0] += 1900
+	}
+	return &jsDate{time.Date(c[0], time.Month(c[1]+1), c[2], c[3], c[4], c[5], c[6]*1000000, now.Location())}
+}
+
+func (it *jsInterpreter) dateMethod(d *jsDate, key string) jsValue {
+	getter := func(f func(t time.Time) int) jsValue {
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return float64(f(d.t)), nil
+		})
+	}
+	utc := func(f func(t time.Time) int) jsValue {
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return float64(f(d.t.UTC())), nil
+		})
+	}
+	fullYear := func(t time.Time) int { return t.Year() }
+	month := func(t time.Time) int { return int(t.Month()) - 1 }
+	date := func(t time.Time) int { return t.Day() }
+	day := func(t time.Time) int { return int(t.Weekday()) }
+	hours := func(t time.Time) int { return t.Hour() }
+	minutes := func(t time.Time) int { return t.Minute() }
+	seconds := func(t time.Time) int { return t.Second() }
+	millis := func(t time.Time) int { return t.Nanosecond() / 1000000 }
+	switch key {
+	case "getFullYear":
+		return getter(fullYear)
+	case "getYear":
+		return getter(func(t time.Time) int { return t.Year() - 1900 })
+	case "getMonth":
+		return getter(month)
+	case "getDate":
+		return getter(date)
+	case "getDay":
+		return getter(day)
+	case "getHours":
+		return getter(hours)
+	case "getMinutes":
+		return getter(minutes)
+	case "getSeconds":
+		return getter(seconds)
+	case "getMilliseconds":
+		return getter(millis)
+	case "getUTCFullYear":
+		return utc(fullYear)
+	case "getUTCMonth":
+		return utc(month)
+	case "getUTCDate":
+		return utc(date)
+	case "getUTCDay":
+		return utc(day)
+	case "getUTCHours":
+		return utc(hours)
+	case "getUTCMinutes":
+		return utc(minutes)
+	case "getUTCSeconds":
+		return utc(seconds)
+	case "getUTCMilliseconds":
+		return utc(millis)
+	case "getTimezoneOffset":
+		return getter(func(t time.Time) int {
+			_, offset := t.Zone()
+			return -offset / 60
+		})
+	case "getTime", "valueOf":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return float64(d.t.UnixMilli()), nil
+		})
+	case "toString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return jsToString(d), nil
+		})
+	case "toUTCString", "toGMTString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return d.t.UTC().Format(time.RFC1123), nil
+		})
+	case "toISOString":
+		return it.native(key, func(this jsValue, args []jsValue) (jsValue, error) {
+			return d.t.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+		})
+	}
+	return nil
+}
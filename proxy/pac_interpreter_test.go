@@ -0,0 +1,261 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var dataJSEval = []struct {
+	script string
+	expect string
+}{
+	// Literals and arithmetic
+	{"return 1 + 2 * 3;", "7"},
+	{"return (1 + 2) * 3;", "9"},
+	{"return 7 % 3;", "1"},
+	{"return 1 / 4;", "0.25"},
+	{"return 0x1F;", "31"},
+	{"return 1e21;", "1e+21"},
+	{"return 1 / 0;", "Infinity"},
+	{"return 0 / 0;", "NaN"},
+	{"return 'a' + 1 + 2;", "a12"},
+	{"return 1 + 2 + 'a';", "3a"},
+	{"return '3' * '4';", "12"},
+	{"return \"tab\\there\";", "tab\there"},
+	{"return '\\x41\\u0042';", "AB"},
+	// Comparison
+	{"return 1 == '1';", "true"},
+	{"return 1 === '1';", "false"},
+	{"return null == undefined;", "true"},
+	{"return null === undefined;", "false"},
+	{"return 'b' > 'a';", "true"},
+	{"return 2 < '10';", "true"},
+	{"return '2' < '10';", "false"},
+	{"return NaN == NaN;", "false"},
+	// Logical
+	{"return 0 || 'x';", "x"},
+	{"return 1 && 'y';", "y"},
+	{"return !'';", "true"},
+	{"return null ? 'a' : 'b';", "b"},
+	// Bitwise
+	{"return 5 & 3;", "1"},
+	{"return 5 | 3;", "7"},
+	{"return 1 << 4;", "16"},
+	{"return -16 >> 2;", "-4"},
+	{"return -1 >>> 28;", "15"},
+	{"return ~5;", "-6"},
+	// typeof
+	{"return typeof undefinedVariable;", "undefined"},
+	{"return typeof 'a' + typeof 1 + typeof null + typeof function() {};", "stringnumberobjectfunction"},
+	// Variables and assignment
+	{"var a = 1, b = 2; a += b; return a;", "3"},
+	{"var s = 'a'; s += 'b'; return s;", "ab"},
+	{"var i = 1; var j = i++; return i + ',' + j;", "2,1"},
+	{"var i = 1; var j = ++i; return i + ',' + j;", "2,2"},
+	{"let x = 1; const y = 2; return x + y;", "3"},
+	{"implicitGlobal = 5; return implicitGlobal;", "5"},
+	// Control flow
+	{"if (1 > 2) { return 'a'; } else if (2 > 1) { return 'b'; } else { return 'c'; }", "b"},
+	{"var s = 0; for (var i = 0; i < 10; i++) { if (i == 5) break; if (i % 2) continue; s += i; } return s;", "6"},
+	{"var i = 0; while (i < 3) i++; return i;", "3"},
+	{"var i = 0; do { i++; } while (i < 3); return i;", "3"},
+	{"var k = ''; var o = {a: 1, b: 2}; for (var x in o) k += x; return k;", "ab"},
+	{"switch (2) { case 1: return 'one'; case 2: case 3: return 'two or three'; default: return 'other'; }", "two or three"},
+	{"var r = ''; switch ('z') { case 'a': r = 'a'; break; default: r = 'd'; } return r;", "d"},
+	{"try { throw 'oops'; } catch (e) { return 'caught ' + e; }", "caught oops"},
+	{"try { undefinedFunction(); } catch (e) { return e.name; }", "ReferenceError"},
+	{"var r = ''; try { r += 'a'; } finally { r += 'b'; } return r;", "ab"},
+	{"try { throw new Error('x'); } catch (e) { return e.message + (e instanceof Error); }", "xtrue"},
+	// Automatic semicolon insertion
+	{"var a = 1\nvar b = 2\nreturn a + b", "3"},
+	{"var a = 1\nreturn\na", "undefined"},
+	// Functions
+	{"function add(a, b) { return a + b; } return add(1, 2);", "3"},
+	{"return later(); function later() { return 'hoisted'; }", "hoisted"},
+	{"var f = function(n) { return n <= 1 ? 1 : n * f(n - 1); }; return f(5);", "120"},
+	{"var f = function fact(n) { return n <= 1 ? 1 : n * fact(n - 1); }; return f(4);", "24"},
+	{"function counter() { var c = 0; return function() { return ++c; }; } var c = counter(); c(); return c();", "2"},
+	{"function f() { return arguments.length; } return f(1, 2, 3);", "3"},
+	{"function f(a, b) { return b; } return typeof f(1);", "undefined"},
+	{"function P(x) { this.x = x; } var p = new P(3); return p.x;", "3"},
+	{"function f() { return this.v; } return f.call({v: 'c'}) + f.apply({v: 'a'}, []);", "ca"},
+	// Strings
+	{"return 'Hello'.length;", "5"},
+	{"return 'Hello'.charAt(1) + 'Hello'[4];", "eo"},
+	{"return 'Hello'.charCodeAt(0);", "72"},
+	{"return 'a.b.c'.indexOf('.') + ',' + 'a.b.c'.lastIndexOf('.');", "1,3"},
+	{"return 'abcdef'.substring(4, 1);", "bcd"},
+	{"return 'abcdef'.substr(-3, 2);", "de"},
+	{"return 'abcdef'.slice(1, -1);", "bcde"},
+	{"return 'MiXeD'.toLowerCase() + 'MiXeD'.toUpperCase();", "mixedMIXED"},
+	{"return '  x  '.trim();", "x"},
+	{"return 'a,b,c'.split(',').length;", "3"},
+	{"return 'a1b2c'.split(/\\d/).join('-');", "a-b-c"},
+	{"return 'abc'.split('').join('|');", "a|b|c"},
+	{"return 'a.b.c'.replace('.', '-');", "a-b.c"},
+	{"return 'a.b.c'.replace(/\\./g, '-');", "a-b-c"},
+	{"return 'john smith'.replace(/(\\w+)\\s(\\w+)/, '$2, $1');", "smith, john"},
+	{"return 'abc'.replace(/b/, function(m) { return m.toUpperCase(); });", "aBc"},
+	{"return 'www.rapid7.com'.match(/\\.(\\w+)\\./)[1];", "rapid7"},
+	{"return 'abc'.match(/x/);", "null"},
+	{"return 'abc'.startsWith('ab') && 'abc'.endsWith('bc') && 'abc'.includes('b');", "true"},
+	{"return 'abc'.search(/c/);", "2"},
+	// Arrays
+	{"var a = [1, 2, 3]; a.push(4); return a.length + ':' + a.join('');", "4:1234"},
+	{"var a = []; a[2] = 'x'; return a.length;", "3"},
+	{"return [3, 1, 2].sort().join();", "1,2,3"},
+	{"return [3, 10, 2].sort(function(a, b) { return a - b; }).join();", "2,3,10"},
+	{"return [1, 2, 3].indexOf(2) + [1, 2, 3].indexOf(4);", "0"},
+	{"return [1, 2, 3].map(function(x) { return x * 2; }).join();", "2,4,6"},
+	{"return [1, 2, 3].filter(function(x) { return x > 1; }).length;", "2"},
+	{"return [1, 2, 3].some(function(x) { return x > 2; });", "true"},
+	{"return [1, 2, 3].slice(1).concat([4]).reverse().join();", "4,3,2"},
+	{"return new Array(3).length;", "3"},
+	// Objects
+	{"var o = {'a': 1, b: {c: 2}}; return o.a + o.b.c + o['b']['c'];", "5"},
+	{"var o = {a: 1}; delete o.a; return typeof o.a;", "undefined"},
+	{"return ('a' in {a: 1}) + ',' + ({a: 1}).hasOwnProperty('b');", "true,false"},
+	// Regular expressions
+	{"return /^www\\./i.test('WWW.rapid7.com');", "true"},
+	{"return new RegExp('^[a-z]+$').test('abc1');", "false"},
+	{"var re = /a/g; re.exec('aa'); return re.lastIndex;", "1"},
+	// Numbers and globals
+	{"return parseInt('42px') + parseInt('0x10') + parseInt('11', 2);", "61"},
+	{"return parseFloat('3.5abc');", "3.5"},
+	{"return isNaN(parseInt('abc'));", "true"},
+	{"return (255).toString(16) + (1.5).toFixed(2);", "ff1.50"},
+	{"return Math.max(1, 5, 3) + Math.floor(2.7) + Math.abs(-1);", "8"},
+	{"return String(12) + Number('3');", "123"},
+	{"var a = [1, 2]; a.push(a); return a.join('-');", "1-2-"},
+	{"var a = [1, [2, 3]]; return a + '';", "1,2,3"},
+	{"return 'a-b-c'.split('-', 2).length + 'abc'.split('').length;", "5"},
+	// Dates
+	{"var d = new Date(); return d.getFullYear() + '-' + d.getMonth() + '-' + d.getDate();", "2018-5-15"},
+	{"return new Date().getDay();", "5"},
+	{"return new Date(2018, 0, 2).getDate();", "2"},
+}
+
+func TestJSInterpreter_Eval(t *testing.T) {
+	now := func() time.Time {
+		return time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	}
+	for _, tt := range dataJSEval {
+		t.Run(tt.script, func(t *testing.T) {
+			a := assert.New(t)
+			prog, err := jsParse("function main() {\n" + tt.script + "\n}")
+			if !a.NoError(err) {
+				return
+			}
+			it := newJSInterpreter(context.Background(), now)
+			if !a.NoError(it.run(prog)) {
+				return
+			}
+			v, err := it.callGlobal("main")
+			if !a.NoError(err) {
+				return
+			}
+			a.Equal(tt.expect, jsToString(v))
+		})
+	}
+}
+
+var dataJSSyntaxError = []string{
+	"function (",
+	"var 1a = 2;",
+	"return 'unterminated;",
+	"if (x {",
+	"a b",
+	"/* unterminated",
+	"var x = ;",
+	"1 = 2;",
+	"try { }",
+}
+
+func TestJSParse_SyntaxError(t *testing.T) {
+	for _, script := range dataJSSyntaxError {
+		t.Run(script, func(t *testing.T) {
+			a := assert.New(t)
+			_, err := jsParse(script)
+			a.Error(err)
+		})
+	}
+}
+
+var dataJSRuntimeError = []struct {
+	script string
+	expect string
+}{
+	{"undefinedFunction();", "ReferenceError: undefinedFunction is not defined"},
+	{"var x; x.y;", "TypeError: cannot read property 'y' of undefined"},
+	{"var x = 1; x();", "TypeError: x is not a function"},
+	{"throw 'custom';", "uncaught exception: custom"},
+	{"/(?=lookahead)/.test('a');", "SyntaxError: invalid regular expression"},
+	{"while (true) {}", errJSStepLimit.Error()},
+	{"function f() { return f(); } f();", errJSCallDepth.Error()},
+	{"try { while (true) {} } catch (e) {}", errJSStepLimit.Error()},
+	// Memory exhaustion
+	{`var s="xxxxxxxx"; for(var i=0;i<31;i++){s=s+s;}`, "RangeError: script exceeded the maximum memory allocation"},
+	{"var s = 'x'; for (var i = 0; i < 31; i++) { s += s.toUpperCase(); }", "RangeError: script exceeded the maximum memory allocation"},
+	{"var s = 'xx'; for (var i = 0; i < 31; i++) { s = s.replace(/x/g, '$&$&'); }", "RangeError: script exceeded the maximum memory allocation"},
+	{"var s = 'x'; for (var i = 0; i < 31; i++) { s = s.concat(s); }", "RangeError: script exceeded the maximum memory allocation"},
+	{"var a = [1]; for (var i = 0; i < 31; i++) { a = a.concat(a); }", "RangeError: script exceeded the maximum memory allocation"},
+	{"var a = [1]; for (var i = 0; i < 31; i++) { a.push.apply(a, a); }", "RangeError: script exceeded the maximum memory allocation"},
+	{"var a = []; a.length = 9999999;", "RangeError: script exceeded the maximum memory allocation"},
+	{"new Array(9999999);", "RangeError: script exceeded the maximum memory allocation"},
+	{"var a = [new Array(1000).join('x')]; for (var i = 0; i < 14; i++) { a = a.concat(a); } a.join('');", "RangeError: script exceeded the maximum memory allocation"},
+	{"var o = {}; for (var i = 0; i < 1000000; i++) { o['k' + i] = i; }", "RangeError: script exceeded the maximum memory allocation"},
+	{"try { var s = 'xxxxxxxx'; while (true) { s = s + s; } } catch (e) {} s.split('');", "RangeError: script exceeded the maximum memory allocation"},
+}
+
+func TestJSInterpreter_RuntimeError(t *testing.T) {
+	for _, tt := range dataJSRuntimeError {
+		t.Run(tt.script, func(t *testing.T) {
+			a := assert.New(t)
+			prog, err := jsParse(tt.script)
+			if !a.NoError(err) {
+				return
+			}
+			err = newJSInterpreter(context.Background(), time.Now).run(prog)
+			if a.Error(err) {
+				a.Contains(err.Error(), tt.expect)
+			}
+		})
+	}
+}
+
+var dataJSNumberToString = []struct {
+	n      float64
+	expect string
+}{
+	{0, "0"},
+	{1, "1"},
+	{-1.5, "-1.5"},
+	{123456789, "123456789"},
+	{0.000001, "0.000001"},
+	{0.0000001, "1e-7"},
+	{1e21, "1e+21"},
+	{1.5e300, "1.5e+300"},
+}
+
+func TestJSNumberToString(t *testing.T) {
+	for _, tt := range dataJSNumberToString {
+		t.Run(tt.expect, func(t *testing.T) {
+			a := assert.New(t)
+			a.Equal(tt.expect, jsNumberToString(tt.n))
+		})
+	}
+}
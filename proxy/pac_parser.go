@@ -0,0 +1,1375 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+This file contains the lexer and parser for the subset of JavaScript (ECMAScript 5) found in PAC files.
+Supported are function declarations and expressions, var/let/const (all function scoped), if/else, for, for-in,
+while, do-while, switch, try/catch/finally, throw, break/continue (without labels), and the usual expression operators.
+Unsupported are classes, arrow functions, template literals, getters/setters, labels and generators.
+*/
+
+type jsTokenKind int
+
+const (
+	jsTokenEOF jsTokenKind = iota
+	jsTokenIdent
+	jsTokenNumber
+	jsTokenString
+	jsTokenRegExp
+	jsTokenPunct
+)
+
+type jsToken struct {
+	kind jsTokenKind
+	// Identifier name, punctuator, string contents or regular expression source
+	value string
+	// Regular expression flags
+	flags string
+	num   float64
+	line  int
+	// A line terminator precedes this token, used for automatic semicolon insertion
+	nl bool
+}
+
+func (t jsToken) String() string {
+	switch t.kind {
+	case jsTokenEOF:
+		return "end of script"
+	case jsTokenString:
+		return strconv.Quote(t.value)
+	case jsTokenRegExp:
+		return "/" + t.value + "/" + t.flags
+	default:
+		return "\"" + t.value + "\""
+	}
+}
+
+type jsSyntaxError struct {
+	line int
+	msg  string
+}
+
+func (e *jsSyntaxError) Error() string {
+	return fmt.Sprintf("SyntaxError: line %d: %s", e.line, e.msg)
+}
+
+var jsPunctuators = []string{
+	">>>=", "===", "!==", ">>>", "<<=", ">>=",
+	"==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>",
+	"{", "}", "(", ")", "[", "]", ";", ",", "<", ">", "+", "-", "*", "/", "%", "&", "|", "^", "!", "~", "?", ":", "=", ".",
+}
+
+// Keywords after which a "/" starts a regular expression rather than a division
+var jsRegExpPrefixKeywords = map[string]bool{
+	"return": true, "typeof": true, "case": true, "do": true, "else": true, "in": true, "instanceof": true,
+	"new": true, "delete": true, "void": true, "throw": true,
+}
+
+/*
+Split the given JavaScript source into tokens.
+Params:
+	src: The JavaScript source
+Returns:
+	[]jsToken, nil: The tokens, terminated by a jsTokenEOF token
+	nil, error: The source contains an invalid token
+*/
+func jsTokenize(src string) ([]jsToken, error) {
+	var tokens []jsToken
+	line := 1
+	nl := false
+	i := 0
+	regExpAllowed := func() bool {
+		if len(tokens) == 0 {
+			return true
+		}
+		prev := tokens[len(tokens)-1]
+		switch prev.kind {
+		case jsTokenNumber, jsTokenString, jsTokenRegExp:
+			return false
+		case jsTokenIdent:
+			return jsRegExpPrefixKeywords[prev.value]
+		case jsTokenPunct:
+			return prev.value != ")" && prev.value != "]" && prev.value != "}"
+		}
+		return true
+	}
+	for i < len(src) {
+		c := src[i]
+		// Whitespace and line terminators
+		if c == '\n' {
+			line++
+			nl = true
+			i++
+			continue
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v' {
+			i++
+			continue
+		}
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(src[i:])
+			if r == '\u2028' || r == '\u2029' {
+				line++
+				nl = true
+				i += size
+				continue
+			}
+			if unicode.IsSpace(r) || r == '\ufeff' {
+				i += size
+				continue
+			}
+		}
+		// Comments
+		if strings.HasPrefix(src[i:], "//") {
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		if strings.HasPrefix(src[i:], "/*") {
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, &jsSyntaxError{line, "unterminated comment"}
+			}
+			comment := src[i : i+2+end+2]
+			if n := strings.Count(comment, "\n"); n > 0 {
+				line += n
+				nl = true
+			}
+			i += len(comment)
+			continue
+		}
+		tok := jsToken{line: line, nl: nl}
+		switch {
+		case isJSIdentStart(c):
+			j := i
+			for j < len(src) && isJSIdentPart(src[j]) {
+				j++
+			}
+			tok.kind = jsTokenIdent
+			tok.value = src[i:j]
+			i = j
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			n, size, err := jsScanNumber(src[i:])
+			if err != nil {
+				return nil, &jsSyntaxError{line, err.Error()}
+			}
+			tok.kind = jsTokenNumber
+			tok.num = n
+			tok.value = src[i : i+size]
+			i += size
+		case c == '"' || c == '\'':
+			s, size, err := jsScanString(src[i:])
+			if err != nil {
+				return nil, &jsSyntaxError{line, err.Error()}
+			}
+			tok.kind = jsTokenString
+			tok.value = s
+			line += strings.Count(src[i:i+size], "\n")
+			i += size
+		case c == '/' && regExpAllowed():
+			source, flags, size, err := jsScanRegExp(src[i:])
+			if err != nil {
+				return nil, &jsSyntaxError{line, err.Error()}
+			}
+			tok.kind = jsTokenRegExp
+			tok.value = source
+			tok.flags = flags
+			i += size
+		default:
+			matched := ""
+			for _, p := range jsPunctuators {
+				if strings.HasPrefix(src[i:], p) {
+					matched = p
+					break
+				}
+			}
+			if matched == "" {
+				r, _ := utf8.DecodeRuneInString(src[i:])
+				return nil, &jsSyntaxError{line, fmt.Sprintf("unexpected character %q", r)}
+			}
+			tok.kind = jsTokenPunct
+			tok.value = matched
+			i += len(matched)
+		}
+		tokens = append(tokens, tok)
+		nl = false
+	}
+	tokens = append(tokens, jsToken{kind: jsTokenEOF, line: line, nl: true})
+	return tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isJSIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '$'
+}
+
+func isJSIdentPart(c byte) bool {
+	return isJSIdentStart(c) || isDigit(c)
+}
+
+/*
+Scan a numeric literal at the start of s.
+Returns:
+	The value, the number of bytes consumed, and an error if the literal is malformed.
+*/
+func jsScanNumber(s string) (float64, int, error) {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		j := 2
+		for j < len(s) && isHexDigit(s[j]) {
+			j++
+		}
+		n, err := strconv.ParseUint(s[2:j], 16, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid number %q", s[:j])
+		}
+		return float64(n), j, nil
+	}
+	j := 0
+	for j < len(s) && isDigit(s[j]) {
+		j++
+	}
+	if j < len(s) && s[j] == '.' {
+		j++
+		for j < len(s) && isDigit(s[j]) {
+			j++
+		}
+	}
+	if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+		k := j + 1
+		if k < len(s) && (s[k] == '+' || s[k] == '-') {
+			k++
+		}
+		if k < len(s) && isDigit(s[k]) {
+			for k < len(s) && isDigit(s[k]) {
+				k++
+			}
+			j = k
+		}
+	}
+	if j < len(s) && isJSIdentStart(s[j]) {
+		return 0, 0, fmt.Errorf("invalid number %q", s[:j+1])
+	}
+	n, err := strconv.ParseFloat(s[:j], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid number %q", s[:j])
+	}
+	return n, j, nil
+}
+
+/*
+Scan a quoted string literal at the start of s, resolving escape sequences.
+Returns:
+	The string value, the number of bytes consumed, and an error if the literal is malformed.
+*/
+func jsScanString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	i := 1
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case c == '\\':
+			i++
+			if i >= len(s) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			e := s[i]
+			i++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'v':
+				b.WriteByte('\v')
+			case '0':
+				b.WriteByte(0)
+			case '\r':
+				// Line continuation
+				if i < len(s) && s[i] == '\n' {
+					i++
+				}
+			case '\n':
+				// Line continuation
+			case 'x':
+				if i+2 > len(s) || !isHexDigit(s[i]) || !isHexDigit(s[i+1]) {
+					return "", 0, fmt.Errorf("invalid hexadecimal escape sequence")
+				}
+				n, _ := strconv.ParseUint(s[i:i+2], 16, 8)
+				b.WriteRune(rune(n))
+				i += 2
+			case 'u':
+				var hex string
+				if i < len(s) && s[i] == '{' {
+					end := strings.IndexByte(s[i:], '}')
+					if end < 0 {
+						return "", 0, fmt.Errorf("invalid Unicode escape sequence")
+					}
+					hex = s[i+1 : i+end]
+					i += end + 1
+				} else if i+4 <= len(s) {
+					hex = s[i : i+4]
+					i += 4
+				}
+				n, err := strconv.ParseUint(hex, 16, 32)
+				if err != nil || hex == "" {
+					return "", 0, fmt.Errorf("invalid Unicode escape sequence")
+				}
+				b.WriteRune(rune(n))
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+/*
+Scan a regular expression literal at the start of s.
+Returns:
+	The pattern source, the flags, the number of bytes consumed, and an error if the literal is malformed.
+*/
+func jsScanRegExp(s string) (string, string, int, error) {
+	inClass := false
+	i := 1
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\n' {
+			break
+		} else if c == '\\' {
+			i++
+		} else if c == '[' {
+			inClass = true
+		} else if c == ']' {
+			inClass = false
+		} else if c == '/' && !inClass {
+			j := i + 1
+			for j < len(s) && isJSIdentPart(s[j]) {
+				j++
+			}
+			return s[1:i], s[i+1 : j], j, nil
+		}
+	}
+	return "", "", 0, fmt.Errorf("unterminated regular expression")
+}
+
+// AST
+
+type jsNode interface{}
+
+type jsProgram struct {
+	body  []jsNode
+	vars  []string
+	funcs []*jsFunctionDecl
+}
+
+type jsFunctionDecl struct {
+	name   string
+	params []string
+	body   []jsNode
+	// Hoisted var declarations and function declarations
+	vars  []string
+	funcs []*jsFunctionDecl
+	// The function is a declaration rather than an expression
+	declaration bool
+}
+
+type (
+	jsLiteral struct {
+		value jsValue
+	}
+	jsIdentifier struct {
+		name string
+	}
+	jsArrayLiteral struct {
+		elements []jsNode
+	}
+	jsObjectLiteral struct {
+		keys   []string
+		values []jsNode
+	}
+	jsFunctionLiteral struct {
+		decl *jsFunctionDecl
+	}
+	jsRegExpLiteral struct {
+		source string
+		flags  string
+	}
+	jsUnary struct {
+		op      string
+		operand jsNode
+	}
+	jsUpdate struct {
+		op     string
+		prefix bool
+		target jsNode
+	}
+	jsBinary struct {
+		op          string
+		left, right jsNode
+	}
+	jsLogical struct {
+		op          string
+		left, right jsNode
+	}
+	jsConditional struct {
+		test, consequent, alternate jsNode
+	}
+	jsAssign struct {
+		op     string
+		target jsNode
+		value  jsNode
+	}
+	jsMember struct {
+		object jsNode
+		// Either the computed property expression, or nil when name is used
+		property jsNode
+		name     string
+	}
+	jsCall struct {
+		callee jsNode
+		args   []jsNode
+	}
+	jsNew struct {
+		callee jsNode
+		args   []jsNode
+	}
+	jsSequence struct {
+		exprs []jsNode
+	}
+)
+
+type (
+	jsVarDecl struct {
+		names []string
+		inits []jsNode
+	}
+	jsExprStmt struct {
+		expr jsNode
+	}
+	jsIf struct {
+		test       jsNode
+		consequent jsNode
+		alternate  jsNode
+	}
+	jsFor struct {
+		init   jsNode
+		test   jsNode
+		update jsNode
+		body   jsNode
+	}
+	jsForIn struct {
+		name   string
+		object jsNode
+		body   jsNode
+	}
+	jsWhile struct {
+		test jsNode
+		body jsNode
+	}
+	jsDoWhile struct {
+		body jsNode
+		test jsNode
+	}
+	jsReturn struct {
+		value jsNode
+	}
+	jsBreak    struct{}
+	jsContinue struct{}
+	jsBlock    struct {
+		body []jsNode
+	}
+	jsSwitch struct {
+		discriminant jsNode
+		tests        []jsNode
+		bodies       [][]jsNode
+	}
+	jsThrowStmt struct {
+		value jsNode
+	}
+	jsTry struct {
+		block     []jsNode
+		param     string
+		handler   []jsNode
+		finalizer []jsNode
+	}
+	jsEmpty struct{}
+)
+
+type jsParser struct {
+	tokens []jsToken
+	pos    int
+	// The function currently being parsed, collecting hoisted declarations
+	scope *jsFunctionDecl
+}
+
+/*
+Parse the given JavaScript source into a program.
+Params:
+	src: The JavaScript source
+Returns:
+	*jsProgram, nil: The source was parsed successfully
+	nil, error: The source contains a syntax error
+*/
+func jsParse(src string) (*jsProgram, error) {
+	tokens, err := jsTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &jsParser{tokens: tokens, scope: new(jsFunctionDecl)}
+	var body []jsNode
+	for p.peek().kind != jsTokenEOF {
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmt)
+	}
+	return &jsProgram{body: body, vars: p.scope.vars, funcs: p.scope.funcs}, nil
+}
+
+func (p *jsParser) peek() jsToken {
+	return p.tokens[p.pos]
+}
+
+func (p *jsParser) peekAt(offset int) jsToken {
+	if p.pos+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *jsParser) next() jsToken {
+	t := p.tokens[p.pos]
+	if t.kind != jsTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *jsParser) is(kind jsTokenKind, value string) bool {
+	t := p.peek()
+	return t.kind == kind && t.value == value
+}
+
+func (p *jsParser) isPunct(value string) bool {
+	return p.is(jsTokenPunct, value)
+}
+
+func (p *jsParser) isKeyword(value string) bool {
+	return p.is(jsTokenIdent, value)
+}
+
+func (p *jsParser) errorf(format string, args ...interface{}) error {
+	return &jsSyntaxError{p.peek().line, fmt.Sprintf(format, args...)}
+}
+
+func (p *jsParser) expectPunct(value string) error {
+	if !p.isPunct(value) {
+		return p.errorf("expected \"%s\" but found %s", value, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *jsParser) expectIdentifier() (string, error) {
+	t := p.peek()
+	if t.kind != jsTokenIdent || jsReservedWords[t.value] {
+		return "", p.errorf("expected identifier but found %s", t)
+	}
+	p.next()
+	return t.value, nil
+}
+
+/*
+Consume the end of a statement, applying automatic semicolon insertion.
+*/
+func (p *jsParser) consumeSemicolon() error {
+	if p.isPunct(";") {
+		p.next()
+		return nil
+	}
+	t := p.peek()
+	if t.nl || t.kind == jsTokenEOF || (t.kind == jsTokenPunct && t.value == "}") {
+		return nil
+	}
+	return p.errorf("unexpected %s", t)
+}
+
+var jsReservedWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "continue": true, "default": true, "delete": true, "do": true,
+	"else": true, "finally": true, "for": true, "function": true, "if": true, "in": true, "instanceof": true,
+	"new": true, "return": true, "switch": true, "this": true, "throw": true, "try": true, "typeof": true,
+	"var": true, "void": true, "while": true, "with": true, "null": true, "true": true, "false": true,
+	"const": true, "let": true, "class": true, "enum": true, "export": true, "extends": true, "import": true,
+	"super": true,
+}
+
+func (p *jsParser) declareVar(name string) {
+	for _, v := range p.scope.vars {
+		if v == name {
+			return
+		}
+	}
+	p.scope.vars = append(p.scope.vars, name)
+}
+
+func (p *jsParser) parseStatement() (jsNode, error) {
+	t := p.peek()
+	if t.kind == jsTokenPunct {
+		switch t.value {
+		case "{":
+			body, err := p.parseBlock()
+			if err != nil {
+				return nil, err
+			}
+			return &jsBlock{body}, nil
+		case ";":
+			p.next()
+			return &jsEmpty{}, nil
+		}
+	}
+	if t.kind == jsTokenIdent {
+		switch t.value {
+		case "var", "let", "const":
+			p.next()
+			decl, err := p.parseVarDeclarations()
+			if err != nil {
+				return nil, err
+			}
+			return decl, p.consumeSemicolon()
+		case "function":
+			p.next()
+			decl, err := p.parseFunction(true)
+			if err != nil {
+				return nil, err
+			}
+			p.scope.funcs = append(p.scope.funcs, decl)
+			return &jsEmpty{}, nil
+		case "if":
+			return p.parseIf()
+		case "for":
+			return p.parseFor()
+		case "while":
+			p.next()
+			test, err := p.parseParenthesized()
+			if err != nil {
+				return nil, err
+			}
+			body, err := p.parseStatement()
+			if err != nil {
+				return nil, err
+			}
+			return &jsWhile{test, body}, nil
+		case "do":
+			p.next()
+			body, err := p.parseStatement()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isKeyword("while") {
+				return nil, p.errorf("expected \"while\" but found %s", p.peek())
+			}
+			p.next()
+			test, err := p.parseParenthesized()
+			if err != nil {
+				return nil, err
+			}
+			if p.isPunct(";") {
+				p.next()
+			}
+			return &jsDoWhile{body, test}, nil
+		case "return":
+			p.next()
+			var value jsNode
+			if n := p.peek(); !n.nl && n.kind != jsTokenEOF && !(n.kind == jsTokenPunct && (n.value == ";" || n.value == "}")) {
+				var err error
+				if value, err = p.parseExpression(); err != nil {
+					return nil, err
+				}
+			}
+			return &jsReturn{value}, p.consumeSemicolon()
+		case "break":
+			p.next()
+			return &jsBreak{}, p.consumeSemicolon()
+		case "continue":
+			p.next()
+			return &jsContinue{}, p.consumeSemicolon()
+		case "switch":
+			return p.parseSwitch()
+		case "throw":
+			p.next()
+			if p.peek().nl {
+				return nil, p.errorf("illegal newline after throw")
+			}
+			value, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			return &jsThrowStmt{value}, p.consumeSemicolon()
+		case "try":
+			return p.parseTry()
+		}
+	}
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &jsExprStmt{expr}, p.consumeSemicolon()
+}
+
+func (p *jsParser) parseBlock() ([]jsNode, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var body []jsNode
+	for !p.isPunct("}") {
+		if p.peek().kind == jsTokenEOF {
+			return nil, p.errorf("unexpected end of script")
+		}
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmt)
+	}
+	p.next()
+	return body, nil
+}
+
+func (p *jsParser) parseParenthesized() (jsNode, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return expr, p.expectPunct(")")
+}
+
+func (p *jsParser) parseVarDeclarations() (*jsVarDecl, error) {
+	decl := new(jsVarDecl)
+	for {
+		name, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		p.declareVar(name)
+		var init jsNode
+		if p.isPunct("=") {
+			p.next()
+			if init, err = p.parseAssignment(); err != nil {
+				return nil, err
+			}
+		}
+		decl.names = append(decl.names, name)
+		decl.inits = append(decl.inits, init)
+		if !p.isPunct(",") {
+			return decl, nil
+		}
+		p.next()
+	}
+}
+
+func (p *jsParser) parseFunction(declaration bool) (*jsFunctionDecl, error) {
+	decl := &jsFunctionDecl{declaration: declaration}
+	if p.peek().kind == jsTokenIdent && !p.isPunct("(") {
+		name, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		decl.name = name
+	} else if declaration {
+		return nil, p.errorf("expected function name but found %s", p.peek())
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for !p.isPunct(")") {
+		param, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		decl.params = append(decl.params, param)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	outer := p.scope
+	p.scope = decl
+	body, err := p.parseBlock()
+	p.scope = outer
+	if err != nil {
+		return nil, err
+	}
+	decl.body = body
+	return decl, nil
+}
+
+func (p *jsParser) parseIf() (jsNode, error) {
+	p.next()
+	test, err := p.parseParenthesized()
+	if err != nil {
+		return nil, err
+	}
+	consequent, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	var alternate jsNode
+	if p.isKeyword("else") {
+		p.next()
+		if alternate, err = p.parseStatement(); err != nil {
+			return nil, err
+		}
+	}
+	return &jsIf{test, consequent, alternate}, nil
+}
+
+func (p *jsParser) parseFor() (jsNode, error) {
+	p.next()
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	// for (var k in obj) / for (k in obj)
+	offset := 0
+	if p.isKeyword("var") || p.isKeyword("let") || p.isKeyword("const") {
+		offset = 1
+	}
+	if name := p.peekAt(offset); name.kind == jsTokenIdent && !jsReservedWords[name.value] {
+		if in := p.peekAt(offset + 1); in.kind == jsTokenIdent && in.value == "in" {
+			p.pos += offset + 2
+			if offset == 1 {
+				p.declareVar(name.value)
+			}
+			object, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+			body, err := p.parseStatement()
+			if err != nil {
+				return nil, err
+			}
+			return &jsForIn{name.value, object, body}, nil
+		}
+	}
+	loop := new(jsFor)
+	var err error
+	if offset == 1 {
+		p.next()
+		if loop.init, err = p.parseVarDeclarations(); err != nil {
+			return nil, err
+		}
+	} else if !p.isPunct(";") {
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		loop.init = &jsExprStmt{expr}
+	}
+	if err = p.expectPunct(";"); err != nil {
+		return nil, err
+	}
+	if !p.isPunct(";") {
+		if loop.test, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expectPunct(";"); err != nil {
+		return nil, err
+	}
+	if !p.isPunct(")") {
+		if loop.update, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	if loop.body, err = p.parseStatement(); err != nil {
+		return nil, err
+	}
+	return loop, nil
+}
+
+func (p *jsParser) parseSwitch() (jsNode, error) {
+	p.next()
+	discriminant, err := p.parseParenthesized()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	s := &jsSwitch{discriminant: discriminant}
+	for !p.isPunct("}") {
+		var test jsNode
+		if p.isKeyword("case") {
+			p.next()
+			if test, err = p.parseExpression(); err != nil {
+				return nil, err
+			}
+		} else if p.isKeyword("default") {
+			p.next()
+			test = nil
+		} else {
+			return nil, p.errorf("expected \"case\" but found %s", p.peek())
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		var body []jsNode
+		for !p.isKeyword("case") && !p.isKeyword("default") && !p.isPunct("}") {
+			if p.peek().kind == jsTokenEOF {
+				return nil, p.errorf("unexpected end of script")
+			}
+			stmt, err := p.parseStatement()
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, stmt)
+		}
+		s.tests = append(s.tests, test)
+		s.bodies = append(s.bodies, body)
+	}
+	p.next()
+	return s, nil
+}
+
+func (p *jsParser) parseTry() (jsNode, error) {
+	p.next()
+	block, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	t := &jsTry{block: block}
+	if p.isKeyword("catch") {
+		p.next()
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		if t.param, err = p.expectIdentifier(); err != nil {
+			return nil, err
+		}
+		p.declareVar(t.param)
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		if t.handler, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+		if t.handler == nil {
+			t.handler = []jsNode{}
+		}
+	}
+	if p.isKeyword("finally") {
+		p.next()
+		if t.finalizer, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+		if t.finalizer == nil {
+			t.finalizer = []jsNode{}
+		}
+	}
+	if t.handler == nil && t.finalizer == nil {
+		return nil, p.errorf("missing catch or finally after try")
+	}
+	return t, nil
+}
+
+func (p *jsParser) parseExpression() (jsNode, error) {
+	expr, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isPunct(",") {
+		return expr, nil
+	}
+	seq := &jsSequence{exprs: []jsNode{expr}}
+	for p.isPunct(",") {
+		p.next()
+		expr, err := p.parseAssignment()
+		if err != nil {
+			return nil, err
+		}
+		seq.exprs = append(seq.exprs, expr)
+	}
+	return seq, nil
+}
+
+var jsAssignmentOperators = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"&=": true, "|=": true, "^=": true, "<<=": true, ">>=": true, ">>>=": true,
+}
+
+func (p *jsParser) parseAssignment() (jsNode, error) {
+	left, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != jsTokenPunct || !jsAssignmentOperators[t.value] {
+		return left, nil
+	}
+	switch left.(type) {
+	case *jsIdentifier, *jsMember:
+	default:
+		return nil, p.errorf("invalid assignment target")
+	}
+	p.next()
+	value, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	return &jsAssign{t.value, left, value}, nil
+}
+
+func (p *jsParser) parseConditional() (jsNode, error) {
+	test, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isPunct("?") {
+		return test, nil
+	}
+	p.next()
+	consequent, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(":"); err != nil {
+		return nil, err
+	}
+	alternate, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	return &jsConditional{test, consequent, alternate}, nil
+}
+
+// Binary operator precedence, higher binds tighter
+var jsBinaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6, "===": 6, "!==": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7, "in": 7, "instanceof": 7,
+	"<<": 8, ">>": 8, ">>>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+func (p *jsParser) binaryOperator() (string, int) {
+	t := p.peek()
+	if t.kind != jsTokenPunct && !(t.kind == jsTokenIdent && (t.value == "in" || t.value == "instanceof")) {
+		return "", 0
+	}
+	prec, ok := jsBinaryPrecedence[t.value]
+	if !ok {
+		return "", 0
+	}
+	return t.value, prec
+}
+
+func (p *jsParser) parseBinary(minPrec int) (jsNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, prec := p.binaryOperator()
+		if prec == 0 || prec <= minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec)
+		if err != nil {
+			return nil, err
+		}
+		if op == "&&" || op == "||" {
+			left = &jsLogical{op, left, right}
+		} else {
+			left = &jsBinary{op, left, right}
+		}
+	}
+}
+
+func (p *jsParser) parseUnary() (jsNode, error) {
+	t := p.peek()
+	if (t.kind == jsTokenPunct && (t.value == "!" || t.value == "-" || t.value == "+" || t.value == "~")) ||
+		(t.kind == jsTokenIdent && (t.value == "typeof" || t.value == "void" || t.value == "delete")) {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &jsUnary{t.value, operand}, nil
+	}
+	if t.kind == jsTokenPunct && (t.value == "++" || t.value == "--") {
+		p.next()
+		target, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if !isJSAssignable(target) {
+			return nil, p.errorf("invalid increment/decrement operand")
+		}
+		return &jsUpdate{t.value, true, target}, nil
+	}
+	expr, err := p.parseCallOrMember()
+	if err != nil {
+		return nil, err
+	}
+	if n := p.peek(); n.kind == jsTokenPunct && (n.value == "++" || n.value == "--") && !n.nl {
+		if !isJSAssignable(expr) {
+			return nil, p.errorf("invalid increment/decrement operand")
+		}
+		p.next()
+		return &jsUpdate{n.value, false, expr}, nil
+	}
+	return expr, nil
+}
+
+func isJSAssignable(n jsNode) bool {
+	switch n.(type) {
+	case *jsIdentifier, *jsMember:
+		return true
+	}
+	return false
+}
+
+func (p *jsParser) parseArguments() ([]jsNode, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var args []jsNode
+	for !p.isPunct(")") {
+		arg, err := p.parseAssignment()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	return args, p.expectPunct(")")
+}
+
+func (p *jsParser) parseCallOrMember() (jsNode, error) {
+	var expr jsNode
+	var err error
+	if p.isKeyword("new") {
+		p.next()
+		callee, err := p.parseNewCallee()
+		if err != nil {
+			return nil, err
+		}
+		var args []jsNode
+		if p.isPunct("(") {
+			if args, err = p.parseArguments(); err != nil {
+				return nil, err
+			}
+		}
+		expr = &jsNew{callee, args}
+	} else if expr, err = p.parsePrimary(); err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isPunct("."):
+			p.next()
+			t := p.next()
+			if t.kind != jsTokenIdent {
+				return nil, &jsSyntaxError{t.line, fmt.Sprintf("expected property name but found %s", t)}
+			}
+			expr = &jsMember{object: expr, name: t.value}
+		case p.isPunct("["):
+			p.next()
+			property, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("]"); err != nil {
+				return nil, err
+			}
+			expr = &jsMember{object: expr, property: property}
+		case p.isPunct("("):
+			args, err := p.parseArguments()
+			if err != nil {
+				return nil, err
+			}
+			expr = &jsCall{expr, args}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+/*
+Parse the callee of a "new" expression, which is a member expression without call arguments.
+*/
+func (p *jsParser) parseNewCallee() (jsNode, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct(".") {
+		p.next()
+		t := p.next()
+		if t.kind != jsTokenIdent {
+			return nil, &jsSyntaxError{t.line, fmt.Sprintf("expected property name but found %s", t)}
+		}
+		expr = &jsMember{object: expr, name: t.value}
+	}
+	return expr, nil
+}
+
+func (p *jsParser) parsePrimary() (jsNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case jsTokenNumber:
+		p.next()
+		return &jsLiteral{t.num}, nil
+	case jsTokenString:
+		p.next()
+		return &jsLiteral{t.value}, nil
+	case jsTokenRegExp:
+		p.next()
+		return &jsRegExpLiteral{t.value, t.flags}, nil
+	case jsTokenIdent:
+		switch t.value {
+		case "true":
+			p.next()
+			return &jsLiteral{true}, nil
+		case "false":
+			p.next()
+			return &jsLiteral{false}, nil
+		case "null":
+			p.next()
+			return &jsLiteral{nil}, nil
+		case "this":
+			p.next()
+			return &jsIdentifier{"this"}, nil
+		case "function":
+			p.next()
+			decl, err := p.parseFunction(false)
+			if err != nil {
+				return nil, err
+			}
+			return &jsFunctionLiteral{decl}, nil
+		}
+		if jsReservedWords[t.value] {
+			return nil, p.errorf("unexpected %s", t)
+		}
+		p.next()
+		return &jsIdentifier{t.value}, nil
+	case jsTokenPunct:
+		switch t.value {
+		case "(":
+			return p.parseParenthesized()
+		case "[":
+			p.next()
+			arr := new(jsArrayLiteral)
+			for !p.isPunct("]") {
+				if p.isPunct(",") {
+					// Elision
+					p.next()
+					arr.elements = append(arr.elements, nil)
+					continue
+				}
+				elem, err := p.parseAssignment()
+				if err != nil {
+					return nil, err
+				}
+				arr.elements = append(arr.elements, elem)
+				if !p.isPunct(",") {
+					break
+				}
+				p.next()
+			}
+			return arr, p.expectPunct("]")
+		case "{":
+			p.next()
+			obj := new(jsObjectLiteral)
+			for !p.isPunct("}") {
+				k := p.next()
+				var key string
+				switch k.kind {
+				case jsTokenIdent, jsTokenString:
+					key = k.value
+				case jsTokenNumber:
+					key = jsNumberToString(k.num)
+				default:
+					return nil, &jsSyntaxError{k.line, fmt.Sprintf("expected property name but found %s", k)}
+				}
+				if err := p.expectPunct(":"); err != nil {
+					return nil, err
+				}
+				value, err := p.parseAssignment()
+				if err != nil {
+					return nil, err
+				}
+				obj.keys = append(obj.keys, key)
+				obj.values = append(obj.values, value)
+				if !p.isPunct(",") {
+					break
+				}
+				p.next()
+			}
+			return obj, p.expectPunct("}")
+		}
+	}
+	return nil, p.errorf("unexpected %s", t)
+}
@@ -0,0 +1,136 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	pacDirectiveDirect = "DIRECT"
+	pacResultSep       = ";"
+)
+
+// PAC directive -> proxy protocol
+var pacDirectiveProtocols = map[string]string{
+	"PROXY":  protocolHTTP,
+	"HTTP":   protocolHTTP,
+	"HTTPS":  protocolHTTPS,
+	"SOCKS":  protocolSOCKS4,
+	"SOCKS4": protocolSOCKS4,
+	"SOCKS5": protocolSOCKS5,
+}
+
+// Ports used by browsers when a PAC directive omits one
+var pacDefaultPorts = map[string]uint16{
+	protocolHTTP:   80,
+	protocolHTTPS:  443,
+	protocolSOCKS4: 1080,
+	protocolSOCKS5: 1080,
+}
+
+/*
+Parse the return value of a PAC FindProxyForURL call into an ordered list of candidates.
+Each entry is one of the following (case insensitive), separated by ";":
+	DIRECT
+	PROXY host[:port] or HTTP host[:port] -> http, default port 80
+	HTTPS host[:port] -> https, default port 443
+	SOCKS host[:port] or SOCKS4 host[:port] -> socks4, default port 1080
+	SOCKS5 host[:port] -> socks5, default port 1080
+DIRECT entries are returned as a Proxy for which IsDirect returns true, preserving their position so that callers
+can implement the PAC fallback order. Invalid entries are logged and skipped. An empty result is treated as DIRECT.
+For example:
+	("PROXY a:3128; SOCKS5 b; DIRECT", "PAC") -> [http://a:3128, socks5://b:1080, DIRECT]
+	("", "PAC") -> [DIRECT]
+	("BOGUS a:1", "PAC") -> error
+Params:
+	result: The string returned by FindProxyForURL.
+	src: Human readable location where this result was found. Used as the Src of every returned Proxy.
+Returns:
+	[]Proxy, nil: At least one valid entry was found.
+	nil, *ParseError: The result was non empty, but contained no valid entries.
+*/
+func ParsePACResult(result string, src string) ([]Proxy, error) {
+	return parsePACResult(result, src, log.Default())
+}
+
+/*
+ParsePACResult, writing invalid entries to logger.
+*/
+func parsePACResult(result string, src string, logger *log.Logger) ([]Proxy, error) {
+	if strings.TrimSpace(result) == "" {
+		return []Proxy{NewDirectProxy(src)}, nil
+	}
+	var (
+		proxies []Proxy
+		lastErr error
+	)
+	for _, entry := range strings.Split(result, pacResultSep) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		p, err := parsePACEntry(entry, src)
+		if err != nil {
+			logger.Printf("[proxy.ParsePACResult]: invalid PAC entry, skipping %q: %s\n", entry, err)
+			lastErr = err
+			continue
+		}
+		proxies = append(proxies, p)
+	}
+	if len(proxies) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no entries in PAC result %q", result)
+		}
+		return nil, &ParseError{Src: src, Value: result, Err: lastErr}
+	}
+	return proxies, nil
+}
+
+func parsePACEntry(entry string, src string) (Proxy, error) {
+	fields := strings.Fields(entry)
+	directive := strings.ToUpper(fields[0])
+	if directive == pacDirectiveDirect {
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("unexpected value after %s: %q", pacDirectiveDirect, entry)
+		}
+		return NewDirectProxy(src), nil
+	}
+	protocol, ok := pacDirectiveProtocols[directive]
+	if !ok {
+		return nil, fmt.Errorf("unknown PAC directive: %q", fields[0])
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("expected a single host[:port] after %s: %q", directive, entry)
+	}
+	host, port, err := SplitHostPort(&url.URL{Host: fields[1]})
+	if err != nil {
+		return nil, err
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return nil, fmt.Errorf("empty host: %q", entry)
+	}
+	if port == 0 {
+		port = pacDefaultPorts[protocol]
+	}
+	return NewProxy(&url.URL{
+		Scheme: protocol,
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}, src)
+}
@@ -0,0 +1,134 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var dataParsePACResult = []struct {
+	result    string
+	expectP   []Proxy
+	expectErr error
+}{
+	// All directives, in order
+	{
+		"PROXY a:3128; SOCKS5 b:1081; HTTPS c:8443; SOCKS d:1082; SOCKS4 e:1083; HTTP f:8080; DIRECT",
+		[]Proxy{
+			&proxy{protocol: "http", host: "a", port: 3128, src: "PAC"},
+			&proxy{protocol: "socks5", host: "b", port: 1081, src: "PAC"},
+			&proxy{protocol: "https", host: "c", port: 8443, src: "PAC"},
+			&proxy{protocol: "socks4", host: "d", port: 1082, src: "PAC"},
+			&proxy{protocol: "socks4", host: "e", port: 1083, src: "PAC"},
+			&proxy{protocol: "http", host: "f", port: 8080, src: "PAC"},
+			&directProxy{src: "PAC"},
+		}, nil,
+	},
+	// Default ports
+	{
+		"PROXY a; HTTPS b; SOCKS c; SOCKS5 d",
+		[]Proxy{
+			&proxy{protocol: "http", host: "a", port: 80, src: "PAC"},
+			&proxy{protocol: "https", host: "b", port: 443, src: "PAC"},
+			&proxy{protocol: "socks4", host: "c", port: 1080, src: "PAC"},
+			&proxy{protocol: "socks5", host: "d", port: 1080, src: "PAC"},
+		}, nil,
+	},
+	// DIRECT first
+	{
+		"DIRECT; PROXY a:3128",
+		[]Proxy{
+			&directProxy{src: "PAC"},
+			&proxy{protocol: "http", host: "a", port: 3128, src: "PAC"},
+		}, nil,
+	},
+	// Case and whitespace
+	{
+		"  proxy   a:3128 ;;\tdirect;  ",
+		[]Proxy{
+			&proxy{protocol: "http", host: "a", port: 3128, src: "PAC"},
+			&directProxy{src: "PAC"},
+		}, nil,
+	},
+	// IPv6
+	{
+		"PROXY [::1]:3128; SOCKS5 [2001:db8::1]",
+		[]Proxy{
+			&proxy{protocol: "http", host: "[::1]", port: 3128, src: "PAC"},
+			&proxy{protocol: "socks5", host: "[2001:db8::1]", port: 1080, src: "PAC"},
+		}, nil,
+	},
+	// Invalid entries are skipped
+	{
+		"BOGUS a:1; PROXY; PROXY b:notAPort; PROXY c d; DIRECT x; PROXY e:3128",
+		[]Proxy{
+			&proxy{protocol: "http", host: "e", port: 3128, src: "PAC"},
+		}, nil,
+	},
+	// Empty
+	{
+		"",
+		[]Proxy{&directProxy{src: "PAC"}}, nil,
+	},
+	// Only invalid entries
+	{
+		"BOGUS a:1",
+		nil, errors.New("unknown PAC directive: \"BOGUS\""),
+	},
+	{
+		"PROXY a:99999",
+		nil, errors.New("value out of range"),
+	},
+	{
+		";;",
+		nil, errors.New("no entries in PAC result"),
+	},
+}
+
+func TestParsePACResult(t *testing.T) {
+	for _, tt := range dataParsePACResult {
+		t.Run(tt.result, func(t *testing.T) {
+			a := assert.New(t)
+			ps, err := ParsePACResult(tt.result, "PAC")
+			a.Equal(tt.expectP, ps)
+			if tt.expectErr == nil {
+				a.Nil(err)
+			} else if a.NotNil(err) {
+				a.Contains(err.Error(), tt.expectErr.Error())
+				var parseErr *ParseError
+				if a.True(errors.As(err, &parseErr)) {
+					a.Equal(tt.result, parseErr.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestDirectProxy(t *testing.T) {
+	a := assert.New(t)
+	p := NewDirectProxy("PAC")
+	a.True(IsDirect(p))
+	a.Equal("direct", p.Protocol())
+	a.Equal("", p.Host())
+	a.Equal(uint16(0), p.Port())
+	a.Equal("PAC", p.Src())
+	a.Equal("direct:", p.URL().String())
+	a.Equal("PAC|DIRECT", p.String())
+	b, err := p.MarshalJSON()
+	a.Nil(err)
+	a.JSONEq(`{"protocol":"direct","host":null,"port":null,"src":"PAC","username":null,"password":null}`, string(b))
+	a.False(IsDirect(nil))
+	a.False(IsDirect(&proxy{protocol: "http", host: "a", port: 80}))
+}
@@ -0,0 +1,365 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPACScript = `
+// Typical corporate PAC file
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || dnsDomainIs(host, ".corp.rapid7.com")) {
+		return "DIRECT";
+	}
+	if (shExpMatch(url, "*://*.internal.example.com/*") || isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) {
+		return "DIRECT";
+	}
+	if (isInNet(myIpAddress(), "192.168.0.0", "255.255.0.0")) {
+		return "PROXY branch-proxy:3128; DIRECT";
+	}
+	if (weekdayRange("SAT", "SUN")) {
+		return "PROXY weekend-proxy:8080";
+	}
+	return "PROXY proxy1.rapid7.com:8080; PROXY proxy2.rapid7.com:8080";
+}
+`
+
+var dataPACFindProxyForURL = []struct {
+	targetUrl string
+	host      string
+	myIP      string
+	expect    string
+}{
+	{"http://intranet/", "intranet", "172.16.0.1", "DIRECT"},
+	{"https://wiki.corp.rapid7.com/", "wiki.corp.rapid7.com", "172.16.0.1", "DIRECT"},
+	{"https://WIKI.CORP.RAPID7.COM/", "WIKI.CORP.RAPID7.COM", "172.16.0.1", "DIRECT"},
+	{"https://app.internal.example.com/path", "app.internal.example.com", "172.16.0.1", "DIRECT"},
+	{"https://private.rapid7.com/", "private.rapid7.com", "172.16.0.1", "DIRECT"},
+	{"https://rapid7.com/", "rapid7.com", "192.168.1.20", "PROXY branch-proxy:3128; DIRECT"},
+	{"https://rapid7.com/", "rapid7.com", "172.16.0.1", "PROXY proxy1.rapid7.com:8080; PROXY proxy2.rapid7.com:8080"},
+	{"https://unresolvable.rapid7.com/", "unresolvable.rapid7.com", "172.16.0.1", "PROXY proxy1.rapid7.com:8080; PROXY proxy2.rapid7.com:8080"},
+	// Host derived from the URL
+	{"https://private.rapid7.com:443/", "", "172.16.0.1", "DIRECT"},
+}
+
+func TestPAC_FindProxyForURL(t *testing.T) {
+	for _, tt := range dataPACFindProxyForURL {
+		t.Run(tt.targetUrl+" "+tt.myIP, func(t *testing.T) {
+			a := assert.New(t)
+			p, err := newTestPAC(testPACScript)
+			if !a.NoError(err) {
+				return
+			}
+			p.localIPs = func(*log.Logger) []net.IP {
+				return []net.IP{net.ParseIP(tt.myIP)}
+			}
+			result, err := p.FindProxyForURL(tt.targetUrl, tt.host)
+			a.NoError(err)
+			a.Equal(tt.expect, result)
+		})
+	}
+}
+
+func TestPAC_FindProxyForURL_weekend(t *testing.T) {
+	a := assert.New(t)
+	p, err := newTestPAC(testPACScript)
+	if !a.NoError(err) {
+		return
+	}
+	// Saturday
+	p.now = func() time.Time {
+		return time.Date(2018, time.June, 16, 10, 0, 0, 0, time.UTC)
+	}
+	result, err := p.FindProxyForURL("https://rapid7.com", "rapid7.com")
+	a.NoError(err)
+	a.Equal("PROXY weekend-proxy:8080", result)
+}
+
+func TestPAC_FindProxyForURLEx(t *testing.T) {
+	a := assert.New(t)
+	p, err := newTestPAC(`
+		function FindProxyForURL(url, host) { return "PROXY legacy:80"; }
+		function FindProxyForURLEx(url, host) {
+			if (isInNetEx(host, "2001:db8::/32")) {
+				return "DIRECT";
+			}
+			return "PROXY ex:80";
+		}`)
+	if !a.NoError(err) {
+		return
+	}
+	result, err := p.FindProxyForURL("http://[2001:db8::1]/", "")
+	a.NoError(err)
+	a.Equal("DIRECT", result)
+	result, err = p.FindProxyForURL("http://rapid7.com/", "")
+	a.NoError(err)
+	a.Equal("PROXY ex:80", result)
+}
+
+func TestPAC_FindProxyForURL_functionExpression(t *testing.T) {
+	a := assert.New(t)
+	p, err := NewPAC(`var FindProxyForURL = function(url, host) { return "PROXY " + host + ":80"; };`)
+	if !a.NoError(err) {
+		return
+	}
+	result, err := p.FindProxyForURL("http://test/", "test")
+	a.NoError(err)
+	a.Equal("PROXY test:80", result)
+}
+
+var dataPACInvalid = []struct {
+	script string
+	expect string
+}{
+	{"", "does not define FindProxyForURL"},
+	{"function findProxyForURL(url, host) { return 'DIRECT'; }", "does not define FindProxyForURL"},
+	{"function FindProxyForURL(url, host) { return 'DIRECT';", "SyntaxError"},
+}
+
+func TestNewPAC_invalid(t *testing.T) {
+	for _, tt := range dataPACInvalid {
+		t.Run(tt.script, func(t *testing.T) {
+			a := assert.New(t)
+			p, err := NewPAC(tt.script)
+			a.Nil(p)
+			if a.Error(err) {
+				a.Contains(err.Error(), tt.expect)
+			}
+		})
+	}
+}
+
+var dataPACEvaluationError = []struct {
+	script string
+	expect string
+}{
+	{"function FindProxyForURL(url, host) { return undefinedVariable; }", "ReferenceError"},
+	{"function FindProxyForURL(url, host) { }", "FindProxyForURL returned undefined"},
+	{"function FindProxyForURL(url, host) { return null; }", "FindProxyForURL returned null"},
+	{"function FindProxyForURL(url, host) { while (true) {} }", "maximum number of execution steps"},
+	{"throw 'init'; function FindProxyForURL(url, host) { return 'DIRECT'; }", "uncaught exception: init"},
+	{"var FindProxyForURL = 'DIRECT';", "is not a function"},
+}
+
+func TestPAC_FindProxyForURL_error(t *testing.T) {
+	for _, tt := range dataPACEvaluationError {
+		t.Run(tt.script, func(t *testing.T) {
+			a := assert.New(t)
+			p, err := newTestPAC(tt.script)
+			if !a.NoError(err) {
+				return
+			}
+			result, err := p.FindProxyForURL("http://test", "test")
+			a.Equal("", result)
+			if a.Error(err) {
+				a.Contains(err.Error(), tt.expect)
+			}
+		})
+	}
+}
+
+var dataPACHelpers = []struct {
+	call   string
+	expect string
+}{
+	{"isPlainHostName('www')", "true"},
+	{"isPlainHostName('www.rapid7.com')", "false"},
+	{"dnsDomainIs('www.rapid7.com', '.rapid7.com')", "true"},
+	{"dnsDomainIs('www', '.rapid7.com')", "false"},
+	{"dnsDomainIs('www.example.com', '.rapid7.com')", "false"},
+	{"localHostOrDomainIs('www.rapid7.com', 'www.rapid7.com')", "true"},
+	{"localHostOrDomainIs('www', 'www.rapid7.com')", "true"},
+	{"localHostOrDomainIs('www.example.com', 'www.rapid7.com')", "false"},
+	{"localHostOrDomainIs('home.rapid7.com', 'www.rapid7.com')", "false"},
+	{"isResolvable('private.rapid7.com')", "true"},
+	{"isResolvable('unresolvable.rapid7.com')", "false"},
+	{"isResolvable('1.2.3.4')", "true"},
+	{"isInNet('private.rapid7.com', '10.0.0.0', '255.0.0.0')", "true"},
+	{"isInNet('10.1.2.3', '10.1.0.0', '255.255.0.0')", "true"},
+	{"isInNet('10.2.2.3', '10.1.0.0', '255.255.0.0')", "false"},
+	{"isInNet('unresolvable.rapid7.com', '0.0.0.0', '0.0.0.0')", "false"},
+	{"isInNet('10.1.2.3', 'invalid', '255.0.0.0')", "false"},
+	{"dnsResolve('private.rapid7.com')", "10.1.2.3"},
+	{"dnsResolve('dualstack.rapid7.com')", "192.0.2.1"},
+	{"dnsResolve('unresolvable.rapid7.com')", "null"},
+	{"myIpAddress()", "172.16.0.1"},
+	{"dnsDomainLevels('www')", "0"},
+	{"dnsDomainLevels('www.rapid7.com')", "2"},
+	{"shExpMatch('http://home.rapid7.com/people/index.html', '*/people/*')", "true"},
+	{"shExpMatch('http://home.rapid7.com/local/index.html', '*/people/*')", "false"},
+	{"shExpMatch('www.rapid7.com', 'www.rapid?.com')", "true"},
+	{"shExpMatch('www.rapid7.com', 'www.rapid7.c')", "false"},
+	{"shExpMatch('wwwXrapid7.com', 'www.rapid7.com')", "false"},
+	{"shExpMatch('www.rapid7.com', '*')", "true"},
+	{"shExpMatch('', '*')", "true"},
+	{"shExpMatch('', '?')", "false"},
+	{"shExpMatch('www.rapid7.com', '*.*.com')", "true"},
+	{"shExpMatch('www.rapid7.com.au', '*.com')", "false"},
+	{"shExpMatch('a.b.c.d', 'a**d')", "true"},
+	{"shExpMatch('abcbcd', 'a*bcd')", "true"},
+	{"shExpMatch('[rapid7]', '[rapid7]')", "true"},
+	{"isResolvableEx('dualstack.rapid7.com')", "true"},
+	{"dnsResolveEx('dualstack.rapid7.com')", "2001:db8::1;192.0.2.1"},
+	{"dnsResolveEx('unresolvable.rapid7.com')", ""},
+	{"myIpAddressEx()", "172.16.0.1"},
+	{"isInNetEx('dualstack.rapid7.com', '2001:db8::/32')", "true"},
+	{"isInNetEx('private.rapid7.com', '192.0.2.0/24')", "false"},
+	{"sortIpAddressList('10.2.3.9;2001:4898:28:3:201:2ff:feea:fc14;10.2.3.5')", "2001:4898:28:3:201:2ff:feea:fc14;10.2.3.5;10.2.3.9"},
+	{"sortIpAddressList('10.2.3.9;invalid')", ""},
+	{"convert_addr('104.16.41.2')", "1745889538"},
+	{"getClientVersion()", "1.0"},
+	// Friday 2018-06-15 13:30:00 UTC, 15:30:00 local (UTC+2)
+	{"weekdayRange('MON', 'FRI')", "true"},
+	{"weekdayRange('FRI')", "true"},
+	{"weekdayRange('SAT', 'SUN')", "false"},
+	{"weekdayRange('THU', 'MON')", "true"},
+	{"weekdayRange('SAT', 'THU')", "false"},
+	{"weekdayRange('FRI', 'GMT')", "true"},
+	{"weekdayRange('INVALID')", "false"},
+	{"dateRange(15)", "true"},
+	{"dateRange(1, 14)", "false"},
+	{"dateRange(10, 20)", "true"},
+	{"dateRange(20, 16)", "true"},
+	{"dateRange(20, 14)", "false"},
+	{"dateRange('JUN')", "true"},
+	{"dateRange('MAY', 'JUL')", "true"},
+	{"dateRange('NOV', 'FEB')", "false"},
+	{"dateRange('OCT', 'JUN')", "true"},
+	{"dateRange(2018)", "true"},
+	{"dateRange(2016, 2017)", "false"},
+	{"dateRange(1, 'JUN', 15, 'JUN')", "true"},
+	{"dateRange(16, 'JUN', 1, 'JUL')", "false"},
+	{"dateRange(1, 'DEC', 20, 'JUN')", "true"},
+	{"dateRange('APR', 2018, 'JAN', 2019)", "true"},
+	{"dateRange('JUL', 2018, 'JAN', 2019)", "false"},
+	{"dateRange(1, 'JUN', 2018, 15, 'JUN', 2018)", "true"},
+	{"dateRange(16, 'JUN', 2018, 15, 'JUN', 2019)", "false"},
+	{"dateRange(15, 'GMT')", "true"},
+	{"dateRange(1, 2, 3)", "false"},
+	{"dateRange('INVALID')", "false"},
+	{"timeRange(15)", "true"},
+	{"timeRange(13, 'GMT')", "true"},
+	{"timeRange(9, 17)", "true"},
+	{"timeRange(16, 17)", "false"},
+	{"timeRange(22, 16)", "true"},
+	{"timeRange(15, 0, 15, 30)", "true"},
+	{"timeRange(15, 31, 17, 0)", "false"},
+	{"timeRange(15, 30, 0, 15, 30, 0)", "true"},
+	{"timeRange(15, 30, 1, 15, 30, 59)", "false"},
+	{"timeRange(1, 2, 3)", "false"},
+}
+
+func TestPAC_Helpers(t *testing.T) {
+	for _, tt := range dataPACHelpers {
+		t.Run(tt.call, func(t *testing.T) {
+			a := assert.New(t)
+			p, err := newTestPAC(fmt.Sprintf("function FindProxyForURL(url, host) { return '' + %s; }", tt.call))
+			if !a.NoError(err) {
+				return
+			}
+			result, err := p.FindProxyForURL("http://test", "test")
+			a.NoError(err)
+			a.Equal(tt.expect, result)
+		})
+	}
+}
+
+func TestPAC_FindProxyForURL_dnsCache(t *testing.T) {
+	a := assert.New(t)
+	p, err := newTestPAC(`function FindProxyForURL(url, host) {
+		if (isInNet(host, "192.168.0.0", "255.255.0.0") || isInNet(host, "172.16.0.0", "255.240.0.0") || isInNet(host, "10.0.0.0", "255.0.0.0")) {
+			return "DIRECT";
+		}
+		return "PROXY proxy:80";
+	}`)
+	if !a.NoError(err) {
+		return
+	}
+	lookups := 0
+	p.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	result, err := p.FindProxyForURL("http://private", "private")
+	a.NoError(err)
+	a.Equal("DIRECT", result)
+	a.Equal(1, lookups)
+}
+
+func newTestPAC(script string) (*pac, error) {
+	p, err := newPAC(script, defaultResolveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string][]net.IP{
+		"private.rapid7.com":   {net.ParseIP("10.1.2.3")},
+		"rapid7.com":           {net.ParseIP("104.16.41.2")},
+		"dualstack.rapid7.com": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+	}
+	p.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if ips, ok := hosts[strings.ToLower(host)]; ok {
+			return ips, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	p.localIPs = func(*log.Logger) []net.IP {
+		return []net.IP{net.ParseIP("172.16.0.1")}
+	}
+	p.now = func() time.Time {
+		return time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC).In(time.FixedZone("UTC+2", 2*60*60))
+	}
+	return p, nil
+}
+
+func TestPAC_FindProxyForURL_cancelled(t *testing.T) {
+	a := assert.New(t)
+	p, err := newTestPAC(`function FindProxyForURL(url, host) {
+		while (true) {
+		}
+	}`)
+	if !a.NoError(err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = p.findProxyForURL(ctx, log.Default(), "http://rapid7.com", "rapid7.com")
+	a.True(errors.Is(err, context.Canceled))
+	a.Less(time.Since(start), 5*time.Second)
+}
+
+func TestPAC_FindProxyForURL_logger(t *testing.T) {
+	a := assert.New(t)
+	p, err := newTestPAC(`function FindProxyForURL(url, host) {
+		alert("evaluating " + host);
+		dnsResolve("unknown.rapid7.com");
+		return "DIRECT";
+	}`)
+	if !a.NoError(err) {
+		return
+	}
+	var b strings.Builder
+	_, err = p.findProxyForURL(context.Background(), log.New(&b, "", 0), "http://rapid7.com", "rapid7.com")
+	a.NoError(err)
+	a.Equal("[proxy.PAC.alert]: evaluating rapid7.com\n[proxy.PAC.resolve]: failed to resolve \"unknown.rapid7.com\": no such host\n", b.String())
+}
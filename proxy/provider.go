@@ -15,6 +15,7 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -24,7 +25,33 @@ import (
 	"strings"
 )
 
+/*
+Looks up proxy configurations, distinguishing why no proxy is to be used, and reporting why none was found.
+*/
+type ProviderV2 interface {
+	/*
+		Returns the proxy configuration for the given traffic protocol and targetUrl.
+		Params:
+			ctx: Bounds the lookup. Sources which require external resources (i.e. WPAD/PAC) are abandoned once it is done.
+			protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+			targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+		Returns:
+			Result, nil: A proxy was found, a PAC script prefers a direct connection, or targetUrl is bypassed.
+			Result, error: No source is configured for targetUrl.
+				errors.Is(err, ErrNotFound): Nothing was found before the sources were exhausted.
+				errors.Is(err, ErrTimeout): ctx expired before a source was found.
+				errors.Is(err, context.Canceled): ctx was cancelled before a source was found. This matches neither of the above.
+				errors.As(err, *ParseError): A source was configured with a value which could not be parsed.
+	*/
+	Lookup(ctx context.Context, protocol string, targetUrl string) (Result, error)
+}
+
+/*
+Retrieves proxy configurations. Every method is a wrapper around Lookup, which should be preferred.
+*/
 type Provider interface {
+	ProviderV2
+
 	/*
 		Returns the Proxy configuration for the given traffic protocol and targetUrl.
 		If none is found, or an error occurs, nil is returned.
@@ -96,6 +123,17 @@ type Provider interface {
 	*/
 	SetTimeouts(resolve int, connect int, send int, receive int)
 	GetProxies(protocol string, targetUrl string) []Proxy
+
+	/*
+		Performs the same lookup as GetProxies, recording every source consulted along the way.
+		Use this to diagnose why a proxy was, or was not, found.
+		Params:
+			protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+			targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+		Returns:
+			Trace: Each source consulted in order, what it read, and which source determined the result.
+	*/
+	Explain(protocol string, targetUrl string) *Trace
 }
 
 const (
@@ -103,6 +141,9 @@ const (
 	protocolHTTPS         = "https"
 	protocolFTP           = "ftp"
 	protocolSOCKS         = "socks"
+	protocolSOCKS4        = "socks4"
+	protocolSOCKS5        = "socks5"
+	protocolDirect        = "direct"
 	proxyKeyFormat        = "%s_PROXY"
 	noProxyKeyUpper       = "NO_PROXY"
 	noProxyKeyLower       = "no_proxy"
@@ -112,6 +153,8 @@ const (
 	domainDelimiter       = "."
 	bypassLocal           = "<local>"
 	srcConfigurationFile  = "ConfigurationFile"
+	configKeySources      = "sources"
+	configKeyTLS          = "tls"
 	srcEnvironmentFmt     = "Environment[%s]"
 	defaultResolveTimeout = 5000
 	defaultConnectTimeout = 5000
@@ -124,25 +167,73 @@ type getEnvAdapter func(string) string
 type commandAdapter func(context.Context, string, ...string) *exec.Cmd
 
 type provider struct {
+	sources        []Source
+	sourceOrder    []string
 	configFile     string
+	logger         *log.Logger
 	getEnv         getEnvAdapter
+	envSrc         func(key string) string
 	proc           commandAdapter
+	commands       *commandCache
+	pacFetcher     *pacFetcher
 	resolveTimeout int
 	connectTimeout int
 	sendTimeout    int
 	receiveTimeout int
 }
 
-func (p *provider) init(configFile string) {
-	p.configFile = configFile
+func (p *provider) init(sources []Source) {
+	p.sources = sources
+	p.sourceOrder = defaultSourceOrder
+	p.logger = log.Default()
 	p.getEnv = os.Getenv
+	p.envSrc = srcEnvironment
 	p.proc = exec.CommandContext
+	p.pacFetcher = defaultPACFetcher
 	p.resolveTimeout = defaultResolveTimeout
 	p.connectTimeout = defaultConnectTimeout
 	p.sendTimeout = defaultSendTimeout
 	p.receiveTimeout = defaultReceiveTimeout
 }
 
+/*
+Apply opts, and select the sources to consult according to the source order, unless they are given (WithSources).
+The "sources" key of the configuration file, if present, takes precedence over WithSourceOrder,
+so that the order of a deployed program may be adjusted.
+Params:
+	opts: The options to apply.
+Returns:
+	nil: The provider is configured.
+	error: The source order is invalid.
+*/
+func (p *provider) configure(opts []Option) error {
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.sources != nil {
+		return nil
+	}
+	order, err := p.readConfigFileSourceOrder(p.configFile)
+	if err != nil {
+		return err
+	} else if order != nil {
+		p.sourceOrder = order
+	}
+	p.sources, err = selectSources(p.configFile, p.sourceOrder)
+	return err
+}
+
+/*
+Read configFile, consulting the sources in the order of its "sources" key.
+Should that order be invalid, the error is logged, and the default order is used.
+*/
+func (p *provider) configureConfigFile(configFile string) {
+	if err := p.configure([]Option{WithConfigFile(configFile)}); err != nil {
+		p.logger.Printf("[proxy.NewProvider]: %s\n", err)
+		p.sources = DefaultSources(configFile)
+	}
+}
+
 /*
 Set the timeouts used by this provider making a call which requires external resources (i.e. WPAD/PAC).
 Should any of these timeouts be exceeded, that particular call will be cancelled.
@@ -165,66 +256,267 @@ func (p *provider) SetTimeouts(resolve int, connect int, send int, receive int)
 }
 
 /*
-Returns the Proxy configuration for the given traffic protocol and targetUrl.
-If none is found, or an error occurs, nil is returned.
+Consult each of p.sources in order, until one produces proxies or bypasses targetUrl.
 Params:
+	ctx: Bounds the lookup. No further source is consulted once it is done.
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Records the sources consulted.
 Returns:
-	Proxy: A proxy was found.
-	nil: A proxy was not found, or an error occurred.
+	[]Proxy: The proxies of the first source to produce any. Empty if targetUrl is bypassed, or none were found.
 */
-func (p *provider) get(protocol string, targetUrl *url.URL) Proxy {
-	proxy := p.readConfigFileProxy(protocol)
-	if proxy != nil {
-		return proxy
+func (p *provider) getProxies(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace) []Proxy {
+	for _, s := range p.sources {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := p.lookupSource(ctx, s, protocol, targetUrl, t)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				p.logger.Printf("[proxy.Provider.getProxies]: %s: %s\n", s.Name(), err)
+			}
+			continue
+		}
+		if r.Bypass != "" {
+			return []Proxy{}
+		}
+		return r.Proxies
 	}
-	return p.readSystemEnvProxy(protocol, targetUrl)
+	return []Proxy{}
+}
+
+/*
+Consult a single source, recording it in t.
+Built in sources record their own (possibly several) steps, which are used to find the bypass entry, if any.
+Returns:
+	SourceResult, nil: The source produced proxies, or bypassed targetUrl.
+	SourceResult, ErrNotFound: The source is not configured for protocol.
+	SourceResult, error: The source failed.
+*/
+func (p *provider) lookupSource(ctx context.Context, s Source, protocol string, targetUrl *url.URL, t *Trace) (SourceResult, error) {
+	var (
+		r   SourceResult
+		err error
+	)
+	if b, ok := s.(builtinSource); ok {
+		first := len(t.Steps)
+		r.Proxies, err = b.lookup(ctx, p, protocol, targetUrl, t)
+		for _, step := range t.Steps[first:] {
+			if step.Bypass != "" {
+				r.Bypass = step.Bypass
+			}
+		}
+	} else {
+		step := t.step(s.Name())
+		r, err = s.Lookup(ctx, protocol, targetUrl)
+		if err == nil || !errors.Is(err, ErrNotFound) {
+			step.setEnabled(true)
+			step.setError(err)
+			step.setBypass(r.Bypass)
+			step.setProxies(r.Proxies...)
+		}
+	}
+	if err == nil && r.Bypass == "" && len(r.Proxies) == 0 {
+		err = ErrNotFound
+	}
+	return r, err
 }
 
 /*
 Unmarshal the proxy.config file, and return the first proxy matched for the given protocol.
 If no proxy is found, or an error occurs reading the proxy.config file, nil is returned.
 Params:
+	configFile: Optional. Path to the configuration file.
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	t: Optional. Records the sources consulted.
 Returns:
 	Proxy: A proxy is found in proxy.config for the given protocol.
 	nil: No proxy is found or an error occurs reading the proxy.config file.
 */
-func (p *provider) readConfigFileProxy(protocol string) Proxy {
-	proxyJson, err := p.unmarshalProxyConfigFile()
+func (p *provider) readConfigFileProxy(configFile string, protocol string, t *Trace) Proxy {
+	step := t.step(srcConfigurationFile)
+	step.setEnabled(configFile != "")
+	proxyJson, err := p.unmarshalProxyConfigFile(configFile)
 	if err != nil {
-		log.Printf("[proxy.Provider.readConfigFileProxy]: %s\n", err)
+		p.logger.Printf("[proxy.Provider.readConfigFileProxy]: %s\n", err)
+		step.setError(err)
 		return nil
 	}
 	uStr, exists := proxyJson[protocol]
 	if !exists {
 		return nil
 	}
+	step.setValue(uStr)
 	uUrl, uErr := ParseURL(uStr, "")
 	var uProxy Proxy
 	if uErr == nil {
 		uProxy, uErr = NewProxy(uUrl, srcConfigurationFile)
 	}
 	if uErr != nil {
-		log.Printf("[proxy.Provider.readConfigFileProxy]: invalid config file proxy, skipping \"%s\": \"%s\"\n", protocol, uStr)
+		p.logger.Printf("[proxy.Provider.readConfigFileProxy]: invalid config file proxy, skipping \"%s\": \"%s\"\n", protocol, uStr)
+		step.setError(&ParseError{Src: srcConfigurationFile, Value: uStr, Err: uErr})
 		return nil
 	}
+	if uProxy.Protocol() == protocolHTTPS {
+		tlsConfig, err := p.readConfigFileTLS(configFile)
+		if err != nil {
+			p.logger.Printf("[proxy.Provider.readConfigFileProxy]: invalid \"%s\" in config file, skipping \"%s\": %s\n", configKeyTLS, protocol, err)
+			step.setError(&ParseError{Src: srcConfigurationFile, Value: configKeyTLS, Err: err})
+			return nil
+		}
+		uProxy.(*proxy).tls = tlsConfig
+	}
+	step.setProxies(uProxy)
 	return uProxy
 }
 
 /*
-Unmarshal the proxy.config file into a simple map[string]string structure.
+Fetch and evaluate the PAC script at pacUrl for the given targetUrl.
+If the script cannot be fetched or evaluated, nil is returned.
+Params:
+	ctx: Bounds the download, and the evaluation, of the script.
+	src: If a proxy is constructed, the human readable source to associate it with.
+	pacUrl: The location of the PAC script. (i.e. http://wpad/wpad.dat, file:///etc/proxy.pac)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	[]Proxy: The candidates returned by the script, in order. DIRECT entries are included, see IsDirect.
+	nil: The script could not be fetched or evaluated.
+*/
+func (p *provider) readPACProxy(ctx context.Context, src string, pacUrl string, targetUrl *url.URL, t *Trace) []Proxy {
+	step := t.step(src)
+	step.setValue(pacUrl)
+	script, err := p.pacFetcher.fetch(ctx, pacUrl, p.pacTimeouts(), p.logger)
+	if err != nil {
+		p.logger.Printf("[proxy.Provider.readPACProxy]: failed to fetch PAC script %s: %s\n", pacUrl, err)
+		step.setError(err)
+		return nil
+	}
+	return p.evaluatePACProxy(ctx, src, pacUrl, script, targetUrl, step)
+}
+
+/*
+Same as readPACProxy, for a PAC script given inline rather than by URL (i.e. by a NetworkManager connection).
+The compiled script is cached by its content, see pacFetcher.compileScript.
+Params:
+	name: Identifies the script in the trace and the log. (i.e. pac-script)
+	script: The content of the PAC script.
+*/
+func (p *provider) readPACScriptProxy(ctx context.Context, src string, name string, script string, targetUrl *url.URL, t *Trace) []Proxy {
+	step := t.step(src)
+	step.setValue(name)
+	compiled, err := p.pacFetcher.compileScript(script, p.pacTimeouts())
+	if err != nil {
+		p.logger.Printf("[proxy.Provider.readPACScriptProxy]: %s: %s\n", name, err)
+		step.setError(err)
+		return nil
+	}
+	return p.evaluatePACProxy(ctx, src, name, compiled, targetUrl, step)
+}
+
+/*
+Evaluate script for targetUrl, recording the result in step.
+Params:
+	ctx: Bounds the evaluation, and the DNS lookups made by the script.
+	name: Identifies the script in the trace and the log. (i.e. its URL)
+*/
+func (p *provider) evaluatePACProxy(ctx context.Context, src string, name string, script *pac, targetUrl *url.URL, step *TraceStep) []Proxy {
+	result, err := script.findProxyForURL(ctx, p.logger, targetUrl.String(), "")
+	if err != nil {
+		p.logger.Printf("[proxy.Provider.readPACProxy]: %s: %s\n", name, err)
+		step.setError(err)
+		return nil
+	}
+	step.setValue(fmt.Sprintf("%s => %s", name, result))
+	proxies, err := parsePACResult(result, src, p.logger)
+	if err != nil {
+		p.logger.Printf("[proxy.Provider.readPACProxy]: %s: %s\n", name, err)
+		step.setError(err)
+		return nil
+	}
+	step.setProxies(proxies...)
+	return proxies
+}
+
+func (p *provider) pacTimeouts() pacTimeouts {
+	return pacTimeouts{
+		resolve: p.resolveTimeout,
+		connect: p.connectTimeout,
+		send:    p.sendTimeout,
+		receive: p.receiveTimeout,
+	}
+}
+
+/*
+Unmarshal the proxy.config file into a simple map[string]string structure of protocol to proxy.
+Values which are not strings (i.e. the "sources" key) are not included.
+Params:
+	configFile: Optional. Path to the configuration file.
 Returns:
 	map[string]string, nil: Unmarshal of proxy.config is successful.
 	nil, error: Unmarshal of proxy.config is not successful.
 */
-func (p *provider) unmarshalProxyConfigFile() (map[string]string, error) {
+func (p *provider) unmarshalProxyConfigFile(configFile string) (map[string]string, error) {
 	m := map[string]string{}
-	if p.configFile == "" {
+	raw, err := p.readProxyConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range raw {
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			m[k] = s
+		}
+	}
+	// Sanitize the protocols so we can be case insensitive
+	for protocol, v := range m {
+		delete(m, protocol)
+		m[strings.ToLower(protocol)] = v
+	}
+	return m, nil
+}
+
+/*
+Read the "sources" key of the proxy.config file, which orders the sources consulted. See WithSourceOrder.
+For example:
+	{"https": "http://proxy.rapid7.com:3128", "sources": ["system", "config", "env"]}
+Params:
+	configFile: Optional. Path to the configuration file.
+Returns:
+	[]string, nil: The source names, nil if the file or key is not present.
+	nil, error: The key is present, but is not a list of strings.
+*/
+func (p *provider) readConfigFileSourceOrder(configFile string) ([]string, error) {
+	raw, err := p.readProxyConfigFile(configFile)
+	if err != nil {
+		p.logger.Printf("[proxy.Provider.readConfigFileSourceOrder]: %s\n", err)
+		return nil, nil
+	}
+	value, exists := raw[configKeySources]
+	if !exists {
+		return nil, nil
+	}
+	var order []string
+	if err := json.Unmarshal(value, &order); err != nil {
+		return nil, fmt.Errorf("invalid \"%s\" in proxy configuration file: %s: %s", configKeySources, configFile, err)
+	}
+	return order, nil
+}
+
+/*
+Read and unmarshal the proxy.config file.
+Params:
+	configFile: Optional. Path to the configuration file.
+Returns:
+	map[string]json.RawMessage, nil: The content of proxy.config. Empty if configFile is "".
+	nil, error: proxy.config could not be read, or is not a JSON object.
+*/
+func (p *provider) readProxyConfigFile(configFile string) (map[string]json.RawMessage, error) {
+	m := map[string]json.RawMessage{}
+	if configFile == "" {
 		return m, nil
 	}
-	f := filepath.Join(p.configFile)
+	f := filepath.Join(configFile)
 	stat, err := os.Stat(f)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -246,11 +538,6 @@ func (p *provider) unmarshalProxyConfigFile() (map[string]string, error) {
 	if err = json.Unmarshal(out, &m); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal proxy configuration file: %s: %s", f, err)
 	}
-	// Sanitize the protocols so we can be case insensitive
-	for protocol, v := range m {
-		delete(m, protocol)
-		m[strings.ToLower(protocol)] = v
-	}
 	return m, nil
 }
 
@@ -260,11 +547,12 @@ If no proxy is found, or an error occurs, nil is returned.
 Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
 Returns:
 	proxy: A proxy is found through environment variables for the given traffic protocol.
 	nil: No proxy is found or an error occurs reading the environment variables.
 */
-func (p *provider) readSystemEnvProxy(prefix string, targetUrl *url.URL) Proxy {
+func (p *provider) readSystemEnvProxy(prefix string, targetUrl *url.URL, t *Trace) Proxy {
 	// SOCKS configuration is set as ALL_PROXY and all_proxy on Linux. Replace here for all OSs to keep consistent
 	if strings.HasPrefix(prefix, prefixSOCKS) {
 		prefix = prefixAll
@@ -277,24 +565,31 @@ func (p *provider) readSystemEnvProxy(prefix string, targetUrl *url.URL) Proxy {
 		noProxyKeyLower: p.getEnv(noProxyKeyLower)}
 K:
 	for _, key := range keys {
+		step := t.step(p.envSrc(key))
+		if value := strings.TrimSpace(p.getEnv(key)); value != "" {
+			step.setValue(value)
+		}
 		proxy, err := p.parseEnvProxy(key)
 		if err != nil {
-			if !isNotFound(err) {
-				log.Printf("[proxy.Provider.readSystemEnvProxy]: failed to parse \"%s\" value: %s\n", key, err)
+			if !errors.Is(err, ErrNotFound) {
+				p.logger.Printf("[proxy.Provider.readSystemEnvProxy]: failed to parse \"%s\" value: %s\n", key, err)
+				step.setError(err)
 			}
 			continue
 		}
-		bypass := false
-		for noProxyKey, proxyBypass := range noProxyValues {
+		for _, noProxyKey := range []string{noProxyKeyUpper, noProxyKeyLower} {
+			proxyBypass := noProxyValues[noProxyKey]
 			if proxyBypass == "" {
 				continue
 			}
-			bypass = p.isProxyBypass(targetUrl, proxyBypass, ",")
-			log.Printf("[proxy.Provider.readSystemEnvProxy]: \"%s\"=\"%s\", targetUrl=%s, bypass=%t", noProxyKey, proxyBypass, targetUrl, bypass)
+			match, bypass := p.matchProxyBypass(targetUrl, proxyBypass, ",")
+			p.logger.Printf("[proxy.Provider.readSystemEnvProxy]: \"%s\"=\"%s\", targetUrl=%s, bypass=%t", noProxyKey, proxyBypass, targetUrl, bypass)
 			if bypass {
+				step.setBypass(fmt.Sprintf("%s=%s", noProxyKey, match))
 				continue K
 			}
 		}
+		step.setProxies(proxy)
 		return proxy
 	}
 	return nil
@@ -319,6 +614,17 @@ Returns:
 	false: Otherwise
 */
 func (p *provider) isProxyBypass(targetUrl *url.URL, proxyBypass string, sep string) bool {
+	_, bypass := p.matchProxyBypass(targetUrl, proxyBypass, sep)
+	return bypass
+}
+
+/*
+Same as isProxyBypass, additionally returning the entry of proxyBypass which matched targetUrl.
+Returns:
+	entry, true: The proxy should be bypassed for the given targetUrl, because of entry
+	"", false: Otherwise
+*/
+func (p *provider) matchProxyBypass(targetUrl *url.URL, proxyBypass string, sep string) (string, bool) {
 	targetHost, _, _ := SplitHostPort(targetUrl)
 	for _, s := range strings.Split(proxyBypass, sep) {
 		s = strings.TrimSpace(s)
@@ -328,15 +634,16 @@ func (p *provider) isProxyBypass(targetUrl *url.URL, proxyBypass string, sep str
 		} else if s == bypassLocal {
 			// Windows uses <local> for local domains
 			if IsLoopbackHost(targetHost) {
-				return true
+				return s, true
 			}
 		}
 		// Exact match
 		if m, err := filepath.Match(s, targetHost); err != nil {
-			return false
+			return "", false
 		} else if m {
-			return true
+			return s, true
 		}
+		entry := s
 		// Prefix "* for wildcard matches (rapid7.com -> *.rapid7.com)
 		if strings.Index(s, targetUrlWildcard) != 0 {
 			// (rapid7.com -> .rapid7.com)
@@ -346,12 +653,19 @@ func (p *provider) isProxyBypass(targetUrl *url.URL, proxyBypass string, sep str
 			s = targetUrlWildcard + s
 		}
 		if m, err := filepath.Match(s, targetHost); err != nil {
-			return false
+			return "", false
 		} else if m {
-			return true
+			return entry, true
 		}
 	}
-	return false
+	return "", false
+}
+
+/*
+Returns the source of the environment variable key (i.e. Environment[HTTPS_PROXY]).
+*/
+func srcEnvironment(key string) string {
+	return fmt.Sprintf(srcEnvironmentFmt, key)
 }
 
 /*
@@ -360,17 +674,21 @@ Returns nil if no proxy is configured, or an error occurs.
 Params:
 	key: The environment variable key
 Returns:
-	proxy: A proxy was found for the given environment variable key and is valid.
-	false: Otherwise
+	proxy, nil: A proxy was found for the given environment variable key and is valid.
+	nil, ErrNotFound: The environment variable is not set.
+	nil, *ParseError: The environment variable is set, but is not a valid proxy.
 */
 func (p *provider) parseEnvProxy(key string) (Proxy, error) {
+	src := p.envSrc(key)
 	proxyUrl, err := p.parseEnvURL(key)
-	if err != nil {
+	if errors.Is(err, ErrNotFound) {
 		return nil, err
+	} else if err != nil {
+		return nil, &ParseError{Src: src, Value: p.getEnv(key), Err: err}
 	}
-	proxy, err := NewProxy(proxyUrl, fmt.Sprintf(srcEnvironmentFmt, key))
+	proxy, err := NewProxy(proxyUrl, src)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Src: src, Value: p.getEnv(key), Err: err}
 	}
 	return proxy, nil
 }
@@ -381,56 +699,12 @@ Params:
 	key: The name of the environment variable
 Returns:
 	url.URL: If the environment variable was populated, the parsed value. Otherwise nil.
-	error: If the environment variable was populated, but we failed to parse it.
+	error: If the environment variable was populated, but we failed to parse it. ErrNotFound if it was not populated.
 */
 func (p *provider) parseEnvURL(key string) (*url.URL, error) {
 	value := strings.TrimSpace(p.getEnv(key))
 	if value != "" {
 		return ParseURL(value, "")
 	}
-	return nil, new(notFoundError)
-}
-
-type notFoundError struct{}
-
-func (e notFoundError) Error() string {
-	return "No proxy found"
-}
-
-type timeoutError struct{}
-
-func (e timeoutError) Error() string {
-	return "Timed out"
-}
-
-/*
-Returns:
-	true: The error represents a Proxy not being found
-	false: Otherwise
-s*/
-func isNotFound(e error) bool {
-	switch e.(type) {
-	case *notFoundError:
-		return true
-	case notFoundError:
-		return true
-	default:
-		return false
-	}
-}
-
-/*
-Returns:
-	true: The error represents a Time out
-	false: Otherwise
-s*/
-func isTimedOut(e error) bool {
-	switch e.(type) {
-	case *timeoutError:
-		return true
-	case timeoutError:
-		return true
-	default:
-		return false
-	}
+	return nil, ErrNotFound
 }
@@ -16,8 +16,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"regexp"
 	"strings"
@@ -32,19 +32,56 @@ type providerDarwin struct {
 Create a new Provider which is used to retrieve Proxy configurations.
 Params:
 	configFile: Optional. Path to a configuration file which specifies proxies.
+		Should its "sources" key be invalid, the error is logged and the default source order is used.
 */
 func NewProvider(configFile string) Provider {
 	c := new(providerDarwin)
-	c.init(configFile)
+	c.init(nil)
+	c.configureConfigFile(configFile)
 	return c
 }
 
+/*
+Create a new Provider which is used to retrieve Proxy configurations, configured by opts.
+For example, to read a configuration file, and the environment of a child process:
+	proxy.NewProviderWithOptions(proxy.WithConfigFile("proxy.config"), proxy.WithEnvMap(childEnv))
+Params:
+	opts: Optional. See WithConfigFile, WithSourceOrder, WithSources, WithEnv, WithCommandRunner, WithTimeouts, WithLogger,
+		and WithHTTPClient.
+Returns:
+	Provider, nil: The provider was created.
+	nil, error: The source order (WithSourceOrder, or the "sources" key of the configuration file) is invalid.
+*/
+func NewProviderWithOptions(opts ...Option) (Provider, error) {
+	c := new(providerDarwin)
+	c.init(nil)
+	if err := c.configure(opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+Returns the sources of the operating system's settings, selected by the "system" source name. See WithSourceOrder.
+*/
+func systemSources() []Source {
+	return []Source{ScutilSource()}
+}
+
+/*
+Returns the sources of the operating system's settings which are only consulted when named. See WithSourceOrder.
+*/
+func optionalSources() []Source {
+	return nil
+}
+
 /*
 Returns the Proxy configuration for the given proxy protocol and targetUrl.
 If none is found, or an error occurs, nil is returned.
 This function searches the following locations in the following order:
 	* Configuration file: proxy.config
 	* Environment: HTTPS_PROXY, https_proxy, ...
+	* Network Settings: scutil --proxy
 Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
@@ -53,11 +90,11 @@ Returns:
 	nil: A proxy was not found, or an error occurred
 */
 func (p *providerDarwin) GetProxy(protocol string, targetUrlStr string) Proxy {
-	targetUrl := ParseTargetURL(targetUrlStr, protocol)
-	if proxy := p.provider.get(protocol, targetUrl); proxy != nil {
-		return proxy
+	r, err := p.Lookup(context.Background(), protocol, targetUrlStr)
+	if err != nil {
+		return nil
 	}
-	return p.readDarwinNetworkSettingProxy(protocol, targetUrl)
+	return r.Proxy
 }
 
 /*
@@ -113,11 +150,63 @@ func (p *providerDarwin) GetSOCKSProxy(targetUrl string) Proxy {
 }
 
 func (p *providerDarwin) GetProxies(protocol string, targetUrl string) []Proxy {
-	proxy := p.GetProxy(protocol, targetUrl)
-	if proxy != nil {
-		return []Proxy{proxy}
+	r, _ := p.Lookup(context.Background(), protocol, targetUrl)
+	return r.Proxies
+}
+
+/*
+Returns the proxy configuration for the given traffic protocol and targetUrl.
+The same locations as GetProxy are searched.
+Params:
+	ctx: Bounds the lookup. Should ctx have no deadline, scutil is given one second.
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	Result, nil: A proxy was found, or targetUrl is bypassed.
+	Result, error: No source is configured for targetUrl. See ProviderV2.
+*/
+func (p *providerDarwin) Lookup(ctx context.Context, protocol string, targetUrlStr string) (Result, error) {
+	r, _, err := lookup(ctx, protocol, targetUrlStr, p.getProxies)
+	return r, err
+}
+
+/*
+Performs the same lookup as GetProxies, recording every source consulted along the way.
+Params:
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	Trace: Each source consulted in order, what it read, and which source determined the result.
+*/
+func (p *providerDarwin) Explain(protocol string, targetUrlStr string) *Trace {
+	_, t, _ := lookup(context.Background(), protocol, targetUrlStr, p.getProxies)
+	return t
+}
+
+const sourceNameScutil = "scutil"
+
+/*
+Create a Source which reads the Network Settings through scutil --proxy, respecting its ExceptionsList.
+*/
+func ScutilSource() Source {
+	return new(scutilSource)
+}
+
+type scutilSource struct{}
+
+func (s *scutilSource) Name() string {
+	return sourceNameScutil
+}
+
+func (s *scutilSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *scutilSource) lookup(ctx context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	if proxy := p.readDarwinNetworkSettingProxy(ctx, protocol, targetUrl, t); proxy != nil {
+		return []Proxy{proxy}, nil
 	}
-	return []Proxy{}
+	return nil, nil
 }
 
 const (
@@ -130,27 +219,38 @@ const (
 	scUtilExceptionsList  = "ExceptionsList"
 	exceptionsListPattern = "ExceptionsList.*:.*{(.|\n)*.}"
 	srcScUtil             = "State:/Network/Global/Proxies"
+	// Applied to scutil when the lookup's context has no deadline
+	scUtilTimeout = time.Second
 )
 
 /*
 Returns the Network Setting Proxy found.
 If none is found, or an error occurs, nil is returned.
 Params:
+	ctx: Bounds the execution of scutil.
 	protocol: The proxy's protocol (i.e. https)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.myorganization.com)
+	t: Optional. Records the sources consulted.
 Returns:
 	Proxy: A proxy was found
 	nil: A proxy was not found, or an error occurred
 */
-func (p *providerDarwin) readDarwinNetworkSettingProxy(protocol string, targetUrl *url.URL) Proxy {
-	proxy, err := p.parseScutildata(protocol, targetUrl, scUtilBinary, scUtilBinaryArgument)
+func (p *provider) readDarwinNetworkSettingProxy(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace) Proxy {
+	step := t.step(srcScUtil)
+	proxy, err := p.parseScutildata(ctx, protocol, targetUrl, step, scUtilBinary, scUtilBinaryArgument)
+	if proxy != nil {
+		step.setProxies(proxy)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		step.setError(err)
+	}
 	if err != nil {
-		if isNotFound(err) {
-			log.Printf("[proxy.Provider.readDarwinNetworkSettingProxy]: %s proxy is not enabled.\n", protocol)
-		} else if isTimedOut(err) {
-			log.Printf("[proxy.Provider.readDarwinNetworkSettingProxy]: Operation timed out. \n")
+		if errors.Is(err, ErrNotFound) {
+			p.logger.Printf("[proxy.Provider.readDarwinNetworkSettingProxy]: %s proxy is not enabled.\n", protocol)
+		} else if errors.Is(err, ErrTimeout) {
+			p.logger.Printf("[proxy.Provider.readDarwinNetworkSettingProxy]: Operation timed out. \n")
 		} else {
-			log.Printf("[proxy.Provider.readDarwinNetworkSettingProxy]: Failed to parse Scutil data, %s\n", err)
+			p.logger.Printf("[proxy.Provider.readDarwinNetworkSettingProxy]: Failed to parse Scutil data, %s\n", err)
 		}
 	}
 	return proxy
@@ -160,26 +260,34 @@ func (p *providerDarwin) readDarwinNetworkSettingProxy(protocol string, targetUr
 Returns the Proxy found by parsing the Scutil output.
 If none is found, or an error occurs, nil is returned.
 Params:
+	ctx: Bounds the execution of the program. If ctx has no deadline, scUtilTimeout is applied.
 	protocol: The proxy's protocol (i.e. https)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.myorganization.com)
+	step: Optional. Records what was read.
 	name: The name of the program (scutil)
 	arg: The list of the arguments (--proxy)
 Returns:
-	Proxy: A proxy was found, nil if no proxy found or an error occurred
-	error: the error that has occurred, nil if there is no error
+	Proxy, nil: A proxy was found
+	nil, nil: The proxy is bypassed for targetUrl
+	nil, ErrNotFound: The proxy is not enabled for protocol
+	nil, ErrTimeout: The program did not complete in time, or failed
+	nil, *ParseError: The proxy is enabled, but is not valid
 */
-func (p *providerDarwin) parseScutildata(protocol string, targetUrl *url.URL, name string, arg ...string) (Proxy, error) {
+func (p *provider) parseScutildata(ctx context.Context, protocol string, targetUrl *url.URL, step *TraceStep, name string, arg ...string) (Proxy, error) {
 	lookupProtocol := strings.ToUpper(protocol) // to cover search for http, HTTP, https, HTTPS
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1) // Die after one second
-	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scUtilTimeout)
+		defer cancel()
+	}
 
 	cmd := p.proc(ctx, name, arg...)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
 	if err != nil {
-		return nil, new(timeoutError)
+		return nil, fmt.Errorf("%w: %s: %w", ErrTimeout, name, err)
 	}
 	scutilData := out.String()
 	scanner := bufio.NewScanner(strings.NewReader(scutilData))
@@ -242,18 +350,19 @@ func (p *providerDarwin) parseScutildata(protocol string, targetUrl *url.URL, na
 		}
 	}
 	if !enable {
-		return nil, new(notFoundError)
+		return nil, ErrNotFound
 	}
 
 	proxyUrlStr := host + ":" + port
+	step.setValue(proxyUrlStr)
 	proxyUrl, err := ParseURL(proxyUrlStr, "")
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Src: srcScUtil, Value: proxyUrlStr, Err: err}
 	}
 	src := srcScUtil
 	proxy, err := NewProxy(proxyUrl, src)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Src: srcScUtil, Value: proxyUrlStr, Err: err}
 	}
 	// if no bypass info exists, return the proxy obtained
 	if bypassProxyEnable == false {
@@ -264,9 +373,10 @@ func (p *providerDarwin) parseScutildata(protocol string, targetUrl *url.URL, na
 		return nil, err
 	}
 	if proxyBypass != "" {
-		bypass := p.isProxyBypass(targetUrl, proxyBypass, ",")
-		log.Printf("[proxy.Provider.parseProxyInfo]: ProxyBypass=\"%s\", targetUrl=%s, bypass=%t", proxyBypass, targetUrl, bypass)
+		match, bypass := p.matchProxyBypass(targetUrl, proxyBypass, ",")
+		p.logger.Printf("[proxy.Provider.parseProxyInfo]: ProxyBypass=\"%s\", targetUrl=%s, bypass=%t", proxyBypass, targetUrl, bypass)
 		if bypass {
+			step.setBypass(fmt.Sprintf("%s=%s", scUtilExceptionsList, match))
 			return nil, nil
 		}
 	}
@@ -282,7 +392,7 @@ Returns:
 	Bypass Proxy list: List of bypass proxies that are found, "" when none found or an error occurred
 	error: the error that has occurred, nil if there is no error
 */
-func (p *providerDarwin) readScutilBypassProxy(scutilData string) (string, error) {
+func (p *provider) readScutilBypassProxy(scutilData string) (string, error) {
 	regexBypassProxy, err := regexp.Compile(exceptionsListPattern)
 	if err != nil {
 		return "", err
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os/exec"
@@ -150,7 +151,7 @@ func TestParseScutildata_Read_HTTPS_HTTP(t *testing.T) {
 	protocols := [4]string{"http", "https", "HTTP", "HTTPS"}
 	for _, protocol := range protocols {
 		for _, command := range commands {
-			expectedProxy, err := c.parseScutildata(protocol, targetUrl, "echo", command)
+			expectedProxy, err := c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command)
 			// test error is nil
 			a.Nil(err)
 			// test https and https proxies are not nil
@@ -183,7 +184,7 @@ func TestParseScutildata_Read_HTTPS(t *testing.T) {
 	protocols := [4]string{"http", "https", "HTTP", "HTTPS"}
 	for _, protocol := range protocols {
 		for _, command := range commands {
-			expectedProxy, err := c.parseScutildata(protocol, targetUrl, "echo", command)
+			expectedProxy, err := c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command)
 			if strings.ToLower(protocol) == "https" {
 				// test error is nil
 				a.Nil(err)
@@ -195,7 +196,7 @@ func TestParseScutildata_Read_HTTPS(t *testing.T) {
 			} else {
 				// test http proxy is nil
 				a.Nil(expectedProxy)
-				a.Equal(isNotFound(err), true)
+				a.True(errors.Is(err, ErrNotFound))
 			}
 		}
 	}
@@ -222,7 +223,7 @@ func TestParseScutildata_Read_HTTP(t *testing.T) {
 	protocols := [4]string{"http", "https", "HTTP", "HTTPS"}
 	for _, protocol := range protocols {
 		for _, command := range commands {
-			expectedProxy, err := c.parseScutildata(protocol, targetUrl, "echo", command)
+			expectedProxy, err := c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command)
 			if strings.ToLower(protocol) == "http" {
 				// test error is nil
 				a.Nil(err)
@@ -234,7 +235,7 @@ func TestParseScutildata_Read_HTTP(t *testing.T) {
 			} else {
 				// test https proxy is nil
 				a.Nil(expectedProxy)
-				a.Equal(isNotFound(err), true)
+				a.True(errors.Is(err, ErrNotFound))
 			}
 		}
 	}
@@ -249,9 +250,9 @@ func TestExecCommandsHandledProperly(t *testing.T) {
 	c := newDarwinTestProvider()
 
 	targetUrl := ParseTargetURL("", "")
-	expectedProxy, err := c.parseScutildata("", targetUrl, "exit", "")
+	expectedProxy, err := c.parseScutildata(context.Background(), "", targetUrl, nil, "exit", "")
 
-	a.Equal(isTimedOut(err), true)
+	a.True(errors.Is(err, ErrTimeout))
 	a.Equal(expectedProxy, nil)
 }
 
@@ -274,21 +275,21 @@ func TestParseScutildata_Read_HTTPS_BYPASS_TARGET_URL(t *testing.T) {
 
 	// test empty target URL
 	targetUrl := ParseTargetURL("", "")
-	expectedProxy, err := c.parseScutildata(protocol, targetUrl, "echo", command)
+	expectedProxy, err := c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command)
 	// test error is nil
 	a.Nil(err)
 	// test expected proxy matches hardcoded proxy
 	a.Equal(&proxy{src: "State:/Network/Global/Proxies", host: "1.2.3.4", port: 1234},
 		expectedProxy)
 	// test proxy is not nil
-	a.NotNil(c.parseScutildata(protocol, targetUrl, "echo", command))
+	a.NotNil(c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command))
 
 	// tests https
 	for _, tests := range bypassProxySettingsHostsDomains {
 		for _, test := range tests {
 			for urlStr, result := range test {
 				targetUrl := ParseTargetURL(urlStr, "")
-				expectedProxy, err := c.parseScutildata(protocol, targetUrl, "echo", command)
+				expectedProxy, err := c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command)
 				// test error is nil
 				a.Nil(err)
 				if result == true {
@@ -309,9 +310,9 @@ func TestParseScutildata_Read_HTTPS_BYPASS_TARGET_URL(t *testing.T) {
 		for _, test := range tests {
 			for urlStr := range test {
 				targetUrl := ParseTargetURL(urlStr, "")
-				expectedProxy, err := c.parseScutildata(protocol, targetUrl, "echo", command)
+				expectedProxy, err := c.parseScutildata(context.Background(), protocol, targetUrl, nil, "echo", command)
 				// test error is returned correctly
-				a.Equal(isNotFound(err), true)
+				a.True(errors.Is(err, ErrNotFound))
 				// test proxy is nil
 				a.Nil(expectedProxy)
 			}
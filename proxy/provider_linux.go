@@ -12,6 +12,8 @@
 // without specific prior written permission.
 package proxy
 
+import "context"
+
 type providerLinux struct {
 	provider
 }
@@ -20,19 +22,62 @@ type providerLinux struct {
 Create a new Provider which is used to retrieve Proxy configurations.
 Params:
 	configFile: Optional. Path to a configuration file which specifies proxies.
+		Should its "sources" key be invalid, the error is logged and the default source order is used.
 */
 func NewProvider(configFile string) Provider {
 	c := new(providerLinux)
-	c.init(configFile)
+	c.init(nil)
+	c.configureConfigFile(configFile)
 	return c
 }
 
+/*
+Create a new Provider which is used to retrieve Proxy configurations, configured by opts.
+For example, to read a configuration file, and the environment of a child process:
+	proxy.NewProviderWithOptions(proxy.WithConfigFile("proxy.config"), proxy.WithEnvMap(childEnv))
+Params:
+	opts: Optional. See WithConfigFile, WithSourceOrder, WithSources, WithEnv, WithCommandRunner, WithTimeouts, WithLogger,
+		and WithHTTPClient.
+Returns:
+	Provider, nil: The provider was created.
+	nil, error: The source order (WithSourceOrder, or the "sources" key of the configuration file) is invalid.
+*/
+func NewProviderWithOptions(opts ...Option) (Provider, error) {
+	c := new(providerLinux)
+	c.init(nil)
+	if err := c.configure(opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+Returns the sources of the operating system's settings, selected by the "system" source name. See WithSourceOrder.
+*/
+func systemSources() []Source {
+	return []Source{EnvFilesSource(), SystemdSource(""), GNOMESource(), KDESource(), NetworkManagerSource()}
+}
+
+/*
+Returns the sources of the operating system's settings which are only consulted when named, as they query the network. See WithSourceOrder.
+*/
+func optionalSources() []Source {
+	return []Source{WPADSource()}
+}
+
 /*
 Returns the Proxy configuration for the given proxy protocol and targetUrl.
 If none is found, or an error occurs, nil is returned.
 This function searches the following locations in the following order:
 	* Configuration file: proxy.config
 	* Environment: HTTPS_PROXY, https_proxy, ...
+	* Environment files: /etc/security/pam_env.conf, /etc/environment, /etc/profile.d/*.sh
+	* systemd: systemctl show-environment, or DefaultEnvironment= of /etc/systemd/system.conf(.d)
+	* GNOME: gsettings org.gnome.system.proxy
+	* KDE: ~/.config/kioslaverc
+	* NetworkManager: PAC URL or script of the active connections (nmcli)
+WPAD is only attempted should the "wpad" source be named. See WithSourceOrder.
+Should a PAC script prefer a direct connection for targetUrl, nil is returned.
 Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
@@ -41,7 +86,11 @@ Returns:
 	nil: A proxy was not found, or an error occurred
 */
 func (p *providerLinux) GetProxy(protocol string, targetUrlStr string) Proxy {
-	return p.provider.get(protocol, ParseTargetURL(targetUrlStr, protocol))
+	r, err := p.Lookup(context.Background(), protocol, targetUrlStr)
+	if err != nil {
+		return nil
+	}
+	return r.Proxy
 }
 
 /*
@@ -96,10 +145,46 @@ func (p *providerLinux) GetSOCKSProxy(targetUrl string) Proxy {
 	return p.GetProxy(protocolSOCKS, targetUrl)
 }
 
-func (p *providerLinux) GetProxies(protocol string, targetUrl string) []Proxy {
-	proxy := p.GetProxy(protocol, targetUrl)
-	if proxy != nil {
-		return []Proxy{proxy}
-	}
-	return []Proxy{}
+/*
+Returns the Proxy configurations for the given proxy protocol and targetUrl, in order of preference.
+The same locations as GetProxy are searched. Proxies found through WPAD are returned in the order of the PAC result,
+including DIRECT entries (see IsDirect), so that callers may fall back as a browser would.
+Params:
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	[]Proxy: The proxies found, which is empty if none were found.
+*/
+func (p *providerLinux) GetProxies(protocol string, targetUrlStr string) []Proxy {
+	r, _ := p.Lookup(context.Background(), protocol, targetUrlStr)
+	return r.Proxies
+}
+
+/*
+Returns the proxy configuration for the given traffic protocol and targetUrl.
+The same locations as GetProxy are searched.
+Params:
+	ctx: Bounds the lookup. WPAD discovery is abandoned once it is done.
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	Result, nil: A proxy was found, a PAC script prefers a direct connection, or targetUrl is bypassed.
+	Result, error: No source is configured for targetUrl. See ProviderV2.
+*/
+func (p *providerLinux) Lookup(ctx context.Context, protocol string, targetUrlStr string) (Result, error) {
+	r, _, err := lookup(ctx, protocol, targetUrlStr, p.getProxies)
+	return r, err
+}
+
+/*
+Performs the same lookup as GetProxies, recording every source consulted along the way.
+Params:
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	Trace: Each source consulted in order, what it read, and which source determined the result.
+*/
+func (p *providerLinux) Explain(protocol string, targetUrlStr string) *Trace {
+	_, t, _ := lookup(context.Background(), protocol, targetUrlStr, p.getProxies)
+	return t
 }
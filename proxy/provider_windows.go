@@ -13,8 +13,9 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"github.com/rapid7/go-get-proxied/winhttp"
-	"log"
 	"net/url"
 	"reflect"
 	"strings"
@@ -24,13 +25,49 @@ import (
 Create a new Provider which is used to retrieve Proxy configurations.
 Params:
 	configFile: Optional. Path to a configuration file which specifies proxies.
+		Should its "sources" key be invalid, the error is logged and the default source order is used.
 */
 func NewProvider(configFile string) Provider {
 	c := new(providerWindows)
-	c.init(configFile)
+	c.init(nil)
+	c.configureConfigFile(configFile)
 	return c
 }
 
+/*
+Create a new Provider which is used to retrieve Proxy configurations, configured by opts.
+For example, to read a configuration file, and the environment of a child process:
+	proxy.NewProviderWithOptions(proxy.WithConfigFile("proxy.config"), proxy.WithEnvMap(childEnv))
+Params:
+	opts: Optional. See WithConfigFile, WithSourceOrder, WithSources, WithEnv, WithCommandRunner, WithTimeouts, WithLogger,
+		and WithHTTPClient.
+Returns:
+	Provider, nil: The provider was created.
+	nil, error: The source order (WithSourceOrder, or the "sources" key of the configuration file) is invalid.
+*/
+func NewProviderWithOptions(opts ...Option) (Provider, error) {
+	c := new(providerWindows)
+	c.init(nil)
+	if err := c.configure(opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+Returns the sources of the operating system's settings, selected by the "system" source name. See WithSourceOrder.
+*/
+func systemSources() []Source {
+	return []Source{WinHTTPSource()}
+}
+
+/*
+Returns the sources of the operating system's settings which are only consulted when named. See WithSourceOrder.
+*/
+func optionalSources() []Source {
+	return nil
+}
+
 /*
 Returns the Proxy configuration for the given proxy protocol and targetUrl.
 If none is found, or an error occurs, nil is returned.
@@ -41,6 +78,7 @@ This function searches the following locations in the following order:
 	* IE Proxy Config: AutoConfig URL
 	* IE Proxy Config: Manual
 	* WinHTTP Default
+Where a location lists several proxies, the first is returned, as it is by Lookup.
 Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
@@ -49,16 +87,11 @@ Returns:
 	nil: A proxy was not found, or an error occurred
 */
 func (p *providerWindows) GetProxy(protocol string, targetUrlStr string) Proxy {
-	targetUrl := ParseTargetURL(targetUrlStr, protocol)
-	proxy := p.provider.get(protocol, targetUrl)
-	if proxy != nil {
-		return proxy
-	}
-	proxies := p.readWinHttpProxy(protocol, targetUrl)
-	if len(proxies) == 0 {
+	r, err := p.Lookup(context.Background(), protocol, targetUrlStr)
+	if err != nil {
 		return nil
 	}
-	return proxies[len(proxies) - 1]
+	return r.Proxy
 }
 
 /*
@@ -114,65 +147,132 @@ func (p *providerWindows) GetSOCKSProxy(targetUrl string) Proxy {
 }
 
 func (p *providerWindows) GetProxies(protocol string, targetUrlStr string) []Proxy {
-	targetUrl := ParseTargetURL(targetUrlStr, protocol)
-	proxy := p.provider.get(protocol, targetUrl)
-	if proxy != nil {
-		return  []Proxy{proxy}
-	}
-	proxies := p.readWinHttpProxy(protocol, targetUrl)
-	return proxies
+	r, _ := p.Lookup(context.Background(), protocol, targetUrlStr)
+	return r.Proxies
+}
+
+/*
+Returns the proxy configuration for the given traffic protocol and targetUrl.
+The same locations as GetProxy are searched.
+Params:
+	ctx: Bounds the lookup. WinHTTP calls can not be interrupted, but no further source is consulted once it is done.
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	Result, nil: A proxy was found, or targetUrl is bypassed.
+	Result, error: No source is configured for targetUrl. See ProviderV2.
+*/
+func (p *providerWindows) Lookup(ctx context.Context, protocol string, targetUrlStr string) (Result, error) {
+	r, _, err := lookup(ctx, protocol, targetUrlStr, p.getProxies)
+	return r, err
+}
+
+/*
+Performs the same lookup as GetProxies, recording every source consulted along the way.
+Params:
+	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+Returns:
+	Trace: Each source consulted in order, what it read, and which source determined the result.
+*/
+func (p *providerWindows) Explain(protocol string, targetUrlStr string) *Trace {
+	_, t, _ := lookup(context.Background(), protocol, targetUrlStr, p.getProxies)
+	return t
 }
 
 const (
-	userAgent        = "ir_agent"
-	srcAutoDetect    = "WinHTTP:AutoDetect"
-	srcAutoConfigUrl = "WinHTTP:AutoConfigUrl"
-	srcNamedProxy    = "WinHTTP:NamedProxy"
-	srcWinHttp       = "WinHTTP:WinHttpDefault"
+	sourceNameWinHttp = "winhttp"
+	userAgent         = "ir_agent"
+	srcAutoDetect     = "WinHTTP:AutoDetect"
+	srcAutoConfigUrl  = "WinHTTP:AutoConfigUrl"
+	srcNamedProxy     = "WinHTTP:NamedProxy"
+	srcWinHttp        = "WinHTTP:WinHttpDefault"
 )
 
 type providerWindows struct {
 	provider
 }
 
+/*
+Create a Source which reads the Internet Options (automatic detection, automatic configuration script, and manual proxy),
+followed by the WinHTTP default settings (netsh winhttp).
+*/
+func WinHTTPSource() Source {
+	return new(winHttpSource)
+}
+
+type winHttpSource struct{}
+
+func (s *winHttpSource) Name() string {
+	return sourceNameWinHttp
+}
+
+func (s *winHttpSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *winHttpSource) lookup(ctx context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	return p.readWinHttpProxy(ctx, protocol, targetUrl, t), nil
+}
+
 //noinspection SpellCheckingInspection
-func (p *providerWindows) readWinHttpProxy(protocol string, targetUrl *url.URL) []Proxy {
+func (p *provider) readWinHttpProxy(ctx context.Context, protocol string, targetUrl *url.URL, t *Trace) []Proxy {
 	// Internet Options
 	ieProxyConfig, err := p.getIeProxyConfigCurrentUser()
 	if err != nil {
-		log.Printf("[proxy.Provider.readWinHttpProxy] Failed to read IE proxy config: %s\n", err)
+		p.logger.Printf("[proxy.Provider.readWinHttpProxy] Failed to read IE proxy config: %s\n", err)
 	} else {
 		defer p.freeWinHttpResource(ieProxyConfig)
+		step := t.step(srcAutoDetect)
 		if ieProxyConfig.FAutoDetect {
-			proxy, err := p.getProxyAutoDetect(protocol, targetUrl)
+			step.setEnabled(true)
+			proxy, err := p.getProxyAutoDetect(protocol, targetUrl, step)
 			if err == nil {
+				step.setProxies(proxy...)
 				return proxy
-			} else if !isNotFound(err) {
-				log.Printf("[proxy.Provider.readWinHttpProxy] No proxy discovered via AutoDetect: %s\n", err)
+			} else if !errors.Is(err, ErrNotFound) {
+				p.logger.Printf("[proxy.Provider.readWinHttpProxy] No proxy discovered via AutoDetect: %s\n", err)
+				step.setError(err)
 			}
 		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		step = t.step(srcAutoConfigUrl)
 		if autoConfigUrl := winhttp.LpwstrToString(ieProxyConfig.LpszAutoConfigUrl); autoConfigUrl != "" {
-			proxies, err := p.getProxyAutoConfigUrl(protocol, targetUrl, autoConfigUrl)
+			step.setValue(autoConfigUrl)
+			proxies, err := p.getProxyAutoConfigUrl(protocol, targetUrl, autoConfigUrl, step)
 			if err == nil {
+				step.setProxies(proxies...)
 				return proxies
-			} else if !isNotFound(err) {
-				log.Printf("[proxy.Provider.readWinHttpProxy] No proxy discovered via AutoConfigUrl, %s: %s\n", autoConfigUrl, err)
+			} else if !errors.Is(err, ErrNotFound) {
+				p.logger.Printf("[proxy.Provider.readWinHttpProxy] No proxy discovered via AutoConfigUrl, %s: %s\n", autoConfigUrl, err)
+				step.setError(err)
 			}
 		}
 		// LpszProxy may contain multiple proxies which needs to be parsed into a list of Proxy
-		proxies, err := p.parseProxyInfo(srcNamedProxy, protocol, targetUrl, ieProxyConfig.LpszProxy, ieProxyConfig.LpszProxyBypass)
+		step = t.step(srcNamedProxy)
+		proxies, err := p.parseProxyInfo(srcNamedProxy, protocol, targetUrl, ieProxyConfig.LpszProxy, ieProxyConfig.LpszProxyBypass, step)
 		if err == nil {
+			step.setProxies(proxies...)
 			return proxies
-		} else if !isNotFound(err) {
-			log.Printf("[proxy.Provider.readWinHttpProxy] Failed to parse named proxy: %s\n", err)
+		} else if !errors.Is(err, ErrNotFound) {
+			p.logger.Printf("[proxy.Provider.readWinHttpProxy] Failed to parse named proxy: %s\n", err)
+			step.setError(err)
 		}
 	}
+	if ctx.Err() != nil {
+		return nil
+	}
 	// netsh winhttp
-	proxies, err := p.getProxyWinHttpDefault(protocol, targetUrl)
+	step := t.step(srcWinHttp)
+	proxies, err := p.getProxyWinHttpDefault(protocol, targetUrl, step)
 	if err == nil {
+		step.setProxies(proxies...)
 		return proxies
-	} else if !isNotFound(err) {
-		log.Printf("[proxy.Provider.readWinHttpProxy] Failed to parse WinHttp default proxy info: %s\n", err)
+	} else if !errors.Is(err, ErrNotFound) {
+		p.logger.Printf("[proxy.Provider.readWinHttpProxy] Failed to parse WinHttp default proxy info: %s\n", err)
+		step.setError(err)
 	}
 	return nil
 }
@@ -184,7 +284,7 @@ Returns:
 	CurrentUserIEProxyConfig, nil: No errors occurred
 	nil, error: An error occurred
 */
-func (p *providerWindows) getIeProxyConfigCurrentUser() (*winhttp.CurrentUserIEProxyConfig, error) {
+func (p *provider) getIeProxyConfigCurrentUser() (*winhttp.CurrentUserIEProxyConfig, error) {
 	ieProxyConfig, err := winhttp.GetIEProxyConfigForCurrentUser()
 	if err != nil {
 		return nil, err
@@ -197,13 +297,14 @@ Returns the Proxy found through automatic detection, if any.
 Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	step: Optional. Records what was read.
 Returns:
 	Proxy, nil: A proxy was found
-	nil, notFoundError: No proxy was found
+	nil, ErrNotFound: No proxy was found
 	nil, error: An error occurred
 */
-func (p *providerWindows) getProxyAutoDetect(protocol string, targetUrl *url.URL) ([]Proxy, error) {
-	return p.getProxyForUrl(srcAutoDetect, protocol, targetUrl,
+func (p *provider) getProxyAutoDetect(protocol string, targetUrl *url.URL, step *TraceStep) ([]Proxy, error) {
+	return p.getProxyForUrl(srcAutoDetect, protocol, targetUrl, step,
 		&winhttp.AutoProxyOptions{
 			DwFlags:                winhttp.WINHTTP_AUTOPROXY_AUTO_DETECT,
 			DwAutoDetectFlags:      winhttp.WINHTTP_AUTO_DETECT_TYPE_DHCP | winhttp.WINHTTP_AUTO_DETECT_TYPE_DNS_A,
@@ -217,13 +318,14 @@ Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
 	autoConfigUrl: The URL to be used to retrieve the PAC file.
+	step: Optional. Records what was read.
 Returns:
 	Proxy, nil: A proxy was found
-	nil, notFoundError: No proxy was found
+	nil, ErrNotFound: No proxy was found
 	nil, error: An error occurred
 */
-func (p *providerWindows) getProxyAutoConfigUrl(protocol string, targetUrl *url.URL, autoConfigUrl string) ([]Proxy, error) {
-	return p.getProxyForUrl(srcAutoConfigUrl, protocol, targetUrl,
+func (p *provider) getProxyAutoConfigUrl(protocol string, targetUrl *url.URL, autoConfigUrl string, step *TraceStep) ([]Proxy, error) {
+	return p.getProxyForUrl(srcAutoConfigUrl, protocol, targetUrl, step,
 		&winhttp.AutoProxyOptions{
 			DwFlags:                winhttp.WINHTTP_AUTOPROXY_CONFIG_URL,
 			LpszAutoConfigUrl:      winhttp.StringToLpwstr(autoConfigUrl),
@@ -237,18 +339,19 @@ This is typically configured via: `netsh winhttp set proxy`
 Params:
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	step: Optional. Records what was read.
 Returns:
 	Proxy, nil: A proxy was found
-	nil, notFoundError: No proxy was found
+	nil, ErrNotFound: No proxy was found
 	nil, error: An error occurred
 */
-func (p *providerWindows) getProxyWinHttpDefault(protocol string, targetUrl *url.URL) ([]Proxy, error) {
+func (p *provider) getProxyWinHttpDefault(protocol string, targetUrl *url.URL, step *TraceStep) ([]Proxy, error) {
 	pInfo, err := winhttp.GetDefaultProxyConfiguration()
 	if err != nil {
 		return nil, err
 	}
 	defer p.freeWinHttpResource(pInfo)
-	return p.parseProxyInfo(srcWinHttp, protocol, targetUrl, pInfo.LpszProxy, pInfo.LpszProxyBypass)
+	return p.parseProxyInfo(srcWinHttp, protocol, targetUrl, pInfo.LpszProxy, pInfo.LpszProxyBypass, step)
 }
 
 /*
@@ -257,19 +360,20 @@ Params:
 	src: If a proxy is constructed, the human readable source to associated it with.
 	protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	step: Optional. Records what was read.
 	autoProxyOptions: Use this to inform WinHTTP what route to take when doing the lookup (automatic detection, or automatic configuration URL)
 Returns:
 	Proxy, nil: A list of proxy was found
-	nil, notFoundError: No proxy was found
+	nil, ErrNotFound: No proxy was found
 	nil, error: An error occurred
 */
-func (p *providerWindows) getProxyForUrl(src string, protocol string, targetUrl *url.URL, autoProxyOptions *winhttp.AutoProxyOptions) ([]Proxy, error) {
+func (p *provider) getProxyForUrl(src string, protocol string, targetUrl *url.URL, step *TraceStep, autoProxyOptions *winhttp.AutoProxyOptions) ([]Proxy, error) {
 	pInfo, err := p.getProxyInfoForUrl(targetUrl, autoProxyOptions)
 	if err != nil {
 		return nil, err
 	}
 	defer p.freeWinHttpResource(pInfo)
-	return p.parseProxyInfo(src, protocol, targetUrl, pInfo.LpszProxy, pInfo.LpszProxyBypass)
+	return p.parseProxyInfo(src, protocol, targetUrl, pInfo.LpszProxy, pInfo.LpszProxyBypass, step)
 }
 
 /*
@@ -281,7 +385,7 @@ Returns:
 	ProxyInfo, nil: A proxy was found
 	nil, error: An error occurred
 */
-func (p *providerWindows) getProxyInfoForUrl(targetUrl *url.URL, autoProxyOptions *winhttp.AutoProxyOptions) (*winhttp.ProxyInfo, error) {
+func (p *provider) getProxyInfoForUrl(targetUrl *url.URL, autoProxyOptions *winhttp.AutoProxyOptions) (*winhttp.ProxyInfo, error) {
 	h, err := winhttp.Open(
 		winhttp.StringToLpwstr(userAgent),
 		winhttp.WINHTTP_ACCESS_TYPE_NO_PROXY,
@@ -311,29 +415,35 @@ Params:
 	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
 	lpszProxy: The Lpwstr which represents the proxy value (if any). This value can be optionally separated by protocol.
 	lpszProxyBypass: The Lpwstr which represents the proxy bypass value (if any).
+	step: Optional. Records what was read.
 Returns:
 	Proxy, nil: A list of proxies matching the lookup criteria
-	nil, notFoundError: No proxy was found or was bypassed
+	nil, ErrNotFound: No proxy was found or was bypassed
 	nil, error: An error occurred
 */
 //noinspection SpellCheckingInspection
-func (p *providerWindows) parseProxyInfo(src string, protocol string, targetUrl *url.URL, lpszProxy winhttp.Lpwstr, lpszProxyBypass winhttp.Lpwstr) ([]Proxy, error) {
+func (p *provider) parseProxyInfo(src string, protocol string, targetUrl *url.URL, lpszProxy winhttp.Lpwstr, lpszProxyBypass winhttp.Lpwstr, step *TraceStep) ([]Proxy, error) {
 	proxies := []Proxy{}
+	proxyStr := winhttp.LpwstrToString(lpszProxy)
+	if proxyStr != "" {
+		step.setValue(proxyStr)
+	}
 	proxyBypass := winhttp.LpwstrToString(lpszProxyBypass)
 	if proxyBypass != "" {
-		if p.isLpszProxyBypass(targetUrl, proxyBypass) {
+		if match, bypass := p.matchProxyBypass(targetUrl, proxyBypass, ";"); bypass {
+			step.setBypass(match)
 			return proxies, nil
 		}
 	}
 
-	proxyUrlStrList := p.parseLpszProxy(protocol, winhttp.LpwstrToString(lpszProxy))
+	proxyUrlStrList := p.parseLpszProxy(protocol, proxyStr)
 	if len(proxyUrlStrList) == 0 {
-		return nil, new(notFoundError)
+		return nil, ErrNotFound
 	}
 	for _, proxyUrlStr := range proxyUrlStrList {
 		proxyUrl, err := ParseURL(proxyUrlStr, "")
 		if err != nil {
-			log.Printf("Failed to parse proxy URL %q", proxyUrlStr)
+			p.logger.Printf("Failed to parse proxy URL %q", proxyUrlStr)
 			continue
 		}
 		pr, _ := NewProxy(proxyUrl, src)
@@ -357,7 +467,7 @@ Returns:
 	string: The list of proxy URL (if any) from the lpszProxy value.
 */
 //noinspection SpellCheckingInspection
-func (p *providerWindows) parseLpszProxy(protocol string, lpszProxy string) []string {
+func (p *provider) parseLpszProxy(protocol string, lpszProxy string) []string {
 	proxies := []string{}
 	lpszProxy = strings.TrimSpace(lpszProxy)
 	if len(lpszProxy) == 0 {
@@ -390,7 +500,7 @@ Returns:
 	false: Otherwise
 */
 //noinspection SpellCheckingInspection
-func (p *providerWindows) isLpszProxyBypass(targetUrl *url.URL, lpszProxyBypass string) bool {
+func (p *provider) isLpszProxyBypass(targetUrl *url.URL, lpszProxyBypass string) bool {
 	return p.isProxyBypass(targetUrl, lpszProxyBypass, ";")
 }
 
@@ -399,9 +509,9 @@ Close the given handle. This should always be called when use of a handle is no
 Params:
 	h: The handle
 */
-func (p *providerWindows) closeHandle(h winhttp.HInternet) {
+func (p *provider) closeHandle(h winhttp.HInternet) {
 	if err := winhttp.CloseHandle(h); err != nil {
-		log.Printf("[proxy.Provider.closeHandle] Failed to close handle \"%d\": %s\n", h, err)
+		p.logger.Printf("[proxy.Provider.closeHandle] Failed to close handle \"%d\": %s\n", h, err)
 	}
 }
 
@@ -410,11 +520,11 @@ Free an allocated object. This should always be called for structs returned from
 Params:
 	r: The resource
 */
-func (p *providerWindows) freeWinHttpResource(r winhttp.Allocated) {
+func (p *provider) freeWinHttpResource(r winhttp.Allocated) {
 	if r == nil {
 		return
 	}
 	if err := r.Free(); err != nil {
-		log.Printf("[proxy.Provider.readWinHttp] Failed to free struct \"%s\": %s\n", reflect.TypeOf(r), err)
+		p.logger.Printf("[proxy.Provider.readWinHttp] Failed to free struct \"%s\": %s\n", reflect.TypeOf(r), err)
 	}
 }
@@ -13,6 +13,7 @@
 package proxy
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"net/url"
 	"testing"
@@ -99,8 +100,22 @@ func TestProviderWindows_IsLpszProxyBypass(t *testing.T) {
 	}
 }
 
+func TestProviderWindows_GetProxy_candidates(t *testing.T) {
+	a := assert.New(t)
+	first := newTestProxy("http", "1.2.3.4", 8443, nil, srcNamedProxy)
+	second := newTestProxy("http", "4.5.6.7", 8999, nil, srcNamedProxy)
+	p := newTestProviderWithSources(&testSource{name: "winhttp", result: SourceResult{Proxies: []Proxy{first, second}}})
+
+	r, err := p.Lookup(context.Background(), "https", "https://test.endpoint.rapid7.com")
+	a.NoError(err)
+	a.Equal(first, r.Proxy)
+	a.Equal([]Proxy{first, second}, r.Proxies)
+	a.Equal(first, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	a.Equal([]Proxy{first, second}, p.GetProxies("https", "https://test.endpoint.rapid7.com"))
+}
+
 func newWindowsTestProvider() *providerWindows {
 	c := new(providerWindows)
-	c.init("")
+	c.init(DefaultSources(""))
 	return c
 }
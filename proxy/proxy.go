@@ -55,10 +55,19 @@ func NewProxy(u *url.URL, src string) (Proxy, error) {
 }
 
 const (
-	defaultPort = 8443
+	defaultPort      = 8443
+	defaultSOCKSPort = 1080
 )
 
-var defaultPorts = map[string]uint16{"": defaultPort, protocolHTTP: defaultPort, protocolHTTPS: defaultPort}
+var defaultPorts = map[string]uint16{
+	"":              defaultPort,
+	protocolHTTP:    defaultPort,
+	protocolHTTPS:   defaultPort,
+	protocolSOCKS4:  defaultSOCKSPort,
+	protocolSOCKS4A: defaultSOCKSPort,
+	protocolSOCKS5:  defaultSOCKSPort,
+	protocolSOCKS5H: defaultSOCKSPort,
+}
 
 type proxy struct {
 	protocol string
@@ -66,6 +75,8 @@ type proxy struct {
 	port     uint16
 	user     *url.Userinfo
 	src      string
+	// Optional. The TLS configuration of an https proxy, see ProxyTLSConfig
+	tls *ProxyTLSConfig
 }
 
 func (p *proxy) init(u *url.URL, src string) error {
@@ -170,3 +181,82 @@ func (p *proxy) toMap() map[string]interface{} {
 	}
 	return m
 }
+
+/*
+Returns a Proxy which represents a direct connection, as returned by the PAC "DIRECT" directive.
+The returned Proxy has the protocol "direct", an empty host, and a 0 port. Its URL is "direct:".
+Params:
+	src: Human readable location where this directive was found.
+Returns:
+	A Proxy representing a direct connection.
+*/
+func NewDirectProxy(src string) Proxy {
+	return &directProxy{src: src}
+}
+
+/*
+Determines if the given Proxy represents a direct connection (i.e. no proxy should be used).
+Params:
+	p: The Proxy to check.
+Returns:
+	true: p is a DIRECT entry.
+	false: p is nil or a real proxy.
+*/
+func IsDirect(p Proxy) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.(*directProxy)
+	return ok
+}
+
+type directProxy struct {
+	src string
+}
+
+func (p *directProxy) Protocol() string {
+	return protocolDirect
+}
+
+func (p *directProxy) Host() string {
+	return ""
+}
+
+func (p *directProxy) Port() uint16 {
+	return 0
+}
+
+func (p *directProxy) Username() (string, bool) {
+	return "", false
+}
+
+func (p *directProxy) Password() (string, bool) {
+	return "", false
+}
+
+func (p *directProxy) Src() string {
+	return p.src
+}
+
+func (p *directProxy) URL() *url.URL {
+	return &url.URL{Scheme: protocolDirect}
+}
+
+func (p *directProxy) String() string {
+	return fmt.Sprintf("%s|DIRECT", p.Src())
+}
+
+func (p *directProxy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.toMap())
+}
+
+func (p *directProxy) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"protocol": p.Protocol(),
+		"host":     nil,
+		"port":     nil,
+		"src":      p.Src(),
+		"username": nil,
+		"password": nil,
+	}
+}
@@ -49,6 +49,15 @@ var dataNewProxy = []struct {
 		&url.URL{Scheme: "gopher", Host: "testProxy"},
 		&proxy{protocol: "gopher", host: "testProxy", port: 8443, user: nil, src: "Test"}, nil,
 	},
+	// No port - SOCKS
+	{
+		&url.URL{Scheme: "socks4", Host: "testProxy"},
+		&proxy{protocol: "socks4", host: "testProxy", port: 1080, user: nil, src: "Test"}, nil,
+	},
+	{
+		&url.URL{Scheme: "socks5h", Host: "testProxy"},
+		&proxy{protocol: "socks5h", host: "testProxy", port: 1080, user: nil, src: "Test"}, nil,
+	},
 	// 0 port
 	{
 		&url.URL{Scheme: "https", Host: "testProxy:0"},
@@ -0,0 +1,233 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	sourceNameConfigFile  = "config"
+	sourceNameEnvironment = "env"
+	// All sources of the operating system's settings. See systemSources.
+	sourceNameSystem = "system"
+)
+
+var defaultSourceOrder = []string{sourceNameConfigFile, sourceNameEnvironment, sourceNameSystem}
+
+/*
+A location proxy configurations are read from (i.e. the environment, or a management server's policy).
+A Provider consults its sources in order, stopping at the first which produces proxies or bypasses the target.
+See WithSources.
+*/
+type Source interface {
+	// A short name identifying this source (i.e. env). Sources which are not built in are traced by this name.
+	Name() string
+
+	/*
+		Returns the proxy configuration of this source for the given traffic protocol and targetUrl.
+		Params:
+			ctx: Bounds the lookup.
+			protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+			targetUrl: The URL the proxy is to be used for, as sanitized by ParseTargetURL.
+		Returns:
+			SourceResult, nil: Proxies were found, or Bypass is set. No further source is consulted.
+			SourceResult, ErrNotFound: This source is not configured for protocol. The next source is consulted.
+			SourceResult, error: This source failed. The error is reported should no source be found, and the next source is consulted.
+	*/
+	Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error)
+}
+
+/*
+The outcome of Source.Lookup.
+*/
+type SourceResult struct {
+	// The candidates, in order of preference. May include DIRECT entries (see NewDirectProxy).
+	Proxies []Proxy
+	// If not empty, the bypass entry which matched the target (i.e. NO_PROXY=.rapid7.com). Proxies are then ignored.
+	Bypass string
+}
+
+/*
+A Source implemented by this package, which reads the settings (timeouts, environment) of the provider consulting it,
+and traces its own steps.
+*/
+type builtinSource interface {
+	Source
+	/*
+		Params:
+			ctx: Bounds the lookup.
+			p: The provider consulting this source.
+			protocol: The protocol of traffic the proxy is to be used for. (i.e. http, https, ftp, socks)
+			targetUrl: The URL the proxy is to be used for.
+			t: Records the steps of this source. Any bypass decision must be recorded with TraceStep.setBypass.
+		Returns:
+			[]Proxy: The proxies found, empty if none were found or targetUrl is bypassed.
+			error: This source failed.
+	*/
+	lookup(ctx context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error)
+}
+
+/*
+Returns the sources consulted by NewProvider by default, in order:
+	config: ConfigFileSource
+	env: EnvironmentSource
+	system: EnvFilesSource, SystemdSource, GNOMESource, KDESource, and NetworkManagerSource on Linux, ScutilSource on MacOS, WinHTTPSource on Windows
+WPADSource, which queries the network, is only consulted should it be named. See WithSourceOrder.
+Params:
+	configFile: Optional. Path to a configuration file which specifies proxies.
+*/
+func DefaultSources(configFile string) []Source {
+	sources, _ := selectSources(configFile, defaultSourceOrder)
+	return sources
+}
+
+/*
+Order, or disable, the sources consulted by the Provider. Sources which are not named are not consulted.
+Names are those of the built in sources (config, env, and those of the system), or "system" for all of the system's sources
+but those which are only consulted when named (i.e. wpad on Linux).
+For example, to prefer the system's settings over a stale HTTPS_PROXY, to ignore the environment entirely, and to discover a PAC script with WPAD:
+	proxy.WithSourceOrder("system", "config", "env")
+	proxy.WithSourceOrder("config", "system")
+	proxy.WithSourceOrder("config", "env", "system", "wpad")
+The order may also be set by the "sources" key of the configuration file, which takes precedence.
+NewProviderWithOptions fails should a name be unknown or repeated.
+*/
+func WithSourceOrder(names ...string) Option {
+	return func(p *provider) {
+		p.sourceOrder = names
+	}
+}
+
+/*
+Resolve source names to the sources to consult, in order.
+Params:
+	configFile: Optional. Path to a configuration file, for the config source.
+	order: Source names, see WithSourceOrder.
+Returns:
+	[]Source, nil: The sources to consult.
+	nil, error: A name is unknown or repeated, or no name is given.
+*/
+func selectSources(configFile string, order []string) ([]Source, error) {
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no proxy sources specified, expected any of: %s", strings.Join(sourceNames(), ", "))
+	}
+	var sources []Source
+	seen := map[string]bool{}
+	for _, name := range order {
+		var selected []Source
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case sourceNameConfigFile:
+			selected = []Source{ConfigFileSource(configFile)}
+		case sourceNameEnvironment:
+			selected = []Source{EnvironmentSource()}
+		case sourceNameSystem:
+			selected = systemSources()
+		default:
+			for _, s := range append(systemSources(), optionalSources()...) {
+				if s.Name() == name {
+					selected = []Source{s}
+				}
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("unknown proxy source %q, expected any of: %s", name, strings.Join(sourceNames(), ", "))
+		}
+		for _, s := range selected {
+			if seen[s.Name()] {
+				return nil, fmt.Errorf("proxy source %q is specified more than once", s.Name())
+			}
+			seen[s.Name()] = true
+			sources = append(sources, s)
+		}
+	}
+	return sources, nil
+}
+
+/*
+Returns the names accepted by WithSourceOrder.
+*/
+func sourceNames() []string {
+	names := []string{sourceNameConfigFile, sourceNameEnvironment, sourceNameSystem}
+	for _, s := range append(systemSources(), optionalSources()...) {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+/*
+Looks up a built in source outside of a Provider, with the default settings.
+*/
+func lookupBuiltinSource(ctx context.Context, s builtinSource, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	p := new(provider)
+	p.init(nil)
+	return p.lookupSource(ctx, s, protocol, targetUrl, newTrace(protocol, targetUrl))
+}
+
+/*
+Create a Source which reads a JSON configuration file, mapping protocols to proxies.
+For example:
+	{"https": "http://proxy.rapid7.com:3128", "ftp": "proxy.rapid7.com:2121"}
+Params:
+	configFile: Optional. Path to the configuration file. If empty, the source is never configured.
+*/
+func ConfigFileSource(configFile string) Source {
+	return &configFileSource{configFile: configFile}
+}
+
+type configFileSource struct {
+	configFile string
+}
+
+func (s *configFileSource) Name() string {
+	return sourceNameConfigFile
+}
+
+func (s *configFileSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *configFileSource) lookup(_ context.Context, p *provider, protocol string, _ *url.URL, t *Trace) ([]Proxy, error) {
+	if proxy := p.readConfigFileProxy(s.configFile, protocol, t); proxy != nil {
+		return []Proxy{proxy}, nil
+	}
+	return nil, nil
+}
+
+/*
+Create a Source which reads the environment: HTTPS_PROXY, https_proxy, ..., respecting NO_PROXY and no_proxy.
+SOCKS proxies are read from ALL_PROXY and all_proxy.
+*/
+func EnvironmentSource() Source {
+	return new(environmentSource)
+}
+
+type environmentSource struct{}
+
+func (s *environmentSource) Name() string {
+	return sourceNameEnvironment
+}
+
+func (s *environmentSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *environmentSource) lookup(_ context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	if proxy := p.readSystemEnvProxy(protocol, targetUrl, t); proxy != nil {
+		return []Proxy{proxy}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+A Source with a fixed result, which counts its lookups.
+*/
+type testSource struct {
+	name    string
+	result  SourceResult
+	err     error
+	lookups int
+	// The arguments of the last lookup
+	protocol  string
+	targetUrl *url.URL
+}
+
+func (s *testSource) Name() string {
+	return s.name
+}
+
+func (s *testSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	s.lookups++
+	s.protocol = protocol
+	s.targetUrl = targetUrl
+	return s.result, s.err
+}
+
+/*
+Returns a provider consulting sources, in order. See WithSources.
+*/
+func newTestProviderWithSources(sources ...Source) Provider {
+	p, _ := NewProviderWithOptions(WithSources(sources...))
+	return p
+}
+
+func TestWithSources(t *testing.T) {
+	a := assert.New(t)
+	policyProxy := newTestProxy("http", "policy", 3128, nil, "policy")
+	notConfigured := &testSource{name: "notConfigured", err: ErrNotFound}
+	failing := &testSource{name: "failing", err: errors.New("policy server unreachable")}
+	policy := &testSource{name: "policy", result: SourceResult{Proxies: []Proxy{policyProxy}}}
+	never := &testSource{name: "never", result: SourceResult{Proxies: []Proxy{newTestProxy("http", "never", 80, nil, "never")}}}
+	p := newTestProviderWithSources(notConfigured, failing, policy, never)
+
+	r, err := p.Lookup(context.Background(), "https", "https://test.endpoint.rapid7.com")
+	a.NoError(err)
+	a.Equal(Result{Kind: ResultProxy, Proxy: policyProxy, Proxies: []Proxy{policyProxy}, Src: "policy"}, r)
+	a.Equal(1, notConfigured.lookups)
+	a.Equal(1, failing.lookups)
+	a.Equal(0, never.lookups)
+	a.Equal(policyProxy, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+
+	tr := p.Explain("https", "https://test.endpoint.rapid7.com")
+	a.Equal([]*TraceStep{
+		{Source: "notConfigured"},
+		{Source: "failing", Enabled: true, Error: "policy server unreachable", err: failing.err},
+		{Source: "policy", Enabled: true, Proxies: []Proxy{policyProxy}, Selected: true},
+	}, tr.Steps)
+
+	// Bypass is decisive
+	bypass := &testSource{name: "policy", result: SourceResult{Bypass: "*.rapid7.com", Proxies: []Proxy{policyProxy}}}
+	r, err = newTestProviderWithSources(bypass, never).Lookup(context.Background(), "https", "https://test.endpoint.rapid7.com")
+	a.NoError(err)
+	a.Equal(Result{Kind: ResultBypassed, Proxies: []Proxy{}, Src: "policy", Bypass: "*.rapid7.com"}, r)
+
+	// Nothing found, the failure is reported
+	_, err = newTestProviderWithSources(notConfigured, failing).Lookup(context.Background(), "https", "https://test.endpoint.rapid7.com")
+	a.True(errors.Is(err, ErrNotFound))
+	a.True(errors.Is(err, failing.err))
+
+	// No sources
+	_, err = newTestProviderWithSources().Lookup(context.Background(), "https", "https://test.endpoint.rapid7.com")
+	a.Equal(ErrNotFound, err)
+
+	// The source order is ignored, as are the sources of the configuration file
+	tmpDir, err := os.MkdirTemp("", "TestWithSources")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	f := filepath.Join(tmpDir, "proxy.config")
+	if !a.NoError(os.WriteFile(f, []byte(`{"https": "http://config:8080", "sources": ["config", "bogus"]}`), 0644)) {
+		return
+	}
+	p, err = NewProviderWithOptions(WithConfigFile(f), WithSourceOrder("config"), WithSources(policy))
+	if a.NoError(err) {
+		a.Equal(policyProxy, p.GetProxy("https", "https://test.endpoint.rapid7.com"))
+	}
+}
+
+func TestConfigFileSource(t *testing.T) {
+	a := assert.New(t)
+	tmpDir, err := os.MkdirTemp("", "TestConfigFileSource")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	f := filepath.Join(tmpDir, "proxy.config")
+	if !a.NoError(os.WriteFile(f, []byte(`{"https": "http://config:8080"}`), 0644)) {
+		return
+	}
+	targetUrl := ParseTargetURL("https://test.endpoint.rapid7.com", "")
+	s := ConfigFileSource(f)
+	a.Equal("config", s.Name())
+	r, err := s.Lookup(context.Background(), "https", targetUrl)
+	a.NoError(err)
+	a.Equal(SourceResult{Proxies: []Proxy{newTestProxy("http", "config", 8080, nil, srcConfigurationFile)}}, r)
+	_, err = s.Lookup(context.Background(), "ftp", targetUrl)
+	a.Equal(ErrNotFound, err)
+	_, err = ConfigFileSource("").Lookup(context.Background(), "https", targetUrl)
+	a.Equal(ErrNotFound, err)
+}
+
+func TestEnvironmentSource(t *testing.T) {
+	a := assert.New(t)
+	p := newTestProvider("")
+	p.getEnv = func(key string) string {
+		return map[string]string{"HTTPS_PROXY": "http://env:8080", "NO_PROXY": "example.com"}[key]
+	}
+	s := EnvironmentSource()
+	a.Equal("env", s.Name())
+	ctx := context.Background()
+	trace := func(targetUrl string) *Trace {
+		return newTrace("https", ParseTargetURL(targetUrl, ""))
+	}
+
+	r, err := p.lookupSource(ctx, s, "https", ParseTargetURL("https://test.endpoint.rapid7.com", ""), trace("https://test.endpoint.rapid7.com"))
+	a.NoError(err)
+	a.Equal(SourceResult{Proxies: []Proxy{newTestProxy("http", "env", 8080, nil, "Environment[HTTPS_PROXY]")}}, r)
+
+	r, err = p.lookupSource(ctx, s, "https", ParseTargetURL("https://www.example.com", ""), trace("https://www.example.com"))
+	a.NoError(err)
+	a.Equal(SourceResult{Bypass: "NO_PROXY=example.com"}, r)
+
+	_, err = p.lookupSource(ctx, s, "ftp", ParseTargetURL("ftp://www.example.com", ""), trace("ftp://www.example.com"))
+	a.Equal(ErrNotFound, err)
+}
+
+var dataSelectSources = []struct {
+	order     []string
+	expect    []string
+	expectErr string
+}{
+	{[]string{"config", "env", "system"}, append([]string{"config", "env"}, testSourceNames(systemSources())...), ""},
+	{[]string{"system", "config", "env"}, append(testSourceNames(systemSources()), "config", "env"), ""},
+	{[]string{"config", "system"}, append([]string{"config"}, testSourceNames(systemSources())...), ""},
+	{[]string{" ENV "}, []string{"env"}, ""},
+	{[]string{systemSources()[0].Name(), "env"}, []string{systemSources()[0].Name(), "env"}, ""},
+	{append([]string{"system"}, testSourceNames(optionalSources())...), testSourceNames(append(systemSources(), optionalSources()...)), ""},
+	// Invalid
+	{[]string{}, nil, "no proxy sources specified"},
+	{[]string{"env", "bogus"}, nil, "unknown proxy source \"bogus\""},
+	{[]string{"env", "config", "env"}, nil, "proxy source \"env\" is specified more than once"},
+	{[]string{"system", systemSources()[0].Name()}, nil, "is specified more than once"},
+}
+
+func TestSelectSources(t *testing.T) {
+	for _, tt := range dataSelectSources {
+		t.Run(fmt.Sprintf("%s", tt.order), func(t *testing.T) {
+			a := assert.New(t)
+			sources, err := selectSources("", tt.order)
+			if tt.expectErr == "" {
+				a.NoError(err)
+				a.Equal(tt.expect, testSourceNames(sources))
+			} else if a.Error(err) {
+				a.Contains(err.Error(), tt.expectErr)
+			}
+		})
+	}
+}
+
+func testSourceNames(sources []Source) []string {
+	names := []string{}
+	for _, s := range sources {
+		names = append(names, s.Name())
+	}
+	return names
+}
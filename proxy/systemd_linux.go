@@ -0,0 +1,432 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const sourceNameSystemd = "systemd"
+
+/*
+Create a Source which reads HTTPS_PROXY, https_proxy, ..., respecting NO_PROXY and no_proxy, from the environment
+systemd gives a unit: that of the manager (systemctl show-environment, or else DefaultEnvironment= of system.conf and
+its drop-ins), overridden by the Environment=, EnvironmentFile= and UnsetEnvironment= settings of the unit file and
+its drop-ins. Proxies are sourced by the file which set them (i.e. /etc/systemd/system/agent.service.d/proxy.conf[HTTPS_PROXY]).
+The output of systemctl is reused for 30 seconds.
+For example, to explain why a service does, or does not, use a proxy:
+	provider, _ := proxy.NewProviderWithOptions(proxy.WithSources(proxy.SystemdSource("agent.service")))
+	provider.Explain("https", "https://rapid7.com")
+Params:
+	unit: Optional. The unit (i.e. agent.service, or agent for a service). If empty, only the manager's environment is read.
+*/
+func SystemdSource(unit string) Source {
+	if unit != "" && !strings.Contains(unit, ".") {
+		unit += systemdServiceSuffix
+	}
+	return &systemdSource{unit: unit, root: "/", commands: newCommandCache()}
+}
+
+type systemdSource struct {
+	unit string
+	// The file system the configuration is read from, "/" but in tests
+	root     string
+	commands *commandCache
+}
+
+func (s *systemdSource) Name() string {
+	return sourceNameSystemd
+}
+
+func (s *systemdSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *systemdSource) lookup(ctx context.Context, p *provider, protocol string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	if proxy := p.readFileEnvProxy(p.withCommandCache(s.commands).readSystemdEnv(ctx, s.root, s.unit), protocol, targetUrl, t); proxy != nil {
+		return []Proxy{proxy}, nil
+	}
+	return nil, nil
+}
+
+const (
+	systemctlBinary          = "systemctl"
+	systemctlShowEnvironment = "show-environment"
+	systemdServiceSuffix     = ".service"
+	systemdSystemConf        = "system.conf"
+	systemdDropInSuffix      = ".d"
+	systemdManagerSection    = "[Manager]"
+	systemdDefaultEnv        = "DefaultEnvironment"
+	systemdEnv               = "Environment"
+	systemdEnvFile           = "EnvironmentFile"
+	systemdUnsetEnv          = "UnsetEnvironment"
+	srcSystemd               = "Systemd"
+	srcSystemctl             = systemctlBinary + " " + systemctlShowEnvironment
+	// Applied to systemctl when the lookup's context has no deadline
+	systemctlTimeout = time.Second
+)
+
+// Directories of system.conf and its drop-ins (system.conf.d), relative to the root, in decreasing priority
+var systemdConfDirs = []string{"etc/systemd", "run/systemd", "usr/local/lib/systemd", "usr/lib/systemd"}
+
+// Directories of the units and their drop-ins (i.e. agent.service.d), relative to the root, in decreasing priority
+var systemdUnitDirs = []string{"etc/systemd/system", "run/systemd/system", "usr/local/lib/systemd/system", "usr/lib/systemd/system", "lib/systemd/system"}
+
+/*
+An assignment of the environment, and the file which made it.
+*/
+type systemdAssignment struct {
+	key   string
+	value string
+	file  string
+}
+
+/*
+Returns the environment systemd gives unit, or that of the manager should unit be empty.
+The files are read relative to root. Those which cannot be read are logged, and skipped.
+*/
+func (p *provider) readSystemdEnv(ctx context.Context, root string, unit string) *fileEnv {
+	name := srcSystemd
+	if unit != "" {
+		name += ":" + unit
+	}
+	env := newFileEnv(name)
+	if err := p.readSystemctlEnv(ctx, env); err != nil {
+		p.logger.Printf("[proxy.Provider.readSystemdEnv]: %s, reading %s\n", err, systemdSystemConf)
+		p.readSystemdManagerEnv(root, env)
+	}
+	if unit != "" {
+		p.readSystemdUnitEnv(root, unit, env)
+	}
+	return env
+}
+
+/*
+Read the environment of the running manager, which includes DefaultEnvironment= and systemctl set-environment.
+If ctx has no deadline, systemctlTimeout is applied.
+*/
+func (p *provider) readSystemctlEnv(ctx context.Context, env *fileEnv) error {
+	out, _, err := p.runCommand(ctx, systemctlTimeout, systemctlBinary, systemctlShowEnvironment)
+	if err != nil {
+		return fmt.Errorf("%s: %w", srcSystemctl, err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || !isEnvName(key) {
+			continue
+		}
+		// Values which are not printable as they are, are quoted as $'...'
+		if strings.HasPrefix(value, "$'") && strings.HasSuffix(value, "'") && len(value) >= 3 {
+			value = unescapeSystemdWord(value[2 : len(value)-1])
+		}
+		env.set(key, value, srcSystemctl)
+	}
+	return nil
+}
+
+/*
+Read DefaultEnvironment= of system.conf, and its drop-ins.
+*/
+func (p *provider) readSystemdManagerEnv(root string, env *fileEnv) {
+	var files []string
+	for _, dir := range systemdConfDirs {
+		if f := filepath.Join(root, dir, systemdSystemConf); fileExists(f) {
+			files = append(files, f)
+			break
+		}
+	}
+	files = append(files, systemdDropIns(root, systemdConfDirs, []string{systemdSystemConf})...)
+	var assignments []systemdAssignment
+	for _, f := range files {
+		content, err := readEnvFile(f)
+		if err != nil {
+			p.logger.Printf("[proxy.Provider.readSystemdManagerEnv]: %s\n", err)
+			continue
+		}
+		for _, setting := range parseSystemdConfig(content, systemdManagerSection) {
+			if setting.key == systemdDefaultEnv {
+				assignments = appendSystemdEnv(assignments, setting.value, f)
+			}
+		}
+	}
+	for _, a := range assignments {
+		env.set(a.key, a.value, a.file)
+	}
+}
+
+/*
+Read the Environment=, EnvironmentFile= and UnsetEnvironment= settings of unit, and its drop-ins.
+As systemd does, the files of EnvironmentFile= override Environment=, and UnsetEnvironment= is applied last.
+*/
+func (p *provider) readSystemdUnitEnv(root string, unit string, env *fileEnv) {
+	names := []string{unit}
+	// The template of an instance (i.e. agent@.service for agent@1.service)
+	if at := strings.Index(unit, "@"); at >= 0 {
+		if dot := strings.LastIndex(unit, "."); dot > at+1 {
+			names = []string{unit, unit[:at+1] + unit[dot:]}
+		}
+	}
+	var files []string
+	for _, name := range names {
+		if f := findSystemdUnit(root, name); f != "" {
+			files = append(files, f)
+			break
+		}
+	}
+	if len(files) == 0 {
+		p.logger.Printf("[proxy.Provider.readSystemdUnitEnv]: unit %s not found\n", unit)
+	}
+	files = append(files, systemdDropIns(root, systemdUnitDirs, names)...)
+	// The settings are those of the section named after the unit's type (i.e. [Service])
+	section := unit[strings.LastIndex(unit, ".")+1:]
+	if section != "" {
+		section = "[" + strings.ToUpper(section[:1]) + section[1:] + "]"
+	}
+	var assignments []systemdAssignment
+	var envFiles, unset []string
+	for _, f := range files {
+		content, err := readEnvFile(f)
+		if err != nil {
+			p.logger.Printf("[proxy.Provider.readSystemdUnitEnv]: %s\n", err)
+			continue
+		}
+		for _, setting := range parseSystemdConfig(content, section) {
+			switch setting.key {
+			case systemdEnv:
+				assignments = appendSystemdEnv(assignments, setting.value, f)
+			case systemdEnvFile:
+				if setting.value == "" {
+					envFiles = nil
+				} else {
+					envFiles = append(envFiles, setting.value)
+				}
+			case systemdUnsetEnv:
+				if setting.value == "" {
+					unset = nil
+				} else {
+					unset = append(unset, splitSystemdWords(setting.value)...)
+				}
+			}
+		}
+	}
+	for _, a := range assignments {
+		env.set(a.key, a.value, a.file)
+	}
+	for _, envFile := range envFiles {
+		optional := strings.HasPrefix(envFile, "-")
+		f := filepath.Join(root, strings.TrimPrefix(envFile, "-"))
+		content, err := readEnvFile(f)
+		if err != nil {
+			if !optional || !errors.Is(err, os.ErrNotExist) {
+				p.logger.Printf("[proxy.Provider.readSystemdUnitEnv]: %s: %s\n", systemdEnvFile, err)
+			}
+			continue
+		}
+		parseEnvironmentFile(content, f, env)
+	}
+	for _, u := range unset {
+		// Either KEY, or KEY=VALUE which only unsets that value
+		if key, value, ok := strings.Cut(u, "="); !ok {
+			env.unset(u)
+		} else if v, set := env.values[key]; set && v == value {
+			env.unset(key)
+		}
+	}
+}
+
+/*
+Append the assignments of an Environment= (or DefaultEnvironment=) setting. An empty setting resets those made so far.
+*/
+func appendSystemdEnv(assignments []systemdAssignment, value string, file string) []systemdAssignment {
+	if value == "" {
+		return nil
+	}
+	for _, word := range splitSystemdWords(value) {
+		if key, v, ok := strings.Cut(word, "="); ok && isEnvName(key) {
+			assignments = append(assignments, systemdAssignment{key: key, value: v, file: file})
+		}
+	}
+	return assignments
+}
+
+/*
+Returns the file of the unit name, found in the directory of highest priority. Empty if it is not found.
+*/
+func findSystemdUnit(root string, name string) string {
+	for _, dir := range systemdUnitDirs {
+		if f := filepath.Join(root, dir, name); fileExists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+/*
+Returns the drop-ins (*.conf of the directories name.d) of the given names, ordered by file name.
+Should several directories have a drop-in of the same file name, that of highest priority is used.
+Params:
+	dirs: The directories of the drop-in directories, in decreasing priority.
+	names: The units, or configuration files, the drop-ins are for (i.e. agent@1.service and agent@.service).
+*/
+func systemdDropIns(root string, dirs []string, names []string) []string {
+	dropIns := map[string]string{}
+	for _, dir := range dirs {
+		for _, name := range names {
+			matches, _ := filepath.Glob(filepath.Join(root, dir, name+systemdDropInSuffix, "*.conf"))
+			for _, match := range matches {
+				if _, ok := dropIns[filepath.Base(match)]; !ok {
+					dropIns[filepath.Base(match)] = match
+				}
+			}
+		}
+	}
+	var files []string
+	for _, f := range dropIns {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return files
+}
+
+func fileExists(f string) bool {
+	stat, err := os.Stat(f)
+	return err == nil && !stat.IsDir()
+}
+
+/*
+A setting of a systemd configuration file.
+*/
+type systemdSetting struct {
+	key   string
+	value string
+}
+
+/*
+Parse the settings of section (i.e. [Service]) in a systemd configuration file, in order.
+Comments (# and ;) are skipped, and lines ending in a backslash are continued.
+*/
+func parseSystemdConfig(content []byte, section string) []systemdSetting {
+	var settings []systemdSetting
+	inSection := false
+	continued := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if continued == "" && (strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";")) {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			continued += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		line, continued = continued+line, ""
+		if strings.HasPrefix(line, "[") {
+			inSection = line == section
+			continue
+		} else if !inSection {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			settings = append(settings, systemdSetting{key: strings.TrimSpace(key), value: strings.TrimSpace(value)})
+		}
+	}
+	return settings
+}
+
+/*
+Split the value of a setting into words, separated by white space, removing quotes and unescaping backslashes.
+For example:
+	A=1 "B=2 3" 'C=$4' -> [A=1, B=2 3, C=$4]
+*/
+func splitSystemdWords(value string) []string {
+	var words []string
+	var b strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, unescapeSystemdWord(b.String()))
+				b.Reset()
+				inWord = false
+			}
+		case c == '\\' && i+1 < len(value):
+			// Unescaped with the word, so that an escaped quote does not end it
+			i++
+			b.WriteString(value[i-1 : i+1])
+			inWord = true
+		default:
+			b.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, unescapeSystemdWord(b.String()))
+	}
+	return words
+}
+
+/*
+Replace the C escape sequences of s (\n, \t, \\, \", \', \s and \xNN).
+*/
+func unescapeSystemdWord(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 's':
+			b.WriteByte(' ')
+		case 'x':
+			var c byte
+			if i+2 < len(s) {
+				if _, err := fmt.Sscanf(s[i+1:i+3], "%02x", &c); err == nil {
+					b.WriteByte(c)
+					i += 2
+					continue
+				}
+			}
+			b.WriteString(`\x`)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
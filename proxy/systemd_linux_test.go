@@ -0,0 +1,175 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var dataSplitSystemdWords = []struct {
+	value  string
+	expect []string
+}{
+	{"HTTPS_PROXY=http://proxy:3128", []string{"HTTPS_PROXY=http://proxy:3128"}},
+	{"A=1  B=2\tC=3", []string{"A=1", "B=2", "C=3"}},
+	{`"NO_PROXY=localhost, .rapid7.com" 'FTP_PROXY=$PROXY'`, []string{"NO_PROXY=localhost, .rapid7.com", "FTP_PROXY=$PROXY"}},
+	{`NO_PROXY="localhost .rapid7.com"`, []string{"NO_PROXY=localhost .rapid7.com"}},
+	{`A=a\sb B=\x41\\ "C=\"quoted\""`, []string{"A=a b", `B=A\`, `C="quoted"`}},
+	{`""`, []string{""}},
+	{"", nil},
+}
+
+func TestSplitSystemdWords(t *testing.T) {
+	a := assert.New(t)
+	for _, tt := range dataSplitSystemdWords {
+		a.Equal(tt.expect, splitSystemdWords(tt.value), tt.value)
+	}
+}
+
+func TestParseSystemdConfig(t *testing.T) {
+	a := assert.New(t)
+	content := `[Unit]
+Environment=IGNORED=1
+
+[Service]
+# Environment=COMMENTED=1
+; Environment=COMMENTED=2
+Environment=HTTPS_PROXY=http://proxy:3128 \
+  NO_PROXY=localhost
+Environment=
+ExecStart = /usr/bin/agent
+`
+	a.Equal([]systemdSetting{
+		{"Environment", "HTTPS_PROXY=http://proxy:3128  NO_PROXY=localhost"},
+		{"Environment", ""},
+		{"ExecStart", "/usr/bin/agent"},
+	}, parseSystemdConfig([]byte(content), "[Service]"))
+	a.Nil(parseSystemdConfig([]byte(content), "[Manager]"))
+}
+
+/*
+Write the files, relative to root, creating their directories.
+*/
+func writeTestSystemdFiles(a *assert.Assertions, root string, files map[string]string) bool {
+	for f, content := range files {
+		f = filepath.Join(root, f)
+		if !a.NoError(os.MkdirAll(filepath.Dir(f), 0755)) || !a.NoError(os.WriteFile(f, []byte(content), 0644)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProvider_ReadSystemdEnv(t *testing.T) {
+	a := assert.New(t)
+	root, err := os.MkdirTemp("", "TestProvider_ReadSystemdEnv")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+	if !writeTestSystemdFiles(a, root, map[string]string{
+		"usr/lib/systemd/system.conf":                  "[Manager]\nDefaultEnvironment=HTTPS_PROXY=http://ignored:3128\n",
+		"etc/systemd/system.conf":                      "[Manager]\nDefaultEnvironment=HTTPS_PROXY=http://manager:3128 \"NO_PROXY=localhost, .rapid7.com\"\n",
+		"usr/lib/systemd/system.conf.d/10-proxy.conf":  "[Manager]\nDefaultEnvironment=FTP_PROXY=http://ignored:2121\n",
+		"etc/systemd/system.conf.d/10-proxy.conf":      "[Manager]\nDefaultEnvironment=FTP_PROXY=http://manager:2121\n",
+		"usr/lib/systemd/system/agent@.service":        "[Service]\nEnvironment=HTTP_PROXY=http://unit:8080 ALL_PROXY=socks5://unit:1080\nEnvironmentFile=-/etc/default/agent\nEnvironmentFile=-/etc/default/missing\nUnsetEnvironment=ALL_PROXY\n",
+		"etc/systemd/system/agent@.service.d/20.conf":  "[Service]\nEnvironment=HTTPS_PROXY=http://template:3128\n",
+		"etc/systemd/system/agent@1.service.d/30.conf": "[Service]\nEnvironment=HTTPS_PROXY=http://instance:3128 FTP_PROXY=http://instance:2121\nUnsetEnvironment=FTP_PROXY=http://other:2121\n",
+		"run/systemd/system/agent@1.service.d/20.conf": "[Service]\nEnvironment=HTTPS_PROXY=http://ignored:3128\n",
+		"etc/default/agent":                            "HTTP_PROXY=http://file:8080\n",
+	}) {
+		return
+	}
+	p := newTestProvider("")
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "systemctl-not-installed", arg...)
+	}
+
+	// The manager's defaults, from system.conf of highest priority and its drop-ins
+	env := p.readSystemdEnv(context.Background(), root, "")
+	a.Equal(map[string]string{
+		"HTTPS_PROXY": "http://manager:3128",
+		"NO_PROXY":    "localhost, .rapid7.com",
+		"FTP_PROXY":   "http://manager:2121",
+	}, env.values)
+	a.Equal(filepath.Join(root, "etc/systemd/system.conf")+"[HTTPS_PROXY]", env.src("HTTPS_PROXY"))
+	a.Equal("Systemd[HTTP_PROXY]", env.src("HTTP_PROXY"))
+
+	// An instance of a template, overriding the manager's defaults
+	env = p.readSystemdEnv(context.Background(), root, "agent@1.service")
+	a.Equal(map[string]string{
+		"HTTPS_PROXY": "http://instance:3128",
+		"HTTP_PROXY":  "http://file:8080",
+		"NO_PROXY":    "localhost, .rapid7.com",
+		"FTP_PROXY":   "http://instance:2121",
+	}, env.values)
+	a.Equal(filepath.Join(root, "etc/systemd/system/agent@1.service.d/30.conf")+"[HTTPS_PROXY]", env.src("HTTPS_PROXY"))
+	a.Equal(filepath.Join(root, "etc/default/agent")+"[HTTP_PROXY]", env.src("HTTP_PROXY"))
+	a.Equal("Systemd:agent@1.service[ALL_PROXY]", env.src("ALL_PROXY"))
+
+	// The running manager's environment takes precedence over system.conf
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "echo", "HTTPS_PROXY=http://systemctl:3128\nNO_PROXY=$'localhost\\t.rapid7.com'\nnot an assignment")
+	}
+	env = p.readSystemdEnv(context.Background(), root, "")
+	a.Equal(map[string]string{"HTTPS_PROXY": "http://systemctl:3128", "NO_PROXY": "localhost\t.rapid7.com"}, env.values)
+	a.Equal(srcSystemctl+"[HTTPS_PROXY]", env.src("HTTPS_PROXY"))
+}
+
+func TestSystemdSource_lookup(t *testing.T) {
+	a := assert.New(t)
+	root, err := os.MkdirTemp("", "TestSystemdSource_lookup")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+	if !writeTestSystemdFiles(a, root, map[string]string{
+		"etc/systemd/system/agent.service":              "[Service]\nExecStart=/usr/bin/agent\n",
+		"etc/systemd/system/agent.service.d/proxy.conf": "[Service]\nEnvironment=HTTPS_PROXY=http://proxy.rapid7.com:3128 NO_PROXY=.intranet.rapid7.com\n",
+	}) {
+		return
+	}
+	p := newTestProvider("")
+	runs := 0
+	p.proc = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		runs++
+		return exec.CommandContext(ctx, "true")
+	}
+	now := time.Date(2018, time.June, 15, 13, 30, 0, 0, time.UTC)
+	s := SystemdSource("agent").(*systemdSource)
+	s.root = root
+	s.commands.now = func() time.Time { return now }
+	a.Equal("agent.service", s.unit)
+	src := filepath.Join(root, "etc/systemd/system/agent.service.d/proxy.conf") + "[HTTPS_PROXY]"
+	targetUrl := ParseTargetURL("https://test.endpoint.rapid7.com", "")
+	r, err := p.lookupSource(context.Background(), s, "https", targetUrl, newTrace("https", targetUrl))
+	a.NoError(err)
+	a.Equal(SourceResult{Proxies: []Proxy{newTestProxy("http", "proxy.rapid7.com", 3128, nil, src)}}, r)
+	targetUrl = ParseTargetURL("https://wiki.intranet.rapid7.com", "")
+	r, err = p.lookupSource(context.Background(), s, "https", targetUrl, newTrace("https", targetUrl))
+	a.NoError(err)
+	a.Equal("NO_PROXY=.intranet.rapid7.com", r.Bypass)
+
+	// systemctl is run once for consecutive lookups, and again once its output expires
+	a.Equal(1, runs)
+	now = now.Add(commandCacheTTL)
+	_, err = p.lookupSource(context.Background(), s, "https", targetUrl, newTrace("https", targetUrl))
+	a.NoError(err)
+	a.Equal(2, runs)
+}
@@ -0,0 +1,194 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Request schemes which are not traffic protocols, mapped to the protocol of their traffic
+var requestSchemeProtocols = map[string]string{
+	"ws":  protocolHTTP,
+	"wss": protocolHTTPS,
+}
+
+// Proxy protocols supported by http.Transport
+var transportProxyProtocols = map[string]bool{
+	protocolHTTP:    true,
+	protocolHTTPS:   true,
+	protocolSOCKS5:  true,
+	protocolSOCKS5H: true,
+}
+
+/*
+Create a function for http.Transport.Proxy which looks up the proxy of each request with provider.
+For example:
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy.ProxyFunc(provider)
+The protocol looked up is the scheme of the request (ws and wss are looked up as http and https),
+and the target is the full URL of the request. The lookup is bounded by the request's context.
+Params:
+	provider: The provider to look up proxies with.
+Returns:
+	A function which returns:
+		*url.URL, nil: The request is to be sent through the proxy.
+		nil, nil: The request is to be sent directly: no proxy is configured, the target is bypassed,
+			or a PAC script prefers a direct connection.
+		nil, error: The lookup was abandoned (see ErrTimeout), or the proxy's protocol is not supported by http.Transport
+			(i.e. socks4). The request fails.
+The TLS session with an https proxy is that of http.Transport, configured by its TLSClientConfig.
+Use NewTransport for the proxy's ProxyTLSConfig to apply.
+*/
+func ProxyFunc(provider Provider) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		p, err := requestProxy(provider, req)
+		if p == nil || err != nil {
+			return nil, err
+		}
+		return transportProxyURL(p)
+	}
+}
+
+/*
+Look up the proxy of req.
+Returns:
+	Proxy, nil: The request is to be sent through the proxy.
+	nil, nil: The request is to be sent directly.
+	nil, error: The lookup was abandoned.
+*/
+func requestProxy(provider Provider, req *http.Request) (Proxy, error) {
+	r, err := provider.Lookup(req.Context(), requestProtocol(req), req.URL.String())
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if r.Kind != ResultProxy {
+		return nil, nil
+	}
+	return r.Proxy, nil
+}
+
+/*
+Returns:
+	The traffic protocol to look up for req, see ProxyFunc.
+*/
+func requestProtocol(req *http.Request) string {
+	protocol := strings.ToLower(req.URL.Scheme)
+	if p, exists := requestSchemeProtocols[protocol]; exists {
+		return p
+	}
+	return protocol
+}
+
+/*
+Returns:
+	*url.URL, nil: The URL of p, for http.Transport.Proxy. Proxies without a protocol are HTTP proxies.
+	nil, error: The protocol of p is not supported by http.Transport.
+*/
+func transportProxyURL(p Proxy) (*url.URL, error) {
+	u := p.URL()
+	if u.Scheme == "" {
+		u.Scheme = protocolHTTP
+	}
+	if !transportProxyProtocols[u.Scheme] {
+		return nil, fmt.Errorf("unsupported proxy protocol for net/http: %s", p)
+	}
+	return u, nil
+}
+
+/*
+Create an http.Transport which sends requests through the proxies found by provider.
+The transport is a clone of http.DefaultTransport, with Proxy set as ProxyFunc(provider) would.
+The TLS session with an https proxy is established by its DialContext, so that the proxy's ProxyTLSConfig applies.
+Params:
+	provider: The provider to look up proxies with.
+*/
+func NewTransport(provider Provider) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsProxies := new(tlsProxies)
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		p, err := requestProxy(provider, req)
+		if p == nil || err != nil {
+			return nil, err
+		}
+		return tlsProxies.proxyURL(p)
+	}
+	transport.DialContext = tlsProxies.dialContext(transport.DialContext)
+	return transport
+}
+
+/*
+The https proxies an http.Transport connects to. The transport sends requests to them as to http proxies,
+over a TLS session established by dialContext with their ProxyTLSConfig,
+rather than by the transport with its TLSClientConfig (which is that of the target).
+The transport is given each of them under a reserved host name (see tlsProxyHost) rather than its address,
+so that only the connections of requests sent through the proxy are wrapped, and not those made to its address directly.
+*/
+type tlsProxies struct {
+	// By reserved address, one per proxy URL
+	proxies sync.Map
+}
+
+/*
+Returns:
+	*url.URL, nil: The URL of p for http.Transport.Proxy. The URL of an https proxy is rewritten to http, with its reserved host name.
+	nil, error: The protocol of p is not supported by http.Transport.
+*/
+func (t *tlsProxies) proxyURL(p Proxy) (*url.URL, error) {
+	u, err := transportProxyURL(p)
+	if err != nil || u.Scheme != protocolHTTPS {
+		return u, err
+	}
+	addr := net.JoinHostPort(tlsProxyHost(u), strconv.Itoa(int(p.Port())))
+	t.proxies.Store(addr, p)
+	u.Scheme = protocolHTTP
+	u.Host = addr
+	return u, nil
+}
+
+/*
+Returns:
+	The reserved host name (RFC 2606) under which the https proxy u is given to http.Transport, derived from its URL.
+*/
+func tlsProxyHost(u *url.URL) string {
+	digest := sha256.Sum256([]byte(u.String()))
+	return hex.EncodeToString(digest[:8]) + ".tls-proxy.invalid"
+}
+
+/*
+Returns:
+	A function for http.Transport.DialContext, which completes a TLS handshake with https proxies after dialing them.
+*/
+func (t *tlsProxies) dialContext(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if p, exists := t.proxies.Load(strings.ToLower(addr)); exists {
+			return dialTLSProxy(ctx, dial, p.(Proxy), nil)
+		}
+		return dial(ctx, network, addr)
+	}
+}
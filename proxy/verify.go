@@ -0,0 +1,308 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The phases of a Report, in the order they take place
+const (
+	// Connecting to the proxy
+	PhaseConnect = "connect"
+	// The TLS handshake with an https proxy
+	PhaseProxyTLS = "proxy-tls"
+	// The CONNECT request, or SOCKS handshake, including authentication
+	PhaseHandshake = "handshake"
+	// The TLS handshake with the target, through the proxy
+	PhaseTLS = "tls"
+)
+
+/*
+The outcome of Verify.
+*/
+type Report struct {
+	// The proxy, as a human readable string with user info obfuscated
+	Proxy string
+	// The target connected to through the proxy
+	Target string
+	// The phases which took place, in order. The last has an error should the verification have failed in it.
+	// A phase may repeat, should the proxy close the connection while authenticating.
+	Phases []*Phase
+	// The status code of the proxy's last response to a CONNECT request (i.e. 200), or the reply code of a SOCKS proxy
+	// which refused the connection (i.e. 0x05). Zero if there was none.
+	StatusCode int
+	// The status line of the proxy's last response to a CONNECT request, or the meaning of the reply code of a SOCKS proxy
+	Status string
+	// The challenges of the proxy's Proxy-Authenticate headers (i.e. NTLM, or Basic realm="proxy"), in order
+	Challenges []string
+	// The duration of the verification
+	Duration time.Duration
+	// The error the verification failed with, if any
+	Error string
+}
+
+/*
+A phase of a verification, see Report.
+*/
+type Phase struct {
+	// The name of the phase (i.e. PhaseConnect)
+	Name string
+	// How long the phase took
+	Duration time.Duration
+	// The error the phase failed with, if any
+	Error string
+	// Set while the phase is in progress
+	start time.Time
+}
+
+/*
+The TLS configuration Verify completes the handshake with the target with. ServerName defaults to the target's host.
+Only used by Verify.
+*/
+func WithVerifyTLS(config *tls.Config) DialerOption {
+	return func(d *dialer) {
+		d.verifyTLS = config
+	}
+}
+
+/*
+Verify that a connection to target may be established through p, reporting each phase.
+For example, to check the proxy of a lookup:
+	report, err := proxy.Verify(ctx, provider.GetProxy("https", "https://rapid7.com"), "https://rapid7.com")
+Params:
+	ctx: Bounds the verification.
+	p: The proxy, of any protocol supported by Dialer.
+	target: A URL (i.e. https://rapid7.com), or a host:port. A TLS handshake is completed with https and wss URLs.
+	opts: Optional. See Dialer, and WithVerifyTLS.
+Returns:
+	Report, nil: The connection was established, and the TLS handshake with the target, if any, completed.
+	Report, error: The verification failed, as recorded by the report.
+*/
+func Verify(ctx context.Context, p Proxy, target string, opts ...DialerOption) (Report, error) {
+	r := Report{Target: target}
+	err := r.verify(ctx, p, target, opts)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r, err
+}
+
+func (r *Report) verify(ctx context.Context, p Proxy, target string, opts []DialerOption) error {
+	if p == nil || IsDirect(p) {
+		return errors.New("no proxy to verify")
+	}
+	r.Proxy = p.String()
+	addr, serverName, err := verifyTarget(target)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		r.Duration = time.Since(start)
+	}()
+
+	d := Dialer(p, opts...).(*dialer)
+	d.trace = r.trace(p)
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	r.end(err)
+	var socksErr *SOCKSError
+	if errors.As(err, &socksErr) {
+		r.StatusCode, r.Status = int(socksErr.Code), socksErr.reason()
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if serverName == "" {
+		return nil
+	}
+
+	r.begin(PhaseTLS)
+	config := new(tls.Config)
+	if d.verifyTLS != nil {
+		config = d.verifyTLS.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	err = tls.Client(conn, config).HandshakeContext(ctx)
+	r.end(err)
+	return err
+}
+
+/*
+Returns:
+	The hooks of a dialer which record the phases, status, and challenges of the connection to p.
+*/
+func (r *Report) trace(p Proxy) *dialTrace {
+	return &dialTrace{
+		dialing: func() {
+			r.end(nil)
+			r.begin(PhaseConnect)
+		},
+		connected: func(err error) {
+			r.end(err)
+			if err != nil {
+				return
+			}
+			if p.Protocol() == protocolHTTPS {
+				r.begin(PhaseProxyTLS)
+			} else {
+				r.begin(PhaseHandshake)
+			}
+		},
+		proxyTLSDone: func(err error) {
+			r.end(err)
+			if err == nil {
+				r.begin(PhaseHandshake)
+			}
+		},
+		connectResponse: func(resp *http.Response) {
+			r.StatusCode, r.Status = resp.StatusCode, resp.Status
+			for _, c := range resp.Header.Values(headerProxyAuthenticate) {
+				if !slices.Contains(r.Challenges, c) {
+					r.Challenges = append(r.Challenges, c)
+				}
+			}
+		},
+	}
+}
+
+/*
+Start a phase, which is in progress until it ends.
+*/
+func (r *Report) begin(name string) {
+	r.Phases = append(r.Phases, &Phase{Name: name, start: time.Now()})
+}
+
+/*
+End the phase in progress, if any, with err.
+*/
+func (r *Report) end(err error) {
+	if len(r.Phases) == 0 {
+		return
+	}
+	phase := r.Phases[len(r.Phases)-1]
+	if phase.start.IsZero() {
+		return
+	}
+	phase.Duration = time.Since(phase.start)
+	phase.start = time.Time{}
+	if err != nil {
+		phase.Error = err.Error()
+	}
+}
+
+/*
+Returns:
+	string, string, nil: The host:port of target, and the server name to complete a TLS handshake with (empty if none).
+	"", "", error: target is neither a URL with a host, nor a host:port.
+*/
+func verifyTarget(target string) (string, string, error) {
+	if !strings.Contains(target, "://") {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return "", "", fmt.Errorf("invalid target %q, expected a URL or host:port: %w", target, err)
+		}
+		return target, "", nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid target %q, missing host", target)
+	}
+	var port, serverName string
+	switch strings.ToLower(u.Scheme) {
+	case "https", "wss":
+		port, serverName = "443", u.Hostname()
+	case "http", "ws":
+		port = "80"
+	default:
+		return "", "", fmt.Errorf("unsupported target scheme %q", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), serverName, nil
+}
+
+/*
+A human readable, multi line, representation of this Report. User info (if any) is obfuscated.
+*/
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s -> %s\n", r.Proxy, r.Target)
+	for i, phase := range r.Phases {
+		fmt.Fprintf(&b, "  %d. %s (%s)", i+1, phase.Name, phase.Duration.Round(time.Microsecond))
+		if phase.Error != "" {
+			fmt.Fprintf(&b, " error=%q", phase.Error)
+		}
+		b.WriteString("\n")
+	}
+	if r.Status != "" {
+		fmt.Fprintf(&b, "Status: %s\n", r.Status)
+	}
+	if len(r.Challenges) > 0 {
+		fmt.Fprintf(&b, "Challenges: %s\n", strings.Join(r.Challenges, "; "))
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "Failed after %s: %s\n", r.Duration.Round(time.Microsecond), r.Error)
+	} else {
+		fmt.Fprintf(&b, "Succeeded in %s\n", r.Duration.Round(time.Microsecond))
+	}
+	return b.String()
+}
+
+/*
+Durations are written in milliseconds.
+*/
+func (r Report) MarshalJSON() ([]byte, error) {
+	phases := make([]map[string]interface{}, 0, len(r.Phases))
+	for _, phase := range r.Phases {
+		phases = append(phases, map[string]interface{}{
+			"name":       phase.Name,
+			"durationMs": durationMillis(phase.Duration),
+			"error":      phase.Error,
+		})
+	}
+	challenges := r.Challenges
+	if challenges == nil {
+		challenges = []string{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"proxy":      r.Proxy,
+		"target":     r.Target,
+		"phases":     phases,
+		"statusCode": r.StatusCode,
+		"status":     r.Status,
+		"challenges": challenges,
+		"durationMs": durationMillis(r.Duration),
+		"error":      r.Error,
+	})
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,220 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+/*
+Returns:
+	The names of the phases of r, and their errors, as name or name:error.
+*/
+func reportPhases(r Report) []string {
+	var phases []string
+	for _, phase := range r.Phases {
+		if phase.Error != "" {
+			phases = append(phases, phase.Name+":error")
+		} else {
+			phases = append(phases, phase.Name)
+		}
+	}
+	return phases
+}
+
+func TestVerify_connect(t *testing.T) {
+	a := assert.New(t)
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	p := newTestConnectProxy(http.StatusOK)
+	defer p.Close()
+
+	r, err := Verify(context.Background(), p.proxy(a), target.URL, WithVerifyTLS(&tls.Config{RootCAs: roots}))
+	a.NoError(err)
+	a.Equal([]string{PhaseConnect, PhaseHandshake, PhaseTLS}, reportPhases(r))
+	a.Equal(http.StatusOK, r.StatusCode)
+	a.Equal("200 Connection established", r.Status)
+	a.Empty(r.Challenges)
+	a.Empty(r.Error)
+	a.True(r.Duration > 0)
+
+	// The target's certificate is not trusted
+	r, err = Verify(context.Background(), p.proxy(a), target.URL)
+	a.Error(err)
+	a.Equal([]string{PhaseConnect, PhaseHandshake, PhaseTLS + ":error"}, reportPhases(r))
+	a.Contains(r.Error, "certificate")
+}
+
+func TestVerify_httpsProxy(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	p := newTestTLSConnectProxy(http.StatusOK, tls.NoClientCert)
+	defer p.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(p.Certificate())
+
+	r, err := Verify(context.Background(), p.proxy(a), echo.Addr().String(), WithProxyTLS(&ProxyTLSConfig{RootCAs: roots}))
+	a.NoError(err)
+	a.Equal([]string{PhaseConnect, PhaseProxyTLS, PhaseHandshake}, reportPhases(r))
+
+	r, err = Verify(context.Background(), p.proxy(a), echo.Addr().String())
+	a.Error(err)
+	a.Equal([]string{PhaseConnect, PhaseProxyTLS + ":error"}, reportPhases(r))
+}
+
+func TestVerify_auth(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	p := newTestNTLMProxy("RAPID7", "user", "secret", true)
+	defer p.Close()
+
+	// The request without credentials is refused, and the connection closed, then NTLM succeeds over a new connection
+	r, err := Verify(context.Background(), p.proxy(a, url.UserPassword(`RAPID7\user`, "secret")), echo.Addr().String())
+	a.NoError(err)
+	a.Equal([]string{PhaseConnect, PhaseHandshake, PhaseConnect, PhaseHandshake}, reportPhases(r))
+	a.Equal(http.StatusOK, r.StatusCode)
+	if a.Len(r.Challenges, 3) {
+		a.Equal([]string{authSchemeNTLM, `Basic realm="test"`}, r.Challenges[:2])
+	}
+
+	r, err = Verify(context.Background(), p.proxy(a, nil), echo.Addr().String())
+	var connectErr *ConnectError
+	a.True(errors.As(err, &connectErr))
+	a.Equal([]string{PhaseConnect, PhaseHandshake + ":error"}, reportPhases(r))
+	a.Equal(http.StatusProxyAuthRequired, r.StatusCode)
+	a.Equal([]string{authSchemeNTLM, `Basic realm="test"`}, r.Challenges)
+}
+
+func TestVerify_socks(t *testing.T) {
+	a := assert.New(t)
+	echo := newTestEchoServer(a)
+	defer echo.Close()
+	s := newTestSOCKS5Server(a, "", "")
+	defer s.Close()
+	p := newTestProxyFromURL(a, "socks5://"+s.Addr().String())
+
+	r, err := Verify(context.Background(), p, echo.Addr().String())
+	a.NoError(err)
+	a.Equal([]string{PhaseConnect, PhaseHandshake}, reportPhases(r))
+	a.Equal(0, r.StatusCode)
+
+	// Connection refused
+	s.reply = 0x05
+	r, err = Verify(context.Background(), p, echo.Addr().String())
+	a.Error(err)
+	a.Equal([]string{PhaseConnect, PhaseHandshake + ":error"}, reportPhases(r))
+	a.Equal(0x05, r.StatusCode)
+	a.Equal("connection refused", r.Status)
+}
+
+func TestVerify_unreachable(t *testing.T) {
+	a := assert.New(t)
+	r, err := Verify(context.Background(), newTestProxyFromURL(a, newTestDeadProxyURL(a)), "rapid7.com:443")
+	a.Error(err)
+	a.Equal([]string{PhaseConnect + ":error"}, reportPhases(r))
+	a.Equal(err.Error(), r.Error)
+
+	_, err = Verify(context.Background(), NewDirectProxy("test"), "rapid7.com:443")
+	a.Error(err)
+}
+
+func TestVerify_timeout(t *testing.T) {
+	a := assert.New(t)
+	// A proxy which never responds
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r, err := Verify(ctx, newTestProxyFromURL(a, s.URL), "rapid7.com:443")
+	a.True(errors.Is(err, ErrTimeout))
+	a.Equal([]string{PhaseConnect, PhaseHandshake + ":error"}, reportPhases(r))
+}
+
+var dataVerifyTarget = []struct {
+	target     string
+	expectAddr string
+	expectName string
+	expectErr  bool
+}{
+	{"https://rapid7.com", "rapid7.com:443", "rapid7.com", false},
+	{"wss://rapid7.com:8443/socket", "rapid7.com:8443", "rapid7.com", false},
+	{"http://rapid7.com", "rapid7.com:80", "", false},
+	{"rapid7.com:443", "rapid7.com:443", "", false},
+	{"[::1]:443", "[::1]:443", "", false},
+	{"rapid7.com", "", "", true},
+	{"ftp://rapid7.com", "", "", true},
+	{"https://", "", "", true},
+}
+
+func TestVerifyTarget(t *testing.T) {
+	for _, tt := range dataVerifyTarget {
+		t.Run(tt.target, func(t *testing.T) {
+			a := assert.New(t)
+			addr, serverName, err := verifyTarget(tt.target)
+			if tt.expectErr {
+				a.Error(err)
+				return
+			}
+			a.NoError(err)
+			a.Equal(tt.expectAddr, addr)
+			a.Equal(tt.expectName, serverName)
+		})
+	}
+}
+
+func TestReport_json(t *testing.T) {
+	a := assert.New(t)
+	r := Report{
+		Proxy:      "http://proxy:3128",
+		Target:     "rapid7.com:443",
+		Phases:     []*Phase{{Name: PhaseConnect, Duration: 1500 * time.Microsecond}, {Name: PhaseHandshake, Duration: time.Millisecond, Error: "refused"}},
+		StatusCode: http.StatusForbidden,
+		Status:     "403 Forbidden",
+		Duration:   2500 * time.Microsecond,
+		Error:      "refused",
+	}
+	b, err := json.Marshal(r)
+	a.NoError(err)
+	a.JSONEq(`{
+		"proxy": "http://proxy:3128",
+		"target": "rapid7.com:443",
+		"phases": [{"name": "connect", "durationMs": 1.5, "error": ""}, {"name": "handshake", "durationMs": 1, "error": "refused"}],
+		"statusCode": 403,
+		"status": "403 Forbidden",
+		"challenges": [],
+		"durationMs": 2.5,
+		"error": "refused"
+	}`, string(b))
+	a.Equal(`http://proxy:3128 -> rapid7.com:443
+  1. connect (1.5ms)
+  2. handshake (1ms) error="refused"
+Status: 403 Forbidden
+Failed after 2.5ms: refused
+`, r.String())
+}
@@ -0,0 +1,231 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	srcWPADDHCP        = "WPAD:DHCP"
+	dhcpOptionWPAD     = 252
+	dhcpOptionPad      = 0
+	dhcpOptionEnd      = 255
+	maxLeaseFileSize   = 1048576
+	bootpHeaderSize    = 236
+	systemdLeaseOption = "OPTION_252"
+	systemdLeaseWPAD   = "WPAD"
+)
+
+// Lease files searched for the WPAD option, in no particular order. The most recently modified lease wins.
+var defaultDHCPLeaseFiles = []string{
+	// dhclient
+	"/var/lib/dhcp/*.leases",
+	"/var/lib/dhclient/*.leases",
+	"/var/lib/NetworkManager/dhclient-*.lease",
+	// dhcpcd
+	"/var/lib/dhcpcd/*.lease",
+	"/var/lib/dhcpcd5/*.lease",
+	"/var/db/dhcpcd/*.lease",
+	// NetworkManager internal client
+	"/var/lib/NetworkManager/internal-*.lease",
+	// systemd-networkd
+	"/run/systemd/netif/leases/*",
+}
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// dhclient only names option 252 if it is declared in dhclient.conf, otherwise it is reported as unknown-252
+var dhclientWPADOption = regexp.MustCompile(`^\s*option\s+(?:wpad|wpad-url|wpad-curl|proxy-auto-config|unknown-252)\s+(.+?)\s*;\s*$`)
+
+/*
+Find the PAC URL advertised by DHCP (option 252) in the lease files matched by leaseFiles.
+Supported formats are dhclient leases, dhcpcd binary leases, and systemd-networkd/NetworkManager key=value leases.
+Params:
+	leaseFiles: Glob patterns of the lease files.
+Returns:
+	string, nil: The PAC URL from the most recently modified lease which provides one.
+	"", ErrNotFound: No lease provides a PAC URL.
+*/
+func (p *provider) readDHCPWPADURL(leaseFiles []string) (string, error) {
+	var (
+		wpadUrl string
+		modTime time.Time
+	)
+	for _, pattern := range leaseFiles {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			p.logger.Printf("[proxy.Provider.readDHCPWPADURL]: invalid lease file pattern %q: %s\n", pattern, err)
+			continue
+		}
+		for _, f := range files {
+			stat, err := os.Stat(f)
+			if err != nil || stat.IsDir() || stat.Size() > maxLeaseFileSize {
+				continue
+			}
+			content, err := os.ReadFile(f)
+			if err != nil {
+				p.logger.Printf("[proxy.Provider.readDHCPWPADURL]: failed to read lease file %s: %s\n", f, err)
+				continue
+			}
+			u := parseDHCPLeaseWPAD(content)
+			if u == "" {
+				continue
+			}
+			p.logger.Printf("[proxy.Provider.readDHCPWPADURL]: %s: %s\n", f, u)
+			if wpadUrl == "" || stat.ModTime().After(modTime) {
+				wpadUrl = u
+				modTime = stat.ModTime()
+			}
+		}
+	}
+	if wpadUrl == "" {
+		return "", ErrNotFound
+	}
+	return wpadUrl, nil
+}
+
+/*
+Extract the WPAD option from the content of a lease file, detecting its format.
+Returns:
+	The PAC URL, or "" if the lease does not provide one.
+*/
+func parseDHCPLeaseWPAD(content []byte) string {
+	if len(content) >= bootpHeaderSize+len(dhcpMagicCookie) &&
+		bytes.Equal(content[bootpHeaderSize:bootpHeaderSize+len(dhcpMagicCookie)], dhcpMagicCookie) {
+		return sanitizeWPADURL(parseDHCPMessageOption(content[bootpHeaderSize+len(dhcpMagicCookie):], dhcpOptionWPAD))
+	}
+	var wpadUrl string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// dhclient: option wpad "http://wpad/wpad.dat";
+		if m := dhclientWPADOption.FindStringSubmatch(line); m != nil {
+			if v := parseDhclientValue(m[1]); v != "" {
+				// Leases are appended, the last one is the most recent
+				wpadUrl = v
+			}
+			continue
+		}
+		// systemd-networkd: OPTION_252=687474703a2f2f...
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case systemdLeaseOption:
+			if b, err := hex.DecodeString(value); err == nil {
+				wpadUrl = string(b)
+			}
+		case systemdLeaseWPAD:
+			wpadUrl = value
+		}
+	}
+	return sanitizeWPADURL(wpadUrl)
+}
+
+/*
+Return the value of the given option from the options section of a DHCP message (after the magic cookie).
+*/
+func parseDHCPMessageOption(options []byte, code byte) string {
+	var value []byte
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case dhcpOptionPad:
+			i++
+			continue
+		case dhcpOptionEnd:
+			return string(value)
+		}
+		if i+1 >= len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if i+2+length > len(options) {
+			break
+		}
+		if options[i] == code {
+			// Long options may be split across several instances (RFC 3396)
+			value = append(value, options[i+2:i+2+length]...)
+		}
+		i += 2 + length
+	}
+	return string(value)
+}
+
+/*
+Decode a dhclient option value, which is either a quoted string or colon separated hex.
+For example:
+	"\"http://wpad/wpad.dat\"" -> "http://wpad/wpad.dat"
+	"68:74:74:70:3a:2f:2f:77" -> "http://w"
+*/
+func parseDhclientValue(value string) string {
+	if strings.HasPrefix(value, "\"") {
+		if s, err := strconv.Unquote(value); err == nil {
+			return s
+		}
+		return strings.Trim(value, "\"")
+	}
+	var b []byte
+	for _, octet := range strings.Split(value, ":") {
+		n, err := strconv.ParseUint(octet, 16, 8)
+		if err != nil {
+			return ""
+		}
+		b = append(b, byte(n))
+	}
+	return string(b)
+}
+
+/*
+Servers commonly NUL terminate the option value (a workaround for old Internet Explorer), so trim it.
+*/
+func sanitizeWPADURL(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+/*
+Find the proxies for targetUrl using the PAC URL advertised by DHCP.
+Params:
+	ctx: Bounds the download of the PAC script.
+	leaseFiles: Glob patterns of the lease files, see readDHCPWPADURL.
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	[]Proxy, nil: The PAC script was evaluated.
+	nil, ErrNotFound: No PAC URL is advertised by DHCP.
+	nil, error: The PAC script could not be fetched or evaluated.
+*/
+func (p *provider) readDHCPWPADProxy(ctx context.Context, leaseFiles []string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	wpadUrl, err := p.readDHCPWPADURL(leaseFiles)
+	if err != nil {
+		t.step(srcWPADDHCP)
+		return nil, err
+	}
+	proxies := p.readPACProxy(ctx, srcWPADDHCP, wpadUrl, targetUrl, t)
+	if proxies == nil {
+		return nil, fmt.Errorf("failed to evaluate PAC script %s", wpadUrl)
+	}
+	return proxies, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDhclientLeases = `lease {
+  interface "eth0";
+  fixed-address 10.0.0.23;
+  option subnet-mask 255.255.255.0;
+  option wpad "http://old.rapid7.com/wpad.dat";
+  renew 2 2018/06/12 10:00:00;
+}
+lease {
+  interface "eth0";
+  fixed-address 10.0.0.23;
+  option subnet-mask 255.255.255.0;
+  option routers 10.0.0.1;
+  option wpad "http://wpad.rapid7.com/wpad.dat";
+  renew 5 2018/06/15 10:00:00;
+}
+`
+
+const testSystemdLease = `# This is private data. Do not parse.
+ADDRESS=10.0.0.23
+NETMASK=255.255.255.0
+ROUTER=10.0.0.1
+DOMAINNAME=rapid7.com
+OPTION_252=687474703a2f2f777061642e7261706964372e636f6d2f777061642e64617400
+`
+
+var dataParseDHCPLeaseWPAD = []struct {
+	name    string
+	content []byte
+	expect  string
+}{
+	{"dhclient", []byte(testDhclientLeases), "http://wpad.rapid7.com/wpad.dat"},
+	{"dhclient unknown-252", []byte("lease {\n  option unknown-252 \"http://wpad/wpad.dat\\000\";\n}\n"), "http://wpad/wpad.dat"},
+	{"dhclient hex", []byte("lease {\n  option unknown-252 68:74:74:70:3a:2f:2f:77:70:61:64:2f;\n}\n"), "http://wpad/"},
+	{"dhclient no wpad", []byte("lease {\n  option routers 10.0.0.1;\n}\n"), ""},
+	{"systemd-networkd", []byte(testSystemdLease), "http://wpad.rapid7.com/wpad.dat"},
+	{"NetworkManager", []byte("ADDRESS=10.0.0.23\nWPAD=http://wpad.rapid7.com/proxy.pac\n"), "http://wpad.rapid7.com/proxy.pac"},
+	{"systemd invalid hex", []byte("OPTION_252=zz\n"), ""},
+	{"dhcpcd", newTestDHCPMessage([]byte{53, 1, 5}, append([]byte{252, 10}, "http://wpa"...), append([]byte{252, 14}, "d/wpad.dat\x00\x00\x00\x00"...)), "http://wpad/wpad.dat"},
+	{"dhcpcd no wpad", newTestDHCPMessage([]byte{53, 1, 5}, []byte{0, 0, 1, 4, 255, 255, 255, 0}), ""},
+	{"dhcpcd truncated", newTestDHCPMessage(append([]byte{252, 100}, "http://wpad"...)), ""},
+	{"empty", []byte{}, ""},
+}
+
+func TestParseDHCPLeaseWPAD(t *testing.T) {
+	for _, tt := range dataParseDHCPLeaseWPAD {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			a.Equal(tt.expect, parseDHCPLeaseWPAD(tt.content))
+		})
+	}
+}
+
+func TestProvider_ReadDHCPWPADURL(t *testing.T) {
+	a := assert.New(t)
+	tmpDir, err := os.MkdirTemp("", "TestReadDHCPWPADURL")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	p := newTestProvider("")
+	leaseFiles := []string{
+		filepath.Join(tmpDir, "dhcp", "*.leases"),
+		filepath.Join(tmpDir, "netif", "leases", "*"),
+		filepath.Join(tmpDir, "[invalid"),
+	}
+	// No lease files
+	_, err = p.readDHCPWPADURL(leaseFiles)
+	a.True(errors.Is(err, ErrNotFound))
+
+	now := time.Now()
+	writeTestLease(a, filepath.Join(tmpDir, "dhcp", "dhclient.eth0.leases"), []byte(testDhclientLeases), now.Add(-time.Hour))
+	writeTestLease(a, filepath.Join(tmpDir, "dhcp", "dhclient.eth1.leases"), []byte("lease {\n}\n"), now)
+	u, err := p.readDHCPWPADURL(leaseFiles)
+	a.NoError(err)
+	a.Equal("http://wpad.rapid7.com/wpad.dat", u)
+
+	// The most recently modified lease wins
+	writeTestLease(a, filepath.Join(tmpDir, "netif", "leases", "2"), []byte("WPAD=http://newer/wpad.dat\n"), now)
+	u, err = p.readDHCPWPADURL(leaseFiles)
+	a.NoError(err)
+	a.Equal("http://newer/wpad.dat", u)
+}
+
+func writeTestLease(a *assert.Assertions, f string, content []byte, modTime time.Time) {
+	a.NoError(os.MkdirAll(filepath.Dir(f), 0755))
+	a.NoError(os.WriteFile(f, content, 0644))
+	a.NoError(os.Chtimes(f, modTime, modTime))
+}
+
+/*
+Build a DHCP message, as stored by dhcpcd, with the given options.
+*/
+func newTestDHCPMessage(options ...[]byte) []byte {
+	m := make([]byte, bootpHeaderSize)
+	m[0] = 2
+	m = append(m, dhcpMagicCookie...)
+	for _, o := range options {
+		m = append(m, o...)
+	}
+	return append(m, dhcpOptionEnd)
+}
+
+/*
+Returns a WPAD source which reads the lease files, and the resolv.conf, of a host named localhost.
+Without a resolv.conf (empty), the host has no DNS domains, so that WPAD DNS is never attempted.
+*/
+func newTestWPADSource(leaseFiles []string, resolvConf string) *wpadSource {
+	return &wpadSource{
+		dhcpLeaseFiles: leaseFiles,
+		resolvConf:     resolvConf,
+		hostname: func() (string, error) {
+			return "localhost", nil
+		},
+		resolver: net.DefaultResolver,
+	}
+}
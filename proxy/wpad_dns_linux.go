@@ -0,0 +1,222 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	srcWPADDNS         = "WPAD:DNS"
+	wpadHostPrefix     = "wpad."
+	wpadPath           = "/wpad.dat"
+	defaultResolvConf  = "/etc/resolv.conf"
+	maxResolvConfSize  = 1048576
+	resolvConfSearch   = "search"
+	resolvConfDomain   = "domain"
+	minWPADDomainLabel = 2
+)
+
+var errWPADDNSMissed = errors.New("no WPAD server was found recently, not retried until the PAC cache expires")
+
+/*
+Resolves host names. Satisfied by *net.Resolver.
+*/
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Second level labels which, under a two letter country code, are registries rather than organizations (i.e. co.uk).
+// This approximates the public suffix list for the purpose of never querying wpad.co.uk and the like.
+// Registries which it does not cover (i.e. those under generic top level domains, such as github.io, or the
+// third level registries of some country codes) are not recognized: their WPAD host names are queried.
+// The list is kept here, rather than using golang.org/x/net/publicsuffix, so that the package has no such dependency.
+var publicSecondLevelLabels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "go": true, "gob": true, "gov": true, "gv": true,
+	"ltd": true, "mil": true, "ne": true, "net": true, "nic": true, "or": true, "org": true, "plc": true, "sch": true,
+}
+
+/*
+Find the proxies for targetUrl by walking the host's DNS domains for a WPAD server.
+For each domain (see readWPADDomains), candidates are tried from the most to the least specific:
+	corp.emea.rapid7.com -> wpad.corp.emea.rapid7.com, wpad.emea.rapid7.com, wpad.rapid7.com
+The first candidate which resolves is used, by evaluating the PAC script at http://<candidate>/wpad.dat.
+Should none do, the walk is not attempted again until the PAC cache's TTL passes (see pacFetcher.missed),
+so that lookups on networks without WPAD are not delayed by name resolution.
+Params:
+	ctx: Bounds name resolution and the download of the PAC script.
+	s: The source, whose resolv.conf, host name, and resolver are used.
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	[]Proxy, nil: The PAC script was evaluated.
+	nil, ErrNotFound: No WPAD server was found.
+	nil, ErrTimeout: ctx expired before a WPAD server was found.
+*/
+func (p *provider) readDNSWPADProxy(ctx context.Context, s *wpadSource, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	candidates := wpadDNSCandidates(p.readWPADDomains(s))
+	missKey := srcWPADDNS + ":" + strings.Join(candidates, ",")
+	if len(candidates) == 0 {
+		t.step(srcWPADDNS)
+		return nil, ErrNotFound
+	} else if p.pacFetcher.missed(missKey) {
+		step := t.step(srcWPADDNS)
+		step.setValue(strings.Join(candidates, ","))
+		step.setError(errWPADDNSMissed)
+		return nil, ErrNotFound
+	}
+	for _, host := range candidates {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		if err := p.resolve(ctx, s.resolver, host); err != nil {
+			step := t.step(srcWPADDNS)
+			step.setValue(host)
+			step.setError(err)
+			continue
+		}
+		wpadUrl := (&url.URL{Scheme: protocolHTTP, Host: host, Path: wpadPath}).String()
+		p.logger.Printf("[proxy.Provider.readDNSWPADProxy]: trying %s\n", wpadUrl)
+		if proxies := p.readPACProxy(ctx, srcWPADDNS, wpadUrl, targetUrl, t); proxies != nil {
+			return proxies, nil
+		}
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	p.pacFetcher.setMissed(missKey)
+	return nil, ErrNotFound
+}
+
+/*
+Resolve host with resolver, within the provider's resolve timeout, or until ctx is done.
+Returns:
+	nil: host resolves to at least one address.
+	error: Otherwise
+*/
+func (p *provider) resolve(ctx context.Context, resolver hostResolver, host string) error {
+	if p.resolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(p.resolveTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses found for %s", host)
+	}
+	return err
+}
+
+/*
+Return the DNS domains of this host, in order of preference:
+the "domain" and "search" entries of the resolv.conf of s, followed by the domain of its host name (if fully qualified).
+*/
+func (p *provider) readWPADDomains(s *wpadSource) []string {
+	var domains []string
+	if content, err := readResolvConf(s.resolvConf); err != nil {
+		p.logger.Printf("[proxy.Provider.readWPADDomains]: %s\n", err)
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case resolvConfSearch, resolvConfDomain:
+				domains = append(domains, fields[1:]...)
+			}
+		}
+	}
+	if hostname, err := s.hostname(); err == nil {
+		if i := strings.Index(hostname, domainDelimiter); i >= 0 {
+			domains = append(domains, hostname[i+1:])
+		}
+	}
+	return domains
+}
+
+func readResolvConf(resolvConf string) ([]byte, error) {
+	if resolvConf == "" {
+		return nil, nil
+	}
+	stat, err := os.Stat(resolvConf)
+	if err != nil {
+		return nil, err
+	} else if stat.Size() > maxResolvConfSize {
+		return nil, fmt.Errorf("resolv.conf too large: %s", resolvConf)
+	}
+	return os.ReadFile(resolvConf)
+}
+
+/*
+Derive the WPAD host names to try for the given domains, without duplicates.
+The walk stops at the organizational boundary, so wpad.com and wpad.co.uk are never returned.
+For example:
+	["corp.rapid7.com"] -> ["wpad.corp.rapid7.com", "wpad.rapid7.com"]
+	["corp.rapid7.co.uk"] -> ["wpad.corp.rapid7.co.uk", "wpad.rapid7.co.uk"]
+	["com", "localdomain"] -> []
+*/
+func wpadDNSCandidates(domains []string) []string {
+	var candidates []string
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), domainDelimiter)
+		if domain == "" {
+			continue
+		}
+		labels := strings.Split(domain, domainDelimiter)
+		minLabels := minWPADDomainLabel
+		if n := len(labels); n >= 2 && len(labels[n-1]) == 2 && publicSecondLevelLabels[labels[n-2]] {
+			minLabels++
+		}
+		for i := 0; len(labels)-i >= minLabels; i++ {
+			candidate := wpadHostPrefix + strings.Join(labels[i:], domainDelimiter)
+			if !seen[candidate] {
+				seen[candidate] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	return candidates
+}
+
+/*
+Find the proxies for targetUrl through WPAD, trying DHCP before DNS as WinHTTP does.
+Params:
+	ctx: Bounds name resolution and the download of PAC scripts.
+	s: The source, whose lease files, resolv.conf, host name, and resolver are used.
+	targetUrl: The URL the proxy is to be used for. (i.e. https://test.endpoint.rapid7.com)
+	t: Optional. Records the sources consulted.
+Returns:
+	[]Proxy, nil: A PAC script was discovered and evaluated.
+	nil, ErrNotFound: No PAC script was discovered, or none could be evaluated.
+	nil, ErrTimeout: ctx expired before a PAC script was discovered.
+*/
+func (p *provider) readWPADProxy(ctx context.Context, s *wpadSource, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	proxies, err := p.readDHCPWPADProxy(ctx, s.dhcpLeaseFiles, targetUrl, t)
+	if err == nil {
+		return proxies, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		p.logger.Printf("[proxy.Provider.readWPADProxy]: No proxy discovered via WPAD DHCP: %s\n", err)
+	}
+	return p.readDNSWPADProxy(ctx, s, targetUrl, t)
+}
@@ -0,0 +1,254 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var dataWPADDNSCandidates = []struct {
+	domains []string
+	expect  []string
+}{
+	{[]string{"corp.emea.rapid7.com"}, []string{"wpad.corp.emea.rapid7.com", "wpad.emea.rapid7.com", "wpad.rapid7.com"}},
+	{[]string{"rapid7.com"}, []string{"wpad.rapid7.com"}},
+	{[]string{"corp.rapid7.co.uk"}, []string{"wpad.corp.rapid7.co.uk", "wpad.rapid7.co.uk"}},
+	{[]string{"rapid7.co.uk", "co.uk"}, []string{"wpad.rapid7.co.uk"}},
+	{[]string{"corp.rapid7.io"}, []string{"wpad.corp.rapid7.io", "wpad.rapid7.io"}},
+	{[]string{" Corp.Rapid7.COM. ", "rapid7.com"}, []string{"wpad.corp.rapid7.com", "wpad.rapid7.com"}},
+	{[]string{"com", "localdomain", "", "."}, nil},
+	{nil, nil},
+}
+
+func TestWPADDNSCandidates(t *testing.T) {
+	for _, tt := range dataWPADDNSCandidates {
+		t.Run(strings.Join(tt.domains, ","), func(t *testing.T) {
+			a := assert.New(t)
+			a.Equal(tt.expect, wpadDNSCandidates(tt.domains))
+		})
+	}
+}
+
+func TestProvider_ReadWPADDomains(t *testing.T) {
+	a := assert.New(t)
+	tmpDir, err := os.MkdirTemp("", "TestReadWPADDomains")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	f := filepath.Join(tmpDir, "resolv.conf")
+	if !a.NoError(os.WriteFile(f, []byte("# comment\nnameserver 10.0.0.1\ndomain corp.rapid7.com\nsearch emea.rapid7.com rapid7.com\noptions ndots:2\n"), 0644)) {
+		return
+	}
+	p := newTestProvider("")
+	s := newTestWPADSource(nil, f)
+	s.hostname = func() (string, error) { return "host1.lab.rapid7.com", nil }
+	a.Equal([]string{"corp.rapid7.com", "emea.rapid7.com", "rapid7.com", "lab.rapid7.com"}, p.readWPADDomains(s))
+
+	s.resolvConf = filepath.Join(tmpDir, "missing")
+	s.hostname = func() (string, error) { return "host1", nil }
+	a.Empty(p.readWPADDomains(s))
+}
+
+func TestProvider_ReadDNSWPADProxy(t *testing.T) {
+	a := assert.New(t)
+	s := newTestPACServer(`function FindProxyForURL(url, host) { return "PROXY proxy.rapid7.com:3128"; }`)
+	defer s.Close()
+	dns, err := newTestDNSServer("wpad.rapid7.com")
+	if !a.NoError(err) {
+		return
+	}
+	defer dns.Close()
+	tmpDir, err := os.MkdirTemp("", "TestReadDNSWPADProxy")
+	if !a.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	f := filepath.Join(tmpDir, "resolv.conf")
+	if !a.NoError(os.WriteFile(f, []byte("search corp.emea.rapid7.com\n"), 0644)) {
+		return
+	}
+	var requested []string
+	p := newTestProvider("")
+	wpad := newTestWPADSource(nil, f)
+	wpad.hostname = func() (string, error) { return "host1", nil }
+	wpad.resolver = dns.resolver()
+	p.pacFetcher = newPACFetcher()
+	p.pacFetcher.client = func(timeouts pacTimeouts) *http.Client {
+		// Route every request to the test server, recording the requested URL
+		return &http.Client{Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				requested = append(requested, r.URL.String())
+				return nil, nil
+			},
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return net.Dial("tcp", s.Listener.Addr().String())
+			},
+		}}
+	}
+	proxies, err := p.readDNSWPADProxy(context.Background(), wpad, ParseTargetURL("https://test.endpoint.rapid7.com", ""), nil)
+	a.NoError(err)
+	a.Equal([]Proxy{newTestProxy("http", "proxy.rapid7.com", 3128, nil, srcWPADDNS)}, proxies)
+	a.Equal([]string{"http://wpad.rapid7.com/wpad.dat"}, requested)
+	a.Equal([]string{"wpad.corp.emea.rapid7.com", "wpad.emea.rapid7.com", "wpad.rapid7.com"}, dns.queried())
+
+	// Nothing resolves
+	wpad.resolvConf = ""
+	wpad.hostname = func() (string, error) { return "host1.lab.example.com", nil }
+	now := time.Now()
+	p.pacFetcher.now = func() time.Time { return now }
+	_, err = p.readDNSWPADProxy(context.Background(), wpad, ParseTargetURL("https://test.endpoint.rapid7.com", ""), nil)
+	a.True(errors.Is(err, ErrNotFound))
+	queries := dns.queryCount()
+
+	// The failure is remembered, nothing is resolved until the PAC cache's TTL passes
+	trace := newTrace("https", ParseTargetURL("https://test.endpoint.rapid7.com", ""))
+	_, err = p.readDNSWPADProxy(context.Background(), wpad, ParseTargetURL("https://test.endpoint.rapid7.com", ""), trace)
+	a.True(errors.Is(err, ErrNotFound))
+	a.Equal(queries, dns.queryCount())
+	if a.Len(trace.Steps, 1) {
+		a.Equal("wpad.lab.example.com,wpad.example.com", trace.Steps[0].Value)
+		a.Equal(errWPADDNSMissed.Error(), trace.Steps[0].Error)
+	}
+	now = now.Add(pacCacheTTL)
+	_, err = p.readDNSWPADProxy(context.Background(), wpad, ParseTargetURL("https://test.endpoint.rapid7.com", ""), nil)
+	a.True(errors.Is(err, ErrNotFound))
+	a.Greater(dns.queryCount(), queries)
+}
+
+/*
+A minimal DNS server answering A queries for the given names with 127.0.0.1, and NXDOMAIN otherwise.
+*/
+type testDNSServer struct {
+	conn    net.PacketConn
+	names   map[string]bool
+	mu      sync.Mutex
+	queries []string
+}
+
+func newTestDNSServer(names ...string) (*testDNSServer, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &testDNSServer{conn: conn, names: map[string]bool{}}
+	for _, name := range names {
+		s.names[name] = true
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp, err := s.answer(buf[:n]); err == nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *testDNSServer) answer(query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("short query")
+	}
+	// Question name
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil, errors.New("invalid name")
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(query) {
+		return nil, errors.New("invalid question")
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	name := strings.ToLower(strings.Join(labels, "."))
+	known := s.names[name]
+	if qtype == 1 {
+		s.mu.Lock()
+		s.queries = append(s.queries, name)
+		s.mu.Unlock()
+	}
+	resp := make([]byte, 12)
+	copy(resp, query[:2])
+	// Response, recursion desired/available
+	resp[2], resp[3] = 0x81, 0x80
+	if !known {
+		// NXDOMAIN
+		resp[3] |= 3
+	}
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, question...)
+	if known && qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// Pointer to the question name, A, IN, TTL 60, 127.0.0.1
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+	}
+	return resp, nil
+}
+
+func (s *testDNSServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return net.Dial("udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *testDNSServer) queryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queries)
+}
+
+func (s *testDNSServer) queried() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The resolver may retry, or append search domains, only keep the first query for each name
+	var names []string
+	seen := map[string]bool{}
+	for _, q := range s.queries {
+		if !seen[q] && strings.HasPrefix(q, wpadHostPrefix) && strings.HasSuffix(q, "rapid7.com") {
+			seen[q] = true
+			names = append(names, q)
+		}
+	}
+	return names
+}
+
+func (s *testDNSServer) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,51 @@
+// Copyright 2018, Rapid7, Inc.
+// License: BSD-3-clause
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+// * Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software
+// without specific prior written permission.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+)
+
+const sourceNameWPAD = "wpad"
+
+/*
+Create a Source which discovers a PAC script through WPAD, trying DHCP (option 252) before DNS (wpad.<domain>).
+*/
+func WPADSource() Source {
+	return &wpadSource{dhcpLeaseFiles: defaultDHCPLeaseFiles, resolvConf: defaultResolvConf, hostname: os.Hostname, resolver: net.DefaultResolver}
+}
+
+/*
+The lease files, resolv.conf, host name, and resolver WPAD is discovered with: those of the host but in tests.
+*/
+type wpadSource struct {
+	dhcpLeaseFiles []string
+	resolvConf     string
+	hostname       func() (string, error)
+	resolver       hostResolver
+}
+
+func (s *wpadSource) Name() string {
+	return sourceNameWPAD
+}
+
+func (s *wpadSource) Lookup(ctx context.Context, protocol string, targetUrl *url.URL) (SourceResult, error) {
+	return lookupBuiltinSource(ctx, s, protocol, targetUrl)
+}
+
+func (s *wpadSource) lookup(ctx context.Context, p *provider, _ string, targetUrl *url.URL, t *Trace) ([]Proxy, error) {
+	return p.readWPADProxy(ctx, s, targetUrl, t)
+}